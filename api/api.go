@@ -1,23 +1,36 @@
 package api
 
 import (
+	"net"
 	"net/http"
+	"strings"
 
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
 
 	"github.com/briansan/user-go/config"
+	"github.com/briansan/user-go/errors"
+	"github.com/briansan/user-go/store"
 )
 
-func New() *echo.Echo {
+// New returns the echo server with every route backed by the given store
+func New(s store.UserStore) *echo.Echo {
 	e := echo.New()
+	e.Use(middleware.RequestID())
 	e.Use(middleware.Logger())
 	e.Use(middleware.RemoveTrailingSlash())
 	e.Use(middleware.Recover())
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
 		AllowOrigins:     []string{config.GetWWWHost()},
 		AllowCredentials: true,
+		ExposeHeaders: []string{headerTotalCount, headerLink, headerETag, echo.HeaderXRequestID, headerRetryAfter,
+			headerRateLimit, headerRateLimitRemaining, headerRateLimitReset, headerRateLimitPolicy},
 	}))
+	e.Use(rateLimits(s))
+
+	// public keys for other services to verify sessions with
+	e.GET("/.well-known/jwks.json", GetJWKS)
+	e.GET("/.well-known/openid-configuration", GetOpenIDConfiguration)
 
 	// setup /api
 	api := e.Group("/api/v1")
@@ -31,9 +44,90 @@ func New() *echo.Echo {
 	})
 
 	// setup users
-	initAuth(api)
+	api.Use(useStore(s))
+	initAuth(api, s)
 	initUsers(api)
+	initAudit(api)
+	initOAuth(api)
+	initFederation(api)
+	initTwoFactor(api)
+	initPasskeys(api)
+	initPersonalTokens(api)
+	initPassword(api)
+	initEmail(api)
+	initLockout(api)
+	initSessions(api)
 
 	// setup the rest
 	return e
 }
+
+// useStore is a middleware that hands every request its own copy of s
+func useStore(s store.UserStore) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			db, err := s.Copy(c.Request().Context())
+			if err != nil {
+				return errors.MongoErrorResponse(err)
+			}
+			defer db.Cleanup()
+
+			c.Set("db", db)
+			return next(c)
+		}
+	}
+}
+
+// getStore returns the store set by useStore
+func getStore(c echo.Context) store.UserStore {
+	return c.Get("db").(store.UserStore)
+}
+
+// clientIP returns the IP the request of c comes from, which is the address
+// of the connection unless that is a trusted proxy, then the last address
+// of X-Forwarded-For that isn't one or else X-Real-IP
+// echo's RealIP believes the headers of anyone, so a client could pick a
+// new IP for every request
+func clientIP(c echo.Context) string {
+	req := c.Request()
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	proxies := config.GetTrustedProxies()
+	if !trustedProxy(proxies, ip) {
+		return ip
+	}
+	if forwarded := req.Header[echo.HeaderXForwardedFor]; len(forwarded) > 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if hop == "" {
+				continue
+			}
+			ip = hop
+			if !trustedProxy(proxies, hop) {
+				break
+			}
+		}
+		return ip
+	}
+	if real := req.Header.Get(echo.HeaderXRealIP); real != "" {
+		return real
+	}
+	return ip
+}
+
+// trustedProxy reports whether ip is in one of proxies
+func trustedProxy(proxies []*net.IPNet, ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, p := range proxies {
+		if p.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
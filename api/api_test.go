@@ -2,40 +2,84 @@ package api
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/labstack/echo"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/suite"
 
+	"github.com/briansan/user-go/errors"
+	"github.com/briansan/user-go/keys"
+	"github.com/briansan/user-go/mail"
+	"github.com/briansan/user-go/oidc/oidctest"
+	"github.com/briansan/user-go/ratelimit"
 	"github.com/briansan/user-go/schema"
 	"github.com/briansan/user-go/store"
+	"github.com/briansan/user-go/totp"
+	"github.com/briansan/user-go/webauthn"
+	"github.com/briansan/user-go/webauthn/webauthntest"
 )
 
+// testRemoteAddr is where test requests come from, as with httptest
+const testRemoteAddr = "192.0.2.1:1234"
+
 type APITestSuite struct {
 	suite.Suite
-	e *echo.Echo
+	e    *echo.Echo
+	last *httptest.ResponseRecorder
+	mail *mail.Memory
 }
 
 func (suite *APITestSuite) SetupTest() {
 	os.Setenv("BT_MONGO_DATABASE", "test")
 	os.Setenv("BT_SECRET", "test_secret")
 	os.Setenv("BT_TESTING", "true")
+	os.Unsetenv("BT_JWT_SIGNING_KEY")
+	os.Unsetenv("BT_JWT_VERIFY_KEYS")
+	os.Unsetenv("BT_JWT_ISSUER")
+	os.Unsetenv("BT_JWT_LEGACY_CLAIMS")
+	os.Unsetenv("BT_REQUIRE_VERIFIED_EMAIL")
+	os.Unsetenv("BT_LOGIN_LOCKOUT_THRESHOLD")
+	os.Unsetenv("BT_LOGIN_LOCKOUT_IP_THRESHOLD")
+	os.Unsetenv("BT_BREACHED_PASSWORDS")
+	os.Unsetenv("BT_SESSION_COOKIE")
+	os.Unsetenv("BT_TRUSTED_PROXIES")
+	// Most tests get by with short passwords
+	os.Setenv("BT_PASSWORD_MIN_LENGTH", "1")
+	os.Setenv("BT_PASSWORD_MIN_STRENGTH", "0")
 
-	store.InitMongoSession()
-	store.Nuke()
-	suite.e = New()
+	suite.e = New(store.NewMemoryStore())
+	suite.mail = &mail.Memory{}
+	mailer = suite.mail
 }
 
 func (suite *APITestSuite) Test001_NormalUsage() {
 	// 0a. GET /api/service/ping
-	code, pong := suite.request("GET", "/api/v1/service/ping", "", nil, nil)
+	var pong string
+	code, _ := suite.request("GET", "/api/v1/service/ping", "", nil, &pong)
 	suite.Equal(http.StatusOK, code)
 	suite.Equal("pong", pong)
 
@@ -60,10 +104,11 @@ func (suite *APITestSuite) Test001_NormalUsage() {
 	}
 
 	secureUser := &schema.UserSecure{}
-	code, _ = suite.request("POST", "/api/v1/users", "", user, secureUser)
+	code, raw := suite.request("POST", "/api/v1/users", "", user, secureUser)
 	suite.Equal(http.StatusCreated, code)
 	suite.Equal(username, secureUser.Username)
 	suite.Equal(email, secureUser.Email)
+	suite.NotContains(raw, `"password"`)
 
 	// save user id
 	uid := secureUser.ID.Hex()
@@ -134,9 +179,1627 @@ func (suite *APITestSuite) Test001_NormalUsage() {
 	suite.Equal(http.StatusOK, code)
 	suite.Equal(username, secureUser.Username)
 	suite.Equal(email, secureUser.Email)
+	suite.NotNil(secureUser.DeletedAt)
+
+	// 5a. Deleted users can neither log in nor use their session
+	code, _ = suite.request("GET", "/api/v1/login", basicAuthString(username, password), nil, &token)
+	suite.Equal(http.StatusUnauthorized, code)
+	code, _ = suite.request("GET", "/api/v1/users/"+uid, jwtAuth, nil, secureUser)
+	suite.Equal(http.StatusUnauthorized, code)
+
+	// 6. POST /api/users/{userID}/restore (as admin)
+	secureUser = &schema.UserSecure{}
+	code, _ = suite.request("POST", "/api/v1/users/"+uid+"/restore", jwtAuthString(adminSession), nil, secureUser)
+	suite.Equal(http.StatusOK, code)
+	suite.Equal(username, secureUser.Username)
+	suite.Nil(secureUser.DeletedAt)
+
+	code, _ = suite.request("GET", "/api/v1/users/"+uid, jwtAuth, nil, secureUser)
+	suite.Equal(http.StatusOK, code)
+
+	// 6a. Restoring a live user is not found
+	code, _ = suite.request("POST", "/api/v1/users/"+uid+"/restore", jwtAuthString(adminSession), nil, secureUser)
+	suite.Equal(http.StatusNotFound, code)
+}
+
+func (suite *APITestSuite) Test002_ListUsers() {
+	var token map[string]string
+	code, _ := suite.request("GET", "/api/v1/login", basicAuthString("boss", "test_secret"), nil, &token)
+	suite.Equal(http.StatusOK, code)
+	adminAuth := jwtAuthString(token["session"])
+
+	for _, name := range []string{"foo", "bar", "baz"} {
+		username, password, email := name, "qux", name+"@example.com"
+		user := &schema.User{Username: &username, Password: &password, Email: &email}
+		code, _ = suite.request("POST", "/api/v1/users", "", user, &schema.UserSecure{})
+		suite.Equal(http.StatusCreated, code)
+	}
+
+	// First page of two users with role user
+	users := []*schema.UserSecure{}
+	code, _ = suite.request("GET", fmt.Sprintf("/api/v1/users?role=%d&sort=username&limit=2", schema.RoleUser), adminAuth, nil, &users)
+	suite.Equal(http.StatusOK, code)
+	suite.Equal("3", suite.last.Header().Get(headerTotalCount))
+	suite.Equal(2, len(users))
+	suite.Equal("bar", users[0].Username)
+	suite.Equal("baz", users[1].Username)
+
+	// Follow the Link header
+	link := suite.last.Header().Get(headerLink)
+	suite.True(strings.HasSuffix(link, `>; rel="next"`))
+	next := strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`)
+
+	mapped := map[string]*schema.UserSecure{}
+	code, _ = suite.request("GET", next+"&mapped=true", adminAuth, nil, &mapped)
+	suite.Equal(http.StatusOK, code)
+	suite.Equal(1, len(mapped))
+	suite.Empty(suite.last.Header().Get(headerLink))
+	for _, u := range mapped {
+		suite.Equal("foo", u.Username)
+	}
+
+	// Bad parameters
+	code, _ = suite.request("GET", "/api/v1/users?sort=password", adminAuth, nil, nil)
+	suite.Equal(http.StatusBadRequest, code)
+	code, _ = suite.request("GET", "/api/v1/users?cursor=garbage", adminAuth, nil, nil)
+	suite.Equal(http.StatusBadRequest, code)
+}
+
+func (suite *APITestSuite) Test003_IfMatch() {
+	var token map[string]string
+	code, _ := suite.request("GET", "/api/v1/login", basicAuthString("boss", "test_secret"), nil, &token)
+	suite.Equal(http.StatusOK, code)
+	adminAuth := jwtAuthString(token["session"])
+
+	username, password, email := "foo", "bar", "foo@bar.com"
+	user := &schema.User{Username: &username, Password: &password, Email: &email}
+	code, _ = suite.request("POST", "/api/v1/users", "", user, &schema.UserSecure{})
+	suite.Equal(http.StatusCreated, code)
+
+	// GET returns the version as ETag
+	secureUser := &schema.UserSecure{}
+	code, _ = suite.request("GET", "/api/v1/users/"+username, adminAuth, nil, secureUser)
+	suite.Equal(http.StatusOK, code)
+	suite.Equal(`"1"`, suite.last.Header().Get(headerETag))
+	uid := secureUser.ID.Hex()
+
+	// PATCH with the current ETag
+	newEmail := "foo@baz.com"
+	code, _ = suite.requestWithHeaders("PATCH", "/api/v1/users/"+uid, adminAuth, map[string]string{headerIfMatch: `"1"`},
+		&schema.User{Email: &newEmail}, secureUser)
+	suite.Equal(http.StatusOK, code)
+	suite.Equal(`"2"`, suite.last.Header().Get(headerETag))
+	suite.Equal(newEmail, secureUser.Email)
+
+	// PATCH and DELETE with a stale ETag
+	code, _ = suite.requestWithHeaders("PATCH", "/api/v1/users/"+uid, adminAuth, map[string]string{headerIfMatch: `"1"`},
+		&schema.User{Email: &email}, nil)
+	suite.Equal(http.StatusPreconditionFailed, code)
+	code, _ = suite.requestWithHeaders("DELETE", "/api/v1/users/"+uid, adminAuth, map[string]string{headerIfMatch: `"1"`}, nil, nil)
+	suite.Equal(http.StatusPreconditionFailed, code)
+
+	// DELETE with any of a list, the admin deletes the user and not itself
+	secureUser = &schema.UserSecure{}
+	code, _ = suite.requestWithHeaders("DELETE", "/api/v1/users/"+uid, adminAuth, map[string]string{headerIfMatch: `"1", "2"`}, nil, secureUser)
+	suite.Equal(http.StatusOK, code)
+	suite.Equal(username, secureUser.Username)
+
+	code, _ = suite.request("GET", "/api/v1/users/boss", adminAuth, nil, secureUser)
+	suite.Equal(http.StatusOK, code)
+}
+
+func (suite *APITestSuite) Test004_Audit() {
+	var token map[string]string
+	code, _ := suite.request("GET", "/api/v1/login", basicAuthString("boss", "test_secret"), nil, &token)
+	suite.Equal(http.StatusOK, code)
+	adminAuth := jwtAuthString(token["session"])
+
+	// Sign up, log in and change the password
+	username, password, email := "foo", "bar", "foo@bar.com"
+	user := &schema.User{Username: &username, Password: &password, Email: &email}
+	secureUser := &schema.UserSecure{}
+	code, _ = suite.request("POST", "/api/v1/users", "", user, secureUser)
+	suite.Equal(http.StatusCreated, code)
+	uid := secureUser.ID.Hex()
+
+	code, _ = suite.requestWithHeaders("GET", "/api/v1/login", basicAuthString(username, password),
+		map[string]string{echo.HeaderXRequestID: "req-login"}, nil, &token)
+	suite.Equal(http.StatusOK, code)
+	suite.Equal("req-login", suite.last.Header().Get(echo.HeaderXRequestID))
+	jwtAuth := jwtAuthString(token["session"])
+
+	// Only admins can read the log
+	code, _ = suite.request("GET", "/api/v1/audit", jwtAuth, nil, nil)
+	suite.Equal(http.StatusForbidden, code)
+
+	newPassword := "baz"
+	code, _ = suite.request("PATCH", "/api/v1/users/"+uid, jwtAuth, &schema.User{Password: &newPassword, OldPassword: &password}, nil)
+	suite.Equal(http.StatusOK, code)
+
+	entries := []*schema.AuditEntry{}
+	code, _ = suite.request("GET", "/api/v1/audit?target="+uid, adminAuth, nil, &entries)
+	suite.Equal(http.StatusOK, code)
+	suite.Len(entries, 3)
+	suite.Equal(schema.AuditUserUpdate, entries[0].Action)
+	suite.Equal(uid, entries[0].Actor)
+	suite.Equal(schema.AuditChange{Old: schema.Redacted, New: schema.Redacted}, entries[0].Diff["password"])
+	suite.Equal(schema.AuditLogin, entries[1].Action)
+	suite.Equal("req-login", entries[1].RequestID)
+	suite.Equal(schema.AuditUserCreate, entries[2].Action)
+	suite.Empty(entries[2].Actor)
+	suite.Equal(username, entries[2].Diff["username"].New)
+	suite.Equal(schema.Redacted, entries[2].Diff["password"].New)
+
+	// Passwords never reach the log
+	_, body := suite.request("GET", "/api/v1/audit", adminAuth, nil, nil)
+	suite.False(strings.Contains(body, newPassword))
+	suite.False(strings.Contains(body, `"`+password+`"`))
+
+	// Filter by actor and time
+	code, _ = suite.request("GET", "/api/v1/audit?actor="+uid+"&limit=1", adminAuth, nil, &entries)
+	suite.Equal(http.StatusOK, code)
+	suite.Len(entries, 1)
+	suite.Equal(schema.AuditUserUpdate, entries[0].Action)
+
+	code, _ = suite.request("GET", "/api/v1/audit?from=2100-01-01T00:00:00Z", adminAuth, nil, &entries)
+	suite.Equal(http.StatusOK, code)
+	suite.Len(entries, 0)
+
+	code, _ = suite.request("GET", "/api/v1/audit?from=yesterday", adminAuth, nil, nil)
+	suite.Equal(http.StatusBadRequest, code)
+}
+
+func (suite *APITestSuite) Test005_Refresh() {
+	username, password, email := "foo", "bar", "foo@bar.com"
+	user := &schema.User{Username: &username, Password: &password, Email: &email}
+	secureUser := &schema.UserSecure{}
+	code, _ := suite.request("POST", "/api/v1/users", "", user, secureUser)
+	suite.Equal(http.StatusCreated, code)
+	uid := secureUser.ID.Hex()
+
+	// Login hands out a refresh token along with the session
+	var login map[string]string
+	code, _ = suite.request("GET", "/api/v1/login", basicAuthString(username, password), nil, &login)
+	suite.Equal(http.StatusOK, code)
+	suite.NotEmpty(login["refresh"])
+
+	// Refresh rotates it
+	var refreshed map[string]string
+	code, _ = suite.request("POST", "/api/v1/token/refresh", "", map[string]string{"refresh": login["refresh"]}, &refreshed)
+	suite.Equal(http.StatusOK, code)
+	suite.NotEmpty(refreshed["session"])
+	suite.NotEqual(login["refresh"], refreshed["refresh"])
+	code, _ = suite.request("GET", "/api/v1/users/"+uid, jwtAuthString(refreshed["session"]), nil, nil)
+	suite.Equal(http.StatusOK, code)
+
+	// Reusing the old one revokes the whole family
+	code, _ = suite.request("POST", "/api/v1/token/refresh", "", map[string]string{"refresh": login["refresh"]}, nil)
+	suite.Equal(http.StatusUnauthorized, code)
+	code, _ = suite.request("POST", "/api/v1/token/refresh", "", map[string]string{"refresh": refreshed["refresh"]}, nil)
+	suite.Equal(http.StatusUnauthorized, code)
+	for _, session := range []string{login["session"], refreshed["session"]} {
+		code, _ = suite.request("GET", "/api/v1/users/"+uid, jwtAuthString(session), nil, nil)
+		suite.Equal(http.StatusUnauthorized, code)
+	}
+
+	// Unknown and missing tokens
+	code, _ = suite.request("POST", "/api/v1/token/refresh", "", map[string]string{"refresh": "garbage"}, nil)
+	suite.Equal(http.StatusUnauthorized, code)
+	code, _ = suite.request("POST", "/api/v1/token/refresh", "", map[string]string{}, nil)
+	suite.Equal(http.StatusBadRequest, code)
+
+	// Logout ends the session and its refresh token but not other logins
+	var other map[string]string
+	code, _ = suite.request("GET", "/api/v1/login", basicAuthString(username, password), nil, &login)
+	suite.Equal(http.StatusOK, code)
+	code, _ = suite.request("GET", "/api/v1/login", basicAuthString(username, password), nil, &other)
+	suite.Equal(http.StatusOK, code)
+
+	code, _ = suite.request("POST", "/api/v1/logout", jwtAuthString(login["session"]), nil, nil)
+	suite.Equal(http.StatusNoContent, code)
+	code, _ = suite.request("GET", "/api/v1/users/"+uid, jwtAuthString(login["session"]), nil, nil)
+	suite.Equal(http.StatusUnauthorized, code)
+	code, _ = suite.request("POST", "/api/v1/token/refresh", "", map[string]string{"refresh": login["refresh"]}, nil)
+	suite.Equal(http.StatusUnauthorized, code)
+	code, _ = suite.request("GET", "/api/v1/users/"+uid, jwtAuthString(other["session"]), nil, nil)
+	suite.Equal(http.StatusOK, code)
+
+	// Reuse and logout are audited
+	var admin map[string]string
+	code, _ = suite.request("GET", "/api/v1/login", basicAuthString("boss", "test_secret"), nil, &admin)
+	suite.Equal(http.StatusOK, code)
+	entries := []*schema.AuditEntry{}
+	code, _ = suite.request("GET", "/api/v1/audit?target="+uid, jwtAuthString(admin["session"]), nil, &entries)
+	suite.Equal(http.StatusOK, code)
+	actions := []string{}
+	for _, e := range entries {
+		actions = append(actions, e.Action)
+	}
+	suite.Equal([]string{
+		schema.AuditLogout, schema.AuditLogin, schema.AuditLogin,
+		schema.AuditTokenReuse, schema.AuditLogin, schema.AuditUserCreate,
+	}, actions)
+}
+
+func (suite *APITestSuite) Test006_SigningKeys() {
+	// Keep the users while the server restarts with other keys
+	db := store.NewMemoryStore()
+	suite.e = New(db)
+
+	// Sessions are signed with the secret and there is nothing to publish
+	jwks := &keys.JWKS{}
+	code, _ := suite.request("GET", "/.well-known/jwks.json", "", nil, jwks)
+	suite.Equal(http.StatusOK, code)
+	suite.Len(jwks.Keys, 0)
+
+	var token map[string]string
+	code, _ = suite.request("GET", "/api/v1/login", basicAuthString("boss", "test_secret"), nil, &token)
+	suite.Equal(http.StatusOK, code)
+	hmacAuth := jwtAuthString(token["session"])
+
+	// Switch to an ed25519 key
+	dir := suite.T().TempDir()
+	_, oldKey, _ := ed25519.GenerateKey(rand.Reader)
+	oldPath := suite.writeKey(dir, "old.pem", oldKey)
+	os.Setenv("BT_JWT_SIGNING_KEY", oldPath)
+	suite.e = New(db)
+
+	code, _ = suite.request("GET", "/api/v1/login", basicAuthString("boss", "test_secret"), nil, &token)
+	suite.Equal(http.StatusOK, code)
+	oldAuth := jwtAuthString(token["session"])
+	code, _ = suite.request("GET", "/api/v1/users/boss", oldAuth, nil, nil)
+	suite.Equal(http.StatusOK, code)
+	code, _ = suite.request("GET", "/api/v1/users/boss", hmacAuth, nil, nil)
+	suite.Equal(http.StatusUnauthorized, code)
+
+	// Anyone can verify the session with the published key
+	code, _ = suite.request("GET", "/.well-known/jwks.json", "", nil, jwks)
+	suite.Equal(http.StatusOK, code)
+	suite.Len(jwks.Keys, 1)
+	suite.Equal("EdDSA", jwks.Keys[0].Alg)
+	x, err := base64.RawURLEncoding.DecodeString(jwks.Keys[0].X)
+	suite.Nil(err)
+	parsed, err := jwt.Parse(token["session"], func(t *jwt.Token) (interface{}, error) {
+		suite.Equal(jwks.Keys[0].Kid, t.Header["kid"])
+		return ed25519.PublicKey(x), nil
+	})
+	suite.Nil(err)
+	suite.True(parsed.Valid)
+
+	// Rotate to an ecdsa key, sessions of the old one work until it is dropped
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	os.Setenv("BT_JWT_SIGNING_KEY", suite.writeKey(dir, "new.pem", newKey))
+	os.Setenv("BT_JWT_VERIFY_KEYS", oldPath)
+	suite.e = New(db)
+
+	code, _ = suite.request("GET", "/.well-known/jwks.json", "", nil, jwks)
+	suite.Equal(http.StatusOK, code)
+	suite.Len(jwks.Keys, 2)
+	suite.Equal("ES256", jwks.Keys[0].Alg)
+
+	code, _ = suite.request("GET", "/api/v1/login", basicAuthString("boss", "test_secret"), nil, &token)
+	suite.Equal(http.StatusOK, code)
+	code, _ = suite.request("GET", "/api/v1/users/boss", jwtAuthString(token["session"]), nil, nil)
+	suite.Equal(http.StatusOK, code)
+	code, _ = suite.request("GET", "/api/v1/users/boss", oldAuth, nil, nil)
+	suite.Equal(http.StatusOK, code)
+
+	os.Unsetenv("BT_JWT_VERIFY_KEYS")
+	suite.e = New(db)
+	code, _ = suite.request("GET", "/api/v1/users/boss", oldAuth, nil, nil)
+	suite.Equal(http.StatusUnauthorized, code)
+}
+
+func (suite *APITestSuite) Test007_Claims() {
+	var token map[string]string
+	code, _ := suite.request("GET", "/api/v1/login", basicAuthString("boss", "test_secret"), nil, &token)
+	suite.Equal(http.StatusOK, code)
+	boss := &schema.UserSecure{}
+	code, _ = suite.request("GET", "/api/v1/users/boss", jwtAuthString(token["session"]), nil, boss)
+	suite.Equal(http.StatusOK, code)
+
+	// The user id is the subject, role and permissions come along
+	claims := map[string]interface{}{}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.Split(token["session"], ".")[1])
+	suite.Nil(err)
+	suite.Nil(json.Unmarshal(payload, &claims))
+	suite.Equal(boss.ID.Hex(), claims["sub"])
+	suite.Equal("bt", claims["iss"])
+	suite.Equal([]interface{}{"bt"}, claims["aud"])
+	suite.Equal("admin", claims["role"])
+	suite.Contains(claims["permissions"], "modifyAllUsers")
+	suite.NotEmpty(claims["jti"])
+
+	// Other issuers are rejected
+	os.Setenv("BT_JWT_ISSUER", "someone-else")
+	code, _ = suite.request("GET", "/api/v1/users/boss", jwtAuthString(token["session"]), nil, nil)
+	suite.Equal(http.StatusUnauthorized, code)
+	os.Unsetenv("BT_JWT_ISSUER")
+
+	// Old sessions with the user id in aud work until turned off
+	legacy, err := signJWT(&jwt.StandardClaims{
+		Audience:  boss.ID.Hex(),
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		IssuedAt:  time.Now().Unix(),
+		Id:        "legacy",
+	})
+	suite.Nil(err)
+	code, _ = suite.request("GET", "/api/v1/users/boss", jwtAuthString(legacy), nil, nil)
+	suite.Equal(http.StatusOK, code)
+	os.Setenv("BT_JWT_LEGACY_CLAIMS", "false")
+	code, _ = suite.request("GET", "/api/v1/users/boss", jwtAuthString(legacy), nil, nil)
+	suite.Equal(http.StatusUnauthorized, code)
+}
+
+func (suite *APITestSuite) Test008_OAuth() {
+	// OIDC needs a signing key and an issuer url
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	os.Setenv("BT_JWT_SIGNING_KEY", suite.writeKey(suite.T().TempDir(), "key.pem", key))
+	os.Setenv("BT_JWT_ISSUER", "https://id.example.com")
+	suite.e = New(store.NewMemoryStore())
+
+	discovery := map[string]interface{}{}
+	code, _ := suite.request("GET", "/.well-known/openid-configuration", "", nil, &discovery)
+	suite.Equal(http.StatusOK, code)
+	suite.Equal("https://id.example.com", discovery["issuer"])
+	suite.Equal("https://id.example.com/api/v1/oauth/token", discovery["token_endpoint"])
+	suite.Equal([]interface{}{"EdDSA"}, discovery["id_token_signing_alg_values_supported"])
+
+	var token map[string]string
+	code, _ = suite.request("GET", "/api/v1/login", basicAuthString("boss", "test_secret"), nil, &token)
+	suite.Equal(http.StatusOK, code)
+	adminAuth := jwtAuthString(token["session"])
+
+	username, password, email := "foo", "bar", "foo@bar.com"
+	user := &schema.User{Username: &username, Password: &password, Email: &email}
+	secureUser := &schema.UserSecure{}
+	code, _ = suite.request("POST", "/api/v1/users", "", user, secureUser)
+	suite.Equal(http.StatusCreated, code)
+	code, _ = suite.request("GET", "/api/v1/login", basicAuthString(username, password), nil, &token)
+	suite.Equal(http.StatusOK, code)
+
+	// Only admins register clients
+	redirectURI := "https://app.example.com/cb"
+	app := map[string]interface{}{
+		"name":         "App",
+		"redirectURIs": []string{redirectURI},
+		"grantTypes":   []string{schema.GrantAuthorizationCode, schema.GrantClientCredentials},
+		"scopes":       []string{schema.ScopeOpenID, schema.ScopeProfile, schema.ScopeEmail},
+	}
+	code, _ = suite.request("POST", "/api/v1/oauth/clients", jwtAuthString(token["session"]), app, nil)
+	suite.Equal(http.StatusForbidden, code)
+	client := map[string]interface{}{}
+	code, _ = suite.request("POST", "/api/v1/oauth/clients", adminAuth, app, &client)
+	suite.Equal(http.StatusCreated, code)
+	clientID, clientSecret := client["clientID"].(string), client["clientSecret"].(string)
+	suite.NotEmpty(clientID)
+	suite.NotEmpty(clientSecret)
+
+	clients := []map[string]interface{}{}
+	code, _ = suite.request("GET", "/api/v1/oauth/clients", adminAuth, nil, &clients)
+	suite.Equal(http.StatusOK, code)
+	suite.Len(clients, 1)
+	suite.Nil(clients[0]["clientSecret"])
+
+	// The user logs in at the authorization endpoint
+	verifier := "a-verifier-that-is-long-enough-for-rfc-7636-purposes"
+	authorize := func(params url.Values, auth string) *url.URL {
+		code, _ := suite.request("GET", "/api/v1/oauth/authorize?"+params.Encode(), auth, nil, nil)
+		if code != http.StatusFound {
+			return nil
+		}
+		location, err := url.Parse(suite.last.Header().Get(echo.HeaderLocation))
+		suite.Nil(err)
+		return location
+	}
+	params := url.Values{
+		"response_type": {"code"}, "client_id": {clientID}, "redirect_uri": {redirectURI},
+		"scope": {"openid profile email"}, "state": {"xyz"}, "nonce": {"n-0S6"},
+		"code_challenge": {pkceS256(verifier)}, "code_challenge_method": {"S256"},
+	}
+	suite.Nil(authorize(params, ""))
+	suite.Equal(http.StatusUnauthorized, suite.last.Code)
+	location := authorize(params, basicAuthString(username, password))
+	suite.Equal("app.example.com", location.Host)
+	suite.Equal("xyz", location.Query().Get("state"))
+	authCode := location.Query().Get("code")
+	suite.NotEmpty(authCode)
+
+	// Bad requests are sent back unless the redirect uri is wrong
+	bad := url.Values{}
+	for k, v := range params {
+		bad[k] = v
+	}
+	bad.Del("code_challenge")
+	suite.Equal(oauthInvalidRequest, authorize(bad, basicAuthString(username, password)).Query().Get("error"))
+	bad.Set("redirect_uri", "https://evil.example.com/cb")
+	suite.Nil(authorize(bad, basicAuthString(username, password)))
+	suite.Equal(http.StatusBadRequest, suite.last.Code)
+
+	// The code is exchanged once with the verifier
+	exchange := url.Values{
+		"grant_type": {schema.GrantAuthorizationCode}, "code": {authCode},
+		"redirect_uri": {redirectURI}, "code_verifier": {verifier},
+	}
+	resp := map[string]interface{}{}
+	code, _ = suite.form("/api/v1/oauth/token", basicAuthString(clientID, "wrong"), exchange, &resp)
+	suite.Equal(http.StatusUnauthorized, code)
+	suite.Equal(oauthInvalidClient, resp["error"])
+	code, _ = suite.form("/api/v1/oauth/token", basicAuthString(clientID, clientSecret), exchange, &resp)
+	suite.Equal(http.StatusOK, code)
+	suite.Equal("no-store", suite.last.Header().Get("Cache-Control"))
+	suite.Equal("Bearer", resp["token_type"])
+	suite.Equal("openid profile email", resp["scope"])
+	access, idToken := resp["access_token"].(string), resp["id_token"].(string)
+
+	code, _ = suite.form("/api/v1/oauth/token", basicAuthString(clientID, clientSecret), exchange, &resp)
+	suite.Equal(http.StatusBadRequest, code)
+	suite.Equal(oauthInvalidGrant, resp["error"])
+
+	// The id token is built from the user and verifies with the published key
+	idClaims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(idToken, idClaims, signer.Keyfunc)
+	suite.Nil(err)
+	suite.Equal("https://id.example.com", idClaims["iss"])
+	suite.Equal(clientID, idClaims["aud"])
+	suite.Equal(secureUser.ID.Hex(), idClaims["sub"])
+	suite.Equal("n-0S6", idClaims["nonce"])
+	suite.Equal(username, idClaims["preferred_username"])
+	suite.Equal(email, idClaims["email"])
+
+	info := map[string]interface{}{}
+	code, _ = suite.request("GET", "/api/v1/oauth/userinfo", jwtAuthString(access), nil, &info)
+	suite.Equal(http.StatusOK, code)
+	suite.Equal(secureUser.ID.Hex(), info["sub"])
+	suite.Equal(email, info["email"])
+
+	// The access token is only good for userinfo, and as long as its session
+	code, _ = suite.request("GET", "/api/v1/users/"+username, jwtAuthString(access), nil, nil)
+	suite.Equal(http.StatusUnauthorized, code)
+	sessions := []*schema.Session{}
+	code, _ = suite.request("GET", "/api/v1/users/"+username+"/sessions", jwtAuthString(token["session"]), nil, &sessions)
+	suite.Equal(http.StatusOK, code)
+	suite.Equal(2, len(sessions))
+	suite.Equal(clientID, sessions[1].ClientID)
+	code, _ = suite.request("DELETE", "/api/v1/users/"+username+"/sessions/"+sessions[1].ID, jwtAuthString(token["session"]), nil, nil)
+	suite.Equal(http.StatusNoContent, code)
+	code, _ = suite.request("GET", "/api/v1/oauth/userinfo", jwtAuthString(access), nil, nil)
+	suite.Equal(http.StatusUnauthorized, code)
+
+	// A wrong verifier burns the code
+	location = authorize(params, basicAuthString(username, password))
+	exchange.Set("code", location.Query().Get("code"))
+	exchange.Set("code_verifier", "some-other-verifier-that-is-also-long-enough")
+	code, _ = suite.form("/api/v1/oauth/token", basicAuthString(clientID, clientSecret), exchange, &resp)
+	suite.Equal(http.StatusBadRequest, code)
+	exchange.Set("code_verifier", verifier)
+	code, _ = suite.form("/api/v1/oauth/token", basicAuthString(clientID, clientSecret), exchange, &resp)
+	suite.Equal(http.StatusBadRequest, code)
+
+	// Client credentials with client_secret_post
+	resp = map[string]interface{}{}
+	code, _ = suite.form("/api/v1/oauth/token", "", url.Values{
+		"grant_type": {schema.GrantClientCredentials}, "scope": {"profile"},
+		"client_id": {clientID}, "client_secret": {clientSecret},
+	}, &resp)
+	suite.Equal(http.StatusOK, code)
+	claims := &Claims{}
+	_, err = jwt.ParseWithClaims(resp["access_token"].(string), claims, signer.Keyfunc)
+	suite.Nil(err)
+	suite.Equal(clientID, claims.Subject)
+	suite.Equal(clientID, claims.ClientID)
+	suite.Equal("profile", claims.Scope)
+	suite.Equal(jwt.ClaimStrings{"bt/oauth"}, claims.Audience)
+
+	code, _ = suite.form("/api/v1/oauth/token", basicAuthString(clientID, clientSecret), url.Values{
+		"grant_type": {"password"},
+	}, &resp)
+	suite.Equal(http.StatusBadRequest, code)
+	suite.Equal(oauthUnsupportedGrant, resp["error"])
+
+	// Deleted clients can't authenticate
+	code, _ = suite.request("DELETE", "/api/v1/oauth/clients/"+clientID, adminAuth, nil, nil)
+	suite.Equal(http.StatusNoContent, code)
+	code, _ = suite.form("/api/v1/oauth/token", basicAuthString(clientID, clientSecret), url.Values{
+		"grant_type": {schema.GrantClientCredentials},
+	}, nil)
+	suite.Equal(http.StatusUnauthorized, code)
+}
+
+// writeKey stores k PKCS #8 encoded in dir/name and returns the path
+func (suite *APITestSuite) Test009_Federation() {
+	idp := oidctest.NewIdP()
+	defer idp.Close()
+	provider := func(provision bool) map[string]interface{} {
+		return map[string]interface{}{
+			"issuer":       idp.URL,
+			"clientID":     oidctest.ClientID,
+			"clientSecret": oidctest.ClientSecret,
+			"redirectURL":  "http://localhost/api/v1/auth/corp/callback",
+			"scopes":       []string{"email", "profile"},
+			"provision":    provision,
+		}
+	}
+	strict := provider(false)
+	strict["redirectURL"] = "http://localhost/api/v1/auth/strict/callback"
+	viper.Set("OIDC_PROVIDERS", map[string]interface{}{"corp": provider(true), "strict": strict})
+	defer viper.Set("OIDC_PROVIDERS", nil)
+	suite.e = New(store.NewMemoryStore())
+
+	// federate runs the login of provider through the idp, linking to the
+	// user of the auth session if there is one, and returns the callback
+	// response, which the browser sends no Authorization header to
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	federate := func(provider, auth string, response interface{}) int {
+		var location string
+		if len(auth) > 0 {
+			link := map[string]string{}
+			code, _ := suite.request("POST", "/api/v1/auth/"+provider+"/link", auth, nil, &link)
+			if code != http.StatusOK {
+				return code
+			}
+			location = link["url"]
+		} else {
+			code, _ := suite.request("GET", "/api/v1/auth/"+provider+"/login", "", nil, nil)
+			if code != http.StatusFound {
+				return code
+			}
+			location = suite.last.Header().Get(echo.HeaderLocation)
+		}
+		cookies := suite.last.Result().Cookies()
+		suite.Len(cookies, 1)
+		suite.True(cookies[0].HttpOnly)
+
+		resp, err := noRedirect.Get(location)
+		suite.Nil(err)
+		resp.Body.Close()
+		suite.Equal(http.StatusFound, resp.StatusCode)
+		callback, err := url.Parse(resp.Header.Get(echo.HeaderLocation))
+		suite.Nil(err)
+		code, _ := suite.requestWithHeaders("GET", callback.RequestURI(), "",
+			map[string]string{"Cookie": cookies[0].Name + "=" + cookies[0].Value}, nil, response)
+		return code
+	}
+
+	code, _ := suite.request("GET", "/api/v1/auth/other/login", "", nil, nil)
+	suite.Equal(http.StatusNotFound, code)
+
+	// A new subject of corp is provisioned as a user
+	var token map[string]string
+	idp.Login(jwt.MapClaims{"sub": "alice-1", "email": "alice@corp.example.com", "preferred_username": "alice"})
+	suite.Equal(http.StatusOK, federate("corp", "", &token))
+	alice := &schema.UserSecure{}
+	code, _ = suite.request("GET", "/api/v1/users/alice", jwtAuthString(token["session"]), nil, alice)
+	suite.Equal(http.StatusOK, code)
+	suite.Equal("alice@corp.example.com", alice.Email)
+	suite.Equal(schema.RoleUser, alice.Role)
+
+	// and logs in as that user from then on
+	token = nil
+	suite.Equal(http.StatusOK, federate("corp", "", &token))
+	suite.NotEmpty(token["refresh"])
+	self := &schema.UserSecure{}
+	code, _ = suite.request("GET", "/api/v1/users/alice", jwtAuthString(token["session"]), nil, self)
+	suite.Equal(http.StatusOK, code)
+	suite.Equal(alice.ID, self.ID)
+
+	// A taken username gets a suffix, a taken email is never attached to
+	idp.Login(jwt.MapClaims{"sub": "alice-2", "email": "alice2@corp.example.com", "preferred_username": "alice"})
+	suite.Equal(http.StatusOK, federate("corp", "", &token))
+	idp.Login(jwt.MapClaims{"sub": "alice-3", "email": "alice@corp.example.com"})
+	suite.Equal(http.StatusConflict, federate("corp", "", nil))
+	idp.Login(jwt.MapClaims{"sub": "alice-4"})
+	suite.Equal(http.StatusForbidden, federate("corp", "", nil))
+
+	// strict only logs in linked users, which link while logged in
+	username, password, email := "foo", "bar", "foo@bar.com"
+	user := &schema.User{Username: &username, Password: &password, Email: &email}
+	foo := &schema.UserSecure{}
+	code, _ = suite.request("POST", "/api/v1/users", "", user, foo)
+	suite.Equal(http.StatusCreated, code)
+	code, _ = suite.request("GET", "/api/v1/login", basicAuthString(username, password), nil, &token)
+	suite.Equal(http.StatusOK, code)
+	fooAuth := jwtAuthString(token["session"])
+
+	idp.Login(jwt.MapClaims{"sub": "foo-1"})
+	suite.Equal(http.StatusForbidden, federate("strict", "", nil))
+	suite.Equal(http.StatusUnauthorized, federate("strict", jwtAuthString("bad"), nil))
+	suite.Equal(http.StatusOK, federate("strict", fooAuth, nil))
+	token = nil
+	suite.Equal(http.StatusOK, federate("strict", "", &token))
+	self = &schema.UserSecure{}
+	code, _ = suite.request("GET", "/api/v1/users/foo", jwtAuthString(token["session"]), nil, self)
+	suite.Equal(http.StatusOK, code)
+	suite.Equal(foo.ID, self.ID)
+
+	// An identity of another user can't be linked
+	idp.Login(jwt.MapClaims{"sub": "alice-1", "email": "alice@corp.example.com"})
+	suite.Equal(http.StatusConflict, federate("corp", fooAuth, nil))
+
+	// The callback only goes with the login that set its cookie
+	code, _ = suite.request("GET", "/api/v1/auth/corp/callback?code=x&state=y", "", nil, nil)
+	suite.Equal(http.StatusBadRequest, code)
+	code, _ = suite.request("GET", "/api/v1/auth/corp/login", "", nil, nil)
+	suite.Equal(http.StatusFound, code)
+	cookie := suite.last.Result().Cookies()[0]
+	code, _ = suite.requestWithHeaders("GET", "/api/v1/auth/corp/callback?code=x&state=y", "",
+		map[string]string{"Cookie": cookie.Name + "=" + cookie.Value}, nil, nil)
+	suite.Equal(http.StatusBadRequest, code)
+	code, _ = suite.requestWithHeaders("GET", "/api/v1/auth/strict/callback?code=x&state=y", "",
+		map[string]string{"Cookie": cookie.Name + "=" + cookie.Value}, nil, nil)
+	suite.Equal(http.StatusBadRequest, code)
+
+	// Links are audited
+	code, _ = suite.request("GET", "/api/v1/login", basicAuthString("boss", "test_secret"), nil, &token)
+	suite.Equal(http.StatusOK, code)
+	entries := []*schema.AuditEntry{}
+	code, _ = suite.request("GET", "/api/v1/audit?target="+foo.ID.Hex(), jwtAuthString(token["session"]), nil, &entries)
+	suite.Equal(http.StatusOK, code)
+	suite.Equal(schema.AuditLogin, entries[0].Action)
+	suite.Equal(schema.AuditChange{New: "strict"}, entries[0].Diff["provider"])
+	suite.Equal(schema.AuditLogin, entries[1].Action)
+	suite.Equal(schema.AuditIdentityLink, entries[2].Action)
+	suite.Equal(schema.AuditChange{New: "foo-1"}, entries[2].Diff["subject"])
+
+	// Users with 2FA still need their second factor
+	enrollment := map[string]string{}
+	code, _ = suite.request("POST", "/api/v1/users/foo/2fa", fooAuth, nil, &enrollment)
+	suite.Equal(http.StatusCreated, code)
+	now, _ := totp.Code(enrollment["secret"], totp.Step(time.Now()))
+	code, _ = suite.request("POST", "/api/v1/users/foo/2fa/confirm", fooAuth, map[string]string{"code": now}, nil)
+	suite.Equal(http.StatusOK, code)
+	idp.Login(jwt.MapClaims{"sub": "foo-1"})
+	challenge := map[string]string{}
+	suite.Equal(http.StatusOK, federate("strict", "", &challenge))
+	suite.Empty(challenge["session"])
+	suite.NotEmpty(challenge["challenge"])
+
+	// and locked out users stay out
+	os.Setenv("BT_LOGIN_LOCKOUT_THRESHOLD", "1")
+	code, _ = suite.request("GET", "/api/v1/login", basicAuthString(username, "wrong"), nil, nil)
+	suite.Equal(http.StatusUnauthorized, code)
+	suite.Equal(http.StatusTooManyRequests, federate("strict", "", nil))
+}
+
+func (suite *APITestSuite) Test010_TwoFactor() {
+	var token map[string]string
+	code, _ := suite.request("GET", "/api/v1/login", basicAuthString("boss", "test_secret"), nil, &token)
+	suite.Equal(http.StatusOK, code)
+	adminAuth := jwtAuthString(token["session"])
+
+	username, password, email := "foo", "bar", "foo@bar.com"
+	user := &schema.User{Username: &username, Password: &password, Email: &email}
+	secureUser := &schema.UserSecure{}
+	code, _ = suite.request("POST", "/api/v1/users", "", user, secureUser)
+	suite.Equal(http.StatusCreated, code)
+	uid := secureUser.ID.Hex()
+	code, _ = suite.request("GET", "/api/v1/login", basicAuthString(username, password), nil, &token)
+	suite.Equal(http.StatusOK, code)
+	jwtAuth := jwtAuthString(token["session"])
+
+	// Enroll and confirm with a code of the secret
+	code, _ = suite.request("GET", "/api/v1/users/foo/2fa", jwtAuth, nil, nil)
+	suite.Equal(http.StatusNotFound, code)
+	code, _ = suite.request("POST", "/api/v1/users/foo/2fa", adminAuth, nil, nil)
+	suite.Equal(http.StatusForbidden, code)
+	enrollment := map[string]string{}
+	code, _ = suite.request("POST", "/api/v1/users/foo/2fa", jwtAuth, nil, &enrollment)
+	suite.Equal(http.StatusCreated, code)
+	suite.True(strings.HasPrefix(enrollment["uri"], "otpauth://totp/bt:foo@bar.com?"))
+	secret := enrollment["secret"]
+
+	code, _ = suite.request("POST", "/api/v1/users/foo/2fa/confirm", jwtAuth, map[string]string{"code": "abcdef"}, nil)
+	suite.Equal(http.StatusBadRequest, code)
+	step := totp.Step(time.Now())
+	now, _ := totp.Code(secret, step)
+	recovery := map[string][]string{}
+	code, _ = suite.request("POST", "/api/v1/users/foo/2fa/confirm", jwtAuth, map[string]string{"code": now}, &recovery)
+	suite.Equal(http.StatusOK, code)
+	suite.Len(recovery["recoveryCodes"], 10)
+	code, _ = suite.request("POST", "/api/v1/users/foo/2fa", jwtAuth, nil, nil)
+	suite.Equal(http.StatusConflict, code)
+
+	status := map[string]interface{}{}
+	code, _ = suite.request("GET", "/api/v1/users/"+uid+"/2fa", adminAuth, nil, &status)
+	suite.Equal(http.StatusOK, code)
+	suite.Equal(true, status["enabled"])
+	suite.Equal(float64(10), status["recoveryCodes"])
+
+	// Logins now need the second factor
+	login := func() string {
+		token = map[string]string{}
+		code, _ := suite.request("GET", "/api/v1/login", basicAuthString(username, password), nil, &token)
+		suite.Equal(http.StatusOK, code)
+		suite.Empty(token["session"])
+		return token["challenge"]
+	}
+	challenge := login()
+	code, _ = suite.request("GET", "/api/v1/users/foo", jwtAuthString(challenge), nil, nil)
+	suite.Equal(http.StatusUnauthorized, code)
+
+	// A code works once, the code that confirmed included
+	code, _ = suite.request("POST", "/api/v1/login/2fa", "", map[string]string{"challenge": challenge, "code": now}, nil)
+	suite.Equal(http.StatusUnauthorized, code)
+	next, _ := totp.Code(secret, step+1)
+	code, _ = suite.request("POST", "/api/v1/login/2fa", "", map[string]string{"challenge": challenge, "code": next}, &token)
+	suite.Equal(http.StatusOK, code)
+	code, _ = suite.request("GET", "/api/v1/users/foo", jwtAuthString(token["session"]), nil, nil)
+	suite.Equal(http.StatusOK, code)
+
+	// and so does a challenge and a recovery code
+	code, _ = suite.request("POST", "/api/v1/login/2fa", "", map[string]string{"challenge": challenge, "code": recovery["recoveryCodes"][0]}, nil)
+	suite.Equal(http.StatusUnauthorized, code)
+	code, _ = suite.request("POST", "/api/v1/login/2fa", "", map[string]string{"challenge": login(), "code": recovery["recoveryCodes"][0]}, &token)
+	suite.Equal(http.StatusOK, code)
+	code, _ = suite.request("POST", "/api/v1/login/2fa", "", map[string]string{"challenge": login(), "code": recovery["recoveryCodes"][0]}, nil)
+	suite.Equal(http.StatusUnauthorized, code)
+	code, _ = suite.request("GET", "/api/v1/users/foo/2fa", jwtAuth, nil, &status)
+	suite.Equal(http.StatusOK, code)
+	suite.Equal(float64(9), status["recoveryCodes"])
+
+	// Wrong codes count as failed logins and burn the challenge
+	challenge = login()
+	for i := 0; i < maxChallengeFailures; i++ {
+		code, _ = suite.request("POST", "/api/v1/login/2fa", "", map[string]string{"challenge": challenge, "code": "wrong-code"}, nil)
+		suite.Equal(http.StatusUnauthorized, code)
+	}
+	lockout := map[string]interface{}{}
+	code, _ = suite.request("GET", "/api/v1/users/foo/lockout", adminAuth, nil, &lockout)
+	suite.Equal(http.StatusOK, code)
+	// along with the used recovery code above
+	suite.Equal(float64(maxChallengeFailures+1), lockout["failures"])
+	code, _ = suite.request("POST", "/api/v1/login/2fa", "", map[string]string{"challenge": challenge, "code": recovery["recoveryCodes"][2]}, nil)
+	suite.Equal(http.StatusUnauthorized, code)
+	code, _ = suite.request("POST", "/api/v1/login/2fa", "", map[string]string{"challenge": login(), "code": recovery["recoveryCodes"][2]}, nil)
+	suite.Equal(http.StatusOK, code)
+	code, _ = suite.request("GET", "/api/v1/users/foo/lockout", adminAuth, nil, &lockout)
+	suite.Equal(http.StatusOK, code)
+	suite.Equal(float64(0), lockout["failures"])
+
+	// Turning it off takes a code
+	code, _ = suite.request("DELETE", "/api/v1/users/foo/2fa", jwtAuth, nil, nil)
+	suite.Equal(http.StatusBadRequest, code)
+	code, _ = suite.request("DELETE", "/api/v1/users/foo/2fa", jwtAuth, map[string]string{"code": strings.ToUpper(recovery["recoveryCodes"][1])}, nil)
+	suite.Equal(http.StatusNoContent, code)
+
+	// unless an admin resets it
+	code, _ = suite.request("POST", "/api/v1/users/foo/2fa", jwtAuth, nil, &enrollment)
+	suite.Equal(http.StatusCreated, code)
+	now, _ = totp.Code(enrollment["secret"], totp.Step(time.Now()))
+	code, _ = suite.request("POST", "/api/v1/users/foo/2fa/confirm", jwtAuth, map[string]string{"code": now}, nil)
+	suite.Equal(http.StatusOK, code)
+	login()
+	code, _ = suite.request("DELETE", "/api/v1/users/foo/2fa", adminAuth, nil, nil)
+	suite.Equal(http.StatusNoContent, code)
+	code, _ = suite.request("GET", "/api/v1/login", basicAuthString(username, password), nil, &token)
+	suite.Equal(http.StatusOK, code)
+	suite.NotEmpty(token["session"])
+
+	entries := []*schema.AuditEntry{}
+	code, _ = suite.request("GET", "/api/v1/audit?target="+uid, adminAuth, nil, &entries)
+	suite.Equal(http.StatusOK, code)
+	suite.Equal(schema.AuditTwoFactorOff, entries[1].Action)
+	suite.NotEqual(uid, entries[1].Actor)
+	suite.Equal(schema.AuditTwoFactorOn, entries[2].Action)
+	suite.Equal(schema.AuditTwoFactorOff, entries[3].Action)
+	suite.Equal(uid, entries[3].Actor)
+	suite.Equal(schema.AuditChange{New: "recovery"}, entries[4].Diff["secondFactor"])
+}
+
+func (suite *APITestSuite) Test011_Passkeys() {
+	var token map[string]string
+	code, _ := suite.request("GET", "/api/v1/login", basicAuthString("boss", "test_secret"), nil, &token)
+	suite.Equal(http.StatusOK, code)
+	adminAuth := jwtAuthString(token["session"])
+
+	username, password, email := "foo", "bar", "foo@bar.com"
+	user := &schema.User{Username: &username, Password: &password, Email: &email}
+	secureUser := &schema.UserSecure{}
+	code, _ = suite.request("POST", "/api/v1/users", "", user, secureUser)
+	suite.Equal(http.StatusCreated, code)
+	uid := secureUser.ID.Hex()
+	code, _ = suite.request("GET", "/api/v1/login", basicAuthString(username, password), nil, &token)
+	suite.Equal(http.StatusOK, code)
+	jwtAuth := jwtAuthString(token["session"])
+
+	viper.Set("WEBAUTHN_ORIGIN", "https://bt.example.com")
+	defer viper.Set("WEBAUTHN_ORIGIN", "")
+	authenticator := webauthntest.New("https://bt.example.com")
+
+	// Register a passkey
+	creation := struct {
+		Ceremony  string                   `json:"ceremony"`
+		PublicKey webauthn.CreationOptions `json:"publicKey"`
+	}{}
+	code, _ = suite.request("POST", "/api/v1/users/foo/passkeys/options", adminAuth, nil, nil)
+	suite.Equal(http.StatusForbidden, code)
+	code, _ = suite.request("POST", "/api/v1/users/foo/passkeys/options", jwtAuth, nil, &creation)
+	suite.Equal(http.StatusOK, code)
+	suite.Equal("bt.example.com", creation.PublicKey.RP.ID)
+	suite.Equal([]byte(secureUser.ID[:]), []byte(creation.PublicKey.User.ID))
+	credential := authenticator.Create(&creation.PublicKey)
+
+	passkey := &schema.Passkey{}
+	body := map[string]interface{}{"ceremony": creation.Ceremony, "name": "phone", "credential": credential}
+	code, _ = suite.request("POST", "/api/v1/users/foo/passkeys", jwtAuth, body, passkey)
+	suite.Equal(http.StatusCreated, code)
+	suite.Equal("phone", passkey.Name)
+	suite.Equal([]string{"internal"}, passkey.Transports)
+
+	// A ceremony is finished once
+	code, _ = suite.request("POST", "/api/v1/users/foo/passkeys", jwtAuth, body, nil)
+	suite.Equal(http.StatusUnauthorized, code)
+
+	// and the same passkey isn't registered twice
+	code, _ = suite.request("POST", "/api/v1/users/foo/passkeys/options", jwtAuth, nil, &creation)
+	suite.Equal(http.StatusOK, code)
+	suite.Len(creation.PublicKey.ExcludeCredentials, 1)
+
+	passkeys := []*schema.Passkey{}
+	code, _ = suite.request("GET", "/api/v1/users/"+uid+"/passkeys", adminAuth, nil, &passkeys)
+	suite.Equal(http.StatusOK, code)
+	suite.Len(passkeys, 1)
+
+	// Log in with it, naming the user or not
+	request := struct {
+		Ceremony  string                  `json:"ceremony"`
+		PublicKey webauthn.RequestOptions `json:"publicKey"`
+	}{}
+	code, _ = suite.request("POST", "/api/v1/login/passkey/options", "", map[string]string{"username": "foo"}, &request)
+	suite.Equal(http.StatusOK, code)
+	suite.Len(request.PublicKey.AllowCredentials, 1)
+	suite.Equal("bt.example.com", request.PublicKey.RPID)
+	assertion := authenticator.Get(&request.PublicKey)
+	body = map[string]interface{}{"ceremony": request.Ceremony, "credential": assertion}
+	token = map[string]string{}
+	code, _ = suite.request("POST", "/api/v1/login/passkey", "", body, &token)
+	suite.Equal(http.StatusOK, code)
+	code, _ = suite.request("GET", "/api/v1/users/foo", jwtAuthString(token["session"]), nil, nil)
+	suite.Equal(http.StatusOK, code)
+	suite.NotEmpty(token["refresh"])
+	code, _ = suite.request("POST", "/api/v1/login/passkey", "", body, nil)
+	suite.Equal(http.StatusUnauthorized, code)
+
+	code, _ = suite.request("POST", "/api/v1/login/passkey/options", "", nil, &request)
+	suite.Equal(http.StatusOK, code)
+	suite.Len(request.PublicKey.AllowCredentials, 0)
+	code, _ = suite.request("POST", "/api/v1/login/passkey", "", map[string]interface{}{"ceremony": request.Ceremony, "credential": authenticator.Get(&request.PublicKey)}, nil)
+	suite.Equal(http.StatusOK, code)
+
+	// A counter that goes back is a cloned passkey
+	code, _ = suite.request("POST", "/api/v1/login/passkey/options", "", nil, &request)
+	suite.Equal(http.StatusOK, code)
+	authenticator.SignCount = 0
+	code, _ = suite.request("POST", "/api/v1/login/passkey", "", map[string]interface{}{"ceremony": request.Ceremony, "credential": authenticator.Get(&request.PublicKey)}, nil)
+	suite.Equal(http.StatusUnauthorized, code)
+
+	// Another origin is refused
+	authenticator.Origin = "https://evil.example.com"
+	authenticator.SignCount = 10
+	code, _ = suite.request("POST", "/api/v1/login/passkey/options", "", nil, &request)
+	suite.Equal(http.StatusOK, code)
+	code, _ = suite.request("POST", "/api/v1/login/passkey", "", map[string]interface{}{"ceremony": request.Ceremony, "credential": authenticator.Get(&request.PublicKey)}, nil)
+	suite.Equal(http.StatusUnauthorized, code)
+
+	// Remove it
+	code, _ = suite.request("DELETE", "/api/v1/users/foo/passkeys/"+passkey.ID.Hex(), jwtAuth, nil, nil)
+	suite.Equal(http.StatusNoContent, code)
+	code, _ = suite.request("DELETE", "/api/v1/users/foo/passkeys/"+passkey.ID.Hex(), jwtAuth, nil, nil)
+	suite.Equal(http.StatusNotFound, code)
+
+	entries := []*schema.AuditEntry{}
+	code, _ = suite.request("GET", "/api/v1/audit?target="+uid, adminAuth, nil, &entries)
+	suite.Equal(http.StatusOK, code)
+	suite.Equal(schema.AuditPasskeyRemove, entries[0].Action)
+	suite.Equal(schema.AuditChange{New: "phone"}, entries[1].Diff["passkey"])
+	suite.Equal(schema.AuditLogin, entries[1].Action)
+	suite.Equal(schema.AuditPasskeyAdd, entries[3].Action)
+}
+
+func (suite *APITestSuite) Test012_PersonalTokens() {
+	var token map[string]string
+	code, _ := suite.request("GET", "/api/v1/login", basicAuthString("boss", "test_secret"), nil, &token)
+	suite.Equal(http.StatusOK, code)
+	adminAuth := jwtAuthString(token["session"])
+
+	username, password, email := "foo", "bar", "foo@bar.com"
+	user := &schema.User{Username: &username, Password: &password, Email: &email}
+	secureUser := &schema.UserSecure{}
+	code, _ = suite.request("POST", "/api/v1/users", "", user, secureUser)
+	suite.Equal(http.StatusCreated, code)
+	uid := secureUser.ID.Hex()
+	code, _ = suite.request("GET", "/api/v1/login", basicAuthString(username, password), nil, &token)
+	suite.Equal(http.StatusOK, code)
+	jwtAuth := jwtAuthString(token["session"])
+
+	// Tokens are limited to the permissions of the role
+	body := map[string]interface{}{"name": "ci", "permissions": []string{"modifyAllUsersRestricted"}}
+	code, _ = suite.request("POST", "/api/v1/users/foo/tokens", jwtAuth, body, nil)
+	suite.Equal(http.StatusBadRequest, code)
+	body["permissions"] = []string{"everything"}
+	code, _ = suite.request("POST", "/api/v1/users/foo/tokens", jwtAuth, body, nil)
+	suite.Equal(http.StatusBadRequest, code)
+	code, _ = suite.request("POST", "/api/v1/users/foo/tokens", jwtAuth, map[string]interface{}{"name": "ci", "expiresInDays": 1000}, nil)
+	suite.Equal(http.StatusBadRequest, code)
+
+	created := map[string]interface{}{}
+	code, _ = suite.request("POST", "/api/v1/users/foo/tokens", jwtAuth, map[string]interface{}{"name": "ci"}, &created)
+	suite.Equal(http.StatusCreated, code)
+	suite.True(strings.HasPrefix(created["token"].(string), "bt_pat_"))
+	userToken := jwtAuthString(created["token"].(string))
+
+	// and work in place of a session
+	code, _ = suite.request("GET", "/api/v1/users/foo", userToken, nil, nil)
+	suite.Equal(http.StatusOK, code)
+	code, _ = suite.request("GET", "/api/v1/users/foo", jwtAuthString("bt_pat_nope"), nil, nil)
+	suite.Equal(http.StatusUnauthorized, code)
+
+	// but can't make more tokens or manage the account
+	code, _ = suite.request("POST", "/api/v1/users/foo/tokens", userToken, map[string]interface{}{"name": "more"}, nil)
+	suite.Equal(http.StatusForbidden, code)
+	code, _ = suite.request("GET", "/api/v1/users/foo/tokens", userToken, nil, nil)
+	suite.Equal(http.StatusForbidden, code)
+	code, _ = suite.request("DELETE", "/api/v1/users/foo/sessions", userToken, nil, nil)
+	suite.Equal(http.StatusForbidden, code)
+	code, _ = suite.request("PATCH", "/api/v1/users/foo", userToken, map[string]string{"email": "evil@bar.com"}, nil)
+	suite.Equal(http.StatusForbidden, code)
+	code, _ = suite.request("DELETE", "/api/v1/users/foo", userToken, nil, nil)
+	suite.Equal(http.StatusForbidden, code)
+
+	// An admin token only has the permissions it was given
+	code, _ = suite.request("POST", "/api/v1/users/boss/tokens", adminAuth, map[string]interface{}{"name": "report", "permissions": []string{"modifyAllUsersRestricted"}}, &created)
+	suite.Equal(http.StatusCreated, code)
+	suite.Equal([]interface{}{"modifyAllUsersRestricted"}, created["permissions"])
+	reportToken := jwtAuthString(created["token"].(string))
+	code, _ = suite.request("GET", "/api/v1/users", reportToken, nil, nil)
+	suite.Equal(http.StatusOK, code)
+	code, _ = suite.request("DELETE", "/api/v1/users/foo", reportToken, nil, nil)
+	suite.Equal(http.StatusForbidden, code)
+	boss := &schema.UserSecure{}
+	code, _ = suite.request("GET", "/api/v1/users/boss", reportToken, nil, boss)
+	suite.Equal(http.StatusOK, code)
+	suite.Equal(schema.RoleAdmin, boss.Role)
+
+	// Using a token records when
+	tokens := []*schema.PersonalToken{}
+	code, _ = suite.request("GET", "/api/v1/users/"+uid+"/tokens", adminAuth, nil, &tokens)
+	suite.Equal(http.StatusOK, code)
+	suite.Len(tokens, 1)
+	suite.Equal("ci", tokens[0].Name)
+	suite.NotNil(tokens[0].LastUsedAt)
+	code, _ = suite.request("GET", "/api/v1/users/boss/tokens", jwtAuth, nil, nil)
+	suite.Equal(http.StatusForbidden, code)
+
+	// Revoked tokens stop working
+	code, _ = suite.request("DELETE", "/api/v1/users/foo/tokens/"+tokens[0].ID.Hex(), jwtAuth, nil, nil)
+	suite.Equal(http.StatusNoContent, code)
+	code, _ = suite.request("DELETE", "/api/v1/users/foo/tokens/"+tokens[0].ID.Hex(), jwtAuth, nil, nil)
+	suite.Equal(http.StatusNotFound, code)
+	code, _ = suite.request("GET", "/api/v1/users/foo", userToken, nil, nil)
+	suite.Equal(http.StatusUnauthorized, code)
+
+	entries := []*schema.AuditEntry{}
+	code, _ = suite.request("GET", "/api/v1/audit?target="+uid, adminAuth, nil, &entries)
+	suite.Equal(http.StatusOK, code)
+	suite.Equal(schema.AuditTokenRevoke, entries[0].Action)
+	suite.Equal(schema.AuditChange{Old: "ci"}, entries[0].Diff["token"])
+	suite.Equal(schema.AuditTokenCreate, entries[1].Action)
+}
+
+func (suite *APITestSuite) Test013_PasswordReset() {
+	username, password, email := "foo", "bar", "foo@bar.com"
+	user := &schema.User{Username: &username, Password: &password, Email: &email}
+	secureUser := &schema.UserSecure{}
+	code, _ := suite.request("POST", "/api/v1/users", "", user, secureUser)
+	suite.Equal(http.StatusCreated, code)
+	var token map[string]string
+	code, _ = suite.request("GET", "/api/v1/login", basicAuthString(username, password), nil, &token)
+	suite.Equal(http.StatusOK, code)
+	jwtAuth := jwtAuthString(token["session"])
+	suite.Eventually(func() bool { return len(suite.mail.Sent()) == 1 }, time.Second, 10*time.Millisecond)
+
+	// Unknown emails get the same answer and no mail
+	code, _ = suite.request("POST", "/api/v1/password/forgot", "", map[string]string{"email": "nobody@bar.com"}, nil)
+	suite.Equal(http.StatusAccepted, code)
+	code, _ = suite.request("POST", "/api/v1/password/forgot", "", map[string]string{"email": email}, nil)
+	suite.Equal(http.StatusAccepted, code)
+	resetToken := func(sent int) string {
+		suite.Eventually(func() bool { return len(suite.mail.Sent()) == sent }, time.Second, 10*time.Millisecond)
+		match := regexp.MustCompile(`reset-password\?token=([\w-]+)`).FindStringSubmatch(suite.mail.Last(email).Body)
+		suite.Len(match, 2)
+		return match[1]
+	}
+	first := resetToken(2)
+	suite.Len(suite.mail.Sent(), 2)
+
+	// Only the last link works
+	code, _ = suite.request("POST", "/api/v1/password/forgot", "", map[string]string{"email": email}, nil)
+	suite.Equal(http.StatusAccepted, code)
+	second := resetToken(3)
+	suite.NotEqual(first, second)
+	code, _ = suite.request("POST", "/api/v1/password/reset", "", map[string]string{"token": first, "password": "baz"}, nil)
+	suite.Equal(http.StatusBadRequest, code)
+	code, _ = suite.request("POST", "/api/v1/password/reset", "", map[string]string{"token": second}, nil)
+	suite.Equal(http.StatusBadRequest, code)
+
+	// and once, logging out everywhere and revoking personal tokens
+	created := map[string]interface{}{}
+	code, _ = suite.request("POST", "/api/v1/users/foo/tokens", jwtAuth, map[string]interface{}{"name": "ci"}, &created)
+	suite.Equal(http.StatusCreated, code)
+	code, _ = suite.request("POST", "/api/v1/password/reset", "", map[string]string{"token": second, "password": "baz"}, nil)
+	suite.Equal(http.StatusNoContent, code)
+	code, _ = suite.request("POST", "/api/v1/password/reset", "", map[string]string{"token": second, "password": "qux"}, nil)
+	suite.Equal(http.StatusBadRequest, code)
+	code, _ = suite.request("GET", "/api/v1/users/foo", jwtAuth, nil, nil)
+	suite.Equal(http.StatusUnauthorized, code)
+	code, _ = suite.request("GET", "/api/v1/users/foo", jwtAuthString(created["token"].(string)), nil, nil)
+	suite.Equal(http.StatusUnauthorized, code)
+	code, _ = suite.request("POST", "/api/v1/token/refresh", "", map[string]string{"refresh": token["refresh"]}, nil)
+	suite.Equal(http.StatusUnauthorized, code)
+
+	code, _ = suite.request("GET", "/api/v1/login", basicAuthString(username, password), nil, nil)
+	suite.Equal(http.StatusUnauthorized, code)
+	code, _ = suite.request("GET", "/api/v1/login", basicAuthString(username, "baz"), nil, &token)
+	suite.Equal(http.StatusOK, code)
+
+	// Changing the password revokes the same
+	jwtAuth = jwtAuthString(token["session"])
+	code, _ = suite.request("POST", "/api/v1/users/foo/tokens", jwtAuth, map[string]interface{}{"name": "ci"}, &created)
+	suite.Equal(http.StatusCreated, code)
+	oldPassword, newPassword := "baz", "qux"
+	patch := &schema.User{OldPassword: &oldPassword, Password: &newPassword}
+	code, _ = suite.request("PATCH", "/api/v1/users/foo", jwtAuth, patch, nil)
+	suite.Equal(http.StatusOK, code)
+	code, _ = suite.request("GET", "/api/v1/users/foo", jwtAuth, nil, nil)
+	suite.Equal(http.StatusUnauthorized, code)
+	code, _ = suite.request("GET", "/api/v1/users/foo", jwtAuthString(created["token"].(string)), nil, nil)
+	suite.Equal(http.StatusUnauthorized, code)
+	code, _ = suite.request("POST", "/api/v1/token/refresh", "", map[string]string{"refresh": token["refresh"]}, nil)
+	suite.Equal(http.StatusUnauthorized, code)
+	code, _ = suite.request("GET", "/api/v1/login", basicAuthString(username, newPassword), nil, nil)
+	suite.Equal(http.StatusOK, code)
+}
+
+func (suite *APITestSuite) Test014_EmailVerification() {
+	var token map[string]string
+	code, _ := suite.request("GET", "/api/v1/login", basicAuthString("boss", "test_secret"), nil, &token)
+	suite.Equal(http.StatusOK, code)
+	adminAuth := jwtAuthString(token["session"])
+
+	// Signing up mails a link to the new email
+	username, password, email := "foo", "bar", "foo@bar.com"
+	user := &schema.User{Username: &username, Password: &password, Email: &email}
+	secureUser := &schema.UserSecure{}
+	code, _ = suite.request("POST", "/api/v1/users", "", user, secureUser)
+	suite.Equal(http.StatusCreated, code)
+	verifyToken := func(to string, sent int) string {
+		suite.Eventually(func() bool { return len(suite.mail.Sent()) == sent }, time.Second, 10*time.Millisecond)
+		match := regexp.MustCompile(`verify-email\?token=([\w-]+)`).FindStringSubmatch(suite.mail.Last(to).Body)
+		suite.Len(match, 2)
+		return match[1]
+	}
+	first := verifyToken(email, 1)
+
+	// Logins can be held back until it is followed
+	os.Setenv("BT_REQUIRE_VERIFIED_EMAIL", "true")
+	code, _ = suite.request("GET", "/api/v1/login", basicAuthString(username, password), nil, nil)
+	suite.Equal(http.StatusForbidden, code)
+	os.Unsetenv("BT_REQUIRE_VERIFIED_EMAIL")
+	code, _ = suite.request("GET", "/api/v1/login", basicAuthString(username, password), nil, &token)
+	suite.Equal(http.StatusOK, code)
+	jwtAuth := jwtAuthString(token["session"])
+
+	// Another link is only sent after a while, and only the last one works
+	code, _ = suite.request("POST", "/api/v1/users/foo/email/verification", jwtAuth, nil, nil)
+	suite.Equal(http.StatusTooManyRequests, code)
+	suite.NotEmpty(suite.last.Header().Get(headerRetryAfter))
+	os.Setenv("BT_EMAIL_VERIFY_RESEND_INTERVAL", "0s")
+	code, _ = suite.request("POST", "/api/v1/users/foo/email/verification", jwtAuth, nil, nil)
+	os.Unsetenv("BT_EMAIL_VERIFY_RESEND_INTERVAL")
+	suite.Equal(http.StatusAccepted, code)
+	second := verifyToken(email, 2)
+	code, _ = suite.request("POST", "/api/v1/email/verify", "", map[string]string{"token": first}, nil)
+	suite.Equal(http.StatusBadRequest, code)
+	code, _ = suite.request("POST", "/api/v1/email/verify", "", map[string]string{"token": second}, nil)
+	suite.Equal(http.StatusNoContent, code)
+	code, _ = suite.request("GET", "/api/v1/users/foo", jwtAuth, nil, secureUser)
+	suite.Equal(http.StatusOK, code)
+	suite.True(secureUser.EmailVerified)
+	code, _ = suite.request("POST", "/api/v1/users/foo/email/verification", jwtAuth, nil, nil)
+	suite.Equal(http.StatusConflict, code)
+
+	// Users can't mark themselves verified
+	verified := true
+	code, _ = suite.request("PATCH", "/api/v1/users/foo", jwtAuth, &schema.User{EmailVerified: &verified}, nil)
+	suite.Equal(http.StatusForbidden, code)
+
+	// A new email waits for its link and must be free
+	code, _ = suite.request("PATCH", "/api/v1/users/foo", jwtAuth, map[string]string{"email": "bk@breadtech.com"}, nil)
+	suite.Equal(http.StatusConflict, code)
+	newEmail := "foo@baz.com"
+	code, _ = suite.request("PATCH", "/api/v1/users/foo", jwtAuth, map[string]string{"email": newEmail}, secureUser)
+	suite.Equal(http.StatusAccepted, code)
+	suite.Equal(email, secureUser.Email)
+	change := verifyToken(newEmail, 3)
+	code, _ = suite.request("POST", "/api/v1/email/verify", "", map[string]string{"token": change}, nil)
+	suite.Equal(http.StatusNoContent, code)
+	code, _ = suite.request("GET", "/api/v1/users/foo", jwtAuth, nil, secureUser)
+	suite.Equal(http.StatusOK, code)
+	suite.Equal(newEmail, secureUser.Email)
+	suite.True(secureUser.EmailVerified)
+
+	// and the old email hears about it
+	suite.Eventually(func() bool { return len(suite.mail.Sent()) == 4 }, time.Second, 10*time.Millisecond)
+	suite.Equal("Your email was changed", suite.mail.Last(email).Subject)
+
+	// Admins set an email right away, unverified unless they say otherwise
+	code, _ = suite.request("PATCH", "/api/v1/users/foo", adminAuth, map[string]string{"email": email}, secureUser)
+	suite.Equal(http.StatusOK, code)
+	suite.Equal(email, secureUser.Email)
+	suite.False(secureUser.EmailVerified)
+	verifyToken(email, 5)
+	code, _ = suite.request("PATCH", "/api/v1/users/foo", adminAuth, &schema.User{EmailVerified: &verified}, secureUser)
+	suite.Equal(http.StatusOK, code)
+	suite.True(secureUser.EmailVerified)
+}
+
+func (suite *APITestSuite) Test015_Lockout() {
+	os.Setenv("BT_LOGIN_LOCKOUT_THRESHOLD", "3")
+	var token map[string]string
+	code, _ := suite.request("GET", "/api/v1/login", basicAuthString("boss", "test_secret"), nil, &token)
+	suite.Equal(http.StatusOK, code)
+	adminAuth := jwtAuthString(token["session"])
+
+	username, password, email := "foo", "bar", "foo@bar.com"
+	user := &schema.User{Username: &username, Password: &password, Email: &email}
+	code, _ = suite.request("POST", "/api/v1/users", "", user, nil)
+	suite.Equal(http.StatusCreated, code)
+
+	// A good password clears the failures before it
+	for i := 0; i < 2; i++ {
+		code, _ = suite.request("GET", "/api/v1/login", basicAuthString(username, "wrong"), nil, nil)
+		suite.Equal(http.StatusUnauthorized, code)
+	}
+	code, _ = suite.request("GET", "/api/v1/login", basicAuthString(username, password), nil, nil)
+	suite.Equal(http.StatusOK, code)
+
+	// Enough failures in a row lock out even the right password,
+	// unknown users just the same
+	for _, name := range []string{username, "nobody"} {
+		for i := 0; i < 3; i++ {
+			code, _ = suite.request("GET", "/api/v1/login", basicAuthString(name, "wrong"), nil, nil)
+			suite.Equal(http.StatusUnauthorized, code)
+		}
+	}
+	code, locked := suite.request("GET", "/api/v1/login", basicAuthString(username, password), nil, nil)
+	suite.Equal(http.StatusTooManyRequests, code)
+	retry := suite.last.Header().Get(headerRetryAfter)
+	suite.Equal("60", retry)
+	code, unknown := suite.request("GET", "/api/v1/login", basicAuthString("nobody", "wrong"), nil, nil)
+	suite.Equal(http.StatusTooManyRequests, code)
+	suite.Equal(locked, unknown)
+	suite.Equal(retry, suite.last.Header().Get(headerRetryAfter))
+
+	// Admins see the lockout and lift it
+	lockout := map[string]interface{}{}
+	code, _ = suite.request("GET", "/api/v1/users/foo/lockout", adminAuth, nil, &lockout)
+	suite.Equal(http.StatusOK, code)
+	suite.Equal(float64(3), lockout["failures"])
+	suite.NotNil(lockout["lockedUntil"])
+	code, _ = suite.request("DELETE", "/api/v1/users/foo/lockout", jwtAuthString(token["session"]), nil, nil)
+	suite.Equal(http.StatusNoContent, code)
+	code, _ = suite.request("GET", "/api/v1/login", basicAuthString(username, password), nil, &token)
+	suite.Equal(http.StatusOK, code)
+	code, _ = suite.request("DELETE", "/api/v1/users/foo/lockout", jwtAuthString(token["session"]), nil, nil)
+	suite.Equal(http.StatusForbidden, code)
+
+	// Failures are audited without a target
+	entries := []*schema.AuditEntry{}
+	code, _ = suite.request("GET", "/api/v1/audit", adminAuth, nil, &entries)
+	suite.Equal(http.StatusOK, code)
+	fails := 0
+	for _, e := range entries {
+		if e.Action == schema.AuditLoginFail {
+			suite.Empty(e.Target)
+			fails++
+		}
+	}
+	suite.Equal(8, fails)
+	suite.Equal(schema.AuditLogin, entries[0].Action)
+	suite.Equal(schema.AuditUserUnlock, entries[1].Action)
+
+	// A source IP is locked out over all the users it tries, until one
+	// of them logs in
+	os.Setenv("BT_LOGIN_LOCKOUT_IP_THRESHOLD", "3")
+	for _, name := range []string{"a", "b", "c", "d"} {
+		if name == "c" {
+			code, _ = suite.request("GET", "/api/v1/login", basicAuthString("boss", "test_secret"), nil, nil)
+			suite.Equal(http.StatusOK, code)
+		}
+		code, _ = suite.request("GET", "/api/v1/login", basicAuthString(name, "wrong"), nil, nil)
+		suite.Equal(http.StatusUnauthorized, code)
+	}
+	code, _ = suite.request("GET", "/api/v1/login", basicAuthString("boss", "test_secret"), nil, nil)
+	suite.Equal(http.StatusOK, code)
+	for _, name := range []string{"a", "b", "c"} {
+		code, _ = suite.request("GET", "/api/v1/login", basicAuthString(name, "wrong"), nil, nil)
+		suite.Equal(http.StatusUnauthorized, code)
+	}
+	code, _ = suite.request("GET", "/api/v1/login", basicAuthString("boss", "test_secret"), nil, nil)
+	suite.Equal(http.StatusTooManyRequests, code)
+
+	// Forwarding headers only count from trusted proxies
+	spoofed := map[string]string{echo.HeaderXForwardedFor: "203.0.113.9", echo.HeaderXRealIP: "203.0.113.9"}
+	code, _ = suite.requestWithHeaders("GET", "/api/v1/login", basicAuthString("boss", "test_secret"), spoofed, nil, nil)
+	suite.Equal(http.StatusTooManyRequests, code)
+	os.Setenv("BT_TRUSTED_PROXIES", "192.0.2.0/24")
+	code, _ = suite.requestWithHeaders("GET", "/api/v1/login", basicAuthString("boss", "test_secret"), spoofed, nil, nil)
+	suite.Equal(http.StatusOK, code)
+}
+
+func (suite *APITestSuite) Test016_RateLimits() {
+	// Anonymous routes are limited per IP out of the box
+	body := map[string]string{"email": "nobody@bar.com"}
+	for i := 4; i >= 0; i-- {
+		code, _ := suite.request("POST", "/api/v1/password/forgot", "", body, nil)
+		suite.Equal(http.StatusAccepted, code)
+		suite.Equal("5", suite.last.Header().Get(headerRateLimit))
+		suite.Equal(strconv.Itoa(i), suite.last.Header().Get(headerRateLimitRemaining))
+		suite.Equal("5;w=3600", suite.last.Header().Get(headerRateLimitPolicy))
+	}
+	code, _ := suite.request("POST", "/api/v1/password/forgot", "", body, nil)
+	suite.Equal(http.StatusTooManyRequests, code)
+	suite.Equal("720", suite.last.Header().Get(headerRetryAfter))
+	suite.Equal("3600", suite.last.Header().Get(headerRateLimitReset))
+	spoofed := map[string]string{echo.HeaderXForwardedFor: "203.0.113.9"}
+	code, _ = suite.requestWithHeaders("POST", "/api/v1/password/forgot", "", spoofed, body, nil)
+	suite.Equal(http.StatusTooManyRequests, code)
+
+	// Routes without a rate limit go untouched
+	code, _ = suite.request("GET", "/api/v1/service/ping", "", nil, nil)
+	suite.Equal(http.StatusOK, code)
+	suite.Empty(suite.last.Header().Get(headerRateLimit))
+
+	// Requests count for their user or personal token if they have one
+	var token map[string]string
+	code, _ = suite.request("GET", "/api/v1/login", basicAuthString("boss", "test_secret"), nil, &token)
+	suite.Equal(http.StatusOK, code)
+	claims, err := AuthenticateJWT(jwtAuthString(token["session"]))
+	suite.Nil(err)
+	for auth, keys := range map[string][3]string{
+		"":                               {"ip:192.0.2.1", "ip:192.0.2.1", "ip:192.0.2.1"},
+		basicAuthString("boss", "wrong"): {"ip:192.0.2.1", "user:boss", "ip:192.0.2.1"},
+		jwtAuthString(token["session"]):  {"ip:192.0.2.1", "user:" + claims.Subject, "ip:192.0.2.1"},
+		jwtAuthString("nope"):            {"ip:192.0.2.1", "ip:192.0.2.1", "ip:192.0.2.1"},
+		jwtAuthString("bt_pat_secret"):   {"ip:192.0.2.1", "ip:192.0.2.1", "key:" + hashToken("bt_pat_secret")},
+	} {
+		req := httptest.NewRequest("GET", "/api/v1/users", nil)
+		if len(auth) > 0 {
+			req.Header.Set(echo.HeaderAuthorization, auth)
+		}
+		c := suite.e.NewContext(req, httptest.NewRecorder())
+		for i, by := range []string{ratelimit.ByIP, ratelimit.ByUser, ratelimit.ByKey} {
+			suite.Equal(keys[i], rateKey(c, by), "%s by %s", auth, by)
+		}
+	}
+
+	// Rate limits are set per route, or for every other route at once,
+	// and can be counted in the store
+	viper.Set("RATE_LIMITS", []map[string]interface{}{
+		{"route": "get /users/:userID", "limit": 1, "period": "1m", "by": "user"},
+		{"route": "*", "limit": 2, "period": "1m"},
+	})
+	viper.Set("RATE_LIMIT_STORE", "shared")
+	defer viper.Set("RATE_LIMITS", nil)
+	defer viper.Set("RATE_LIMIT_STORE", nil)
+	suite.e = New(store.NewMemoryStore())
+	code, _ = suite.request("GET", "/api/v1/login", basicAuthString("boss", "test_secret"), nil, &token)
+	suite.Equal(http.StatusOK, code)
+	code, _ = suite.request("GET", "/api/v1/users/boss", jwtAuthString(token["session"]), nil, nil)
+	suite.Equal(http.StatusOK, code)
+	code, _ = suite.request("GET", "/api/v1/users/boss", jwtAuthString(token["session"]), nil, nil)
+	suite.Equal(http.StatusTooManyRequests, code)
+	code, _ = suite.request("GET", "/api/v1/service/ping", "", nil, nil)
+	suite.Equal(http.StatusOK, code)
+	code, _ = suite.request("POST", "/api/v1/password/forgot", "", body, nil)
+	suite.Equal(http.StatusTooManyRequests, code)
+
+	// A store that can't count still has the requests counted in process
+	suite.e = New(failingRates{store.NewMemoryStore()})
+	for i := 0; i < 2; i++ {
+		code, _ = suite.request("GET", "/api/v1/service/ping", "", nil, nil)
+		suite.Equal(http.StatusOK, code)
+	}
+	code, _ = suite.request("GET", "/api/v1/service/ping", "", nil, nil)
+	suite.Equal(http.StatusTooManyRequests, code)
+}
+
+// failingRates is a store that can't count rate limits
+type failingRates struct {
+	store.UserStore
+}
+
+func (failingRates) TakeRateToken(ctx context.Context, key string, p ratelimit.Policy, now time.Time) (ratelimit.Result, error) {
+	return ratelimit.Result{}, fmt.Errorf("store down")
+}
+
+func (suite *APITestSuite) Test017_PasswordPolicy() {
+	breached := "Correct-Horse-9"
+	sum := sha1.Sum([]byte(breached))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	dir := suite.T().TempDir()
+	suite.Nil(ioutil.WriteFile(filepath.Join(dir, hash[:5]+".txt"), []byte("0018A45C4D1DEF81644B54AB7F969B88D65:1\n"+hash[5:]+":42\n"), 0600))
+
+	os.Setenv("BT_PASSWORD_MIN_LENGTH", "12")
+	os.Setenv("BT_PASSWORD_MIN_CLASSES", "3")
+	os.Setenv("BT_PASSWORD_MIN_STRENGTH", "2")
+	os.Setenv("BT_BREACHED_PASSWORDS", dir)
+	defer os.Unsetenv("BT_PASSWORD_MIN_CLASSES")
+
+	// Every rule the password breaks comes back
+	rules := func(res *errors.PolicyError) []string {
+		names := []string{}
+		for _, v := range res.Violations {
+			names = append(names, v.Rule)
+		}
+		return names
+	}
+	username, email := "alice", "alice.w@bar.com"
+	for pw, want := range map[string][]string{
+		"bar":                                 {"minLength", "characterClasses", "strength"},
+		"Alice-1234567":                       {"username"},
+		"Alice.W-1234567":                     {"username", "email"},
+		breached:                              {"breached"},
+		"passwordpassword12":                  {"characterClasses", "strength"},
+		strings.Repeat("Wide-Lantern-58!", 5): {"maxLength"},
+	} {
+		password := pw
+		user := &schema.User{Username: &username, Password: &password, Email: &email}
+		res := &errors.PolicyError{}
+		code, _ := suite.request("POST", "/api/v1/users", "", user, res)
+		suite.Equal(http.StatusBadRequest, code, pw)
+		suite.Equal("password", res.Field)
+		suite.Equal(want, rules(res), pw)
+	}
+
+	password := "Wide-Lantern-58"
+	user := &schema.User{Username: &username, Password: &password, Email: &email}
+	code, _ := suite.request("POST", "/api/v1/users", "", user, nil)
+	suite.Equal(http.StatusCreated, code)
+
+	// A new password is held up to the username it ends up with
+	var token map[string]string
+	code, _ = suite.request("GET", "/api/v1/login", basicAuthString(username, password), nil, &token)
+	suite.Equal(http.StatusOK, code)
+	newUsername, newPassword := "lantern", "Wide-Lantern-59"
+	res := &errors.PolicyError{}
+	patch := &schema.User{Username: &newUsername, Password: &newPassword, OldPassword: &password}
+	code, _ = suite.request("PATCH", "/api/v1/users/alice", jwtAuthString(token["session"]), patch, res)
+	suite.Equal(http.StatusBadRequest, code)
+	suite.Equal([]string{"username"}, rules(res))
+
+	patch.Username = nil
+	code, _ = suite.request("PATCH", "/api/v1/users/alice", jwtAuthString(token["session"]), patch, nil)
+	suite.Equal(http.StatusOK, code)
+
+	// A reset link survives a password the policy rejects
+	code, _ = suite.request("POST", "/api/v1/password/forgot", "", map[string]string{"email": email}, nil)
+	suite.Equal(http.StatusAccepted, code)
+	suite.Eventually(func() bool { return len(suite.mail.Sent()) == 2 }, time.Second, 10*time.Millisecond)
+	match := regexp.MustCompile(`reset-password\?token=([\w-]+)`).FindStringSubmatch(suite.mail.Last(email).Body)
+	suite.Len(match, 2)
+	code, _ = suite.request("POST", "/api/v1/password/reset", "", map[string]string{"token": match[1], "password": "bar"}, res)
+	suite.Equal(http.StatusBadRequest, code)
+	suite.Equal("password", res.Field)
+	code, _ = suite.request("POST", "/api/v1/password/reset", "", map[string]string{"token": match[1], "password": "Wide-Lantern-60"}, nil)
+	suite.Equal(http.StatusNoContent, code)
+
+	// The admin is only created with a secret that meets the policy
+	err := store.NewMemoryStore().AdminExistsOrCreate(context.Background(), "gammahouse")
+	policy, ok := err.(*errors.PolicyError)
+	suite.True(ok)
+	suite.Equal([]string{"minLength", "characterClasses"}, rules(policy))
+}
+
+func (suite *APITestSuite) Test018_Sessions() {
+	var token map[string]string
+	code, _ := suite.request("GET", "/api/v1/login", basicAuthString("boss", "test_secret"), nil, &token)
+	suite.Equal(http.StatusOK, code)
+	adminAuth := jwtAuthString(token["session"])
+
+	username, password, email := "foo", "bar", "foo@bar.com"
+	user := &schema.User{Username: &username, Password: &password, Email: &email}
+	code, _ = suite.request("POST", "/api/v1/users", "", user, nil)
+	suite.Equal(http.StatusCreated, code)
+	other, otherEmail := "baz", "baz@bar.com"
+	user = &schema.User{Username: &other, Password: &password, Email: &otherEmail}
+	code, _ = suite.request("POST", "/api/v1/users", "", user, nil)
+	suite.Equal(http.StatusCreated, code)
+
+	// Every login is a session of its own, the IP is forwarded by a proxy
+	os.Setenv("BT_TRUSTED_PROXIES", "192.0.2.1")
+	logins := []map[string]string{}
+	for _, agent := range []string{"curl/8.0", "Firefox"} {
+		var login map[string]string
+		code, _ = suite.requestWithHeaders("GET", "/api/v1/login", basicAuthString(username, password), map[string]string{"User-Agent": agent, echo.HeaderXRealIP: "198.51.100.7"}, nil, &login)
+		suite.Equal(http.StatusOK, code)
+		logins = append(logins, login)
+	}
+	auth := jwtAuthString(logins[0]["session"])
+	claims, err := AuthenticateJWT(auth)
+	suite.Nil(err)
+
+	var sessions []*schema.Session
+	code, _ = suite.request("GET", "/api/v1/users/foo/sessions", auth, nil, &sessions)
+	suite.Equal(http.StatusOK, code)
+	suite.Equal(2, len(sessions))
+	suite.Equal(claims.SessionID, sessions[0].ID)
+	suite.True(sessions[0].Current)
+	suite.Equal("curl/8.0", sessions[0].UserAgent)
+	suite.Equal("198.51.100.7", sessions[0].IP)
+	suite.False(sessions[1].Current)
+	suite.Equal("Firefox", sessions[1].UserAgent)
+	firefox := sessions[1].ID
+
+	// Only the user and admins see them
+	code, _ = suite.request("GET", "/api/v1/login", basicAuthString(other, password), nil, &token)
+	suite.Equal(http.StatusOK, code)
+	code, _ = suite.request("GET", "/api/v1/users/foo/sessions", jwtAuthString(token["session"]), nil, nil)
+	suite.Equal(http.StatusForbidden, code)
+	code, _ = suite.request("DELETE", "/api/v1/users/foo/sessions/"+firefox, jwtAuthString(token["session"]), nil, nil)
+	suite.Equal(http.StatusForbidden, code)
+
+	// A refresh stays in its session
+	var refreshed map[string]string
+	code, _ = suite.request("POST", "/api/v1/token/refresh", "", map[string]string{"refresh": logins[0]["refresh"]}, &refreshed)
+	suite.Equal(http.StatusOK, code)
+	refreshedClaims, err := AuthenticateJWT(jwtAuthString(refreshed["session"]))
+	suite.Nil(err)
+	suite.Equal(claims.SessionID, refreshedClaims.SessionID)
+
+	// Ending a session logs out its session and refresh tokens
+	code, _ = suite.request("DELETE", "/api/v1/users/foo/sessions/"+firefox, auth, nil, nil)
+	suite.Equal(http.StatusNoContent, code)
+	code, _ = suite.request("DELETE", "/api/v1/users/foo/sessions/"+firefox, auth, nil, nil)
+	suite.Equal(http.StatusNotFound, code)
+	code, _ = suite.request("GET", "/api/v1/users/foo", jwtAuthString(logins[1]["session"]), nil, nil)
+	suite.Equal(http.StatusUnauthorized, code)
+	code, _ = suite.request("POST", "/api/v1/token/refresh", "", map[string]string{"refresh": logins[1]["refresh"]}, nil)
+	suite.Equal(http.StatusUnauthorized, code)
+	code, _ = suite.request("GET", "/api/v1/users/foo/sessions", auth, nil, &sessions)
+	suite.Equal(http.StatusOK, code)
+	suite.Equal(1, len(sessions))
+
+	// Admins can end them all
+	code, _ = suite.request("DELETE", "/api/v1/users/foo/sessions", adminAuth, nil, nil)
+	suite.Equal(http.StatusNoContent, code)
+	code, _ = suite.request("GET", "/api/v1/users/foo", jwtAuthString(refreshed["session"]), nil, nil)
+	suite.Equal(http.StatusUnauthorized, code)
+	code, _ = suite.request("GET", "/api/v1/users/foo/sessions", adminAuth, nil, &sessions)
+	suite.Equal(http.StatusOK, code)
+	suite.Equal(0, len(sessions))
+
+	var entries []*schema.AuditEntry
+	code, _ = suite.request("GET", "/api/v1/audit?limit=2", adminAuth, nil, &entries)
+	suite.Equal(http.StatusOK, code)
+	suite.Len(entries, 2)
+	suite.Equal(schema.AuditSessionEnd, entries[0].Action)
+	suite.Equal(float64(1), entries[0].Diff["sessions"].Old)
+	suite.Equal(schema.AuditSessionEnd, entries[1].Action)
+	suite.Equal(firefox, entries[1].Diff["session"].Old)
+
+	// and logging out ends one too
+	code, _ = suite.request("GET", "/api/v1/login", basicAuthString(username, password), nil, &token)
+	suite.Equal(http.StatusOK, code)
+	code, _ = suite.request("POST", "/api/v1/logout", jwtAuthString(token["session"]), nil, nil)
+	suite.Equal(http.StatusNoContent, code)
+	code, _ = suite.request("GET", "/api/v1/users/foo/sessions", adminAuth, nil, &sessions)
+	suite.Equal(http.StatusOK, code)
+	suite.Equal(0, len(sessions))
+}
+
+func (suite *APITestSuite) Test019_SessionCookies() {
+	// Without the mode logins set no cookies
+	var token map[string]string
+	code, _ := suite.request("GET", "/api/v1/login", basicAuthString("boss", "test_secret"), nil, &token)
+	suite.Equal(http.StatusOK, code)
+	suite.Empty(suite.last.Result().Cookies())
+	suite.Empty(token["csrf"])
+
+	os.Setenv("BT_SESSION_COOKIE", "true")
+	code, _ = suite.request("GET", "/api/v1/login", basicAuthString("boss", "test_secret"), nil, &token)
+	suite.Equal(http.StatusOK, code)
+	cookies := map[string]*http.Cookie{}
+	for _, cookie := range suite.last.Result().Cookies() {
+		cookies[cookie.Name] = cookie
+		suite.True(cookie.Secure)
+		suite.Equal(http.SameSiteStrictMode, cookie.SameSite)
+	}
+	suite.Equal(token["session"], cookies[cookieSession].Value)
+	suite.Equal("/api/v1", cookies[cookieSession].Path)
+	suite.True(cookies[cookieSession].HttpOnly)
+	suite.Equal(token["refresh"], cookies[cookieRefresh].Value)
+	suite.Equal("/api/v1/token/refresh", cookies[cookieRefresh].Path)
+	suite.True(cookies[cookieRefresh].HttpOnly)
+	suite.Equal(token["csrf"], cookies[cookieCSRF].Value)
+	suite.False(cookies[cookieCSRF].HttpOnly)
+
+	jar := func(session, csrf string) map[string]string {
+		return map[string]string{"Cookie": fmt.Sprintf("%s=%s; %s=%s", cookieSession, session, cookieCSRF, csrf)}
+	}
+	withCSRF := func(headers map[string]string, csrf string) map[string]string {
+		headers[headerCSRF] = csrf
+		return headers
+	}
+
+	// The cookie authenticates reads on its own
+	code, _ = suite.requestWithHeaders("GET", "/api/v1/users/boss", "", jar(token["session"], token["csrf"]), nil, nil)
+	suite.Equal(http.StatusOK, code)
+
+	// and writes along with the CSRF token of its login in the header too
+	username, password, role := "foo", "bar", schema.RoleManager
+	email := "foo@bar.com"
+	user := &schema.User{Username: &username, Password: &password, Email: &email, Role: &role}
+	code, _ = suite.requestWithHeaders("POST", "/api/v1/users", "", jar(token["session"], token["csrf"]), user, nil)
+	suite.Equal(http.StatusForbidden, code)
+	code, _ = suite.requestWithHeaders("POST", "/api/v1/users", "", withCSRF(jar(token["session"], "nope"), token["csrf"]), user, nil)
+	suite.Equal(http.StatusForbidden, code)
+
+	var other map[string]string
+	code, _ = suite.request("GET", "/api/v1/login", basicAuthString("boss", "test_secret"), nil, &other)
+	suite.Equal(http.StatusOK, code)
+	suite.NotEqual(token["csrf"], other["csrf"])
+	code, _ = suite.requestWithHeaders("POST", "/api/v1/users", "", withCSRF(jar(token["session"], other["csrf"]), other["csrf"]), user, nil)
+	suite.Equal(http.StatusForbidden, code)
+
+	created := &schema.UserSecure{}
+	code, _ = suite.requestWithHeaders("POST", "/api/v1/users", "", withCSRF(jar(token["session"], token["csrf"]), token["csrf"]), user, created)
+	suite.Equal(http.StatusCreated, code)
+	suite.Equal(schema.RoleManager, created.Role)
+
+	// The Authorization header still wins over the cookie
+	code, _ = suite.requestWithHeaders("PATCH", "/api/v1/users/boss", jwtAuthString(token["session"]), jar("nope", "nope"), &schema.User{}, nil)
+	suite.Equal(http.StatusOK, code)
+
+	// Refreshing with the cookie needs the CSRF token and keeps it
+	refreshJar := map[string]string{"Cookie": fmt.Sprintf("%s=%s; %s=%s", cookieRefresh, token["refresh"], cookieCSRF, token["csrf"])}
+	code, _ = suite.requestWithHeaders("POST", "/api/v1/token/refresh", "", refreshJar, nil, nil)
+	suite.Equal(http.StatusForbidden, code)
+	var refreshed map[string]string
+	code, _ = suite.requestWithHeaders("POST", "/api/v1/token/refresh", "", withCSRF(refreshJar, token["csrf"]), nil, &refreshed)
+	suite.Equal(http.StatusOK, code)
+	suite.Equal(token["csrf"], refreshed["csrf"])
+	suite.NotEqual(token["refresh"], refreshed["refresh"])
+
+	// Logging out clears the cookies
+	code, _ = suite.requestWithHeaders("POST", "/api/v1/logout", "", withCSRF(jar(refreshed["session"], token["csrf"]), token["csrf"]), nil, nil)
+	suite.Equal(http.StatusNoContent, code)
+	for _, cookie := range suite.last.Result().Cookies() {
+		suite.Empty(cookie.Value, cookie.Name)
+		suite.True(cookie.MaxAge < 0, cookie.Name)
+	}
+	code, _ = suite.requestWithHeaders("GET", "/api/v1/users/boss", "", jar(refreshed["session"], token["csrf"]), nil, nil)
+	suite.Equal(http.StatusUnauthorized, code)
+
+	// and without the mode the cookie is ignored
+	os.Unsetenv("BT_SESSION_COOKIE")
+	code, _ = suite.requestWithHeaders("GET", "/api/v1/users/boss", "", jar(other["session"], other["csrf"]), nil, nil)
+	suite.Equal(http.StatusUnauthorized, code)
+}
+
+func (suite *APITestSuite) writeKey(dir, name string, k interface{}) string {
+	der, err := x509.MarshalPKCS8PrivateKey(k)
+	suite.Nil(err)
+	path := filepath.Join(dir, name)
+	suite.Nil(ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600))
+	return path
 }
 
 func (suite *APITestSuite) request(method, path, auth string, body, response interface{}) (int, string) {
+	return suite.requestWithHeaders(method, path, auth, nil, body, response)
+}
+
+func (suite *APITestSuite) requestWithHeaders(method, path, auth string, headers map[string]string, body, response interface{}) (int, string) {
 	var req *http.Request
 	var err error
 
@@ -160,10 +1823,15 @@ func (suite *APITestSuite) request(method, path, auth string, body, response int
 	if len(auth) > 0 {
 		req.Header.Set(echo.HeaderAuthorization, auth)
 	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	req.RemoteAddr = testRemoteAddr
 
 	// record response
 	rec := httptest.NewRecorder()
 	suite.e.ServeHTTP(rec, req)
+	suite.last = rec
 	resp, _ := ioutil.ReadAll(rec.Body)
 
 	// json string to interface if response
@@ -174,6 +1842,26 @@ func (suite *APITestSuite) request(method, path, auth string, body, response int
 	return rec.Code, string(resp)
 }
 
+// form posts values url encoded to path
+func (suite *APITestSuite) form(path, auth string, values url.Values, response interface{}) (int, string) {
+	req, err := http.NewRequest("POST", path, strings.NewReader(values.Encode()))
+	suite.Nil(err)
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	if len(auth) > 0 {
+		req.Header.Set(echo.HeaderAuthorization, auth)
+	}
+	req.RemoteAddr = testRemoteAddr
+
+	rec := httptest.NewRecorder()
+	suite.e.ServeHTTP(rec, req)
+	suite.last = rec
+	resp, _ := ioutil.ReadAll(rec.Body)
+	if response != nil {
+		json.Unmarshal(resp, response)
+	}
+	return rec.Code, string(resp)
+}
+
 func basicAuthString(user, pass string) string {
 	b64auth := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", user, pass)))
 	return fmt.Sprintf("Basic %s", b64auth)
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+
+	"github.com/briansan/user-go/errors"
+	"github.com/briansan/user-go/schema"
+	"github.com/briansan/user-go/store"
+)
+
+// audit appends an entry for the current request to the audit log
+// actor is nil for anonymous requests, a failed write is only logged
+// so that the change it describes still goes through
+func audit(c echo.Context, action string, actor, target *schema.UserSecure, diff map[string]schema.AuditChange) {
+	e := &schema.AuditEntry{
+		Action:    action,
+		Diff:      diff,
+		IP:        clientIP(c),
+		RequestID: c.Response().Header().Get(echo.HeaderXRequestID),
+	}
+	if actor != nil {
+		e.Actor = actor.ID.Hex()
+	}
+	if target != nil {
+		e.Target = target.ID.Hex()
+	}
+	if err := getStore(c).AppendAudit(c.Request().Context(), e); err != nil {
+		logger.Warn("audit write failed", "action", action, "target", e.Target, "err", err)
+	}
+}
+
+// GetAudit retrieves audit entries, newest first
+//   available to roles with ModifyAllUsers permission
+//   filtered by ?actor and ?target user ids and the ?from and ?to RFC3339 times
+//   limited by ?limit
+func GetAudit(c echo.Context) error {
+	// Type assert user from context and authorize
+	user, ok := c.Get("user").(*schema.UserSecure)
+	if !ok {
+		return echo.ErrUnauthorized
+	}
+	if !allows(c, user, schema.PermissionModifyAllUsers) {
+		return echo.ErrForbidden
+	}
+
+	// Parse query
+	q, err := newAuditQuery(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	// Try to get entries
+	entries, err := getStore(c).FindAudit(c.Request().Context(), q)
+	if err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	return c.JSON(http.StatusOK, entries)
+}
+
+// newAuditQuery reads the filter and limit parameters of GetAudit
+func newAuditQuery(c echo.Context) (*store.AuditQuery, error) {
+	q := &store.AuditQuery{
+		Actor:  c.QueryParam("actor"),
+		Target: c.QueryParam("target"),
+	}
+	for _, param := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &q.From}, {"to", &q.To}} {
+		if v := c.QueryParam(param.name); len(v) > 0 {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, errors.NewValidationError(param.name, "RFC3339 time")
+			}
+			*param.t = t
+		}
+	}
+	if limit := c.QueryParam("limit"); len(limit) > 0 {
+		l, err := strconv.Atoi(limit)
+		if err != nil || l <= 0 {
+			return nil, errors.NewValidationError("limit", "positive integer")
+		}
+		q.Limit = l
+	}
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func initAudit(api *echo.Group) {
+	api.GET("/audit", GetAudit, DoJWTAuth)
+}
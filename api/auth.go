@@ -1,173 +1,482 @@
 package api
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"strings"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/labstack/echo"
 
 	"github.com/briansan/user-go/config"
 	"github.com/briansan/user-go/errors"
+	"github.com/briansan/user-go/keys"
+	"github.com/briansan/user-go/schema"
 	"github.com/briansan/user-go/store"
 )
 
-const (
-	sessionDuration = time.Hour
-)
-
 var (
 	secret = config.GetSecret()
+	// signer signs sessions with env.JWT_SIGNING_KEY, nil signs with secret
+	signer *keys.Set
 )
 
-func initSecret() {
-	// Get user from db
-	db, err := store.NewMongoStore()
-	if err != nil {
+func initSecret(db store.UserStore) {
+	// Reload in case the environment changed since init
+	secret = config.GetSecret()
+
+	// Try to fetch user by creds
+	if err := db.AdminExistsOrCreate(context.Background(), string(secret)); err != nil {
 		panic(err)
 	}
-	defer db.Cleanup()
+}
 
-	// Try to fetch user by creds
-	if err := db.AdminExistsOrCreate(string(secret)); err != nil {
+func initKeys() {
+	var err error
+	if signer, err = keys.FromConfig(); err != nil {
 		panic(err)
 	}
 }
 
+// Claims are the claims of a session
+type Claims struct {
+	jwt.RegisteredClaims
+	// Role and Permissions are the names of the role and permissions the
+	// user had when the session was issued, set if env.JWT_ROLE_CLAIMS
+	Role        string   `json:"role,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+	// ClientID and Scope are set on tokens issued to oauth clients
+	ClientID string `json:"client_id,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+	// SessionID is the login session jwts are issued for, ending it
+	// revokes them
+	SessionID string `json:"sid,omitempty"`
+}
+
 // NewJWTSession creates a jwt token with
-//   aud = user
-//   exp = now + sessionDuration
-//   iss = now
-func NewJWTSession(user string) (string, error) {
-	claims := &jwt.StandardClaims{
-		Audience:  user,
-		ExpiresAt: time.Now().Add(sessionDuration).Unix(),
-		IssuedAt:  time.Now().Unix(),
-	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	ss, err := token.SignedString(secret)
+//   sub = user id
+//   iss = env.JWT_ISSUER
+//   aud = env.JWT_AUDIENCE
+//   exp = now + env.ACCESS_TOKEN_TTL
+//   iat = now
+//   jti = random id to revoke it by
+//   sid = sessionID
+//   role and permissions of user if env.JWT_ROLE_CLAIMS
+func NewJWTSession(user *schema.UserSecure, sessionID string) (string, *Claims, error) {
+	claims, err := newClaims(user.ID.Hex())
+	if err != nil {
+		return "", nil, err
+	}
+	claims.SessionID = sessionID
+	if config.GetJWTRoleClaims() {
+		claims.Role = schema.RoleName(user.Role)
+		claims.Permissions = schema.PermissionNames(user.Role)
+	}
+	ss, err := signJWT(claims)
+	if err != nil {
+		return "", nil, err
+	}
+	return ss, claims, nil
+}
+
+// newClaims returns the claims of a session of subject that is issued now
+func newClaims(subject string) (*Claims, error) {
+	jti, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   subject,
+			Issuer:    config.GetJWTIssuer(),
+			Audience:  jwt.ClaimStrings{config.GetJWTAudience()},
+			ExpiresAt: jwt.NewNumericDate(now.Add(config.GetAccessTokenTTL())),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        jti,
+		},
+	}, nil
+}
+
+// signJWT signs claims with the signing key and its kid, or with the
+// secret if there is none
+func signJWT(claims jwt.Claims) (string, error) {
+	var ss string
+	var err error
+	if signer != nil {
+		ss, err = signer.Sign(claims)
+	} else {
+		ss, err = jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(secret)
+	}
 	if err != nil {
 		logger.Warn("issue signing jwt", "err", err)
-		return "", err
 	}
-	return ss, nil
+	return ss, err
+}
+
+// newPurposeClaims returns the claims of a signed single-purpose token,
+//   which stands for a step of a flow until the next one, such as the 2FA
+//   challenge of a login or the state of a WebAuthn ceremony or of a
+//   federated login
+//   audience names the purpose so it never passes for a session or another
+//   purpose, and the issuer keeps it from passing for a legacy session
+//   subject may be empty, jti is set for the token to be used up by
+func newPurposeClaims(audience, subject string, ttl time.Duration) (jwt.RegisteredClaims, error) {
+	jti, err := randomToken()
+	if err != nil {
+		return jwt.RegisteredClaims{}, err
+	}
+	now := time.Now()
+	return jwt.RegisteredClaims{
+		Subject:   subject,
+		Issuer:    config.GetJWTIssuer(),
+		Audience:  jwt.ClaimStrings{audience},
+		ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		IssuedAt:  jwt.NewNumericDate(now),
+		ID:        jti,
+	}, nil
+}
+
+// purposeClaims are the claims of a single-purpose token, which embed the
+// jwt.RegisteredClaims of newPurposeClaims
+type purposeClaims interface {
+	jwt.Claims
+	VerifyAudience(cmp string, req bool) bool
+	VerifyIssuer(cmp string, req bool) bool
+}
+
+// parsePurposeToken verifies token is a single-purpose token for audience
+// and parses it into claims
+func parsePurposeToken(token, audience string, claims purposeClaims) error {
+	if _, err := jwt.ParseWithClaims(token, claims, jwtKey); err != nil {
+		return err
+	}
+	if !claims.VerifyAudience(audience, true) || !claims.VerifyIssuer(config.GetJWTIssuer(), true) {
+		return fmt.Errorf("not a %v token", audience)
+	}
+	return nil
+}
+
+// jwtKey picks the key to verify token with, by its kid if there are signing
+// keys and else the secret, which is never accepted along with keys
+func jwtKey(token *jwt.Token) (interface{}, error) {
+	if signer != nil {
+		return signer.Keyfunc(token)
+	}
+
+	// Validate alg is HMAC
+	method, ok := token.Method.(*jwt.SigningMethodHMAC)
+	if !ok || method != jwt.SigningMethodHS256 {
+		logger.Warn("bad jwt alg", "alg", token.Header["alg"])
+		return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+	}
+	return secret, nil
 }
 
 // AuthenticateJWT ensures that input jwt string matches
-//   signature of secret and is valid within the given time
-//   returns aud field (username)
-func AuthenticateJWT(authString string) (string, error) {
+//   signature of a known key or secret and is valid within the given time
+//   for env.JWT_ISSUER and env.JWT_AUDIENCE
+//   returns its claims, sub is the user id and jti is always set
+//   tokens of oauth clients are rejected, see authenticateClientJWT
+func AuthenticateJWT(authString string) (*Claims, error) {
+	claims, err := parseJWT(authString, config.GetJWTAudience(), true)
+	if err != nil {
+		return nil, err
+	}
+	if len(claims.ClientID) > 0 {
+		return nil, fmt.Errorf("oauth client token")
+	}
+	return claims, nil
+}
+
+// authenticateClientJWT ensures that input jwt string is a token issued to
+//   an oauth client, like AuthenticateJWT but for clientAudience
+func authenticateClientJWT(authString string) (*Claims, error) {
+	claims, err := parseJWT(authString, clientAudience(), false)
+	if err != nil {
+		return nil, err
+	}
+	if len(claims.ClientID) == 0 {
+		return nil, fmt.Errorf("no client_id field")
+	}
+	return claims, nil
+}
+
+// parseJWT verifies the Bearer jwt of authString for env.JWT_ISSUER and
+//   audience, and returns its claims with sub and jti set
+//   legacy sessions are accepted if legacy and env.JWT_LEGACY_CLAIMS
+func parseJWT(authString, audience string, legacy bool) (*Claims, error) {
 	// Break up auth string by "Bearer" and "jwt"
 	parts := strings.Split(authString, " ")
 	if len(parts) != 2 {
-		return "", fmt.Errorf("failed to split in 2")
+		return nil, fmt.Errorf("failed to split in 2")
 	}
 	jwtString := parts[1]
 
 	// Try to parse jwtString
-	token, err := jwt.Parse(jwtString, func(token *jwt.Token) (interface{}, error) {
-		// Validate alg is HMAC
-		method, ok := token.Method.(*jwt.SigningMethodHMAC)
-		if !ok || method != jwt.SigningMethodHS256 {
-			logger.Warn("bad jwt alg", "alg", token.Header["alg"])
-			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(jwtString, claims, jwtKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sessions from before sub carry the user id in aud and nothing else
+	if len(claims.Subject) == 0 && len(claims.Issuer) == 0 && len(claims.Audience) == 1 {
+		if !legacy || !config.GetJWTLegacyClaims() {
+			return nil, fmt.Errorf("legacy claims")
+		}
+		claims.Subject = claims.Audience[0]
+	} else {
+		if !claims.VerifyIssuer(config.GetJWTIssuer(), true) {
+			return nil, fmt.Errorf("bad iss field")
 		}
-		return secret, nil
-	})
+		if !claims.VerifyAudience(audience, true) {
+			return nil, fmt.Errorf("bad aud field")
+		}
+	}
+
+	// Retrieve sub and jti fields, sessions without a jti can't be revoked
+	if len(claims.Subject) == 0 {
+		return nil, fmt.Errorf("no sub field")
+	}
+	if len(claims.ID) == 0 {
+		return nil, fmt.Errorf("no jti field")
+	}
+	return claims, nil
+}
+
+// parsedJWT is the outcome of AuthenticateJWT for the Authorization header
+// auth of a request
+type parsedJWT struct {
+	auth   string
+	claims *Claims
+	err    error
+}
+
+// requestClaims runs AuthenticateJWT on auth once per request, so the rate
+// limits keyed by user and the auth middleware after them share the work
+func requestClaims(c echo.Context, auth string) (*Claims, error) {
+	if parsed, ok := c.Get("jwt").(*parsedJWT); ok && parsed.auth == auth {
+		return parsed.claims, parsed.err
+	}
+	claims, err := AuthenticateJWT(auth)
+	c.Set("jwt", &parsedJWT{auth: auth, claims: claims, err: err})
+	return claims, err
+}
+
+// userFromJWT authenticates the Authorization:Bearer token auth
+//   and fetches the corresponding user
+//   error is 401 if the token is invalid or revoked, its session was ended
+//   or its user is gone
+func userFromJWT(c echo.Context, auth string) (*schema.UserSecure, *Claims, error) {
+	// Get user id from token
+	claims, err := requestClaims(c, auth)
 	if err != nil {
-		return "", err
+		logger.Warn("jwt auth failed", "reason", err.Error())
+		return nil, nil, echo.ErrUnauthorized
 	}
+	return userFromClaims(c, claims)
+}
 
-	// Type assert as a map
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		return "", fmt.Errorf("failed to assert as map claims")
+// userFromClaims fetches the user of the verified claims of a jwt
+//   error is 401 if it was revoked, its session was ended or its user is
+//   gone
+func userFromClaims(c echo.Context, claims *Claims) (*schema.UserSecure, *Claims, error) {
+	// Get user from db
+	db := getStore(c)
+	ctx := c.Request().Context()
+
+	// Reject sessions ended by logout or a stolen refresh token
+	revoked, err := db.IsAccessTokenRevoked(ctx, claims.ID)
+	if err != nil {
+		return nil, nil, errors.MongoErrorResponse(err)
+	}
+	if revoked {
+		logger.Warn("jwt auth failed", "reason", "revoked", "jti", claims.ID)
+		return nil, nil, echo.ErrUnauthorized
 	}
 
-	// Retrieve aud field
-	user, ok := claims["aud"].(string)
-	if !ok {
-		return "", fmt.Errorf("no aud field")
+	// Sessions issued before logins were recorded have none to check
+	if len(claims.SessionID) > 0 {
+		if err := checkSession(c, claims); err != nil {
+			return nil, nil, err
+		}
 	}
-	return user, nil
+
+	// Try to fetch user by id, deleted users are not found
+	user, err := db.GetUserByID(ctx, claims.Subject)
+	if err == store.ErrNotFound {
+		return nil, nil, echo.ErrUnauthorized
+	}
+	if err != nil {
+		return nil, nil, errors.MongoErrorResponse(err)
+	}
+	if user == nil {
+		return nil, nil, echo.ErrUnauthorized
+	}
+	return user, claims, nil
 }
 
 // DoJWTAuth is a middleware function that will try to
 //   validate the Authorization:Bearer token and fetch the
 //   corresponding user
+//   personal access tokens are accepted too, the session then only has the
+//   permissions of the token, set as scope, and there are no claims
+//   without the header the session cookie is, if env.SESSION_COOKIE is
+//   set, along with the CSRF token unless the request only reads
 func DoJWTAuth(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		// Get Authorization header value
 		values := c.Request().Header[echo.HeaderAuthorization]
-		if len(values) != 1 {
-			return echo.ErrUnauthorized
+		if session, ok := sessionCookie(c); ok && len(values) == 0 {
+			user, claims, err := userFromCookie(c, session)
+			if err != nil {
+				return err
+			}
+			c.Set("user", user)
+			c.Set("claims", claims)
+			return next(c)
 		}
-		auth := values[0]
-
-		// Get user id from token
-		id, err := AuthenticateJWT(auth)
-		if err != nil {
-			logger.Warn("jwt auth failed", "reason", err.Error())
+		if len(values) != 1 {
 			return echo.ErrUnauthorized
 		}
 
-		// Get user from db
-		db, err := store.NewMongoStore()
-		if err != nil {
-			return errors.MongoErrorResponse(err)
+		if parts := strings.SplitN(values[0], " ", 2); len(parts) == 2 && strings.HasPrefix(parts[1], personalTokenPrefix) {
+			user, t, err := userFromPersonalToken(c, parts[1])
+			if err != nil {
+				return err
+			}
+			// allows checks the scope along with the role of the user, so a
+			// user who lost a permission since doesn't keep it through the token
+			scope, _ := schema.PermissionsByNames(t.Permissions)
+			c.Set("user", user)
+			c.Set("personalToken", t)
+			c.Set("scope", scope)
+			return next(c)
 		}
-		defer db.Cleanup()
 
-		// Try to fetch user by creds
-		user, err := db.GetUserByID(id)
+		user, claims, err := userFromJWT(c, values[0])
 		if err != nil {
-			return errors.MongoErrorResponse(err)
-		}
-		if user == nil {
-			return echo.ErrUnauthorized
+			return err
 		}
 
 		c.Set("user", user)
+		c.Set("claims", claims)
 		return next(c)
 	}
 }
 
-func GetLogin(c echo.Context) error {
+// sessionTarget returns the user of the session and the user :userID
+// names, which has to be the same unless others is allowed to the session
+// personal tokens never manage the account of their own user
+func sessionTarget(c echo.Context, others bool) (*schema.UserSecure, *schema.UserSecure, error) {
+	user, ok := c.Get("user").(*schema.UserSecure)
+	if !ok {
+		return nil, nil, echo.ErrUnauthorized
+	}
+	userID := c.Param("userID")
+	if user.ID.Hex() == userID || user.Username == userID {
+		if viaPersonalToken(c) {
+			return nil, nil, echo.ErrForbidden
+		}
+		return user, user, nil
+	}
+	if !others || !allows(c, user, schema.PermissionModifyAllUsers) {
+		return nil, nil, echo.ErrForbidden
+	}
+	target, err := findUser(c.Request().Context(), getStore(c), userID)
+	if err != nil {
+		return nil, nil, errors.MongoErrorResponse(err)
+	}
+	return user, target, nil
+}
+
+// basicAuthUser fetches the user of the BasicAuth credentials of c
+//   error is 401 if there are none or they are wrong, 429 while the user
+//   or the IP of c is locked out
+func basicAuthUser(c echo.Context) (*schema.UserSecure, error) {
 	// Get basic auth creds
 	u, p, ok := c.Request().BasicAuth()
 	if !ok {
-		return echo.ErrUnauthorized
+		return nil, echo.ErrUnauthorized
+	}
+
+	// Don't even check the password while the account or the IP is locked out
+	if err := checkLockout(c, u); err != nil {
+		return nil, err
 	}
 
 	// Authenticate
-	db, err := store.NewMongoStore()
+	db := getStore(c)
+	ctx := c.Request().Context()
+
+	// Try to fetch user by creds
+	user, err := db.GetUserByCreds(ctx, u, p)
+	if err == store.ErrNotFound {
+		loginFailed(c, u)
+		return nil, echo.ErrUnauthorized
+	}
 	if err != nil {
-		return errors.MongoErrorResponse(err)
+		return nil, errors.MongoErrorResponse(err)
+	}
+	// Users with 2FA haven't logged in until their second factor passes
+	enabled, err := hasTwoFactor(c, user)
+	if err != nil {
+		return nil, err
+	}
+	if !enabled {
+		loginSucceeded(c, u)
 	}
-	defer db.Cleanup()
+	if err := requireVerifiedEmail(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
 
-	// Try to fetch user by creds
-	user, err := db.GetUserByCreds(u, p)
+// GetLogin presents the session of the BasicAuth user
+//   users with 2FA get a challenge for POST /login/2fa instead
+func GetLogin(c echo.Context) error {
+	user, err := basicAuthUser(c)
 	if err != nil {
-		if err.Error() == "not found" {
-			return echo.ErrUnauthorized
-		}
+		return err
+	}
+
+	enabled, err := hasTwoFactor(c, user)
+	if err != nil {
+		return err
+	}
+	if enabled {
+		challenge, err := newChallenge(user)
 		if err != nil {
-			return errors.MongoErrorResponse(err)
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 		}
+		return c.JSON(http.StatusOK, map[string]string{"challenge": challenge})
 	}
 
-	// Create JWT token
-	token, err := NewJWTSession(user.ID.Hex())
+	// Create JWT token and start a refresh token family
+	tokens, err := issueTokens(c, user, nil)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		return err
+	}
+	audit(c, schema.AuditLogin, user, user, nil)
+	return c.JSON(http.StatusOK, tokens)
+}
+
+// GetJWKS publishes the public keys sessions are verified with
+//   empty while sessions are signed with the secret
+func GetJWKS(c echo.Context) error {
+	if signer == nil {
+		return c.JSON(http.StatusOK, &keys.JWKS{Keys: []keys.JWK{}})
 	}
-	return c.JSON(http.StatusOK, map[string]string{"session": token})
+	return c.JSON(http.StatusOK, signer.JWKS())
 }
 
-func initAuth(api *echo.Group) {
-	initSecret()
+func initAuth(api *echo.Group, db store.UserStore) {
+	initSecret(db)
+	initKeys()
 	api.GET("/login", GetLogin)
+	api.POST("/token/refresh", PostRefresh)
+	api.POST("/logout", PostLogout, DoJWTAuth)
 }
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+
+	"github.com/briansan/user-go/config"
+	"github.com/briansan/user-go/schema"
+)
+
+const (
+	// cookieSession holds the session jwt, cookieRefresh the refresh token
+	// and cookieCSRF the token requests authenticated by them echo in
+	// headerCSRF
+	cookieSession = "bt_session"
+	cookieRefresh = "bt_refresh"
+	cookieCSRF    = "bt_csrf"
+	headerCSRF    = "X-CSRF-Token"
+
+	// refreshPath is the only route the refresh token cookie is sent to
+	refreshPath = apiPrefix + "/token/refresh"
+)
+
+// csrfToken returns the CSRF token of session sid, the same for every jwt
+// of the login so it survives refreshes
+func csrfToken(sid string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("csrf:" + sid))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// sameSite returns the SameSite of env.SESSION_COOKIE_SAMESITE
+func sameSite() http.SameSite {
+	switch config.GetSessionCookieSameSite() {
+	case "lax":
+		return http.SameSiteLaxMode
+	case "none":
+		return http.SameSiteNoneMode
+	}
+	return http.SameSiteStrictMode
+}
+
+// setCookie sets cookie name to value on path until expiresAt, a zero
+// expiresAt clears it
+//   only the CSRF cookie can be read by scripts
+func setCookie(c echo.Context, name, value, path string, expiresAt time.Time) {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Domain:   config.GetSessionCookieDomain(),
+		Expires:  expiresAt,
+		Secure:   true,
+		HttpOnly: name != cookieCSRF,
+		SameSite: sameSite(),
+	}
+	if expiresAt.IsZero() {
+		cookie.Expires = time.Unix(0, 0)
+		cookie.MaxAge = -1
+	}
+	c.SetCookie(cookie)
+}
+
+// setSessionCookies sets the session jwt, which expires with claims, the
+// refresh token and the CSRF token of login session sid, which expire
+// at expiresAt, and returns the CSRF token
+func setSessionCookies(c echo.Context, session, refresh string, claims *Claims, sid string, expiresAt time.Time) string {
+	csrf := csrfToken(sid)
+	setCookie(c, cookieSession, session, apiPrefix, claims.ExpiresAt.Time)
+	setCookie(c, cookieRefresh, refresh, refreshPath, expiresAt)
+	setCookie(c, cookieCSRF, csrf, "/", expiresAt)
+	return csrf
+}
+
+// clearSessionCookies forgets the cookies of setSessionCookies
+func clearSessionCookies(c echo.Context) {
+	setCookie(c, cookieSession, "", apiPrefix, time.Time{})
+	setCookie(c, cookieRefresh, "", refreshPath, time.Time{})
+	setCookie(c, cookieCSRF, "", "/", time.Time{})
+}
+
+// checkCSRF ensures a request authenticated by a cookie of login session
+//   sid carries its CSRF token in both headerCSRF and cookieCSRF, unless
+//   it only reads
+//   error is 403 if it doesn't
+func checkCSRF(c echo.Context, sid string) error {
+	switch c.Request().Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return nil
+	}
+	header := []byte(c.Request().Header.Get(headerCSRF))
+	cookie, err := c.Cookie(cookieCSRF)
+	if err != nil || len(sid) == 0 || len(header) == 0 ||
+		subtle.ConstantTimeCompare(header, []byte(cookie.Value)) != 1 ||
+		subtle.ConstantTimeCompare(header, []byte(csrfToken(sid))) != 1 {
+		logger.Warn("csrf check failed", "sid", sid, "method", c.Request().Method, "path", c.Path())
+		return echo.NewHTTPError(http.StatusForbidden, "csrf token is missing or invalid")
+	}
+	return nil
+}
+
+// sessionCookie returns the session jwt cookie of c if env.SESSION_COOKIE
+// is set and c has one
+func sessionCookie(c echo.Context) (string, bool) {
+	if !config.GetSessionCookie() {
+		return "", false
+	}
+	cookie, err := c.Cookie(cookieSession)
+	if err != nil || len(cookie.Value) == 0 {
+		return "", false
+	}
+	return cookie.Value, true
+}
+
+// userFromCookie authenticates the session jwt cookie session of c like
+//   userFromJWT, and the CSRF token of c unless it only reads
+//   error is 401 if the jwt is bad, 403 if the CSRF token is
+func userFromCookie(c echo.Context, session string) (*schema.UserSecure, *Claims, error) {
+	user, claims, err := userFromJWT(c, "Bearer "+session)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkCSRF(c, claims.SessionID); err != nil {
+		return nil, nil, err
+	}
+	return user, claims, nil
+}
@@ -0,0 +1,161 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+
+	"github.com/briansan/user-go/config"
+	"github.com/briansan/user-go/errors"
+	"github.com/briansan/user-go/mail"
+	"github.com/briansan/user-go/schema"
+	"github.com/briansan/user-go/store"
+)
+
+const (
+	headerRetryAfter = "Retry-After"
+)
+
+// requireVerifiedEmail refuses to log user in while its email isn't
+// verified if env.REQUIRE_VERIFIED_EMAIL is set
+func requireVerifiedEmail(user *schema.UserSecure) error {
+	if config.GetRequireVerifiedEmail() && !user.EmailVerified {
+		return echo.NewHTTPError(http.StatusForbidden, "email is not verified")
+	}
+	return nil
+}
+
+// sendVerification mails a link confirming email to user, a verify link
+// for its current email or a change link for a new one
+//   only the last link sent for purpose works
+func sendVerification(c echo.Context, user *schema.UserSecure, purpose, email string) error {
+	if err := getStore(c).DeleteEmailTokens(c.Request().Context(), user.ID.Hex(), purpose); err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	ttl := config.GetEmailVerifyTTL()
+	token, err := newEmailToken(c, user, purpose, email, ttl)
+	if err != nil {
+		return err
+	}
+
+	what := "Confirm this is the email of %s by opening"
+	if purpose == schema.EmailTokenChange {
+		what = "%s asked to use this address from now on. To confirm, open"
+	}
+	sendMail(&mail.Message{
+		To:      email,
+		Subject: "Verify your email",
+		Body: fmt.Sprintf(what+"\n\n%s\n\nThe link works once within %v. If it wasn't you, ignore this mail.\n",
+			user.Username, tokenLink(config.GetEmailVerifyURL(), token), ttl),
+	})
+	return nil
+}
+
+// PostEmailVerify confirms the email a verification link was sent to
+//   from {"token": ...}, a pending email change replaces the email of the
+//   user then
+//   error is 400 if the token is bad, expired or used or the email of the
+//   user changed since it was sent, 409 if the new email got taken
+func PostEmailVerify(c echo.Context) error {
+	body := struct {
+		Token string `json:"token"`
+	}{}
+	if err := c.Bind(&body); err != nil || len(body.Token) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, errors.NewValidationError("token", "string").Error())
+	}
+	badToken := echo.NewHTTPError(http.StatusBadRequest, "verification token is invalid or expired")
+
+	db := getStore(c)
+	ctx := c.Request().Context()
+
+	// The token is either for the current email or a new one
+	hash, now := hashToken(body.Token), time.Now()
+	t, err := db.UseEmailToken(ctx, schema.EmailTokenVerify, hash, now)
+	if err == store.ErrNotFound {
+		t, err = db.UseEmailToken(ctx, schema.EmailTokenChange, hash, now)
+	}
+	if err == store.ErrNotFound {
+		return badToken
+	}
+	if err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	user, err := db.GetUserByID(ctx, t.UserID)
+	if err == store.ErrNotFound {
+		return badToken
+	}
+	if err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+
+	verified := true
+	patch := &schema.User{EmailVerified: &verified}
+	if t.Purpose == schema.EmailTokenChange {
+		patch.Email = &t.Email
+	} else if user.Email != t.Email {
+		return badToken
+	}
+
+	diff := schema.DiffUser(user, patch)
+	u, err := db.UpdateUser(ctx, t.UserID, patch, store.AnyVersion)
+	if err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	if err := db.DeleteEmailTokens(ctx, t.UserID, t.Purpose); err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	audit(c, schema.AuditUserUpdate, nil, u, diff)
+
+	// Links to the old email are moot, and its owner should know it's gone
+	if t.Purpose == schema.EmailTokenChange && user.Email != u.Email {
+		if err := db.DeleteEmailTokens(ctx, t.UserID, schema.EmailTokenVerify); err != nil {
+			return errors.MongoErrorResponse(err)
+		}
+		sendMail(&mail.Message{
+			To:      user.Email,
+			Subject: "Your email was changed",
+			Body: fmt.Sprintf("The email of %s is %s from now on. If it wasn't you, reset your password and contact us.\n",
+				u.Username, u.Email),
+		})
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// PostEmailVerification mails another verification link to the email of
+//   a user, at most one every env.EMAIL_VERIFY_RESEND_INTERVAL
+//   available to the user and roles with ModifyAllUsers permission
+//   error is 409 if the email is verified, 429 if a link was sent too
+//   recently
+func PostEmailVerification(c echo.Context) error {
+	_, target, err := sessionTarget(c, true)
+	if err != nil {
+		return err
+	}
+	if target.EmailVerified {
+		return echo.NewHTTPError(http.StatusConflict, "email is verified already")
+	}
+
+	last, err := getStore(c).LastEmailToken(c.Request().Context(), target.ID.Hex(), schema.EmailTokenVerify)
+	if err != nil && err != store.ErrNotFound {
+		return errors.MongoErrorResponse(err)
+	}
+	if last != nil {
+		if wait := config.GetEmailVerifyResendInterval() - time.Since(last.CreatedAt); wait > 0 {
+			c.Response().Header().Set(headerRetryAfter, strconv.Itoa(int(wait.Seconds())+1))
+			return echo.ErrTooManyRequests
+		}
+	}
+
+	if err := sendVerification(c, target, schema.EmailTokenVerify, target.Email); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusAccepted)
+}
+
+func initEmail(api *echo.Group) {
+	api.POST("/email/verify", PostEmailVerify)
+	api.POST("/users/:userID/email/verification", PostEmailVerification, DoJWTAuth)
+}
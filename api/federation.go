@@ -0,0 +1,342 @@
+package api
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/labstack/echo"
+
+	"github.com/briansan/user-go/errors"
+	"github.com/briansan/user-go/oidc"
+	"github.com/briansan/user-go/schema"
+	"github.com/briansan/user-go/store"
+)
+
+const (
+	federationStateCookie   = "bt_oidc_state"
+	federationStateAudience = "bt-oidc-state"
+	federationStateTTL      = 10 * time.Minute
+)
+
+var (
+	// providers are the upstream identity providers of env.OIDC_PROVIDERS
+	providers = map[string]*oidc.Provider{}
+	// providerRoles are the roles users provisioned by each provider get
+	providerRoles = map[string]int{}
+)
+
+// federationState is what the login keeps in a signed cookie for the
+// callback to check the response of the provider against
+type federationState struct {
+	jwt.RegisteredClaims
+	Provider string `json:"provider"`
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	// Link is the user id to link the identity to, set if the login was
+	// started by POST /auth/:provider/link
+	Link string `json:"link,omitempty"`
+}
+
+// provider returns the provider named by the :provider param
+//   error is 404 if there is none
+func provider(c echo.Context) (*oidc.Provider, error) {
+	p, ok := providers[c.Param("provider")]
+	if !ok {
+		return nil, echo.ErrNotFound
+	}
+	return p, nil
+}
+
+// GetFederatedLogin sends the user agent to log in at the provider
+func GetFederatedLogin(c echo.Context) error {
+	p, err := provider(c)
+	if err != nil {
+		return err
+	}
+	u, err := startFederatedLogin(c, p, "")
+	if err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusFound, u)
+}
+
+// PostFederatedLink starts a login at the provider that links the identity
+//   to the user of the session, browsers send no Authorization header along
+//   with a redirect so the link is kept in the state cookie this sets
+//   returns the {"url": ...} of the provider to send the user agent to
+//   personal access tokens can't link identities
+func PostFederatedLink(c echo.Context) error {
+	p, err := provider(c)
+	if err != nil {
+		return err
+	}
+	user, ok := c.Get("user").(*schema.UserSecure)
+	if !ok {
+		return echo.ErrUnauthorized
+	}
+	if viaPersonalToken(c) {
+		return echo.ErrForbidden
+	}
+	u, err := startFederatedLogin(c, p, user.ID.Hex())
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]string{"url": u})
+}
+
+// startFederatedLogin sets the state cookie of a login at p, which links
+// the identity to the user id link unless it is empty, and returns the url
+// of p to log in at
+//   error is 502 if p can't be reached
+func startFederatedLogin(c echo.Context, p *oidc.Provider, link string) (string, error) {
+	state, err := randomToken()
+	if err != nil {
+		return "", echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		return "", echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	verifier, err := randomToken()
+	if err != nil {
+		return "", echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	claims, err := newPurposeClaims(federationStateAudience, "", federationStateTTL)
+	if err != nil {
+		return "", echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	cookie, err := signJWT(&federationState{
+		RegisteredClaims: claims,
+		Provider:         p.Name,
+		State:            state,
+		Nonce:            nonce,
+		Verifier:         verifier,
+		Link:             link,
+	})
+	if err != nil {
+		return "", echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	u, err := p.AuthCodeURL(c.Request().Context(), state, nonce, pkceS256(verifier))
+	if err != nil {
+		logger.Warn("oidc discovery failed", "provider", p.Name, "err", err)
+		return "", echo.NewHTTPError(http.StatusBadGateway, "identity provider unavailable")
+	}
+	c.SetCookie(stateCookie(p, cookie, int(federationStateTTL/time.Second)))
+	return u, nil
+}
+
+// stateCookie returns the state cookie of p with value, a negative maxAge
+// deletes it
+func stateCookie(p *oidc.Provider, value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     federationStateCookie,
+		Value:    value,
+		Path:     "/api/v1/auth/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(p.Config.RedirectURL, "https://"),
+		// Lax still sends it along with the redirect back from the provider
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// federatedState checks the state cookie of the callback of p
+//   error is 400 if it is missing, expired or for another login
+func federatedState(c echo.Context, p *oidc.Provider) (*federationState, error) {
+	cookie, err := c.Cookie(federationStateCookie)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "missing login state")
+	}
+	c.SetCookie(stateCookie(p, "", -1))
+
+	state := &federationState{}
+	if err := parsePurposeToken(cookie.Value, federationStateAudience, state); err != nil || state.Provider != p.Name ||
+		subtle.ConstantTimeCompare([]byte(state.State), []byte(c.QueryParam("state"))) != 1 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "bad login state")
+	}
+	return state, nil
+}
+
+// GetFederatedCallback is where the provider sends the user agent back to
+//   logs in the user linked to the identity, links it to the user who
+//   started the login, or provisions a user for it if the provider may
+//   a login of a user with 2FA returns a challenge for POST /login/2fa
+//   like GET /login, the MFA of the provider doesn't count
+//   error is 401 if the provider didn't authenticate the user, 403 if the
+//   identity has no user and none is provisioned, 409 if it belongs to
+//   another user or the email of a new user is taken, 429 while the user
+//   or the IP is locked out
+func GetFederatedCallback(c echo.Context) error {
+	p, err := provider(c)
+	if err != nil {
+		return err
+	}
+	state, err := federatedState(c, p)
+	if err != nil {
+		return err
+	}
+	if e := c.QueryParam("error"); len(e) > 0 {
+		logger.Warn("oidc login failed", "provider", p.Name, "error", e, "description", c.QueryParam("error_description"))
+		return echo.ErrUnauthorized
+	}
+
+	db := getStore(c)
+	ctx := c.Request().Context()
+
+	token, err := p.Exchange(ctx, c.QueryParam("code"), state.Verifier, state.Nonce)
+	if err != nil {
+		logger.Warn("oidc login failed", "provider", p.Name, "err", err)
+		return echo.ErrUnauthorized
+	}
+
+	identity, err := db.GetIdentity(ctx, p.Name, token.Subject)
+	if err != nil && err != store.ErrNotFound {
+		return errors.MongoErrorResponse(err)
+	}
+
+	var user *schema.UserSecure
+	switch {
+	case identity != nil:
+		if len(state.Link) > 0 && identity.UserID != state.Link {
+			return errors.MongoErrorResponse(errors.NewConflictError("identity", "subject", p.Name+"/"+token.Subject))
+		}
+		// Deleted users stay locked out until they are restored
+		user, err = db.GetUserByID(ctx, identity.UserID)
+		if err == store.ErrNotFound {
+			return echo.ErrForbidden
+		}
+	case len(state.Link) > 0:
+		if user, err = db.GetUserByID(ctx, state.Link); err == store.ErrNotFound {
+			return echo.ErrUnauthorized
+		}
+	case p.Config.Provision:
+		if user, err = provisionUser(c, p, token); err != nil {
+			return err
+		}
+	default:
+		return echo.NewHTTPError(http.StatusForbidden, "no user is linked to this identity")
+	}
+	if err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+
+	// A link comes from a session that passed all of this already
+	if len(state.Link) == 0 {
+		if err := checkLockout(c, user.Username); err != nil {
+			return err
+		}
+	}
+
+	if identity == nil {
+		identity = &schema.Identity{Provider: p.Name, Subject: token.Subject, UserID: user.ID.Hex(), Email: token.Email}
+		if err := db.LinkIdentity(ctx, identity); err != nil {
+			return errors.MongoErrorResponse(err)
+		}
+		audit(c, schema.AuditIdentityLink, user, user, map[string]schema.AuditChange{
+			"provider": {New: p.Name},
+			"subject":  {New: token.Subject},
+		})
+	}
+
+	if len(state.Link) == 0 {
+		enabled, err := hasTwoFactor(c, user)
+		if err != nil {
+			return err
+		}
+		if enabled {
+			challenge, err := newChallenge(user)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+			}
+			return c.JSON(http.StatusOK, map[string]string{"challenge": challenge})
+		}
+	}
+
+	tokens, err := issueTokens(c, user, nil)
+	if err != nil {
+		return err
+	}
+	audit(c, schema.AuditLogin, user, user, map[string]schema.AuditChange{"provider": {New: p.Name}})
+	return c.JSON(http.StatusOK, tokens)
+}
+
+// provisionUser creates the user of an identity that isn't linked yet
+//   the username is the preferred username or the local part of the
+//   email, suffixed if it is taken, and the password is random so that
+//   only the provider logs the user in
+//   error is 403 if the identity has no email, 409 if it is taken
+func provisionUser(c echo.Context, p *oidc.Provider, token *oidc.IDToken) (*schema.UserSecure, error) {
+	if len(token.Email) == 0 {
+		return nil, echo.NewHTTPError(http.StatusForbidden, "the identity provider gave no email")
+	}
+
+	db := getStore(c)
+	ctx := c.Request().Context()
+
+	// Never attach to the account of an existing email, it has to be linked
+	if _, err := db.GetUserByEmail(ctx, token.Email); err != store.ErrNotFound {
+		if err == nil {
+			err = errors.NewConflictError("user", "email", token.Email)
+		}
+		return nil, errors.MongoErrorResponse(err)
+	}
+
+	username := token.PreferredUsername
+	if len(username) == 0 {
+		username = strings.SplitN(token.Email, "@", 2)[0]
+	}
+	if _, err := db.GetUserByUsername(ctx, username); err != store.ErrNotFound {
+		if err != nil {
+			return nil, errors.MongoErrorResponse(err)
+		}
+		suffix, err := randomToken()
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		username += "-" + strings.ToLower(suffix[:6])
+	}
+	password, err := randomToken()
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	role := providerRoles[p.Name]
+	u := &schema.User{Username: &username, Email: &token.Email, Password: &password, Role: &role, EmailVerified: &token.EmailVerified}
+	diff := schema.DiffUser(nil, u)
+	if err := db.CreateUser(ctx, u); err != nil {
+		return nil, errors.MongoErrorResponse(err)
+	}
+	user := u.Secure()
+	audit(c, schema.AuditUserCreate, nil, user, diff)
+	if !user.EmailVerified {
+		if err := sendVerification(c, user, schema.EmailTokenVerify, user.Email); err != nil {
+			logger.Warn("verification failed", "user", user.ID.Hex(), "err", err)
+		}
+	}
+	return user, nil
+}
+
+func initFederation(api *echo.Group) {
+	providers = oidc.FromConfig()
+	providerRoles = map[string]int{}
+	for name, p := range providers {
+		role := schema.RoleUser
+		if len(p.Config.Role) > 0 {
+			var ok bool
+			if role, ok = schema.RoleByName(p.Config.Role); !ok {
+				panic("unknown role " + p.Config.Role + " of oidc provider " + name)
+			}
+		}
+		providerRoles[name] = role
+	}
+
+	api.GET("/auth/:provider/login", GetFederatedLogin)
+	api.POST("/auth/:provider/link", PostFederatedLink, DoJWTAuth)
+	api.GET("/auth/:provider/callback", GetFederatedCallback)
+}
@@ -0,0 +1,155 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+
+	"github.com/briansan/user-go/config"
+	"github.com/briansan/user-go/errors"
+	"github.com/briansan/user-go/schema"
+	"github.com/briansan/user-go/store"
+)
+
+const (
+	// failed logins are counted per username and per source IP
+	lockoutUser = "user:"
+	lockoutIP   = "ip:"
+)
+
+// lockoutKeys returns the keys failed logins of username from the IP of c
+// are counted under with their thresholds, keys without one are left out
+func lockoutKeys(c echo.Context, username string) map[string]int {
+	user, ip := config.GetLoginLockoutThresholds()
+	keys := map[string]int{}
+	if user > 0 {
+		keys[lockoutUser+username] = user
+	}
+	if ip > 0 {
+		keys[lockoutIP+clientIP(c)] = ip
+	}
+	return keys
+}
+
+// checkLockout refuses to check a password for username while it or the
+// IP of c is locked out
+//   error is 429 with Retry-After, the same whether the user exists or not
+func checkLockout(c echo.Context, username string) error {
+	db := getStore(c)
+	ctx := c.Request().Context()
+	base, max := config.GetLoginLockout()
+
+	now := time.Now()
+	until := now
+	for key, threshold := range lockoutKeys(c, username) {
+		f, err := db.GetLoginFailures(ctx, key, now)
+		if err == store.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return errors.MongoErrorResponse(err)
+		}
+		if t := f.LockedUntil(threshold, base, max); t.After(until) {
+			until = t
+		}
+	}
+	if !until.After(now) {
+		return nil
+	}
+	c.Response().Header().Set(headerRetryAfter, strconv.Itoa(int(math.Ceil(until.Sub(now).Seconds()))))
+	return echo.NewHTTPError(http.StatusTooManyRequests, "too many failed logins, try again later")
+}
+
+// loginFailed counts a wrong password for username from the IP of c
+// failures to count are only logged, the login fails either way
+func loginFailed(c echo.Context, username string) {
+	db := getStore(c)
+	ctx := c.Request().Context()
+	now, window := time.Now(), config.GetLoginFailureWindow()
+	for key := range lockoutKeys(c, username) {
+		if _, err := db.AddLoginFailure(ctx, key, now, window); err != nil {
+			logger.Warn("login failure not counted", "key", key, "err", err)
+		}
+	}
+	audit(c, schema.AuditLoginFail, nil, nil, map[string]schema.AuditChange{"username": {New: username}})
+}
+
+// loginSucceeded forgets the failed logins of username and of the IP of c,
+// else the typos of everyone behind a shared NAT add up until they are all
+// locked out, guessing stays limited by the count of each username
+func loginSucceeded(c echo.Context, username string) {
+	ctx := c.Request().Context()
+	for _, key := range []string{lockoutUser + username, lockoutIP + clientIP(c)} {
+		if err := getStore(c).ClearLoginFailures(ctx, key); err != nil {
+			logger.Warn("login failures not cleared", "key", key, "err", err)
+		}
+	}
+}
+
+// lockoutTarget returns the user :userID names if the session may unlock it
+//   available to roles with ModifyAllUsers permission
+func lockoutTarget(c echo.Context) (*schema.UserSecure, *schema.UserSecure, error) {
+	user, ok := c.Get("user").(*schema.UserSecure)
+	if !ok {
+		return nil, nil, echo.ErrUnauthorized
+	}
+	if !allows(c, user, schema.PermissionModifyAllUsers) {
+		return nil, nil, echo.ErrForbidden
+	}
+	target, err := findUser(c.Request().Context(), getStore(c), c.Param("userID"))
+	if err != nil {
+		return nil, nil, errors.MongoErrorResponse(err)
+	}
+	return user, target, nil
+}
+
+// GetLockout tells how many failed logins of a user are counted and
+//   until when it is locked out
+//   available to roles with ModifyAllUsers permission
+func GetLockout(c echo.Context) error {
+	_, target, err := lockoutTarget(c)
+	if err != nil {
+		return err
+	}
+	f, err := getStore(c).GetLoginFailures(c.Request().Context(), lockoutUser+target.Username, time.Now())
+	if err == store.ErrNotFound {
+		f, err = &schema.LoginFailures{}, nil
+	}
+	if err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+
+	threshold, _ := config.GetLoginLockoutThresholds()
+	base, max := config.GetLoginLockout()
+	var lockedUntil *time.Time
+	if t := f.LockedUntil(threshold, base, max); t.After(time.Now()) {
+		lockedUntil = &t
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"failures":    f.Count,
+		"lastFailure": f.LastFailure,
+		"lockedUntil": lockedUntil,
+	})
+}
+
+// DeleteLockout unlocks a user by forgetting its failed logins
+//   available to roles with ModifyAllUsers permission
+func DeleteLockout(c echo.Context) error {
+	user, target, err := lockoutTarget(c)
+	if err != nil {
+		return err
+	}
+	if err := getStore(c).ClearLoginFailures(c.Request().Context(), lockoutUser+target.Username); err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	audit(c, schema.AuditUserUnlock, user, target, nil)
+	return c.NoContent(http.StatusNoContent)
+}
+
+func initLockout(api *echo.Group) {
+	api.GET("/users/:userID/lockout", GetLockout, DoJWTAuth)
+	api.DELETE("/users/:userID/lockout", DeleteLockout, DoJWTAuth)
+}
@@ -0,0 +1,564 @@
+package api
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/labstack/echo"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/briansan/user-go/config"
+	"github.com/briansan/user-go/errors"
+	"github.com/briansan/user-go/schema"
+	"github.com/briansan/user-go/store"
+)
+
+const (
+	authCodeTTL = time.Minute
+
+	// error codes of RFC 6749 4.1.2.1 and 5.2
+	oauthInvalidRequest     = "invalid_request"
+	oauthInvalidClient      = "invalid_client"
+	oauthInvalidGrant       = "invalid_grant"
+	oauthInvalidScope       = "invalid_scope"
+	oauthUnauthorizedClient = "unauthorized_client"
+	oauthUnsupportedGrant   = "unsupported_grant_type"
+	oauthUnsupportedType    = "unsupported_response_type"
+	oauthInsufficientScope  = "insufficient_scope"
+)
+
+// oauthError responds with the json error body of RFC 6749 5.2
+func oauthError(c echo.Context, code int, err, description string) error {
+	return c.JSON(code, map[string]string{"error": err, "error_description": description})
+}
+
+// clientAudience is the aud of the access tokens of oauth clients, which
+// only the userinfo endpoint accepts
+func clientAudience() string {
+	return config.GetJWTAudience() + "/oauth"
+}
+
+// newClientClaims returns the claims of an access token for subject that
+// is issued now to oauth client clientID with scope
+func newClientClaims(subject, clientID, scope string) (*Claims, error) {
+	claims, err := newClaims(subject)
+	if err != nil {
+		return nil, err
+	}
+	claims.Audience = jwt.ClaimStrings{clientAudience()}
+	claims.ClientID, claims.Scope = clientID, scope
+	return claims, nil
+}
+
+// redirectError sends the user agent back to the client with an error
+// as described by RFC 6749 4.1.2.1
+func redirectError(c echo.Context, redirectURI, state, err, description string) error {
+	params := url.Values{"error": {err}, "error_description": {description}}
+	if len(state) > 0 {
+		params.Set("state", state)
+	}
+	return c.Redirect(http.StatusFound, withQuery(redirectURI, params))
+}
+
+// withQuery adds params to the query of uri
+func withQuery(uri string, params url.Values) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	q := u.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// parseScope splits a space separated scope and checks that client may
+// request every part of it
+func parseScope(client *schema.OAuthClient, scope string) ([]string, bool) {
+	scopes := strings.Fields(scope)
+	for _, s := range scopes {
+		if !client.HasScope(s) {
+			return nil, false
+		}
+	}
+	return scopes, true
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// pkceS256 returns the S256 code challenge of verifier (RFC 7636 4.2)
+func pkceS256(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// GetAuthorize is the authorization endpoint of the authorization code flow
+//   logs the user in with BasicAuth like GetLogin
+//   requires a registered redirect_uri and an S256 PKCE code_challenge
+//   redirects back with a code valid for a minute, or an error
+func GetAuthorize(c echo.Context) error {
+	db := getStore(c)
+	ctx := c.Request().Context()
+
+	// Errors about the client itself can't be sent back to it
+	client, err := db.GetClient(ctx, c.QueryParam("client_id"))
+	if err == store.ErrNotFound {
+		return oauthError(c, http.StatusBadRequest, oauthInvalidClient, "unknown client_id")
+	}
+	if err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	redirectURI := c.QueryParam("redirect_uri")
+	if len(redirectURI) == 0 && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+	if !client.HasRedirectURI(redirectURI) {
+		return oauthError(c, http.StatusBadRequest, oauthInvalidRequest, "redirect_uri is not registered")
+	}
+
+	// Validate the request
+	state := c.QueryParam("state")
+	if c.QueryParam("response_type") != "code" {
+		return redirectError(c, redirectURI, state, oauthUnsupportedType, "only code is supported")
+	}
+	if !client.HasGrantType(schema.GrantAuthorizationCode) {
+		return redirectError(c, redirectURI, state, oauthUnauthorizedClient, "client may not use the authorization code grant")
+	}
+	scopes, ok := parseScope(client, c.QueryParam("scope"))
+	if !ok {
+		return redirectError(c, redirectURI, state, oauthInvalidScope, "scope is not allowed for this client")
+	}
+	if hasScope(scopes, schema.ScopeOpenID) && signer == nil {
+		return redirectError(c, redirectURI, state, oauthInvalidScope, "openid needs a signing key")
+	}
+	challenge := c.QueryParam("code_challenge")
+	if len(challenge) == 0 || c.QueryParam("code_challenge_method") != "S256" {
+		return redirectError(c, redirectURI, state, oauthInvalidRequest, "code_challenge with method S256 is required")
+	}
+
+	// Log the user in, with the second factor in X-OTP if they have 2FA
+	user, err := basicAuthUser(c)
+	if err != nil {
+		c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="`+config.AppName+`"`)
+		return err
+	}
+	enabled, err := hasTwoFactor(c, user)
+	if err != nil {
+		return err
+	}
+	if enabled {
+		if _, err := verifySecondFactor(c, user, c.Request().Header.Get(headerOTP)); err != nil {
+			return err
+		}
+	}
+
+	// Issue the code
+	secret, err := randomToken()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	now := time.Now()
+	code := &schema.AuthCode{
+		Hash:          hashToken(secret),
+		ClientID:      client.ID,
+		UserID:        user.ID.Hex(),
+		RedirectURI:   redirectURI,
+		Scope:         strings.Join(scopes, " "),
+		Nonce:         c.QueryParam("nonce"),
+		CodeChallenge: challenge,
+		AuthTime:      now,
+		ExpiresAt:     now.Add(authCodeTTL),
+	}
+	if err := db.CreateAuthCode(ctx, code); err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	audit(c, schema.AuditAuthorize, user, user, map[string]schema.AuditChange{"clientID": {New: client.ID}})
+
+	params := url.Values{"code": {secret}}
+	if len(state) > 0 {
+		params.Set("state", state)
+	}
+	return c.Redirect(http.StatusFound, withQuery(redirectURI, params))
+}
+
+// oauthClient authenticates the client of a token request by
+// client_secret_basic, client_secret_post or, for public clients,
+// its client_id alone
+func oauthClient(c echo.Context) (*schema.OAuthClient, bool, error) {
+	id, secret, ok := c.Request().BasicAuth()
+	if !ok {
+		id, secret = c.FormValue("client_id"), c.FormValue("client_secret")
+	}
+
+	client, err := getStore(c).GetClient(c.Request().Context(), id)
+	if err == store.ErrNotFound {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, errors.MongoErrorResponse(err)
+	}
+	if client.Public() {
+		return client, len(secret) == 0, nil
+	}
+	match := subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(client.SecretHash)) == 1
+	return client, match, nil
+}
+
+// PostToken is the token endpoint
+//   grant_type=authorization_code exchanges a code from GetAuthorize and its
+//   code_verifier for an access token and, with the openid scope, an id token
+//   grant_type=client_credentials gives a confidential client an access token
+//   of its own, with the client id as sub
+func PostToken(c echo.Context) error {
+	client, ok, err := oauthClient(c)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="`+config.AppName+`"`)
+		return oauthError(c, http.StatusUnauthorized, oauthInvalidClient, "client authentication failed")
+	}
+
+	// Tokens must not be cached (RFC 6749 5.1)
+	c.Response().Header().Set("Cache-Control", "no-store")
+	c.Response().Header().Set("Pragma", "no-cache")
+
+	grant := c.FormValue("grant_type")
+	if grant != schema.GrantAuthorizationCode && grant != schema.GrantClientCredentials {
+		return oauthError(c, http.StatusBadRequest, oauthUnsupportedGrant, "grant_type is not supported")
+	}
+	if !client.HasGrantType(grant) {
+		return oauthError(c, http.StatusBadRequest, oauthUnauthorizedClient, "client may not use "+grant)
+	}
+	if grant == schema.GrantClientCredentials {
+		return clientCredentialsGrant(c, client)
+	}
+	return authorizationCodeGrant(c, client)
+}
+
+// authorizationCodeGrant redeems the code of the request for client
+func authorizationCodeGrant(c echo.Context, client *schema.OAuthClient) error {
+	db := getStore(c)
+	ctx := c.Request().Context()
+
+	// Codes work once, for the client, redirect_uri and verifier they were issued for
+	code, err := db.ConsumeAuthCode(ctx, hashToken(c.FormValue("code")))
+	if err == store.ErrNotFound {
+		return oauthError(c, http.StatusBadRequest, oauthInvalidGrant, "code is invalid or was used")
+	}
+	if err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	if code.ClientID != client.ID || code.RedirectURI != c.FormValue("redirect_uri") || !time.Now().Before(code.ExpiresAt) {
+		return oauthError(c, http.StatusBadRequest, oauthInvalidGrant, "code is invalid or expired")
+	}
+	verifier := c.FormValue("code_verifier")
+	if subtle.ConstantTimeCompare([]byte(pkceS256(verifier)), []byte(code.CodeChallenge)) != 1 {
+		return oauthError(c, http.StatusBadRequest, oauthInvalidGrant, "code_verifier does not match")
+	}
+
+	// Deleted users get no tokens
+	user, err := db.GetUserByID(ctx, code.UserID)
+	if err == store.ErrNotFound {
+		return oauthError(c, http.StatusBadRequest, oauthInvalidGrant, "user is gone")
+	}
+	if err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+
+	// The token starts a session of its own, ending it revokes the token
+	claims, err := newClientClaims(user.ID.Hex(), client.ID, code.Scope)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	claims.SessionID = primitive.NewObjectID().Hex()
+	access, err := signJWT(claims)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if err := recordSession(c, user, claims.SessionID, client.ID, claims.ExpiresAt.Time, false); err != nil {
+		return err
+	}
+	resp := tokenResponse(access, claims)
+
+	scopes := strings.Fields(code.Scope)
+	if hasScope(scopes, schema.ScopeOpenID) {
+		idToken, err := newIDToken(user, client, code, scopes)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		resp["id_token"] = idToken
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// clientCredentialsGrant issues client a token of its own
+func clientCredentialsGrant(c echo.Context, client *schema.OAuthClient) error {
+	if client.Public() {
+		return oauthError(c, http.StatusBadRequest, oauthUnauthorizedClient, "public clients may not use "+schema.GrantClientCredentials)
+	}
+	scopes, ok := parseScope(client, c.FormValue("scope"))
+	if !ok || hasScope(scopes, schema.ScopeOpenID) {
+		return oauthError(c, http.StatusBadRequest, oauthInvalidScope, "scope is not allowed for this client")
+	}
+
+	claims, err := newClientClaims(client.ID, client.ID, strings.Join(scopes, " "))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	access, err := signJWT(claims)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, tokenResponse(access, claims))
+}
+
+// tokenResponse is the successful response of the token endpoint
+func tokenResponse(access string, claims *Claims) map[string]interface{} {
+	resp := map[string]interface{}{
+		"access_token": access,
+		"token_type":   "Bearer",
+		"expires_in":   int(time.Until(claims.ExpiresAt.Time).Seconds()),
+	}
+	if len(claims.Scope) > 0 {
+		resp["scope"] = claims.Scope
+	}
+	return resp
+}
+
+// userInfo returns the OIDC claims of user that scopes allow
+func userInfo(user *schema.UserSecure, scopes []string) map[string]interface{} {
+	info := map[string]interface{}{"sub": user.ID.Hex()}
+	if hasScope(scopes, schema.ScopeProfile) {
+		info["preferred_username"] = user.Username
+		if role := schema.RoleName(user.Role); len(role) > 0 {
+			info["role"] = role
+		}
+	}
+	if hasScope(scopes, schema.ScopeEmail) {
+		info["email"] = user.Email
+	}
+	return info
+}
+
+// newIDToken returns the signed id token of user for client
+func newIDToken(user *schema.UserSecure, client *schema.OAuthClient, code *schema.AuthCode, scopes []string) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":       config.GetJWTIssuer(),
+		"aud":       client.ID,
+		"azp":       client.ID,
+		"exp":       now.Add(config.GetAccessTokenTTL()).Unix(),
+		"iat":       now.Unix(),
+		"auth_time": code.AuthTime.Unix(),
+	}
+	if len(code.Nonce) > 0 {
+		claims["nonce"] = code.Nonce
+	}
+	for k, v := range userInfo(user, scopes) {
+		claims[k] = v
+	}
+	return signJWT(claims)
+}
+
+// GetUserInfo returns the claims about the user of the access token
+//   tokens of oauth clients need the openid scope and get the claims of their scopes
+//   sessions get every claim
+func GetUserInfo(c echo.Context) error {
+	user, ok := c.Get("user").(*schema.UserSecure)
+	if !ok {
+		return echo.ErrUnauthorized
+	}
+	claims, ok := c.Get("claims").(*Claims)
+	if !ok {
+		return echo.ErrUnauthorized
+	}
+
+	scopes := []string{schema.ScopeOpenID, schema.ScopeProfile, schema.ScopeEmail}
+	if len(claims.ClientID) > 0 {
+		scopes = strings.Fields(claims.Scope)
+	}
+	if !hasScope(scopes, schema.ScopeOpenID) {
+		return oauthError(c, http.StatusForbidden, oauthInsufficientScope, "openid scope is required")
+	}
+	return c.JSON(http.StatusOK, userInfo(user, scopes))
+}
+
+// DoClientAuth is DoJWTAuth for the userinfo endpoint, which also accepts
+//   the access tokens of oauth clients while the client exists and, for
+//   tokens of users, their session wasn't ended
+func DoClientAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	jwtAuth := DoJWTAuth(next)
+	return func(c echo.Context) error {
+		values := c.Request().Header[echo.HeaderAuthorization]
+		if len(values) != 1 {
+			return jwtAuth(c)
+		}
+		claims, err := authenticateClientJWT(values[0])
+		if err != nil {
+			return jwtAuth(c)
+		}
+
+		_, err = getStore(c).GetClient(c.Request().Context(), claims.ClientID)
+		if err == store.ErrNotFound {
+			logger.Warn("jwt auth failed", "reason", "client deleted", "client", claims.ClientID)
+			return echo.ErrUnauthorized
+		}
+		if err != nil {
+			return errors.MongoErrorResponse(err)
+		}
+		user, claims, err := userFromClaims(c, claims)
+		if err != nil {
+			return err
+		}
+		c.Set("user", user)
+		c.Set("claims", claims)
+		return next(c)
+	}
+}
+
+// GetOpenIDConfiguration serves the OIDC discovery metadata
+// env.JWT_ISSUER has to be the public url of this service for it to work
+func GetOpenIDConfiguration(c echo.Context) error {
+	issuer := config.GetJWTIssuer()
+	base := strings.TrimSuffix(issuer, "/")
+	algs := []string{}
+	if signer != nil {
+		algs = append(algs, signer.Signing().Method.Alg())
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"issuer":                                issuer,
+		"authorization_endpoint":                base + "/api/v1/oauth/authorize",
+		"token_endpoint":                        base + "/api/v1/oauth/token",
+		"userinfo_endpoint":                     base + "/api/v1/oauth/userinfo",
+		"jwks_uri":                              base + "/.well-known/jwks.json",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{schema.GrantAuthorizationCode, schema.GrantClientCredentials},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": algs,
+		"scopes_supported":                      []string{schema.ScopeOpenID, schema.ScopeProfile, schema.ScopeEmail},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported":                      []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "preferred_username", "role", "email"},
+	})
+}
+
+// GetClients lists the registered oauth clients
+//   available to roles with ModifyAllUsers permission
+func GetClients(c echo.Context) error {
+	// Type assert user from context and authorize
+	user, ok := c.Get("user").(*schema.UserSecure)
+	if !ok {
+		return echo.ErrUnauthorized
+	}
+	if !allows(c, user, schema.PermissionModifyAllUsers) {
+		return echo.ErrForbidden
+	}
+
+	clients, err := getStore(c).GetClients(c.Request().Context())
+	if err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	return c.JSON(http.StatusOK, clients)
+}
+
+// PostClients registers an oauth client
+//   available to roles with ModifyAllUsers permission
+//   returns the client with its clientSecret, the only time it is shown,
+//   unless public is set
+func PostClients(c echo.Context) error {
+	// Type assert user from context and authorize
+	user, ok := c.Get("user").(*schema.UserSecure)
+	if !ok {
+		return echo.ErrUnauthorized
+	}
+	if !allows(c, user, schema.PermissionModifyAllUsers) {
+		return echo.ErrForbidden
+	}
+
+	body := struct {
+		schema.OAuthClient
+		Public bool `json:"public"`
+	}{}
+	if err := c.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	client := body.OAuthClient
+	if err := client.Validate(); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if body.Public && client.HasGrantType(schema.GrantClientCredentials) {
+		return echo.NewHTTPError(http.StatusBadRequest, errors.NewValidationError("grantTypes", "list without "+schema.GrantClientCredentials+" for public clients").Error())
+	}
+
+	// Generate the credentials
+	id, err := randomToken()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	client.ID = id
+	secret := ""
+	if !body.Public {
+		if secret, err = randomToken(); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		client.SecretHash = hashToken(secret)
+	}
+
+	if err := getStore(c).CreateClient(c.Request().Context(), &client); err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	audit(c, schema.AuditClientCreate, user, nil, map[string]schema.AuditChange{
+		"clientID": {New: client.ID}, "name": {New: client.Name},
+	})
+
+	return c.JSON(http.StatusCreated, struct {
+		*schema.OAuthClient
+		Secret string `json:"clientSecret,omitempty"`
+	}{&client, secret})
+}
+
+// DeleteClient removes an oauth client, tokens it already got stop working
+//   available to roles with ModifyAllUsers permission
+func DeleteClient(c echo.Context) error {
+	// Type assert user from context and authorize
+	user, ok := c.Get("user").(*schema.UserSecure)
+	if !ok {
+		return echo.ErrUnauthorized
+	}
+	if !allows(c, user, schema.PermissionModifyAllUsers) {
+		return echo.ErrForbidden
+	}
+
+	id := c.Param("clientID")
+	if err := getStore(c).DeleteClient(c.Request().Context(), id); err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	audit(c, schema.AuditClientDelete, user, nil, map[string]schema.AuditChange{"clientID": {Old: id}})
+	return c.NoContent(http.StatusNoContent)
+}
+
+func initOAuth(api *echo.Group) {
+	api.GET("/oauth/authorize", GetAuthorize)
+	api.POST("/oauth/token", PostToken)
+	api.GET("/oauth/userinfo", GetUserInfo, DoClientAuth)
+	api.POST("/oauth/userinfo", GetUserInfo, DoClientAuth)
+	api.GET("/oauth/clients", GetClients, DoJWTAuth)
+	api.POST("/oauth/clients", PostClients, DoJWTAuth)
+	api.DELETE("/oauth/clients/:clientID", DeleteClient, DoJWTAuth)
+}
@@ -0,0 +1,329 @@
+package api
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/labstack/echo"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/briansan/user-go/errors"
+	"github.com/briansan/user-go/schema"
+	"github.com/briansan/user-go/store"
+	"github.com/briansan/user-go/webauthn"
+)
+
+const (
+	ceremonyAudience = "bt-webauthn"
+
+	ceremonyCreate = "create"
+	ceremonyGet    = "get"
+
+	defaultPasskeyName = "passkey"
+)
+
+// ceremony is the state of a WebAuthn ceremony, handed to the client
+// signed along with the options and sent back with the credential
+type ceremony struct {
+	jwt.RegisteredClaims
+	Kind      string         `json:"kind"`
+	Challenge webauthn.Bytes `json:"challenge"`
+}
+
+// newCeremony returns the challenge of a ceremony of kind for user userID,
+// which may be empty for logins, and the token of its state
+func newCeremony(kind, userID string) ([]byte, string, error) {
+	challenge := make([]byte, randomTokenBytes)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, "", err
+	}
+	claims, err := newPurposeClaims(ceremonyAudience, userID, webauthn.Timeout)
+	if err != nil {
+		return nil, "", err
+	}
+	token, err := signJWT(&ceremony{RegisteredClaims: claims, Kind: kind, Challenge: challenge})
+	return challenge, token, err
+}
+
+// finishCeremony checks token is an unused ceremony of kind and uses it up
+//   error is 401 if it is bad, expired or used
+func finishCeremony(c echo.Context, token, kind string) (*ceremony, error) {
+	claims := &ceremony{}
+	if err := parsePurposeToken(token, ceremonyAudience, claims); err != nil || claims.Kind != kind || len(claims.ID) == 0 {
+		return nil, echo.ErrUnauthorized
+	}
+
+	db := getStore(c)
+	ctx := c.Request().Context()
+
+	// A challenge is answered once
+	revoked, err := db.IsAccessTokenRevoked(ctx, claims.ID)
+	if err != nil {
+		return nil, errors.MongoErrorResponse(err)
+	}
+	if revoked {
+		return nil, echo.ErrUnauthorized
+	}
+	if err := db.RevokeAccessToken(ctx, claims.ID, claims.ExpiresAt.Time); err != nil {
+		return nil, errors.MongoErrorResponse(err)
+	}
+	return claims, nil
+}
+
+// descriptors returns the credential descriptors of passkeys
+func descriptors(passkeys []*schema.Passkey) []webauthn.Descriptor {
+	d := []webauthn.Descriptor{}
+	for _, p := range passkeys {
+		id, err := base64.RawURLEncoding.DecodeString(p.CredentialID)
+		if err != nil {
+			continue
+		}
+		d = append(d, webauthn.NewDescriptor(id, p.Transports))
+	}
+	return d
+}
+
+// PostPasskeyOptions starts the registration of a passkey for the user of
+//   the session
+//   returns {"ceremony": ..., "publicKey": ...} where publicKey are the
+//   options of navigator.credentials.create, which excludes the passkeys
+//   the user has already
+func PostPasskeyOptions(c echo.Context) error {
+	user, _, err := sessionTarget(c, false)
+	if err != nil {
+		return err
+	}
+	passkeys, err := getStore(c).GetPasskeys(c.Request().Context(), user.ID.Hex())
+	if err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	challenge, token, err := newCeremony(ceremonyCreate, user.ID.Hex())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	name := user.Email
+	if len(name) == 0 {
+		name = user.Username
+	}
+	entity := webauthn.UserEntity{ID: user.ID[:], Name: name, DisplayName: user.Username}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"ceremony":  token,
+		"publicKey": webauthn.FromConfig().NewCreationOptions(challenge, entity, descriptors(passkeys)),
+	})
+}
+
+// PostPasskey registers a passkey for the user of the session
+//   takes {"ceremony": ..., "name": ..., "credential": ...} where
+//   credential is the json of what navigator.credentials.create returned
+//   error is 400 if the credential doesn't check out, 401 if the ceremony
+//   is bad, 409 if the passkey is registered already
+func PostPasskey(c echo.Context) error {
+	user, _, err := sessionTarget(c, false)
+	if err != nil {
+		return err
+	}
+	body := struct {
+		Ceremony   string                          `json:"ceremony"`
+		Name       string                          `json:"name"`
+		Credential webauthn.RegistrationCredential `json:"credential"`
+	}{}
+	if err := c.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, errors.NewValidationError("credential", "PublicKeyCredential").Error())
+	}
+
+	state, err := finishCeremony(c, body.Ceremony, ceremonyCreate)
+	if err != nil {
+		return err
+	}
+	if state.Subject != user.ID.Hex() {
+		return echo.ErrUnauthorized
+	}
+	credential, err := webauthn.FromConfig().VerifyRegistration(state.Challenge, &body.Credential)
+	if err != nil {
+		logger.Info("passkey registration refused", "user", user.ID.Hex(), "err", err)
+		return echo.NewHTTPError(http.StatusBadRequest, errors.NewValidationError("credential", "PublicKeyCredential").Error())
+	}
+
+	if len(body.Name) == 0 {
+		body.Name = defaultPasskeyName
+	}
+	p := &schema.Passkey{
+		UserID:       user.ID.Hex(),
+		CredentialID: base64.RawURLEncoding.EncodeToString(credential.ID),
+		PublicKey:    credential.PublicKey,
+		SignCount:    int64(credential.SignCount),
+		Transports:   credential.Transports,
+		Name:         body.Name,
+	}
+	if err := getStore(c).CreatePasskey(c.Request().Context(), p); err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	audit(c, schema.AuditPasskeyAdd, user, user, map[string]schema.AuditChange{"passkey": {New: p.Name}})
+	return c.JSON(http.StatusCreated, p)
+}
+
+// GetPasskeys lists the passkeys of a user
+//   available to the user and roles with ModifyAllUsers permission
+func GetPasskeys(c echo.Context) error {
+	_, target, err := sessionTarget(c, true)
+	if err != nil {
+		return err
+	}
+	passkeys, err := getStore(c).GetPasskeys(c.Request().Context(), target.ID.Hex())
+	if err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	return c.JSON(http.StatusOK, passkeys)
+}
+
+// DeletePasskey removes a passkey of a user
+//   available to the user and roles with ModifyAllUsers permission
+func DeletePasskey(c echo.Context) error {
+	user, target, err := sessionTarget(c, true)
+	if err != nil {
+		return err
+	}
+
+	db := getStore(c)
+	ctx := c.Request().Context()
+
+	passkeys, err := db.GetPasskeys(ctx, target.ID.Hex())
+	if err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	for _, p := range passkeys {
+		if p.ID.Hex() != c.Param("passkeyID") {
+			continue
+		}
+		if err := db.DeletePasskey(ctx, target.ID.Hex(), p.ID.Hex()); err != nil {
+			return errors.MongoErrorResponse(err)
+		}
+		audit(c, schema.AuditPasskeyRemove, user, target, map[string]schema.AuditChange{"passkey": {Old: p.Name}})
+		return c.NoContent(http.StatusNoContent)
+	}
+	return echo.ErrNotFound
+}
+
+// PostLoginPasskeyOptions starts a login with a passkey
+//   takes an optional {"username": ...} to offer only the passkeys of that
+//   user, without one the user picks any passkey of the relying party
+//   returns {"ceremony": ..., "publicKey": ...} where publicKey are the
+//   options of navigator.credentials.get
+func PostLoginPasskeyOptions(c echo.Context) error {
+	body := struct {
+		Username string `json:"username"`
+	}{}
+	c.Bind(&body)
+
+	// An unknown username gets the same answer as a user without passkeys
+	var userID string
+	allow := []webauthn.Descriptor{}
+	if len(body.Username) > 0 {
+		db := getStore(c)
+		ctx := c.Request().Context()
+		user, err := db.GetUserByUsername(ctx, body.Username)
+		if err != nil && err != store.ErrNotFound {
+			return errors.MongoErrorResponse(err)
+		}
+		if user != nil {
+			passkeys, err := db.GetPasskeys(ctx, user.ID.Hex())
+			if err != nil {
+				return errors.MongoErrorResponse(err)
+			}
+			userID, allow = user.ID.Hex(), descriptors(passkeys)
+		}
+	}
+
+	challenge, token, err := newCeremony(ceremonyGet, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"ceremony":  token,
+		"publicKey": webauthn.FromConfig().NewRequestOptions(challenge, allow),
+	})
+}
+
+// PostLoginPasskey logs in with a passkey
+//   takes {"ceremony": ..., "credential": ...} where credential is the json
+//   of what navigator.credentials.get returned, and presents the session
+//   like GET /login, passkeys verify the user so 2FA isn't asked for
+//   error is 401 if the ceremony is bad or the credential doesn't check out
+func PostLoginPasskey(c echo.Context) error {
+	body := struct {
+		Ceremony   string                       `json:"ceremony"`
+		Credential webauthn.AssertionCredential `json:"credential"`
+	}{}
+	if err := c.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, errors.NewValidationError("credential", "PublicKeyCredential").Error())
+	}
+	state, err := finishCeremony(c, body.Ceremony, ceremonyGet)
+	if err != nil {
+		return err
+	}
+
+	db := getStore(c)
+	ctx := c.Request().Context()
+
+	credentialID := base64.RawURLEncoding.EncodeToString(body.Credential.RawID)
+	p, err := db.GetPasskey(ctx, credentialID)
+	if err == store.ErrNotFound {
+		return echo.ErrUnauthorized
+	}
+	if err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	// The passkey has to be one of the user the login was started for and
+	// the one the authenticator says it is for
+	if len(state.Subject) > 0 && state.Subject != p.UserID {
+		return echo.ErrUnauthorized
+	}
+	if handle := body.Credential.Response.UserHandle; len(handle) > 0 {
+		oid, err := primitive.ObjectIDFromHex(p.UserID)
+		if err != nil || !bytes.Equal(handle, oid[:]) {
+			return echo.ErrUnauthorized
+		}
+	}
+
+	signCount, err := webauthn.FromConfig().VerifyAssertion(state.Challenge, &body.Credential, p.PublicKey)
+	if err != nil {
+		logger.Info("passkey assertion refused", "user", p.UserID, "err", err)
+		return echo.ErrUnauthorized
+	}
+	err = db.UsePasskey(ctx, credentialID, int64(signCount))
+	if err == store.ErrNotFound {
+		// A counter that doesn't move forward means the passkey was cloned
+		logger.Warn("passkey sign count went back", "user", p.UserID, "passkey", p.ID.Hex(), "count", signCount)
+		return echo.ErrUnauthorized
+	}
+	if err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+
+	user, err := db.GetUserByID(ctx, p.UserID)
+	if err == store.ErrNotFound {
+		return echo.ErrUnauthorized
+	}
+	if err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	tokens, err := issueTokens(c, user, nil)
+	if err != nil {
+		return err
+	}
+	audit(c, schema.AuditLogin, user, user, map[string]schema.AuditChange{"passkey": {New: p.Name}})
+	return c.JSON(http.StatusOK, tokens)
+}
+
+func initPasskeys(api *echo.Group) {
+	api.POST("/login/passkey/options", PostLoginPasskeyOptions)
+	api.POST("/login/passkey", PostLoginPasskey)
+	api.POST("/users/:userID/passkeys/options", PostPasskeyOptions, DoJWTAuth)
+	api.POST("/users/:userID/passkeys", PostPasskey, DoJWTAuth)
+	api.GET("/users/:userID/passkeys", GetPasskeys, DoJWTAuth)
+	api.DELETE("/users/:userID/passkeys/:passkeyID", DeletePasskey, DoJWTAuth)
+}
@@ -0,0 +1,206 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/labstack/echo"
+
+	"github.com/briansan/user-go/config"
+	"github.com/briansan/user-go/errors"
+	"github.com/briansan/user-go/mail"
+	"github.com/briansan/user-go/password"
+	"github.com/briansan/user-go/schema"
+	"github.com/briansan/user-go/store"
+)
+
+const (
+	// mailTimeout bounds sending a mail, which happens after the response
+	mailTimeout = 30 * time.Second
+)
+
+var (
+	// mailer sends the mail of env.SMTP_ADDR
+	mailer mail.Mailer = mail.Log{}
+)
+
+// sendMail sends m in the background so that how long it takes doesn't
+// tell whether there was anything to send, failures are only logged
+func sendMail(m *mail.Message) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), mailTimeout)
+		defer cancel()
+		if err := mailer.Send(ctx, m); err != nil {
+			logger.Warn("mail failed", "to", m.To, "subject", m.Subject, "err", err)
+		}
+	}()
+}
+
+// checkPassword holds pw up to the password policy for the user with
+// username and email
+//   error is 400 listing every rule pw breaks
+func checkPassword(pw, username, email string) error {
+	if err := password.PolicyFromConfig().Check(pw, username, email); err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	return nil
+}
+
+// newEmailToken stores a token of purpose for user to mail to email
+// and returns it
+func newEmailToken(c echo.Context, user *schema.UserSecure, purpose, email string, ttl time.Duration) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	err = getStore(c).CreateEmailToken(c.Request().Context(), &schema.EmailToken{
+		Hash:      hashToken(token),
+		Purpose:   purpose,
+		UserID:    user.ID.Hex(),
+		Email:     email,
+		ExpiresAt: time.Now().Add(ttl),
+	})
+	if err != nil {
+		return "", errors.MongoErrorResponse(err)
+	}
+	return token, nil
+}
+
+// tokenLink returns page with token in its query
+func tokenLink(page, token string) string {
+	u, err := url.Parse(page)
+	if err != nil {
+		logger.Warn("bad link page", "page", page, "err", err)
+		return page
+	}
+	q := u.Query()
+	q.Set("token", token)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// PostPasswordForgot mails a password reset link to {"email": ...} if a
+//   user has that email, the response is the same either way
+func PostPasswordForgot(c echo.Context) error {
+	body := struct {
+		Email string `json:"email"`
+	}{}
+	if err := c.Bind(&body); err != nil || len(body.Email) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, errors.NewValidationError("email", "string").Error())
+	}
+
+	db := getStore(c)
+	ctx := c.Request().Context()
+
+	user, err := db.GetUserByEmail(ctx, body.Email)
+	if err == store.ErrNotFound {
+		return c.NoContent(http.StatusAccepted)
+	}
+	if err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+
+	// Only the last link sent works
+	if err := db.DeleteEmailTokens(ctx, user.ID.Hex(), schema.EmailTokenReset); err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	ttl := config.GetPasswordResetTTL()
+	token, err := newEmailToken(c, user, schema.EmailTokenReset, user.Email, ttl)
+	if err != nil {
+		return err
+	}
+	sendMail(&mail.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Someone asked to reset the password of %s. To choose a new one, open\n\n%s\n\n"+
+			"The link works once within %v. If it wasn't you, ignore this mail and your password stays the same.\n",
+			user.Username, tokenLink(config.GetPasswordResetURL(), token), ttl),
+	})
+	return c.NoContent(http.StatusAccepted)
+}
+
+// PostPasswordReset sets the password of the user a reset link was sent
+//   to from {"token": ..., "password": ...} and ends all of its logins and personal tokens
+//   error is 400 if the token is bad, expired or used, the email of the
+//   user changed since it was sent or the password breaks the policy
+func PostPasswordReset(c echo.Context) error {
+	body := struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}{}
+	if err := c.Bind(&body); err != nil || len(body.Token) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, errors.NewValidationError("token", "string").Error())
+	}
+	if len(body.Password) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, errors.NewValidationError("password", "string").Error())
+	}
+	badToken := echo.NewHTTPError(http.StatusBadRequest, "reset token is invalid or expired")
+
+	db := getStore(c)
+	ctx := c.Request().Context()
+
+	// The token is only used up once the password passes the policy
+	hash := hashToken(body.Token)
+	t, err := db.GetEmailToken(ctx, schema.EmailTokenReset, hash, time.Now())
+	if err == store.ErrNotFound {
+		return badToken
+	}
+	if err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	user, err := db.GetUserByID(ctx, t.UserID)
+	if err == store.ErrNotFound {
+		return badToken
+	}
+	if err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	if user.Email != t.Email {
+		return badToken
+	}
+	if err := checkPassword(body.Password, user.Username, user.Email); err != nil {
+		return err
+	}
+	_, err = db.UseEmailToken(ctx, schema.EmailTokenReset, hash, time.Now())
+	if err == store.ErrNotFound {
+		return badToken
+	}
+	if err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+
+	u, err := db.UpdateUser(ctx, t.UserID, &schema.User{Password: &body.Password}, store.AnyVersion)
+	if err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	if err := revokeCredentials(ctx, db, t.UserID); err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	audit(c, schema.AuditPasswordReset, nil, u, map[string]schema.AuditChange{"password": {Old: schema.Redacted, New: schema.Redacted}})
+	return c.NoContent(http.StatusNoContent)
+}
+
+// revokeCredentials drops whatever lets userID in without its password once
+// the password changes, that is reset links, refresh tokens, sessions and
+// personal access tokens
+func revokeCredentials(ctx context.Context, db store.UserStore, userID string) error {
+	if err := db.DeleteEmailTokens(ctx, userID, schema.EmailTokenReset); err != nil {
+		return err
+	}
+	if err := db.RevokeUserTokens(ctx, userID); err != nil {
+		return err
+	}
+	if err := db.DeleteUserSessions(ctx, userID); err != nil {
+		return err
+	}
+	return db.DeleteUserPersonalTokens(ctx, userID)
+}
+
+func initPassword(api *echo.Group) {
+	mailer = mail.FromConfig()
+	api.POST("/password/forgot", PostPasswordForgot)
+	api.POST("/password/reset", PostPasswordReset)
+}
@@ -0,0 +1,166 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+
+	"github.com/briansan/user-go/errors"
+	"github.com/briansan/user-go/schema"
+	"github.com/briansan/user-go/store"
+)
+
+const (
+	// personalTokenPrefix tells personal tokens from sessions and makes
+	// leaked ones easy to scan for
+	personalTokenPrefix = "bt_pat_"
+
+	defaultPersonalTokenDays = 30
+	maxPersonalTokenDays     = 365
+)
+
+// userFromPersonalToken fetches the user of personal access token token
+//   error is 401 if the token is unknown or expired or its user is gone
+func userFromPersonalToken(c echo.Context, token string) (*schema.UserSecure, *schema.PersonalToken, error) {
+	db := getStore(c)
+	ctx := c.Request().Context()
+
+	t, err := db.GetPersonalToken(ctx, hashToken(token))
+	if err == store.ErrNotFound {
+		logger.Warn("personal token auth failed", "reason", "unknown")
+		return nil, nil, echo.ErrUnauthorized
+	}
+	if err != nil {
+		return nil, nil, errors.MongoErrorResponse(err)
+	}
+	now := time.Now()
+	if !now.Before(t.ExpiresAt) {
+		logger.Warn("personal token auth failed", "reason", "expired", "id", t.ID.Hex())
+		return nil, nil, echo.ErrUnauthorized
+	}
+
+	// Try to fetch user by id, deleted users are not found
+	user, err := db.GetUserByID(ctx, t.UserID)
+	if err == store.ErrNotFound {
+		return nil, nil, echo.ErrUnauthorized
+	}
+	if err != nil {
+		return nil, nil, errors.MongoErrorResponse(err)
+	}
+
+	var last time.Time
+	if t.LastUsedAt != nil {
+		last = *t.LastUsedAt
+	}
+	touchLastUse(ctx, "personal token", t.ID.Hex(), last, now, db.TouchPersonalToken)
+	return user, t, nil
+}
+
+// viaPersonalToken tells whether c was authenticated by a personal access
+// token, which can't change, delete or manage the credentials and sessions
+// of the account of its user
+func viaPersonalToken(c echo.Context) bool {
+	_, ok := c.Get("personalToken").(*schema.PersonalToken)
+	return ok
+}
+
+// GetPersonalTokens lists the personal access tokens of a user
+//   available to the user and roles with ModifyAllUsers permission
+func GetPersonalTokens(c echo.Context) error {
+	_, target, err := sessionTarget(c, true)
+	if err != nil {
+		return err
+	}
+	tokens, err := getStore(c).GetPersonalTokens(c.Request().Context(), target.ID.Hex())
+	if err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	return c.JSON(http.StatusOK, tokens)
+}
+
+// PostPersonalToken makes a personal access token for the user of the
+//   session from {"name": ..., "permissions": [...], "expiresInDays": ...}
+//   where permissions are names of permissions of the role of the user
+//   returns the token along with its record, this is the only time it is
+//   shown
+//   error is 400 if a permission isn't one of the role of the user
+func PostPersonalToken(c echo.Context) error {
+	user, _, err := sessionTarget(c, false)
+	if err != nil {
+		return err
+	}
+	body := struct {
+		Name          string   `json:"name"`
+		Permissions   []string `json:"permissions"`
+		ExpiresInDays int      `json:"expiresInDays"`
+	}{}
+	if err := c.Bind(&body); err != nil || len(body.Name) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, errors.NewValidationError("name", "string").Error())
+	}
+	perms, ok := schema.PermissionsByNames(body.Permissions)
+	if !ok || perms&^user.Role != 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, errors.NewValidationError("permissions", "permissions of the role").Error())
+	}
+	if body.ExpiresInDays == 0 {
+		body.ExpiresInDays = defaultPersonalTokenDays
+	}
+	if body.ExpiresInDays < 0 || body.ExpiresInDays > maxPersonalTokenDays {
+		return echo.NewHTTPError(http.StatusBadRequest, errors.NewValidationError("expiresInDays", "days up to a year").Error())
+	}
+
+	secret, err := randomToken()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	token := personalTokenPrefix + secret
+	t := &schema.PersonalToken{
+		Hash:        hashToken(token),
+		UserID:      user.ID.Hex(),
+		Name:        body.Name,
+		Permissions: schema.PermissionNames(perms),
+		ExpiresAt:   time.Now().AddDate(0, 0, body.ExpiresInDays),
+	}
+	if err := getStore(c).CreatePersonalToken(c.Request().Context(), t); err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	audit(c, schema.AuditTokenCreate, user, user, map[string]schema.AuditChange{"token": {New: t.Name}})
+	return c.JSON(http.StatusCreated, struct {
+		*schema.PersonalToken
+		Token string `json:"token"`
+	}{t, token})
+}
+
+// DeletePersonalToken revokes a personal access token of a user
+//   available to the user and roles with ModifyAllUsers permission
+func DeletePersonalToken(c echo.Context) error {
+	user, target, err := sessionTarget(c, true)
+	if err != nil {
+		return err
+	}
+
+	db := getStore(c)
+	ctx := c.Request().Context()
+
+	tokens, err := db.GetPersonalTokens(ctx, target.ID.Hex())
+	if err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	for _, t := range tokens {
+		if t.ID.Hex() != c.Param("tokenID") {
+			continue
+		}
+		if err := db.DeletePersonalToken(ctx, target.ID.Hex(), t.ID.Hex()); err != nil {
+			return errors.MongoErrorResponse(err)
+		}
+		audit(c, schema.AuditTokenRevoke, user, target, map[string]schema.AuditChange{"token": {Old: t.Name}})
+		return c.NoContent(http.StatusNoContent)
+	}
+	return echo.ErrNotFound
+}
+
+func initPersonalTokens(api *echo.Group) {
+	api.GET("/users/:userID/tokens", GetPersonalTokens, DoJWTAuth)
+	api.POST("/users/:userID/tokens", PostPersonalToken, DoJWTAuth)
+	api.DELETE("/users/:userID/tokens/:tokenID", DeletePersonalToken, DoJWTAuth)
+}
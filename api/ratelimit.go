@@ -0,0 +1,127 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+
+	"github.com/briansan/user-go/config"
+	"github.com/briansan/user-go/ratelimit"
+	"github.com/briansan/user-go/store"
+)
+
+const (
+	headerRateLimit          = "RateLimit-Limit"
+	headerRateLimitRemaining = "RateLimit-Remaining"
+	headerRateLimitReset     = "RateLimit-Reset"
+	headerRateLimitPolicy    = "RateLimit-Policy"
+
+	// apiPrefix is where the api is mounted, rate limits name routes without it
+	apiPrefix = "/api/v1"
+	// anyRoute is the rate limit of the routes no other one names
+	anyRoute = "*"
+	// rateLimitShared counts the rate limits in the store
+	rateLimitShared = "shared"
+)
+
+// ratePolicies returns the rate limits of env.RATE_LIMITS by route
+func ratePolicies() map[string]ratelimit.Policy {
+	policies := map[string]ratelimit.Policy{}
+	for _, l := range config.GetRateLimits() {
+		route := anyRoute
+		if fields := strings.Fields(l.Route); len(fields) == 2 {
+			route = strings.ToUpper(fields[0]) + " " + fields[1]
+		} else if l.Route != anyRoute {
+			logger.Warn("bad rate limit route", "route", l.Route)
+			continue
+		}
+		by := strings.ToLower(l.By)
+		if len(by) == 0 {
+			by = ratelimit.ByIP
+		}
+		if l.Limit <= 0 || l.Period <= 0 || (by != ratelimit.ByIP && by != ratelimit.ByUser && by != ratelimit.ByKey) {
+			logger.Warn("bad rate limit", "route", l.Route, "limit", l.Limit, "period", l.Period, "by", l.By)
+			continue
+		}
+		policies[route] = ratelimit.Policy{Limit: l.Limit, Period: l.Period, By: by}
+	}
+	return policies
+}
+
+// rateKey returns who the request of c is counted for under a policy by
+//   the user or personal token it authenticates with if by asks for it
+//   and it has one, else its IP
+func rateKey(c echo.Context, by string) string {
+	auth := c.Request().Header.Get(echo.HeaderAuthorization)
+	parts := strings.SplitN(auth, " ", 2)
+	bearer := len(parts) == 2 && strings.EqualFold(parts[0], "Bearer")
+	switch {
+	case by == ratelimit.ByKey && bearer && strings.HasPrefix(parts[1], personalTokenPrefix):
+		return "key:" + hashToken(parts[1])
+	case by == ratelimit.ByUser && bearer && !strings.HasPrefix(parts[1], personalTokenPrefix):
+		if claims, err := requestClaims(c, auth); err == nil {
+			return "user:" + claims.Subject
+		}
+	case by == ratelimit.ByUser:
+		if username, _, ok := c.Request().BasicAuth(); ok {
+			return "user:" + username
+		}
+	}
+	return "ip:" + clientIP(c)
+}
+
+// seconds returns d in whole seconds, rounded up
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// rateLimits is a middleware that enforces the rate limits of
+//   env.RATE_LIMITS, counted in s if env.RATE_LIMIT_STORE is shared
+//   error is 429 with Retry-After once the requests run out, the
+//   RateLimit-* headers tell how many are left either way
+//   requests are counted in process while the store can't count them, an
+//   outage of the store never turns the limits off
+func rateLimits(s store.UserStore) echo.MiddlewareFunc {
+	policies := ratePolicies()
+	fallback := ratelimit.NewMemory()
+	var limits ratelimit.Store = fallback
+	if config.GetRateLimitStore() == rateLimitShared {
+		limits = ratelimit.StoreFunc(s.TakeRateToken)
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			route := c.Request().Method + " " + strings.TrimPrefix(c.Path(), apiPrefix)
+			p, ok := policies[route]
+			if !ok {
+				route = anyRoute
+				if p, ok = policies[route]; !ok {
+					return next(c)
+				}
+			}
+
+			ctx, key, now := c.Request().Context(), route+" "+rateKey(c, p.By), time.Now()
+			r, err := limits.Take(ctx, key, p, now)
+			if err != nil {
+				// counting in process never fails
+				logger.Warn("rate limit counted in process", "route", route, "err", err)
+				r, _ = fallback.Take(ctx, key, p, now)
+			}
+			h := c.Response().Header()
+			h.Set(headerRateLimit, strconv.Itoa(p.Limit))
+			h.Set(headerRateLimitRemaining, strconv.Itoa(r.Remaining))
+			h.Set(headerRateLimitReset, seconds(r.Reset))
+			h.Set(headerRateLimitPolicy, fmt.Sprintf("%d;w=%s", p.Limit, seconds(p.Period)))
+			if !r.Allowed {
+				h.Set(headerRetryAfter, seconds(r.RetryAfter))
+				return echo.NewHTTPError(http.StatusTooManyRequests, "rate limit exceeded, try again later")
+			}
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+
+	"github.com/briansan/user-go/errors"
+	"github.com/briansan/user-go/schema"
+	"github.com/briansan/user-go/store"
+)
+
+const (
+	// lastUseTouch is how stale the last use of a session or personal
+	// token gets before it is written again, so busy clients don't write
+	// on every request
+	lastUseTouch = time.Minute
+
+	// maxUserAgent is how much of the User-Agent of a login is kept
+	maxUserAgent = 512
+)
+
+// touchLastUse records with touch that the kind of credential id, last
+// used at last, was used at now unless that was within lastUseTouch
+// failures are only logged, the request goes on either way
+func touchLastUse(ctx context.Context, kind, id string, last, now time.Time, touch func(context.Context, string, time.Time) error) {
+	if now.Sub(last) <= lastUseTouch {
+		return
+	}
+	if err := touch(ctx, id, now); err != nil {
+		logger.Warn(kind+" touch failed", "id", id, "err", err)
+	}
+}
+
+// recordSession stores session id of user logging in through c with the
+//   user agent and IP of c, until expiresAt
+//   clientID names the oauth client the user authorized, if any
+//   a refresh only marks the session used, logins from before sessions
+//   were recorded get theirs then
+func recordSession(c echo.Context, user *schema.UserSecure, id, clientID string, expiresAt time.Time, refresh bool) error {
+	db := getStore(c)
+	ctx := c.Request().Context()
+
+	if refresh {
+		err := db.TouchSession(ctx, id, time.Now())
+		if err == nil {
+			return nil
+		}
+		if err != store.ErrNotFound {
+			return errors.MongoErrorResponse(err)
+		}
+	}
+
+	agent := c.Request().UserAgent()
+	if len(agent) > maxUserAgent {
+		agent = strings.ToValidUTF8(agent[:maxUserAgent], "")
+	}
+	err := db.CreateSession(ctx, &schema.Session{
+		ID:        id,
+		UserID:    user.ID.Hex(),
+		UserAgent: agent,
+		IP:        clientIP(c),
+		ExpiresAt: expiresAt,
+		ClientID:  clientID,
+	})
+	if err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	return nil
+}
+
+// checkSession ensures the session of claims wasn't ended and marks it used
+//   error is 401 if it was ended or expired, or is not of the user and
+//   oauth client of claims
+func checkSession(c echo.Context, claims *Claims) error {
+	db := getStore(c)
+	ctx := c.Request().Context()
+
+	s, err := db.GetSession(ctx, claims.SessionID)
+	if err == store.ErrNotFound {
+		logger.Warn("jwt auth failed", "reason", "session ended", "sid", claims.SessionID)
+		return echo.ErrUnauthorized
+	}
+	if err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	now := time.Now()
+	if s.UserID != claims.Subject || s.ClientID != claims.ClientID || !s.Active(now) {
+		logger.Warn("jwt auth failed", "reason", "session expired", "sid", claims.SessionID)
+		return echo.ErrUnauthorized
+	}
+
+	touchLastUse(ctx, "session", s.ID, s.LastSeenAt, now, db.TouchSession)
+	return nil
+}
+
+// endSession logs session id of user userID out, revoking the tokens
+// issued for it
+//   error is 404 if there is no such session
+func endSession(c echo.Context, userID, id string) error {
+	db := getStore(c)
+	ctx := c.Request().Context()
+
+	s, err := db.GetSession(ctx, id)
+	if err == nil && s.UserID != userID {
+		err = store.ErrNotFound
+	}
+	if err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	if err := db.RevokeTokenFamily(ctx, id); err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	if err := db.DeleteSession(ctx, userID, id); err != nil && err != store.ErrNotFound {
+		return errors.MongoErrorResponse(err)
+	}
+	return nil
+}
+
+// GetSessions lists the active sessions of a user, where and when they
+//   logged in and were last used, the one of the request is current
+//   available to the user and roles with ModifyAllUsers permission
+func GetSessions(c echo.Context) error {
+	_, target, err := sessionTarget(c, true)
+	if err != nil {
+		return err
+	}
+	sessions, err := getStore(c).GetSessions(c.Request().Context(), target.ID.Hex(), time.Now())
+	if err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	if claims, ok := c.Get("claims").(*Claims); ok {
+		for _, s := range sessions {
+			s.Current = s.ID == claims.SessionID
+		}
+	}
+	return c.JSON(http.StatusOK, sessions)
+}
+
+// DeleteSession ends a session of a user, its session and refresh
+//   tokens stop working right away
+//   available to the user and roles with ModifyAllUsers permission
+//   error is 404 if the user has no such session
+func DeleteSession(c echo.Context) error {
+	user, target, err := sessionTarget(c, true)
+	if err != nil {
+		return err
+	}
+	id := c.Param("sessionID")
+	if err := endSession(c, target.ID.Hex(), id); err != nil {
+		return err
+	}
+	audit(c, schema.AuditSessionEnd, user, target, map[string]schema.AuditChange{"session": {Old: id}})
+	return c.NoContent(http.StatusNoContent)
+}
+
+// DeleteSessions ends every session of a user, the one of the request too
+//   available to the user and roles with ModifyAllUsers permission
+func DeleteSessions(c echo.Context) error {
+	user, target, err := sessionTarget(c, true)
+	if err != nil {
+		return err
+	}
+
+	db := getStore(c)
+	ctx := c.Request().Context()
+
+	sessions, err := db.GetSessions(ctx, target.ID.Hex(), time.Now())
+	if err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	if err := db.RevokeUserTokens(ctx, target.ID.Hex()); err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	if err := db.DeleteUserSessions(ctx, target.ID.Hex()); err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	audit(c, schema.AuditSessionEnd, user, target, map[string]schema.AuditChange{"sessions": {Old: len(sessions), New: 0}})
+	return c.NoContent(http.StatusNoContent)
+}
+
+func initSessions(api *echo.Group) {
+	api.GET("/users/:userID/sessions", GetSessions, DoJWTAuth)
+	api.DELETE("/users/:userID/sessions", DeleteSessions, DoJWTAuth)
+	api.DELETE("/users/:userID/sessions/:sessionID", DeleteSession, DoJWTAuth)
+}
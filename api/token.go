@@ -0,0 +1,227 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/briansan/user-go/config"
+	"github.com/briansan/user-go/errors"
+	"github.com/briansan/user-go/schema"
+	"github.com/briansan/user-go/store"
+)
+
+const (
+	randomTokenBytes = 32
+)
+
+// randomToken returns randomTokenBytes of crypto randomness, base64url encoded
+func randomToken() (string, error) {
+	b := make([]byte, randomTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the sha256 of a random secret, such as a refresh
+// token, that the store looks it up by
+// a plain digest is enough since the secret is random and not a password
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueTokens creates a jwt session and a refresh token for user
+//   previous nil starts a new family, else it is rotated out
+//   with env.SESSION_COOKIE the tokens are set in cookies too, along with
+//   the CSRF token, which is returned as csrf
+//   error is 401 if previous was used meanwhile, 403 if the email of user
+//   has to be verified first
+func issueTokens(c echo.Context, user *schema.UserSecure, previous *schema.RefreshToken) (map[string]string, error) {
+	if err := requireVerifiedEmail(user); err != nil {
+		return nil, err
+	}
+	// The family of the refresh tokens of a login is its session id
+	family := primitive.NewObjectID().Hex()
+	if previous != nil {
+		family = previous.Family
+	}
+	session, claims, err := NewJWTSession(user, family)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	secret, err := randomToken()
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	now := time.Now()
+	next := &schema.RefreshToken{
+		Hash:            hashToken(secret),
+		Family:          family,
+		UserID:          user.ID.Hex(),
+		AccessJTI:       claims.ID,
+		AccessExpiresAt: claims.ExpiresAt.Time,
+		CreatedAt:       now,
+		ExpiresAt:       now.Add(config.GetRefreshTokenTTL()),
+	}
+
+	db := getStore(c)
+	ctx := c.Request().Context()
+
+	if previous == nil {
+		err = db.CreateRefreshToken(ctx, next)
+	} else {
+		// Rotation keeps the expiry of the family
+		next.ExpiresAt = previous.ExpiresAt
+		err = db.RotateRefreshToken(ctx, previous, next)
+	}
+	if err == store.ErrTokenReused {
+		return nil, revokeReusedFamily(c, previous)
+	}
+	if err != nil {
+		return nil, errors.MongoErrorResponse(err)
+	}
+	if err := recordSession(c, user, family, "", next.ExpiresAt, previous != nil); err != nil {
+		return nil, err
+	}
+	tokens := map[string]string{"session": session, "refresh": secret}
+	if config.GetSessionCookie() {
+		tokens["csrf"] = setSessionCookies(c, session, secret, claims, family, next.ExpiresAt)
+	}
+	return tokens, nil
+}
+
+// revokeReusedFamily ends every session descending from the login t was
+// issued for, since presenting it twice means someone else holds a copy
+//   error is always 401 unless the store fails
+func revokeReusedFamily(c echo.Context, t *schema.RefreshToken) error {
+	logger.Warn("refresh token reused", "family", t.Family, "user", t.UserID)
+	db := getStore(c)
+	ctx := c.Request().Context()
+	if err := db.RevokeTokenFamily(ctx, t.Family); err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	if err := db.DeleteSession(ctx, t.UserID, t.Family); err != nil && err != store.ErrNotFound {
+		return errors.MongoErrorResponse(err)
+	}
+	target := &schema.UserSecure{}
+	if id, err := primitive.ObjectIDFromHex(t.UserID); err == nil {
+		target.ID = id
+	}
+	audit(c, schema.AuditTokenReuse, nil, target, nil)
+	return echo.ErrUnauthorized
+}
+
+// PostRefresh exchanges a refresh token for a new session and refresh token
+//   error is 401 if the token is unknown, expired, used or revoked
+//   reusing a rotated token revokes its whole family
+//   the refresh token cookie can stand in for the body along with the
+//   CSRF token, error is 403 without it
+func PostRefresh(c echo.Context) error {
+	body := struct {
+		Refresh string `json:"refresh"`
+	}{}
+	err := c.Bind(&body)
+
+	// Browsers send the refresh token cookie instead
+	var fromCookie bool
+	if cookie, cerr := c.Cookie(cookieRefresh); len(body.Refresh) == 0 && cerr == nil && config.GetSessionCookie() {
+		body.Refresh, fromCookie, err = cookie.Value, true, nil
+	}
+	if err != nil || len(body.Refresh) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, errors.NewValidationError("refresh", "token").Error())
+	}
+
+	db := getStore(c)
+	ctx := c.Request().Context()
+
+	// Look up the token by its hash
+	t, err := db.GetRefreshToken(ctx, hashToken(body.Refresh))
+	if err == store.ErrNotFound {
+		return echo.ErrUnauthorized
+	}
+	if err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	if fromCookie {
+		if err := checkCSRF(c, t.Family); err != nil {
+			return err
+		}
+	}
+	if t.RevokedAt != nil {
+		return echo.ErrUnauthorized
+	}
+	if t.UsedAt != nil {
+		return revokeReusedFamily(c, t)
+	}
+	if !t.Active(time.Now()) {
+		return echo.ErrUnauthorized
+	}
+
+	// Deleted users can't refresh their sessions
+	user, err := db.GetUserByID(ctx, t.UserID)
+	if err == store.ErrNotFound {
+		return echo.ErrUnauthorized
+	}
+	if err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+
+	tokens, err := issueTokens(c, user, t)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, tokens)
+}
+
+// PostLogout revokes the current session and the refresh token family
+// it was issued with, and ends its login session and clears its cookies
+func PostLogout(c echo.Context) error {
+	// Type assert user and claims from context
+	user, ok := c.Get("user").(*schema.UserSecure)
+	if !ok {
+		return echo.ErrUnauthorized
+	}
+	claims, ok := c.Get("claims").(*Claims)
+	if !ok {
+		return echo.ErrUnauthorized
+	}
+
+	db := getStore(c)
+	ctx := c.Request().Context()
+
+	if err := db.RevokeAccessToken(ctx, claims.ID, claims.ExpiresAt.Time); err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+
+	// The family is gone if it expired and was purged
+	t, err := db.GetRefreshTokenByJTI(ctx, claims.ID)
+	if err != nil && err != store.ErrNotFound {
+		return errors.MongoErrorResponse(err)
+	}
+	if t != nil {
+		if err := db.RevokeTokenFamily(ctx, t.Family); err != nil {
+			return errors.MongoErrorResponse(err)
+		}
+	}
+	if len(claims.SessionID) > 0 {
+		if err := db.DeleteSession(ctx, user.ID.Hex(), claims.SessionID); err != nil && err != store.ErrNotFound {
+			return errors.MongoErrorResponse(err)
+		}
+	}
+
+	if config.GetSessionCookie() {
+		clearSessionCookies(c)
+	}
+
+	audit(c, schema.AuditLogout, user, user, nil)
+	return c.NoContent(http.StatusNoContent)
+}
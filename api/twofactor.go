@@ -0,0 +1,343 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/labstack/echo"
+
+	"github.com/briansan/user-go/config"
+	"github.com/briansan/user-go/errors"
+	"github.com/briansan/user-go/schema"
+	"github.com/briansan/user-go/store"
+	"github.com/briansan/user-go/totp"
+)
+
+const (
+	challengeAudience  = "bt-2fa"
+	challengeTTL       = 5 * time.Minute
+	recoveryCodeCount  = 10
+	recoveryCodeLength = 10
+
+	// headerOTP carries the second factor of BasicAuth logins that can't
+	// go through POST /login/2fa, such as GET /oauth/authorize
+	headerOTP = "X-OTP"
+
+	secondFactorTOTP     = "totp"
+	secondFactorRecovery = "recovery"
+
+	// totpSkew accepts the codes of the steps next to the current one
+	// to make up for clock drift and typing time
+	totpSkew = 1
+
+	// a challenge is burnt after maxChallengeFailures wrong codes, which
+	// are counted under lockoutChallenge and its jti
+	maxChallengeFailures = 3
+	lockoutChallenge     = "challenge:"
+)
+
+// newRecoveryCode returns a random code formatted as xxxxx-xxxxx
+func newRecoveryCode() (string, error) {
+	b := make([]byte, recoveryCodeLength*5/8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))
+	half := recoveryCodeLength / 2
+	return code[:half] + "-" + code[half:], nil
+}
+
+// hashRecoveryCode returns the hash code is stored by, ignoring case and
+// surrounding space
+func hashRecoveryCode(code string) string {
+	return hashToken(strings.ToLower(strings.TrimSpace(code)))
+}
+
+// verifySecondFactor checks code, a TOTP code or a recovery code, against
+// the enrollment of user and uses it up, returning which kind it was
+//   wrong codes count as failed logins of user, a right one completes
+//   the login
+//   error is 401 if it is wrong or was used already, 429 while the user
+//   or the IP of c is locked out
+func verifySecondFactor(c echo.Context, user *schema.UserSecure, code string) (string, error) {
+	if err := checkLockout(c, user.Username); err != nil {
+		return "", err
+	}
+
+	db := getStore(c)
+	ctx := c.Request().Context()
+	userID := user.ID.Hex()
+
+	t, err := db.GetTwoFactor(ctx, userID)
+	if err == store.ErrNotFound {
+		return "", echo.ErrUnauthorized
+	}
+	if err != nil {
+		return "", errors.MongoErrorResponse(err)
+	}
+
+	method := secondFactorTOTP
+	if len(code) == totp.Digits {
+		step, ok := totp.Validate(t.Secret, code, time.Now(), totpSkew)
+		if !ok {
+			loginFailed(c, user.Username)
+			return "", echo.ErrUnauthorized
+		}
+		err = db.UseTOTPStep(ctx, userID, step)
+	} else {
+		method = secondFactorRecovery
+		err = db.UseRecoveryCode(ctx, userID, hashRecoveryCode(code))
+	}
+	if err == store.ErrNotFound {
+		loginFailed(c, user.Username)
+		return "", echo.ErrUnauthorized
+	}
+	if err != nil {
+		return "", errors.MongoErrorResponse(err)
+	}
+	loginSucceeded(c, user.Username)
+	return method, nil
+}
+
+// hasTwoFactor reports whether logins of user need a second factor
+func hasTwoFactor(c echo.Context, user *schema.UserSecure) (bool, error) {
+	t, err := getStore(c).GetTwoFactor(c.Request().Context(), user.ID.Hex())
+	if err == store.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.MongoErrorResponse(err)
+	}
+	return t.Enabled(), nil
+}
+
+// newChallenge returns the token that stands for the first factor of a
+// login of user until POST /login/2fa completes it
+func newChallenge(user *schema.UserSecure) (string, error) {
+	claims, err := newPurposeClaims(challengeAudience, user.ID.Hex(), challengeTTL)
+	if err != nil {
+		return "", err
+	}
+	return signJWT(&claims)
+}
+
+// challengeFailed counts a wrong code for the challenge of claims and burns
+// it once there were maxChallengeFailures
+// failures to count are only logged, the login fails either way
+func challengeFailed(c echo.Context, claims *jwt.RegisteredClaims) {
+	db := getStore(c)
+	ctx := c.Request().Context()
+	f, err := db.AddLoginFailure(ctx, lockoutChallenge+claims.ID, time.Now(), challengeTTL)
+	if err != nil {
+		logger.Warn("challenge failure not counted", "jti", claims.ID, "err", err)
+		return
+	}
+	if f.Count < maxChallengeFailures {
+		return
+	}
+	if err := db.RevokeAccessToken(ctx, claims.ID, claims.ExpiresAt.Time); err != nil {
+		logger.Warn("challenge not revoked", "jti", claims.ID, "err", err)
+	}
+}
+
+// PostLogin2FA completes a login of a user with 2FA
+//   takes {"challenge": ..., "code": ...} where code is a TOTP code or a
+//   recovery code, and presents the session like GET /login
+//   a challenge takes maxChallengeFailures wrong codes at most
+//   error is 401 if the challenge is bad, expired or used or the code
+//   wrong, 429 while the user or the IP is locked out
+func PostLogin2FA(c echo.Context) error {
+	body := struct {
+		Challenge string `json:"challenge"`
+		Code      string `json:"code"`
+	}{}
+	if err := c.Bind(&body); err != nil || len(body.Challenge) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, errors.NewValidationError("challenge", "token").Error())
+	}
+	if len(body.Code) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, errors.NewValidationError("code", "string").Error())
+	}
+
+	claims := &jwt.RegisteredClaims{}
+	if err := parsePurposeToken(body.Challenge, challengeAudience, claims); err != nil || len(claims.ID) == 0 {
+		return echo.ErrUnauthorized
+	}
+
+	db := getStore(c)
+	ctx := c.Request().Context()
+
+	// A challenge completes one login
+	revoked, err := db.IsAccessTokenRevoked(ctx, claims.ID)
+	if err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	if revoked {
+		return echo.ErrUnauthorized
+	}
+	user, err := db.GetUserByID(ctx, claims.Subject)
+	if err == store.ErrNotFound {
+		return echo.ErrUnauthorized
+	}
+	if err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+
+	method, err := verifySecondFactor(c, user, body.Code)
+	if err == echo.ErrUnauthorized {
+		challengeFailed(c, claims)
+	}
+	if err != nil {
+		return err
+	}
+	if err := db.RevokeAccessToken(ctx, claims.ID, claims.ExpiresAt.Time); err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+
+	tokens, err := issueTokens(c, user, nil)
+	if err != nil {
+		return err
+	}
+	audit(c, schema.AuditLogin, user, user, map[string]schema.AuditChange{"secondFactor": {New: method}})
+	return c.JSON(http.StatusOK, tokens)
+}
+
+// GetTwoFactor tells whether 2FA is enabled for a user and how many
+// recovery codes are left
+//   available to the user and roles with ModifyAllUsers permission
+func GetTwoFactor(c echo.Context) error {
+	_, target, err := sessionTarget(c, true)
+	if err != nil {
+		return err
+	}
+	t, err := getStore(c).GetTwoFactor(c.Request().Context(), target.ID.Hex())
+	if err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"enabled":       t.Enabled(),
+		"createdAt":     t.CreatedAt,
+		"confirmedAt":   t.ConfirmedAt,
+		"recoveryCodes": len(t.RecoveryCodes),
+	})
+}
+
+// PostTwoFactor starts the TOTP enrollment of the user of the session
+//   returns the secret and its otpauth uri to show as a QR code, 2FA is
+//   enabled once POST /users/:userID/2fa/confirm gets a code of it
+//   error is 409 if 2FA is enabled already
+func PostTwoFactor(c echo.Context) error {
+	user, _, err := sessionTarget(c, false)
+	if err != nil {
+		return err
+	}
+	secret, err := totp.NewSecret()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if err := getStore(c).CreateTwoFactor(c.Request().Context(), &schema.TwoFactor{UserID: user.ID.Hex(), Secret: secret}); err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	account := user.Email
+	if len(account) == 0 {
+		account = user.Username
+	}
+	return c.JSON(http.StatusCreated, map[string]string{
+		"secret": secret,
+		"uri":    totp.URI(config.AppName, account, secret),
+	})
+}
+
+// PostTwoFactorConfirm enables 2FA for the user of the session with a
+//   code of the secret of the enrollment
+//   returns the recovery codes, this is the only time they are shown
+//   error is 400 if the code is wrong, 404 if there is nothing to confirm
+func PostTwoFactorConfirm(c echo.Context) error {
+	user, _, err := sessionTarget(c, false)
+	if err != nil {
+		return err
+	}
+	body := struct {
+		Code string `json:"code"`
+	}{}
+	c.Bind(&body)
+
+	db := getStore(c)
+	ctx := c.Request().Context()
+
+	t, err := db.GetTwoFactor(ctx, user.ID.Hex())
+	if err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	if t.Enabled() {
+		return echo.ErrNotFound
+	}
+	step, ok := totp.Validate(t.Secret, body.Code, time.Now(), totpSkew)
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, errors.NewValidationError("code", "current TOTP code").Error())
+	}
+
+	codes, hashes := []string{}, []string{}
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		codes, hashes = append(codes, code), append(hashes, hashRecoveryCode(code))
+	}
+	if err := db.ConfirmTwoFactor(ctx, user.ID.Hex(), step, hashes); err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	audit(c, schema.AuditTwoFactorOn, user, user, nil)
+	return c.JSON(http.StatusOK, map[string][]string{"recoveryCodes": codes})
+}
+
+// DeleteTwoFactor turns 2FA off for a user
+//   the user has to send {"code": ...} with a TOTP or recovery code,
+//   roles with ModifyAllUsers permission reset it for others without one
+func DeleteTwoFactor(c echo.Context) error {
+	user, target, err := sessionTarget(c, true)
+	if err != nil {
+		return err
+	}
+
+	db := getStore(c)
+	ctx := c.Request().Context()
+
+	if target.ID == user.ID {
+		body := struct {
+			Code string `json:"code"`
+		}{}
+		c.Bind(&body)
+		enabled, err := hasTwoFactor(c, user)
+		if err != nil {
+			return err
+		}
+		// Enrollments that were never confirmed can go without a code
+		if enabled {
+			if len(body.Code) == 0 {
+				return echo.NewHTTPError(http.StatusBadRequest, errors.NewValidationError("code", "string").Error())
+			}
+			if _, err := verifySecondFactor(c, user, body.Code); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := db.DeleteTwoFactor(ctx, target.ID.Hex()); err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	audit(c, schema.AuditTwoFactorOff, user, target, nil)
+	return c.NoContent(http.StatusNoContent)
+}
+
+func initTwoFactor(api *echo.Group) {
+	api.POST("/login/2fa", PostLogin2FA)
+	api.GET("/users/:userID/2fa", GetTwoFactor, DoJWTAuth)
+	api.POST("/users/:userID/2fa", PostTwoFactor, DoJWTAuth)
+	api.POST("/users/:userID/2fa/confirm", PostTwoFactorConfirm, DoJWTAuth)
+	api.DELETE("/users/:userID/2fa", DeleteTwoFactor, DoJWTAuth)
+}
@@ -1,7 +1,11 @@
 package api
 
 import (
+	"context"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/labstack/echo"
 	"github.com/mgutz/logxi/v1"
@@ -11,45 +15,108 @@ import (
 	"github.com/briansan/user-go/store"
 )
 
+const (
+	headerTotalCount = "X-Total-Count"
+	headerLink       = "Link"
+	headerETag       = "ETag"
+	headerIfMatch    = "If-Match"
+)
+
 var (
 	logger = log.New("api")
-	allows = schema.RoleHasPermission
 )
 
-// GetUsers retrieves all users
+// allows tells whether user, the user of the session of c, may use perm,
+// which the role of user has to have and so does the scope of the personal
+// access token the session comes from if it does
+func allows(c echo.Context, user *schema.UserSecure, perm int) bool {
+	if !schema.RoleHasPermission(user.Role, perm) {
+		return false
+	}
+	if scope, ok := c.Get("scope").(int); ok {
+		return schema.RoleHasPermission(scope, perm)
+	}
+	return true
+}
+
+// GetUsers retrieves a page of users
 //   available to roles with ModifyAllUsersRestricted permission
+//   filtered by ?role, ?usernamePrefix and ?emailDomain
+//   ordered by ?sort (id, username, email or role, - for descending)
+//   paged by ?limit and the ?cursor found in the next Link header
 func GetUsers(c echo.Context) error {
 	// Type assert user from context and authorize
 	user, ok := c.Get("user").(*schema.UserSecure)
 	if !ok {
 		return echo.ErrUnauthorized
 	}
-	if !allows(user.Role, schema.PermissionModifyAllUsersRestricted) {
+	if !allows(c, user, schema.PermissionModifyAllUsersRestricted) {
 		return echo.ErrForbidden
 	}
 
-	// Get db connection
-	db, err := store.NewMongoStore()
+	// Parse query
+	q, err := newUserQuery(c)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusServiceUnavailable, err.Error())
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
-	defer db.Cleanup()
+
+	// Get db connection
+	db := getStore(c)
+	ctx := c.Request().Context()
 
 	// Try to get users
-	users, err := db.GetAllUsers()
+	page, err := db.FindUsers(ctx, q)
 	if err != nil {
 		return errors.MongoErrorResponse(err)
 	}
 
+	// Point at the next page
+	c.Response().Header().Set(headerTotalCount, strconv.Itoa(page.Total))
+	if len(page.Next) > 0 {
+		next := *c.Request().URL
+		params := next.Query()
+		params.Set("cursor", page.Next)
+		next.RawQuery = params.Encode()
+		c.Response().Header().Set(headerLink, fmt.Sprintf(`<%v>; rel="next"`, next.RequestURI()))
+	}
+
 	//
 	if c.QueryParam("mapped") == "true" {
 		m := map[string]*schema.UserSecure{}
-		for _, u := range users {
+		for _, u := range page.Users {
 			m[u.ID.Hex()] = u
 		}
 		return c.JSON(http.StatusOK, m)
 	}
-	return c.JSON(http.StatusOK, users)
+	return c.JSON(http.StatusOK, page.Users)
+}
+
+// newUserQuery reads the filter, sort and paging parameters of GetUsers
+func newUserQuery(c echo.Context) (*store.UserQuery, error) {
+	q := &store.UserQuery{
+		UsernamePrefix: c.QueryParam("usernamePrefix"),
+		EmailDomain:    c.QueryParam("emailDomain"),
+		Sort:           c.QueryParam("sort"),
+		Cursor:         c.QueryParam("cursor"),
+	}
+	if role := c.QueryParam("role"); len(role) > 0 {
+		r, err := strconv.Atoi(role)
+		if err != nil {
+			return nil, errors.NewValidationError("role", "integer")
+		}
+		q.Role = &r
+	}
+	if limit := c.QueryParam("limit"); len(limit) > 0 {
+		l, err := strconv.Atoi(limit)
+		if err != nil || l <= 0 {
+			return nil, errors.NewValidationError("limit", "positive integer")
+		}
+		q.Limit = l
+	}
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	return q, nil
 }
 
 func PostUsers(c echo.Context) error {
@@ -60,46 +127,92 @@ func PostUsers(c echo.Context) error {
 	if err := u.Validate(); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
+	if err := checkPassword(*u.Password, *u.Username, *u.Email); err != nil {
+		return err
+	}
 
 	// Get user from db
-	db, err := store.NewMongoStore()
-	if err != nil {
-		return errors.MongoErrorResponse(err)
-	}
-	defer db.Cleanup()
+	db := getStore(c)
+	ctx := c.Request().Context()
 
-	// Try to fetch JWT header (for admin)
+	// Try to fetch JWT header or cookie (for admin)
 	var user *schema.UserSecure
 	values, ok := c.Request().Header[echo.HeaderAuthorization]
 	if ok && len(values) == 1 {
-		auth := values[0]
-		// Get user id from token
-		id, err := AuthenticateJWT(auth)
-		if err != nil {
-			logger.Warn("jwt auth failed", "reason", err.Error())
-			return echo.ErrUnauthorized
+		var err error
+		if user, _, err = userFromJWT(c, values[0]); err != nil {
+			return err
 		}
-		// Try to fetch user by creds
-		user, err = db.GetUserByID(id)
-		if err != nil {
-			return errors.MongoErrorResponse(err)
-		}
-		if user == nil {
-			return echo.ErrUnauthorized
+	} else if session, ok := sessionCookie(c); ok {
+		var err error
+		if user, _, err = userFromCookie(c, session); err != nil {
+			return err
 		}
 	}
 
-	// If not admin, default role to user
-	if user == nil || !allows(user.Role, schema.PermissionModifyAllUsers) {
+	// If not admin, default role to user and leave the email unverified
+	if user == nil || !allows(c, user, schema.PermissionModifyAllUsers) {
 		u.Role = &schema.RoleUser
+		u.EmailVerified = nil
 	}
 
 	// Try to add user
-	if err = db.CreateUser(&u); err != nil {
+	diff := schema.DiffUser(nil, &u)
+	if err := db.CreateUser(ctx, &u); err != nil {
 		return errors.MongoErrorResponse(err)
 	}
+	created := u.Secure()
+	audit(c, schema.AuditUserCreate, user, &schema.UserSecure{ID: u.ID}, diff)
+
+	// The user is there either way, a lost link can be sent again
+	if !created.EmailVerified {
+		if err := sendVerification(c, created, schema.EmailTokenVerify, created.Email); err != nil {
+			logger.Warn("verification failed", "user", created.ID.Hex(), "err", err)
+		}
+	}
+
+	return c.JSON(http.StatusCreated, created)
+}
+
+// findUser looks up userID as a username first and then as an id
+func findUser(ctx context.Context, db store.UserStore, userID string) (*schema.UserSecure, error) {
+	u, err := db.GetUserByUsername(ctx, userID)
+	if err != store.ErrNotFound {
+		return u, err
+	}
+	return db.GetUserByID(ctx, userID)
+}
+
+// etag returns the entity tag of u, its quoted version
+func etag(u *schema.UserSecure) string {
+	return fmt.Sprintf(`"%d"`, u.Version)
+}
+
+// ifMatch returns the version a write to u has to expect per If-Match
+//   no header or * is store.AnyVersion
+//   error is 412 if no listed entity tag is the one of u
+func ifMatch(c echo.Context, u *schema.UserSecure) (int, error) {
+	header := c.Request().Header.Get(headerIfMatch)
+	if len(header) == 0 {
+		return store.AnyVersion, nil
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return store.AnyVersion, nil
+		}
+		// Weak tags never match since If-Match compares strongly
+		if tag == etag(u) {
+			return u.Version, nil
+		}
+	}
+	return 0, errors.MongoErrorResponse(errors.ErrVersionMismatch)
+}
 
-	return c.JSON(http.StatusCreated, u)
+// jsonWithETag responds with u and its entity tag
+func jsonWithETag(c echo.Context, code int, u *schema.UserSecure) error {
+	c.Response().Header().Set(headerETag, etag(u))
+	return c.JSON(code, u)
 }
 
 func GetUserByUserID(c echo.Context) error {
@@ -108,41 +221,34 @@ func GetUserByUserID(c echo.Context) error {
 	// Type assert user from context and try to return that if user id's match
 	user, ok := c.Get("user").(*schema.UserSecure)
 	if ok && (user.ID.Hex() == userID || user.Username == userID) {
-		return c.JSON(http.StatusOK, user)
+		return jsonWithETag(c, http.StatusOK, user)
 	}
 
 	// Don't go any further if user role doesn't have permission to view other users
-	if !ok || !allows(user.Role, schema.PermissionModifyAllUsersRestricted) {
+	if !ok || !allows(c, user, schema.PermissionModifyAllUsersRestricted) {
 		return echo.ErrForbidden
 	}
 
 	// Establish db connection
-	db, err := store.NewMongoStore()
-	if err != nil {
-		return errors.MongoErrorResponse(err)
-	}
-	defer db.Cleanup()
+	db := getStore(c)
+	ctx := c.Request().Context()
 
-	// Try to fetch by username
-	u, err := db.GetUserByUsername(userID)
-	if err != nil && err.Error() != "not found" {
-		return errors.MongoErrorResponse(err)
-	}
-
-	// Return if found
-	if u != nil {
-		return c.JSON(http.StatusOK, u)
-	}
-
-	// Try to fetch by ID
-	u, err = db.GetUserByID(userID)
+	// Try to fetch by username, then by ID
+	u, err := findUser(ctx, db, userID)
 	if err != nil {
 		return errors.MongoErrorResponse(err)
 	}
-
-	return c.JSON(http.StatusOK, u)
+	return jsonWithETag(c, http.StatusOK, u)
 }
 
+// PatchUser updates the fields of a user that are present in the body
+//   If-Match with the ETag of GET /users/:userID guards against lost updates
+//   a new email from users without ModifyAllUsers permission is only taken
+//   once the link mailed to it is followed, the response is 202 then
+//   a new password logs the user out everywhere, this session included,
+//   and revokes its personal access tokens
+//   error is 400 listing the rules of the password policy a new password
+//   breaks
 func PatchUser(c echo.Context) error {
 	userID := c.Param("userID")
 
@@ -153,7 +259,7 @@ func PatchUser(c echo.Context) error {
 	}
 
 	// Only allow roles who have permission to ModifyAllUsersRestricted
-	if user.ID.Hex() != userID && user.Username != userID && !allows(user.Role, schema.PermissionModifyAllUsersRestricted) {
+	if user.ID.Hex() != userID && user.Username != userID && !allows(c, user, schema.PermissionModifyAllUsersRestricted) {
 		return echo.ErrForbidden
 	}
 
@@ -161,35 +267,123 @@ func PatchUser(c echo.Context) error {
 	userPatch := &schema.User{}
 	c.Bind(userPatch)
 
-	// Only allow ModifyAllUsers permission to touch the Role field
-	if userPatch.Role != nil && !allows(user.Role, schema.PermissionModifyAllUsers) {
+	// Only allow ModifyAllUsers permission to touch the Role and EmailVerified fields
+	admin := allows(c, user, schema.PermissionModifyAllUsers)
+	if (userPatch.Role != nil || userPatch.EmailVerified != nil) && !admin {
 		return echo.ErrForbidden
 	}
 
 	// Establish db connection
-	db, err := store.NewMongoStore()
+	db := getStore(c)
+	ctx := c.Request().Context()
+
+	// Find the user being patched
+	target, err := findUser(ctx, db, userID)
 	if err != nil {
 		return errors.MongoErrorResponse(err)
 	}
-	defer db.Cleanup()
+
+	// ModifyAllUsersRestricted can't touch users who can ModifyAllUsers
+	if target.ID != user.ID && schema.RoleHasPermission(target.Role, schema.PermissionModifyAllUsers) && !allows(c, user, schema.PermissionModifyAllUsers) {
+		return echo.ErrForbidden
+	}
+	// Personal tokens can't change their own account
+	if target.ID == user.ID && viaPersonalToken(c) {
+		return echo.ErrForbidden
+	}
+
+	version, err := ifMatch(c, target)
+	if err != nil {
+		return err
+	}
 
 	// Authenticate user if password is being touched and isn't an admin
-	if userPatch.Password != nil && !allows(user.Role, schema.PermissionModifyAllUsers) {
+	if userPatch.Password != nil && !admin {
 		if userPatch.OldPassword == nil {
 			return echo.NewHTTPError(http.StatusBadRequest, errors.NewValidationError("oldPassword", "string"))
 		}
-		if user, err = db.GetUserByCreds(user.Username, *userPatch.OldPassword); user == nil {
+		if u, err := db.GetUserByCreds(ctx, user.Username, *userPatch.OldPassword); err != nil || u == nil {
 			return echo.ErrUnauthorized
 		}
 	}
 
+	// The new password is checked against the username and email it ends up with
+	if userPatch.Password != nil {
+		username, email := target.Username, target.Email
+		if userPatch.Username != nil {
+			username = *userPatch.Username
+		}
+		if userPatch.Email != nil {
+			email = *userPatch.Email
+		}
+		if err := checkPassword(*userPatch.Password, username, email); err != nil {
+			return err
+		}
+	}
+
+	// A new email replaces the old one once it is confirmed, unless an
+	// admin sets it, then it starts out unverified
+	var pending *string
+	if userPatch.Email != nil && *userPatch.Email == target.Email {
+		userPatch.Email = nil
+	}
+	if userPatch.Email != nil && !admin {
+		if err := checkEmailFree(ctx, db, target, *userPatch.Email); err != nil {
+			return err
+		}
+		pending, userPatch.Email = userPatch.Email, nil
+	} else if userPatch.Email != nil && userPatch.EmailVerified == nil {
+		unverified := false
+		userPatch.EmailVerified = &unverified
+	}
+
 	// Try to update user
-	if user, err = db.UpdateUser(user.ID.Hex(), userPatch); err != nil {
+	u := target
+	if pending == nil || !userPatch.Empty() {
+		diff := schema.DiffUser(target, userPatch)
+		if u, err = db.UpdateUser(ctx, target.ID.Hex(), userPatch, version); err != nil {
+			return errors.MongoErrorResponse(err)
+		}
+		audit(c, schema.AuditUserUpdate, user, u, diff)
+		if userPatch.Password != nil {
+			if err := revokeCredentials(ctx, db, target.ID.Hex()); err != nil {
+				return errors.MongoErrorResponse(err)
+			}
+		}
+	}
+
+	if pending != nil {
+		if err := sendVerification(c, u, schema.EmailTokenChange, *pending); err != nil {
+			return err
+		}
+		return jsonWithETag(c, http.StatusAccepted, u)
+	}
+	if userPatch.Email != nil && !u.EmailVerified {
+		if err := sendVerification(c, u, schema.EmailTokenVerify, u.Email); err != nil {
+			return err
+		}
+	}
+	return jsonWithETag(c, http.StatusOK, u)
+}
+
+// checkEmailFree tells whether target can take email
+//   error is 409 if another user has it
+func checkEmailFree(ctx context.Context, db store.UserStore, target *schema.UserSecure, email string) error {
+	other, err := db.GetUserByEmail(ctx, email)
+	if err == store.ErrNotFound {
+		return nil
+	}
+	if err != nil {
 		return errors.MongoErrorResponse(err)
 	}
-	return c.JSON(http.StatusOK, user)
+	if other.ID == target.ID {
+		return nil
+	}
+	return errors.MongoErrorResponse(errors.NewConflictError("user", "email", email))
 }
 
+// DeleteUser tombstones a user
+//   If-Match with the ETag of GET /users/:userID guards against lost updates
 func DeleteUser(c echo.Context) error {
 	userID := c.Param("userID")
 
@@ -200,23 +394,63 @@ func DeleteUser(c echo.Context) error {
 	}
 
 	// Only allow roles who have permission to ModifyAllUsers
-	if user.ID.Hex() != userID && !allows(user.Role, schema.PermissionModifyAllUsers) {
+	if user.ID.Hex() != userID && user.Username != userID && !allows(c, user, schema.PermissionModifyAllUsers) {
 		return echo.ErrForbidden
 	}
 
 	// Establish db connection
-	db, err := store.NewMongoStore()
+	db := getStore(c)
+	ctx := c.Request().Context()
+
+	// Find the user being deleted
+	target, err := findUser(ctx, db, userID)
 	if err != nil {
 		return errors.MongoErrorResponse(err)
 	}
-	defer db.Cleanup()
+	// Personal tokens can't delete their own account
+	if target.ID == user.ID && viaPersonalToken(c) {
+		return echo.ErrForbidden
+	}
+
+	version, err := ifMatch(c, target)
+	if err != nil {
+		return err
+	}
 
 	// Try to delete user
-	u, err := db.DeleteUser(user.ID.Hex())
+	u, err := db.DeleteUser(ctx, target.ID.Hex(), version)
 	if err != nil {
 		return errors.MongoErrorResponse(err)
 	}
+	audit(c, schema.AuditUserDelete, user, u, nil)
+
+	return c.JSON(http.StatusOK, u)
+}
+
+// PostRestoreUser brings back a deleted user by id
+//   available to roles with ModifyAllUsers permission
+func PostRestoreUser(c echo.Context) error {
+	userID := c.Param("userID")
+
+	// Type assert user from context and authorize
+	user, ok := c.Get("user").(*schema.UserSecure)
+	if !ok {
+		return echo.ErrUnauthorized
+	}
+	if !allows(c, user, schema.PermissionModifyAllUsers) {
+		return echo.ErrForbidden
+	}
+
+	// Establish db connection
+	db := getStore(c)
+	ctx := c.Request().Context()
 
+	// Try to restore user
+	u, err := db.RestoreUser(ctx, userID)
+	if err != nil {
+		return errors.MongoErrorResponse(err)
+	}
+	audit(c, schema.AuditUserRestore, user, u, nil)
 	return c.JSON(http.StatusOK, u)
 }
 
@@ -226,4 +460,5 @@ func initUsers(api *echo.Group) {
 	api.GET("/users/:userID", GetUserByUserID, DoJWTAuth)
 	api.PATCH("/users/:userID", PatchUser, DoJWTAuth)
 	api.DELETE("/users/:userID", DeleteUser, DoJWTAuth)
+	api.POST("/users/:userID/restore", PostRestoreUser, DoJWTAuth)
 }
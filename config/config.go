@@ -2,6 +2,10 @@ package config
 
 import (
 	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/mgutz/logxi/v1"
 	"github.com/spf13/viper"
@@ -11,23 +15,152 @@ const (
 	AppName        = "bt"
 	ConfigFileName = "bt-config"
 
-	defaultMongoAuth     = "mongo:btmongo"
-	defaultMongoHost     = "localhost:27017"
-	defaultMongoDatabase = "bt"
-	defaultWWWHost       = "https://localhost:8889"
-
-	envWWWHost       = "WWW_HOST"
-	envMongoAuth     = "MONGO_AUTH"
-	envMongoHost     = "MONGO_HOST"
-	envMongoDatabase = "MONGO_DATABASE"
-	envSecret        = "SECRET"
-	envTesting       = "TESTING"
+	defaultStoreDriver    = "mongo"
+	defaultSQLDSN         = "bt.db"
+	defaultMongoAuth      = "mongo:btmongo"
+	defaultMongoHost      = "localhost:27017"
+	defaultMongoDatabase  = "bt"
+	defaultWWWHost        = "https://localhost:8889"
+	defaultMigrateOnStart = true
+	defaultPurgeAfter     = 30
+	defaultPurgeInterval  = "1h"
+	defaultAccessTTL      = "1h"
+	defaultRefreshTTL     = "720h"
+	defaultJWTIssuer      = "bt"
+	defaultJWTAudience    = "bt"
+	defaultJWTLegacy      = true
+	defaultJWTRoleClaims  = true
+	defaultWebAuthnRPName = AppName
+	defaultMailFrom       = "no-reply@localhost"
+	defaultResetTTL       = "1h"
+	defaultVerifyTTL      = "72h"
+	defaultVerifyResend   = "1m"
+	defaultVerifyRequired = false
+	defaultLockUser       = 5
+	defaultLockIP         = 50
+	defaultLockBase       = "1m"
+	defaultLockMax        = "1h"
+	defaultLockWindow     = "24h"
+	defaultRateStore      = "memory"
+	defaultPasswordHash   = "bcrypt"
+	defaultBcryptCost     = 10
+	defaultArgon2Time     = 3
+	defaultArgon2Memory   = 64 * 1024
+	defaultArgon2Threads  = 2
+	defaultPwLength       = 8
+	defaultPwClasses      = 1
+	defaultPwStrength     = 1
+	defaultCookie         = false
+	defaultCookieSite     = "strict"
+
+	envStoreDriver    = "STORE_DRIVER"
+	envSQLDSN         = "SQL_DSN"
+	envWWWHost        = "WWW_HOST"
+	envMongoAuth      = "MONGO_AUTH"
+	envMongoHost      = "MONGO_HOST"
+	envMongoDatabase  = "MONGO_DATABASE"
+	envSecret         = "SECRET"
+	envTesting        = "TESTING"
+	envMigrateOnStart = "MIGRATE_ON_START"
+	envPurgeAfter     = "PURGE_AFTER_DAYS"
+	envPurgeInterval  = "PURGE_INTERVAL"
+	envAccessTTL      = "ACCESS_TOKEN_TTL"
+	envRefreshTTL     = "REFRESH_TOKEN_TTL"
+	envJWTSigningKey  = "JWT_SIGNING_KEY"
+	envJWTVerifyKeys  = "JWT_VERIFY_KEYS"
+	envJWTIssuer      = "JWT_ISSUER"
+	envJWTAudience    = "JWT_AUDIENCE"
+	envJWTLegacy      = "JWT_LEGACY_CLAIMS"
+	envJWTRoleClaims  = "JWT_ROLE_CLAIMS"
+	envOIDCProviders  = "OIDC_PROVIDERS"
+	envWebAuthnRPID   = "WEBAUTHN_RP_ID"
+	envWebAuthnRPName = "WEBAUTHN_RP_NAME"
+	envWebAuthnOrigin = "WEBAUTHN_ORIGIN"
+	envSMTPAddr       = "SMTP_ADDR"
+	envSMTPUsername   = "SMTP_USERNAME"
+	envSMTPPassword   = "SMTP_PASSWORD"
+	envMailFrom       = "MAIL_FROM"
+	envResetURL       = "PASSWORD_RESET_URL"
+	envResetTTL       = "PASSWORD_RESET_TTL"
+	envVerifyURL      = "EMAIL_VERIFY_URL"
+	envVerifyTTL      = "EMAIL_VERIFY_TTL"
+	envVerifyResend   = "EMAIL_VERIFY_RESEND_INTERVAL"
+	envVerifyRequired = "REQUIRE_VERIFIED_EMAIL"
+	envLockUser       = "LOGIN_LOCKOUT_THRESHOLD"
+	envLockIP         = "LOGIN_LOCKOUT_IP_THRESHOLD"
+	envLockBase       = "LOGIN_LOCKOUT_BASE"
+	envLockMax        = "LOGIN_LOCKOUT_MAX"
+	envLockWindow     = "LOGIN_FAILURE_WINDOW"
+	envTrustedProxies = "TRUSTED_PROXIES"
+	envRateLimits     = "RATE_LIMITS"
+	envRateStore      = "RATE_LIMIT_STORE"
+	envPasswordHash   = "PASSWORD_HASHER"
+	envBcryptCost     = "BCRYPT_COST"
+	envArgon2Time     = "ARGON2_TIME"
+	envArgon2Memory   = "ARGON2_MEMORY"
+	envArgon2Threads  = "ARGON2_THREADS"
+	envPwLength       = "PASSWORD_MIN_LENGTH"
+	envPwClasses      = "PASSWORD_MIN_CLASSES"
+	envPwStrength     = "PASSWORD_MIN_STRENGTH"
+	envBreached       = "BREACHED_PASSWORDS"
+	envCookie         = "SESSION_COOKIE"
+	envCookieDomain   = "SESSION_COOKIE_DOMAIN"
+	envCookieSite     = "SESSION_COOKIE_SAMESITE"
 )
 
 var (
 	logger = log.New("config")
+
+	// defaultRateLimits guard the routes anyone can call
+	defaultRateLimits = []map[string]interface{}{
+		{"route": "POST /users", "limit": 10, "period": "1h", "by": "ip"},
+		{"route": "GET /login", "limit": 30, "period": "1m", "by": "ip"},
+		{"route": "POST /login/2fa", "limit": 10, "period": "1m", "by": "ip"},
+		{"route": "POST /password/forgot", "limit": 5, "period": "1h", "by": "ip"},
+	}
 )
 
+// OIDCProvider configures an upstream OpenID Connect identity provider
+// users can log in with
+type OIDCProvider struct {
+	// Issuer is where /.well-known/openid-configuration is found
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the public url of /api/v1/auth/:provider/callback
+	RedirectURL string
+	// Scopes are requested along with openid
+	Scopes []string
+	// Provision creates a user with Role for subjects that aren't linked yet
+	Provision bool
+	Role      string
+}
+
+// RateLimit lets Limit requests to Route through per Period, counted
+// apart per By
+type RateLimit struct {
+	// Route is the method and path of a route under /api/v1 as it is
+	// registered, e.g. GET /users/:userID, or * for the routes no other
+	// rate limit names
+	Route  string
+	Limit  int
+	Period time.Duration
+	// By is ip, user (the user of the session or BasicAuth) or key (the
+	// personal access token), the last two fall back to ip
+	By string
+}
+
+// GetStoreDriver returns the backend users are kept in, one of
+// mongo, postgres or sqlite3
+func GetStoreDriver() string {
+	return viper.GetString(envStoreDriver)
+}
+
+// GetSQLDSN returns the data source name handed to the sql driver
+func GetSQLDSN() string {
+	return viper.GetString(envSQLDSN)
+}
+
 func GetMongoDatabase() string {
 	return viper.GetString(envMongoDatabase)
 }
@@ -47,6 +180,292 @@ func GetWWWHost() string {
 	return viper.GetString(envWWWHost)
 }
 
+// GetWebAuthnOrigin returns the origin passkeys are used from,
+// env.WWW_HOST unless set
+func GetWebAuthnOrigin() string {
+	if origin := viper.GetString(envWebAuthnOrigin); len(origin) > 0 {
+		return strings.TrimSuffix(origin, "/")
+	}
+	if host := GetWWWHost(); len(host) > 0 {
+		return strings.TrimSuffix(host, "/")
+	}
+	return defaultWWWHost
+}
+
+// GetWebAuthnRPID returns the relying party id passkeys are scoped to,
+// the host of the origin unless set
+func GetWebAuthnRPID() string {
+	if id := viper.GetString(envWebAuthnRPID); len(id) > 0 {
+		return id
+	}
+	u, err := url.Parse(GetWebAuthnOrigin())
+	if err != nil {
+		logger.Warn("bad webauthn origin", "err", err)
+		return ""
+	}
+	return u.Hostname()
+}
+
+// GetWebAuthnRPName returns the name authenticators show for the service
+func GetWebAuthnRPName() string {
+	return viper.GetString(envWebAuthnRPName)
+}
+
+// GetSMTPAddr returns the host:port of the SMTP server mail is sent
+// through, mail is only logged if it is empty
+func GetSMTPAddr() string {
+	return viper.GetString(envSMTPAddr)
+}
+
+// GetSMTPAuth returns the credentials for the SMTP server, none if the
+// username is empty
+func GetSMTPAuth() (string, string) {
+	return viper.GetString(envSMTPUsername), viper.GetString(envSMTPPassword)
+}
+
+// GetMailFrom returns the sender of the mail the service sends
+func GetMailFrom() string {
+	return viper.GetString(envMailFrom)
+}
+
+// GetPasswordResetURL returns the page of the frontend password reset
+// links point at, WWW_HOST/reset-password unless set
+func GetPasswordResetURL() string {
+	if u := viper.GetString(envResetURL); len(u) > 0 {
+		return u
+	}
+	host := GetWWWHost()
+	if len(host) == 0 {
+		host = defaultWWWHost
+	}
+	return strings.TrimSuffix(host, "/") + "/reset-password"
+}
+
+// GetPasswordResetTTL returns how long a password reset link works
+func GetPasswordResetTTL() time.Duration {
+	return viper.GetDuration(envResetTTL)
+}
+
+// GetEmailVerifyURL returns the page of the frontend email verification
+// links point at, WWW_HOST/verify-email unless set
+func GetEmailVerifyURL() string {
+	if u := viper.GetString(envVerifyURL); len(u) > 0 {
+		return u
+	}
+	host := GetWWWHost()
+	if len(host) == 0 {
+		host = defaultWWWHost
+	}
+	return strings.TrimSuffix(host, "/") + "/verify-email"
+}
+
+// GetEmailVerifyTTL returns how long an email verification link works
+func GetEmailVerifyTTL() time.Duration {
+	return viper.GetDuration(envVerifyTTL)
+}
+
+// GetEmailVerifyResendInterval returns how long a user waits before
+// another verification link is sent
+func GetEmailVerifyResendInterval() time.Duration {
+	return viper.GetDuration(envVerifyResend)
+}
+
+// GetRequireVerifiedEmail reports whether users have to verify their
+// email before they can log in
+func GetRequireVerifiedEmail() bool {
+	return viper.GetBool(envVerifyRequired)
+}
+
+// GetLoginLockoutThresholds returns after how many failed logins an
+// account and a source IP are locked out, 0 never locks
+func GetLoginLockoutThresholds() (int, int) {
+	return viper.GetInt(envLockUser), viper.GetInt(envLockIP)
+}
+
+// GetLoginLockout returns how long the first lockout lasts and the most
+// any lasts, every failed login past the threshold doubles it
+func GetLoginLockout() (time.Duration, time.Duration) {
+	return viper.GetDuration(envLockBase), viper.GetDuration(envLockMax)
+}
+
+// GetLoginFailureWindow returns how long failed logins are counted after
+// the last one
+func GetLoginFailureWindow() time.Duration {
+	return viper.GetDuration(envLockWindow)
+}
+
+// GetTrustedProxies returns the comma separated IPs and CIDRs of the
+// proxies whose X-Forwarded-For and X-Real-IP headers are believed, the
+// client IP is the address of the connection if there are none
+func GetTrustedProxies() []*net.IPNet {
+	nets := []*net.IPNet{}
+	for _, p := range strings.Split(viper.GetString(envTrustedProxies), ",") {
+		if p = strings.TrimSpace(p); len(p) == 0 {
+			continue
+		}
+		if !strings.Contains(p, "/") {
+			if ip := net.ParseIP(p); ip != nil && ip.To4() != nil {
+				p += "/32"
+			} else {
+				p += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			logger.Warn("bad trusted proxy", "proxy", p, "err", err)
+			continue
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// GetRateLimits returns the rate limits of the routes, they can only be
+// set in the config file and an empty list turns rate limiting off
+func GetRateLimits() []RateLimit {
+	limits := []RateLimit{}
+	if err := viper.UnmarshalKey(envRateLimits, &limits); err != nil {
+		logger.Warn("bad rate limits", "err", err)
+	}
+	return limits
+}
+
+// GetRateLimitStore returns where the rate limits are counted, memory for
+// each replica on its own or shared for all of them in the store
+func GetRateLimitStore() string {
+	return viper.GetString(envRateStore)
+}
+
+// GetMigrateOnStart reports whether pending migrations are applied when
+// the store connects, turn it off to only migrate with -migrate
+func GetMigrateOnStart() bool {
+	return viper.GetBool(envMigrateOnStart)
+}
+
+// GetPurgeAfter returns how long deleted users are kept before they are
+// removed for good, zero keeps them forever
+func GetPurgeAfter() time.Duration {
+	return time.Duration(viper.GetInt(envPurgeAfter)) * 24 * time.Hour
+}
+
+// GetPurgeInterval returns how often deleted users are checked for removal
+func GetPurgeInterval() time.Duration {
+	return viper.GetDuration(envPurgeInterval)
+}
+
+// GetAccessTokenTTL returns how long a jwt session is valid
+func GetAccessTokenTTL() time.Duration {
+	return viper.GetDuration(envAccessTTL)
+}
+
+// GetRefreshTokenTTL returns how long a refresh token can be exchanged
+// for a new session, rotating it does not extend the family
+func GetRefreshTokenTTL() time.Duration {
+	return viper.GetDuration(envRefreshTTL)
+}
+
+// GetJWTSigningKey returns the path of the PEM private key sessions are
+// signed with, sessions are signed with the secret if it is empty
+func GetJWTSigningKey() string {
+	return viper.GetString(envJWTSigningKey)
+}
+
+// GetJWTVerifyKeys returns the comma separated paths of PEM keys that
+// sessions are still accepted from, such as the previous signing key
+func GetJWTVerifyKeys() []string {
+	paths := []string{}
+	for _, p := range strings.Split(viper.GetString(envJWTVerifyKeys), ",") {
+		if p = strings.TrimSpace(p); len(p) > 0 {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// GetJWTIssuer returns the iss claim of sessions, sessions of other issuers are rejected
+func GetJWTIssuer() string {
+	return viper.GetString(envJWTIssuer)
+}
+
+// GetJWTAudience returns the aud claim of sessions, sessions for other audiences are rejected
+func GetJWTAudience() string {
+	return viper.GetString(envJWTAudience)
+}
+
+// GetJWTLegacyClaims reports whether sessions that carry the user id in aud
+// instead of sub are still accepted, turn it off once they have all expired
+func GetJWTLegacyClaims() bool {
+	return viper.GetBool(envJWTLegacy)
+}
+
+// GetJWTRoleClaims reports whether sessions carry the role and permissions
+// of the user so that other services can authorize without asking for it
+func GetJWTRoleClaims() bool {
+	return viper.GetBool(envJWTRoleClaims)
+}
+
+// GetOIDCProviders returns the upstream identity providers by name, they
+// can only be set in the config file
+func GetOIDCProviders() map[string]OIDCProvider {
+	providers := map[string]OIDCProvider{}
+	if err := viper.UnmarshalKey(envOIDCProviders, &providers); err != nil {
+		logger.Warn("bad oidc providers", "err", err)
+	}
+	return providers
+}
+
+// GetPasswordHasher returns the name of the algorithm new passwords are hashed with
+func GetPasswordHasher() string {
+	return viper.GetString(envPasswordHash)
+}
+
+func GetBcryptCost() int {
+	return viper.GetInt(envBcryptCost)
+}
+
+func GetArgon2Time() int {
+	return viper.GetInt(envArgon2Time)
+}
+
+// GetArgon2Memory returns the argon2id memory cost in KiB
+func GetArgon2Memory() int {
+	return viper.GetInt(envArgon2Memory)
+}
+
+func GetArgon2Threads() int {
+	return viper.GetInt(envArgon2Threads)
+}
+
+// GetPasswordPolicy returns the least length, number of character classes
+// and strength, from 0 to 4, new passwords must have
+func GetPasswordPolicy() (length, classes, strength int) {
+	return viper.GetInt(envPwLength), viper.GetInt(envPwClasses), viper.GetInt(envPwStrength)
+}
+
+// GetBreachedPasswords returns the directory of the breached password
+// hashes new passwords are checked against, none if empty
+func GetBreachedPasswords() string {
+	return viper.GetString(envBreached)
+}
+
+// GetSessionCookie reports whether logins also set the session in cookies,
+// for browsers to send instead of an Authorization header
+func GetSessionCookie() bool {
+	return viper.GetBool(envCookie)
+}
+
+// GetSessionCookieDomain returns the domain of the session cookies, the
+// host of the api if empty
+func GetSessionCookieDomain() string {
+	return viper.GetString(envCookieDomain)
+}
+
+// GetSessionCookieSameSite returns the SameSite of the session cookies,
+// strict, lax or none
+func GetSessionCookieSameSite() string {
+	return strings.ToLower(viper.GetString(envCookieSite))
+}
+
 func IsTesting() bool {
 	return viper.GetBool(envTesting)
 }
@@ -54,9 +473,43 @@ func IsTesting() bool {
 func init() {
 	// Set default values
 	viper.SetEnvPrefix(AppName)
+	viper.SetDefault(envStoreDriver, defaultStoreDriver)
+	viper.SetDefault(envSQLDSN, defaultSQLDSN)
 	viper.SetDefault(envMongoAuth, defaultMongoAuth)
 	viper.SetDefault(envMongoHost, defaultMongoHost)
 	viper.SetDefault(envMongoDatabase, defaultMongoDatabase)
+	viper.SetDefault(envMigrateOnStart, defaultMigrateOnStart)
+	viper.SetDefault(envPurgeAfter, defaultPurgeAfter)
+	viper.SetDefault(envPurgeInterval, defaultPurgeInterval)
+	viper.SetDefault(envAccessTTL, defaultAccessTTL)
+	viper.SetDefault(envRefreshTTL, defaultRefreshTTL)
+	viper.SetDefault(envJWTIssuer, defaultJWTIssuer)
+	viper.SetDefault(envJWTAudience, defaultJWTAudience)
+	viper.SetDefault(envJWTLegacy, defaultJWTLegacy)
+	viper.SetDefault(envJWTRoleClaims, defaultJWTRoleClaims)
+	viper.SetDefault(envWebAuthnRPName, defaultWebAuthnRPName)
+	viper.SetDefault(envMailFrom, defaultMailFrom)
+	viper.SetDefault(envResetTTL, defaultResetTTL)
+	viper.SetDefault(envVerifyTTL, defaultVerifyTTL)
+	viper.SetDefault(envVerifyResend, defaultVerifyResend)
+	viper.SetDefault(envVerifyRequired, defaultVerifyRequired)
+	viper.SetDefault(envLockUser, defaultLockUser)
+	viper.SetDefault(envLockIP, defaultLockIP)
+	viper.SetDefault(envLockBase, defaultLockBase)
+	viper.SetDefault(envLockMax, defaultLockMax)
+	viper.SetDefault(envLockWindow, defaultLockWindow)
+	viper.SetDefault(envRateLimits, defaultRateLimits)
+	viper.SetDefault(envRateStore, defaultRateStore)
+	viper.SetDefault(envPasswordHash, defaultPasswordHash)
+	viper.SetDefault(envBcryptCost, defaultBcryptCost)
+	viper.SetDefault(envArgon2Time, defaultArgon2Time)
+	viper.SetDefault(envArgon2Memory, defaultArgon2Memory)
+	viper.SetDefault(envArgon2Threads, defaultArgon2Threads)
+	viper.SetDefault(envPwLength, defaultPwLength)
+	viper.SetDefault(envPwClasses, defaultPwClasses)
+	viper.SetDefault(envPwStrength, defaultPwStrength)
+	viper.SetDefault(envCookie, defaultCookie)
+	viper.SetDefault(envCookieSite, defaultCookieSite)
 	viper.AutomaticEnv()
 
 	// Set config files
@@ -1,13 +1,20 @@
 package errors
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/labstack/echo"
-	"gopkg.in/mgo.v2"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
+// ErrVersionMismatch is returned when a write expected another version
+// of the document than the one stored
+var ErrVersionMismatch = fmt.Errorf("version mismatch")
+
 type ConflictError struct {
 	error
 	Type  string
@@ -42,15 +49,55 @@ func (err ValidationError) Error() string {
 	return fmt.Sprintf("%v field is required as %v", err.Field, err.Type)
 }
 
+// Violation is a rule of a policy a value breaks
+type Violation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// PolicyError lists every rule of a policy the value of Field breaks,
+// it is the body of the 400 response as is
+type PolicyError struct {
+	Message    string      `json:"message"`
+	Field      string      `json:"field"`
+	Violations []Violation `json:"violations"`
+}
+
+func NewPolicyError(field string, violations []Violation) *PolicyError {
+	return &PolicyError{
+		Message:    fmt.Sprintf("%v field breaks the policy", field),
+		Field:      field,
+		Violations: violations,
+	}
+}
+
+func (err PolicyError) Error() string {
+	rules := []string{}
+	for _, v := range err.Violations {
+		rules = append(rules, v.Message)
+	}
+	return fmt.Sprintf("%v: %v", err.Message, strings.Join(rules, ", "))
+}
+
 func MongoErrorResponse(err error) error {
-	if err == mgo.ErrNotFound {
+	if errors.Is(err, mongo.ErrNoDocuments) {
 		return echo.NewHTTPError(http.StatusNotFound, err.Error())
 	}
-	if mgo.IsDup(err) {
+	if mongo.IsDuplicateKeyError(err) {
 		return echo.NewHTTPError(http.StatusConflict, err.Error())
 	}
+	if err == ErrVersionMismatch {
+		return echo.NewHTTPError(http.StatusPreconditionFailed, err.Error())
+	}
 	if conflict, ok := err.(*ConflictError); ok {
 		return echo.NewHTTPError(http.StatusConflict, conflict.Error())
 	}
+	if policy, ok := err.(*PolicyError); ok {
+		return echo.NewHTTPError(http.StatusBadRequest, policy)
+	}
+	// The request was cancelled or ran out of time before the database answered
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, err.Error())
+	}
 	return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 }
@@ -1,11 +1,14 @@
 package errors
 
 import (
+	"context"
 	"fmt"
+	"net/http"
 	"testing"
 
+	"github.com/labstack/echo"
 	"github.com/stretchr/testify/assert"
-	"gopkg.in/mgo.v2"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 func Test001_Conflict(t *testing.T) {
@@ -20,12 +23,32 @@ func Test002_Validation(t *testing.T) {
 
 func Test003_Mongo(t *testing.T) {
 	var err error
-	err = MongoErrorResponse(mgo.ErrNotFound)
-	assert.Equal(t, "code=404, message=not found", err.Error())
+	err = MongoErrorResponse(mongo.ErrNoDocuments)
+	assert.Equal(t, "code=404, message=mongo: no documents in result", err.Error())
+
+	dup := mongo.WriteException{WriteErrors: []mongo.WriteError{{Code: 11000, Message: "E11000 duplicate key"}}}
+	err = MongoErrorResponse(dup)
+	assert.Equal(t, "code=409, message="+dup.Error(), err.Error())
 
 	err = MongoErrorResponse(NewConflictError("foo", "bar", "baz"))
 	assert.Equal(t, "code=409, message=foo with bar as baz already exists", err.Error())
 
+	err = MongoErrorResponse(ErrVersionMismatch)
+	assert.Equal(t, "code=412, message=version mismatch", err.Error())
+
+	err = MongoErrorResponse(fmt.Errorf("find: %w", context.DeadlineExceeded))
+	assert.Equal(t, "code=503, message=find: context deadline exceeded", err.Error())
+
 	err = MongoErrorResponse(fmt.Errorf("foo"))
 	assert.Equal(t, "code=500, message=foo", err.Error())
 }
+
+func Test004_Policy(t *testing.T) {
+	err := NewPolicyError("foo", []Violation{{Rule: "bar", Message: "is bar"}, {Rule: "baz", Message: "is baz"}})
+	assert.Equal(t, "foo field breaks the policy: is bar, is baz", err.Error())
+
+	res, ok := MongoErrorResponse(err).(*echo.HTTPError)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+	assert.Equal(t, err, res.Message)
+}
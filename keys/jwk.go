@@ -0,0 +1,155 @@
+package keys
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+// JWK is the public half of a key as published in a JWKS (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC and OKP
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKS is the document served at /.well-known/jwks.json
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// publicJWK returns the required members of the jwk of pub
+func publicJWK(pub crypto.PublicKey) (JWK, error) {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return JWK{Kty: "RSA", N: encode(pub.N.Bytes()), E: encode(big.NewInt(int64(pub.E)).Bytes())}, nil
+	case *ecdsa.PublicKey:
+		// Coordinates are padded to the size of the curve
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		x, y := make([]byte, size), make([]byte, size)
+		pub.X.FillBytes(x)
+		pub.Y.FillBytes(y)
+		return JWK{Kty: "EC", Crv: pub.Curve.Params().Name, X: encode(x), Y: encode(y)}, nil
+	case ed25519.PublicKey:
+		return JWK{Kty: "OKP", Crv: "Ed25519", X: encode(pub)}, nil
+	}
+	return JWK{}, fmt.Errorf("unsupported key type %T", pub)
+}
+
+// thumbprint returns the RFC 7638 sha256 thumbprint of pub
+func thumbprint(pub crypto.PublicKey) (string, error) {
+	jwk, err := publicJWK(pub)
+	if err != nil {
+		return "", err
+	}
+	// Only the required members in lexicographic order, which is the
+	// order encoding/json writes map keys in
+	members := map[string]string{"kty": jwk.Kty}
+	switch jwk.Kty {
+	case "RSA":
+		members["n"], members["e"] = jwk.N, jwk.E
+	case "EC":
+		members["crv"], members["x"], members["y"] = jwk.Crv, jwk.X, jwk.Y
+	case "OKP":
+		members["crv"], members["x"] = jwk.Crv, jwk.X
+	}
+	b, err := json.Marshal(members)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return encode(sum[:]), nil
+}
+
+// JWK returns the public jwk of k
+func (k *Key) JWK() JWK {
+	// NewKey already encoded the public key once, this can't fail
+	jwk, _ := publicJWK(k.Public)
+	jwk.Kid = k.ID
+	jwk.Use = "sig"
+	jwk.Alg = k.Method.Alg()
+	return jwk
+}
+
+func decode(member, s string) ([]byte, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, fmt.Errorf("bad jwk member %v", member)
+	}
+	return b, nil
+}
+
+// ParseJWK returns the public key of jwk, whose ID is its thumbprint and
+// not its kid
+func ParseJWK(jwk JWK) (*Key, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decode("n", jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode("e", jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return NewKey(&rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())})
+	case "EC":
+		if jwk.Crv != elliptic.P256().Params().Name {
+			return nil, fmt.Errorf("unsupported jwk curve %v", jwk.Crv)
+		}
+		x, err := decode("x", jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode("y", jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, fmt.Errorf("jwk point is not on the curve")
+		}
+		return NewKey(pub)
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported jwk curve %v", jwk.Crv)
+		}
+		x, err := decode("x", jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("bad jwk member x")
+		}
+		return NewKey(ed25519.PublicKey(x))
+	}
+	return nil, fmt.Errorf("unsupported jwk type %v", jwk.Kty)
+}
+
+// JWKS returns the public keys of every key of s
+func (s *Set) JWKS() *JWKS {
+	set := &JWKS{Keys: []JWK{}}
+	for _, k := range s.keys {
+		set.Keys = append(set.Keys, k.JWK())
+	}
+	return set
+}
@@ -0,0 +1,190 @@
+package keys
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/golang-jwt/jwt/v4"
+
+	"github.com/briansan/user-go/config"
+)
+
+// Key is an asymmetric jwt key known by its kid
+type Key struct {
+	// ID is the RFC 7638 thumbprint of the public key, sent as the kid header
+	ID     string
+	Method jwt.SigningMethod
+	Public crypto.PublicKey
+	// Private is nil for keys that only verify
+	Private crypto.PrivateKey
+}
+
+// NewKey wraps a private or public RSA, P-256 ECDSA or Ed25519 key
+// and picks RS256, ES256 or EdDSA to go with it
+func NewKey(k interface{}) (*Key, error) {
+	key := &Key{}
+	switch k := k.(type) {
+	case *rsa.PrivateKey:
+		key.Private, key.Public = k, &k.PublicKey
+	case *ecdsa.PrivateKey:
+		key.Private, key.Public = k, &k.PublicKey
+	case ed25519.PrivateKey:
+		key.Private, key.Public = k, k.Public()
+	case *ed25519.PrivateKey:
+		key.Private, key.Public = *k, k.Public()
+	default:
+		key.Public = k
+	}
+
+	switch pub := key.Public.(type) {
+	case *rsa.PublicKey:
+		key.Method = jwt.SigningMethodRS256
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("unsupported ecdsa curve %v", pub.Curve.Params().Name)
+		}
+		key.Method = jwt.SigningMethodES256
+	case ed25519.PublicKey:
+		key.Method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", k)
+	}
+
+	id, err := thumbprint(key.Public)
+	if err != nil {
+		return nil, err
+	}
+	key.ID = id
+	return key, nil
+}
+
+// ParsePEM reads the first PEM block of data as a private key
+// (PKCS #8, PKCS #1 or SEC 1) or a public key (PKIX or PKCS #1)
+func ParsePEM(data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no pem block found")
+	}
+
+	var k interface{}
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		k, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		k, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		k, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		k, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		k, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported pem block %v", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewKey(k)
+}
+
+// LoadFile reads a PEM encoded key from path
+func LoadFile(path string) (*Key, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ParsePEM(data)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return key, nil
+}
+
+// Set holds the key new tokens are signed with and every key tokens are
+// still accepted from, so that a retired key keeps verifying the tokens
+// it signed until they expire
+type Set struct {
+	signing *Key
+	keys    []*Key
+}
+
+// NewSet returns the set signing with signing, which has to have a private
+// key, and verifying with it and the others
+func NewSet(signing *Key, others ...*Key) (*Set, error) {
+	if signing.Private == nil {
+		return nil, fmt.Errorf("signing key %v has no private key", signing.ID)
+	}
+	s := &Set{signing: signing, keys: []*Key{signing}}
+	for _, k := range others {
+		if s.Get(k.ID) == nil {
+			s.keys = append(s.keys, k)
+		}
+	}
+	return s, nil
+}
+
+// FromConfig loads the set of env.JWT_SIGNING_KEY and env.JWT_VERIFY_KEYS
+// returns nil if no signing key is set, tokens are then signed with env.SECRET
+func FromConfig() (*Set, error) {
+	path := config.GetJWTSigningKey()
+	if len(path) == 0 {
+		return nil, nil
+	}
+	signing, err := LoadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	others := []*Key{}
+	for _, path := range config.GetJWTVerifyKeys() {
+		k, err := LoadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		others = append(others, k)
+	}
+	return NewSet(signing, others...)
+}
+
+// Signing returns the key new tokens are signed with
+func (s *Set) Signing() *Key {
+	return s.signing
+}
+
+// Get returns the key with kid id or nil
+func (s *Set) Get(id string) *Key {
+	for _, k := range s.keys {
+		if k.ID == id {
+			return k
+		}
+	}
+	return nil
+}
+
+// Sign returns the signed token of claims with the kid header set
+func (s *Set) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(s.signing.Method, claims)
+	token.Header["kid"] = s.signing.ID
+	return token.SignedString(s.signing.Private)
+}
+
+// Keyfunc picks the key to verify token by its kid header
+// error if the kid is unknown or the alg isn't the one of the key
+func (s *Set) Keyfunc(token *jwt.Token) (interface{}, error) {
+	id, _ := token.Header["kid"].(string)
+	k := s.Get(id)
+	if k == nil {
+		return nil, fmt.Errorf("unknown kid %q", id)
+	}
+	if token.Method.Alg() != k.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %v for kid %q", token.Header["alg"], id)
+	}
+	return k.Public, nil
+}
@@ -0,0 +1,137 @@
+package keys
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test001_Thumbprint(t *testing.T) {
+	// RFC 8037 appendix A.3
+	x, err := base64.RawURLEncoding.DecodeString("11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo")
+	assert.Nil(t, err)
+	k, err := NewKey(ed25519.PublicKey(x))
+	assert.Nil(t, err)
+	assert.Equal(t, "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k", k.ID)
+	assert.Equal(t, jwt.SigningMethodEdDSA, k.Method)
+	assert.Nil(t, k.Private)
+}
+
+func Test002_ParsePEM(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	pkcs8 := func(k interface{}) []byte {
+		b, err := x509.MarshalPKCS8PrivateKey(k)
+		assert.Nil(t, err)
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b})
+	}
+	pkix := func(k interface{}) []byte {
+		b, err := x509.MarshalPKIXPublicKey(k)
+		assert.Nil(t, err)
+		return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: b})
+	}
+	ecDER, _ := x509.MarshalECPrivateKey(ecKey)
+
+	for alg, pair := range map[string][2][]byte{
+		"RS256": {pkcs8(rsaKey), pkix(&rsaKey.PublicKey)},
+		"ES256": {pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER}), pkix(&ecKey.PublicKey)},
+		"EdDSA": {pkcs8(edKey), pkix(edKey.Public())},
+	} {
+		private, err := ParsePEM(pair[0])
+		assert.Nil(t, err, alg)
+		assert.Equal(t, alg, private.Method.Alg())
+		assert.NotNil(t, private.Private)
+
+		// Both halves share the kid
+		public, err := ParsePEM(pair[1])
+		assert.Nil(t, err, alg)
+		assert.Equal(t, private.ID, public.ID)
+		assert.Nil(t, public.Private)
+	}
+
+	// Other curves and garbage
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	_, err := ParsePEM(pkcs8(p384))
+	assert.NotNil(t, err)
+	_, err = ParsePEM([]byte("garbage"))
+	assert.NotNil(t, err)
+}
+
+func Test003_Rotation(t *testing.T) {
+	_, oldKey, _ := ed25519.GenerateKey(rand.Reader)
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	old, _ := NewKey(oldKey)
+	current, _ := NewKey(newKey)
+	claims := &jwt.StandardClaims{Subject: "foo", ExpiresAt: time.Now().Add(time.Hour).Unix()}
+
+	// Verify-only keys can't sign
+	public, _ := NewKey(oldKey.Public())
+	_, err := NewSet(public)
+	assert.NotNil(t, err)
+
+	before, err := NewSet(old)
+	assert.Nil(t, err)
+	oldToken, err := before.Sign(claims)
+	assert.Nil(t, err)
+
+	// The retired key still verifies, the new one signs with its kid
+	after, err := NewSet(current, public)
+	assert.Nil(t, err)
+	newToken, err := after.Sign(claims)
+	assert.Nil(t, err)
+	for _, ss := range []string{oldToken, newToken} {
+		token, err := jwt.ParseWithClaims(ss, &jwt.StandardClaims{}, after.Keyfunc)
+		assert.Nil(t, err)
+		assert.True(t, token.Valid)
+	}
+	token, _ := jwt.Parse(newToken, after.Keyfunc)
+	assert.Equal(t, current.ID, token.Header["kid"])
+	assert.Equal(t, "ES256", token.Header["alg"])
+
+	// Tokens of dropped keys are rejected
+	_, err = jwt.Parse(newToken, before.Keyfunc)
+	assert.NotNil(t, err)
+
+	// The jwks publishes both public keys
+	jwks := after.JWKS()
+	assert.Len(t, jwks.Keys, 2)
+	assert.Equal(t, JWK{Kty: "EC", Kid: current.ID, Use: "sig", Alg: "ES256", Crv: "P-256",
+		X: jwks.Keys[0].X, Y: jwks.Keys[0].Y}, jwks.Keys[0])
+	assert.Len(t, jwks.Keys[0].X, 43)
+	assert.Equal(t, "OKP", jwks.Keys[1].Kty)
+	assert.Equal(t, old.ID, jwks.Keys[1].Kid)
+}
+
+func Test004_ParseJWK(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	// Every published key parses back to the same public key
+	for _, k := range []interface{}{rsaKey, ecKey, edKey} {
+		key, err := NewKey(k)
+		assert.Nil(t, err)
+		parsed, err := ParseJWK(key.JWK())
+		assert.Nil(t, err)
+		assert.Equal(t, key.ID, parsed.ID)
+		assert.Equal(t, key.Method, parsed.Method)
+		assert.Nil(t, parsed.Private)
+	}
+
+	_, err := ParseJWK(JWK{Kty: "EC", Crv: "P-256", X: "AQ", Y: "AQ"})
+	assert.NotNil(t, err)
+	_, err = ParseJWK(JWK{Kty: "oct"})
+	assert.NotNil(t, err)
+}
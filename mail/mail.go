@@ -0,0 +1,142 @@
+// Package mail sends the plain text mail of the service, such as password
+// reset links, through SMTP
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/mgutz/logxi/v1"
+
+	"github.com/briansan/user-go/config"
+)
+
+var (
+	logger = log.New("mail")
+)
+
+// Message is a plain text mail to one recipient
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends messages
+type Mailer interface {
+	Send(ctx context.Context, m *Message) error
+}
+
+// FromConfig returns the mailer of env.SMTP_ADDR, or one that only logs
+// mail if it is empty
+func FromConfig() Mailer {
+	addr := config.GetSMTPAddr()
+	if len(addr) == 0 {
+		return Log{}
+	}
+	s := &SMTP{Addr: addr, From: config.GetMailFrom()}
+	if username, password := config.GetSMTPAuth(); len(username) > 0 {
+		host, _, _ := net.SplitHostPort(addr)
+		s.Auth = smtp.PlainAuth("", username, password, host)
+	}
+	return s
+}
+
+// format returns m as the data of a mail from from
+func (m *Message) format(from string) ([]byte, error) {
+	if strings.ContainsAny(m.To, "\r\n") || strings.ContainsAny(from, "\r\n") {
+		return nil, fmt.Errorf("line break in address")
+	}
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "From: %s\r\n", from)
+	fmt.Fprintf(b, "To: %s\r\n", m.To)
+	fmt.Fprintf(b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	for _, line := range strings.Split(m.Body, "\n") {
+		b.WriteString(strings.TrimSuffix(line, "\r") + "\r\n")
+	}
+	return b.Bytes(), nil
+}
+
+// SMTP sends mail through an SMTP server, upgrading to TLS if the server
+// offers STARTTLS
+type SMTP struct {
+	Addr string
+	From string
+	// Auth is nil for servers that don't ask for credentials
+	Auth smtp.Auth
+}
+
+// Send delivers m, giving up when ctx is done
+func (s *SMTP) Send(ctx context.Context, m *Message) error {
+	data, err := m.format(s.From)
+	if err != nil {
+		return err
+	}
+
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	host, _, _ := net.SplitHostPort(s.Addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if s.Auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return fmt.Errorf("smtp server doesn't support AUTH")
+		}
+		if err := c.Auth(s.Auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(s.From); err != nil {
+		return err
+	}
+	if err := c.Rcpt(m.To); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// Log writes mail to the log instead of sending it, for development
+type Log struct{}
+
+// Send logs m
+func (Log) Send(ctx context.Context, m *Message) error {
+	logger.Info("mail not sent, SMTP_ADDR is empty", "to", m.To, "subject", m.Subject, "body", m.Body)
+	return nil
+}
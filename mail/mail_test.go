@@ -0,0 +1,93 @@
+package mail
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// smtpServer is an SMTP stand-in that accepts one mail per connection and
+// hands over what it was given
+func smtpServer(t *testing.T) (string, <-chan []string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+
+		lines, data := []string{}, false
+		reply("220 localhost ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			lines = append(lines, line)
+			switch {
+			case data && line == ".":
+				data = false
+				reply("250 ok")
+			case data:
+			case strings.HasPrefix(line, "EHLO"):
+				reply("250 localhost")
+			case strings.HasPrefix(line, "DATA"):
+				data = true
+				reply("354 go ahead")
+			case strings.HasPrefix(line, "QUIT"):
+				reply("221 bye")
+				received <- lines
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	return l.Addr().String(), received
+}
+
+func Test001_SMTP(t *testing.T) {
+	addr, received := smtpServer(t)
+	s := &SMTP{Addr: addr, From: "bt@example.com"}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := s.Send(ctx, &Message{To: "foo@example.com", Subject: "Réinitialiser", Body: "line 1\nline 2"})
+	assert.Nil(t, err)
+
+	lines := <-received
+	assert.Contains(t, lines, "MAIL FROM:<bt@example.com>")
+	assert.Contains(t, lines, "RCPT TO:<foo@example.com>")
+	assert.Contains(t, lines, "To: foo@example.com")
+	assert.Contains(t, lines, "Subject: =?utf-8?q?R=C3=A9initialiser?=")
+	assert.Contains(t, lines, "line 2")
+
+	// Headers can't be smuggled in through the address
+	err = s.Send(ctx, &Message{To: "foo@example.com\r\nBcc: bar@example.com"})
+	assert.NotNil(t, err)
+}
+
+func Test002_Memory(t *testing.T) {
+	m := &Memory{}
+	assert.Nil(t, m.Last("foo@example.com"))
+	m.Send(context.Background(), &Message{To: "foo@example.com", Subject: "1"})
+	m.Send(context.Background(), &Message{To: "bar@example.com", Subject: "2"})
+	m.Send(context.Background(), &Message{To: "foo@example.com", Subject: "3"})
+	assert.Equal(t, "3", m.Last("foo@example.com").Subject)
+	assert.Len(t, m.Sent(), 3)
+}
@@ -0,0 +1,43 @@
+package mail
+
+import (
+	"context"
+	"sync"
+)
+
+// Memory keeps the mail it is given, for tests
+type Memory struct {
+	mu   sync.Mutex
+	sent []*Message
+}
+
+// Send records a copy of m
+func (mm *Memory) Send(ctx context.Context, m *Message) error {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+
+	c := *m
+	mm.sent = append(mm.sent, &c)
+	return nil
+}
+
+// Sent returns the mail sent so far, oldest first
+func (mm *Memory) Sent() []*Message {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+
+	return append([]*Message{}, mm.sent...)
+}
+
+// Last returns the last mail sent to to, nil if there is none
+func (mm *Memory) Last(to string) *Message {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+
+	for i := len(mm.sent) - 1; i >= 0; i-- {
+		if mm.sent[i].To == to {
+			return mm.sent[i]
+		}
+	}
+	return nil
+}
@@ -1,17 +1,76 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+
 	"github.com/briansan/user-go/api"
+	"github.com/briansan/user-go/config"
+	"github.com/briansan/user-go/migrations"
 	"github.com/briansan/user-go/store"
 )
 
-const ()
+var (
+	migrate   = flag.String("migrate", "", "run migrations and exit: up, down or status")
+	migrateTo = flag.Int("to", migrations.Latest, "version to migrate up or down to, down defaults to one step")
+)
+
+// runMigrations carries out the -migrate command
+func runMigrations(ctx context.Context, command string, target int) error {
+	runner, cleanup, err := store.OpenMigrations(ctx)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	switch command {
+	case "up":
+		return runner.Up(ctx, target)
+	case "down":
+		if target == migrations.Latest {
+			statuses, err := runner.Status(ctx)
+			if err != nil {
+				return err
+			}
+			target = migrations.Current(statuses) - 1
+		}
+		return runner.Down(ctx, target)
+	case "status":
+		statuses, err := runner.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%4d  %-19s  %v\n", s.Version, applied, s.Description)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown migrate command %v", command)
+}
 
 func main() {
-	err := store.InitMongoSession()
+	flag.Parse()
+	ctx := context.Background()
+	if len(*migrate) > 0 {
+		if err := runMigrations(ctx, *migrate, *migrateTo); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	db, err := store.Open(ctx)
 	if err != nil {
 		panic(err)
 	}
+	defer db.Cleanup()
+
+	// Remove expired tokens, sessions and rate limit state, and deleted users for good once they're old enough
+	defer store.StartPurge(db, config.GetPurgeAfter(), config.GetPurgeInterval())()
 
-	api.New().Start(":8888")
+	api.New(db).Start(":8888")
 }
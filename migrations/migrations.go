@@ -0,0 +1,158 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/mgutz/logxi/v1"
+)
+
+const (
+	// Latest targets the newest known migration
+	Latest = -1
+)
+
+var (
+	logger = log.New("migrations")
+
+	// ErrIrreversible is returned by Down when a migration can't be reverted
+	ErrIrreversible = fmt.Errorf("migration can't be reverted")
+)
+
+// Status is a known migration and when it was applied, nil if pending
+type Status struct {
+	Version     int        `json:"version"`
+	Description string     `json:"description"`
+	AppliedAt   *time.Time `json:"appliedAt,omitempty"`
+}
+
+// Runner applies and reverts the migrations of one database
+type Runner interface {
+	// Up applies every pending migration up to and including target in order
+	Up(ctx context.Context, target int) error
+	// Down reverts every applied migration above target in reverse order
+	Down(ctx context.Context, target int) error
+	// Status lists every known migration in order
+	Status(ctx context.Context) ([]Status, error)
+}
+
+// backend is what a runner needs of a database
+type backend interface {
+	// applied returns when each recorded version was applied
+	applied(ctx context.Context) (map[int]time.Time, error)
+	// up applies migration i of the backend's list and records it
+	up(ctx context.Context, i int) error
+	// down reverts migration i of the backend's list and forgets it
+	down(ctx context.Context, i int) error
+}
+
+// step is the part of a migration the runner plans with
+type step struct {
+	Version     int
+	Description string
+}
+
+// runner plans runs over the ordered steps of a backend
+type runner struct {
+	b     backend
+	steps []step
+}
+
+func newRunner(b backend, steps []step) *runner {
+	for i := 1; i < len(steps); i++ {
+		if steps[i].Version <= steps[i-1].Version {
+			panic(fmt.Sprintf("migration %v is out of order", steps[i].Version))
+		}
+	}
+	return &runner{b: b, steps: steps}
+}
+
+func (r *runner) Up(ctx context.Context, target int) error {
+	applied, err := r.b.applied(ctx)
+	if err != nil {
+		return err
+	}
+	for i, s := range r.steps {
+		if target != Latest && s.Version > target {
+			break
+		}
+		if _, ok := applied[s.Version]; ok {
+			continue
+		}
+		logger.Info("applying migration", "version", s.Version, "description", s.Description)
+		if err := r.b.up(ctx, i); err != nil {
+			return fmt.Errorf("migration %v (%v): %v", s.Version, s.Description, err)
+		}
+	}
+	return nil
+}
+
+func (r *runner) Down(ctx context.Context, target int) error {
+	applied, err := r.b.applied(ctx)
+	if err != nil {
+		return err
+	}
+	for i := len(r.steps) - 1; i >= 0; i-- {
+		s := r.steps[i]
+		if s.Version <= target {
+			break
+		}
+		if _, ok := applied[s.Version]; !ok {
+			continue
+		}
+		logger.Info("reverting migration", "version", s.Version, "description", s.Description)
+		if err := r.b.down(ctx, i); err != nil {
+			return fmt.Errorf("migration %v (%v): %v", s.Version, s.Description, err)
+		}
+	}
+	return nil
+}
+
+func (r *runner) Status(ctx context.Context) ([]Status, error) {
+	applied, err := r.b.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	statuses := []Status{}
+	for _, s := range r.steps {
+		status := Status{Version: s.Version, Description: s.Description}
+		if t, ok := applied[s.Version]; ok {
+			status.AppliedAt = &t
+		}
+		statuses = append(statuses, status)
+	}
+
+	// Recorded versions this build doesn't know about, e.g. after a rollback
+	for v, t := range applied {
+		if !r.known(v) {
+			t := t
+			statuses = append(statuses, Status{Version: v, Description: "unknown", AppliedAt: &t})
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Version < statuses[j].Version
+	})
+	return statuses, nil
+}
+
+func (r *runner) known(version int) bool {
+	for _, s := range r.steps {
+		if s.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// Current returns the highest applied version in statuses, 0 if none
+func Current(statuses []Status) int {
+	current := 0
+	for _, s := range statuses {
+		if s.AppliedAt != nil && s.Version > current {
+			current = s.Version
+		}
+	}
+	return current
+}
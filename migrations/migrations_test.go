@@ -0,0 +1,130 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func openTestSQLRunner(t *testing.T) (*sql.DB, Runner) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	assert.Nil(t, err)
+	db.SetMaxOpenConns(1)
+
+	runner, err := NewSQLRunner(context.Background(), db, "sqlite3")
+	assert.Nil(t, err)
+	return db, runner
+}
+
+func Test001_SQLUpDown(t *testing.T) {
+	ctx := context.Background()
+	db, runner := openTestSQLRunner(t)
+	defer db.Close()
+
+	// Nothing applied yet
+	statuses, err := runner.Status(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, len(SQL), len(statuses))
+	assert.Equal(t, 0, Current(statuses))
+
+	// Up to a target
+	assert.Nil(t, runner.Up(ctx, 2))
+	statuses, err = runner.Status(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, Current(statuses))
+	assert.NotNil(t, statuses[1].AppliedAt)
+	assert.Nil(t, statuses[2].AppliedAt)
+
+	// Up is repeatable
+	assert.Nil(t, runner.Up(ctx, Latest))
+	assert.Nil(t, runner.Up(ctx, Latest))
+	statuses, _ = runner.Status(ctx)
+	assert.Equal(t, SQL[len(SQL)-1].Version, Current(statuses))
+	_, err = db.Exec(`INSERT INTO users (id, username, version) VALUES ('000000000000000000000000', 'foo', 1)`)
+	assert.Nil(t, err)
+
+	// Down to 3 drops the audit log and the purge index only
+	assert.Nil(t, runner.Down(ctx, 3))
+	statuses, _ = runner.Status(ctx)
+	assert.Equal(t, 3, Current(statuses))
+	var version int
+	assert.Nil(t, db.QueryRow(`SELECT version FROM users`).Scan(&version))
+	assert.Equal(t, 1, version)
+
+	// Down to nothing drops the table
+	assert.Nil(t, runner.Down(ctx, 0))
+	statuses, _ = runner.Status(ctx)
+	assert.Equal(t, 0, Current(statuses))
+	_, err = db.Exec(`SELECT 1 FROM users`)
+	assert.NotNil(t, err)
+}
+
+// fakeBackend records calls instead of touching a database
+type fakeBackend struct {
+	done  map[int]bool
+	calls []int
+	fail  int
+}
+
+func (b *fakeBackend) applied(ctx context.Context) (map[int]time.Time, error) {
+	applied := map[int]time.Time{}
+	for v := range b.done {
+		applied[v] = time.Now()
+	}
+	return applied, nil
+}
+
+func (b *fakeBackend) up(ctx context.Context, i int) error {
+	if i == b.fail {
+		return fmt.Errorf("boom")
+	}
+	b.calls = append(b.calls, i)
+	b.done[fakeSteps[i].Version] = true
+	return nil
+}
+
+func (b *fakeBackend) down(ctx context.Context, i int) error {
+	if i == b.fail {
+		return ErrIrreversible
+	}
+	b.calls = append(b.calls, -i)
+	delete(b.done, fakeSteps[i].Version)
+	return nil
+}
+
+var fakeSteps = []step{{1, "a"}, {2, "b"}, {5, "c"}}
+
+func Test002_Runner(t *testing.T) {
+	ctx := context.Background()
+	b := &fakeBackend{done: map[int]bool{2: true}, fail: -1}
+	r := newRunner(b, fakeSteps)
+
+	// Gaps are filled in order and applied ones skipped
+	assert.Nil(t, r.Up(ctx, Latest))
+	assert.Equal(t, []int{0, 2}, b.calls)
+
+	// Down reverts in reverse order above the target
+	b.calls = nil
+	assert.Nil(t, r.Down(ctx, 1))
+	assert.Equal(t, []int{-2, -1}, b.calls)
+
+	// Failures stop the run
+	b.fail = 1
+	assert.NotNil(t, r.Up(ctx, Latest))
+	statuses, _ := r.Status(ctx)
+	assert.Equal(t, 1, Current(statuses))
+	b.fail = 0
+	assert.NotNil(t, r.Down(ctx, 0))
+	statuses, _ = r.Status(ctx)
+	assert.Equal(t, 1, Current(statuses))
+
+	// Out of order steps are a programming error
+	assert.Panics(t, func() {
+		newRunner(b, []step{{2, "b"}, {1, "a"}})
+	})
+}
@@ -0,0 +1,442 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/briansan/user-go/config"
+	"github.com/briansan/user-go/password"
+)
+
+const (
+	mongoCollectionName          = "migrations"
+	usersCollectionName          = "users"
+	auditCollectionName          = "audit"
+	refreshTokensCollectionName  = "refreshTokens"
+	revokedTokensCollectionName  = "revokedTokens"
+	oauthClientsCollectionName   = "oauthClients"
+	authCodesCollectionName      = "authCodes"
+	identitiesCollectionName     = "identities"
+	passkeysCollectionName       = "passkeys"
+	personalTokensCollectionName = "personalTokens"
+	emailTokensCollectionName    = "emailTokens"
+	loginFailuresCollectionName  = "loginFailures"
+	rateBucketsCollectionName    = "rateBuckets"
+	sessionsCollectionName       = "sessions"
+)
+
+// MongoMigration is one ordered step of the mongo schema
+// a nil Down can't be reverted
+type MongoMigration struct {
+	Version     int
+	Description string
+	Up          func(ctx context.Context, db *mongo.Database) error
+	Down        func(ctx context.Context, db *mongo.Database) error
+}
+
+// Mongo lists the mongo migrations in order
+// never edit a released migration, append a new one instead
+var Mongo = []MongoMigration{
+	{
+		Version:     1,
+		Description: "unique username index",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection(usersCollectionName).Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys:    bson.D{{Key: "username", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			})
+			return err
+		},
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection(usersCollectionName).Indexes().DropOne(ctx, "username_1")
+			return err
+		},
+	},
+	{
+		Version:     2,
+		Description: "unique email index",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			c := db.Collection(usersCollectionName)
+
+			// The index can only be built once existing duplicates are resolved
+			dups, err := findDuplicateEmails(ctx, c)
+			if err != nil {
+				return err
+			}
+			if len(dups) > 0 {
+				report := []string{}
+				for _, dup := range dups {
+					ids := []string{}
+					for _, id := range dup.IDs {
+						ids = append(ids, id.Hex())
+					}
+					report = append(report, fmt.Sprintf("%v (%v)", dup.Email, strings.Join(ids, ", ")))
+				}
+				return fmt.Errorf("emails shared by several users: %v", strings.Join(report, "; "))
+			}
+
+			_, err = c.Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys:    bson.D{{Key: "email", Value: 1}},
+				Options: options.Index().SetUnique(true).SetSparse(true),
+			})
+			return err
+		},
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection(usersCollectionName).Indexes().DropOne(ctx, "email_1")
+			return err
+		},
+	},
+	{
+		Version:     3,
+		Description: "backfill user versions",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection(usersCollectionName).UpdateMany(ctx,
+				bson.M{"version": bson.M{"$exists": false}},
+				bson.M{"$set": bson.M{"version": 1}},
+			)
+			return err
+		},
+		// Versions are harmless to keep around
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			return nil
+		},
+	},
+	{
+		Version:     4,
+		Description: "deletedAt index for the purge job",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection(usersCollectionName).Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys:    bson.D{{Key: "deletedAt", Value: 1}},
+				Options: options.Index().SetSparse(true),
+			})
+			return err
+		},
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection(usersCollectionName).Indexes().DropOne(ctx, "deletedAt_1")
+			return err
+		},
+	},
+	{
+		Version:     5,
+		Description: "wrap legacy sha256 password hashes in bcrypt",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			c := db.Collection(usersCollectionName)
+			w := &password.WrappedSHA256{Cost: config.GetBcryptCost()}
+
+			// Every modern hash starts with $
+			iter, err := c.Find(ctx,
+				bson.M{"password": bson.M{"$not": primitive.Regex{Pattern: `^\$`}}},
+				options.Find().SetProjection(bson.M{"password": 1}))
+			if err != nil {
+				return err
+			}
+			defer iter.Close(ctx)
+
+			doc := struct {
+				ID       primitive.ObjectID `bson:"_id"`
+				Password string             `bson:"password"`
+			}{}
+			for iter.Next(ctx) {
+				if err := iter.Decode(&doc); err != nil {
+					return err
+				}
+				if !password.IsLegacy(doc.Password) {
+					continue
+				}
+				wrapped, err := w.Wrap(doc.Password)
+				if err != nil {
+					return err
+				}
+				// Only replace the hash if a login didn't upgrade it meanwhile
+				_, err = c.UpdateOne(ctx, bson.M{"_id": doc.ID, "password": doc.Password}, bson.M{"$set": bson.M{"password": wrapped}})
+				if err != nil {
+					return err
+				}
+			}
+			return iter.Err()
+		},
+	},
+	{
+		Version:     6,
+		Description: "audit indexes by time, actor and target",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			models := []mongo.IndexModel{}
+			for _, keys := range auditIndexes {
+				models = append(models, mongo.IndexModel{Keys: keys})
+			}
+			_, err := db.Collection(auditCollectionName).Indexes().CreateMany(ctx, models)
+			return err
+		},
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			c := db.Collection(auditCollectionName)
+			for _, keys := range auditIndexes {
+				if _, err := c.Indexes().DropOne(ctx, indexName(keys)); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version:     7,
+		Description: "refresh and revoked token indexes",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection(refreshTokensCollectionName).Indexes().CreateMany(ctx, []mongo.IndexModel{
+				{Keys: bson.D{{Key: "hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+				{Keys: bson.D{{Key: "family", Value: 1}}},
+				{Keys: bson.D{{Key: "accessJTI", Value: 1}}},
+				{Keys: bson.D{{Key: "expiresAt", Value: 1}}},
+			})
+			if err != nil {
+				return err
+			}
+			_, err = db.Collection(revokedTokensCollectionName).Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys: bson.D{{Key: "expiresAt", Value: 1}},
+			})
+			return err
+		},
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			if _, err := db.Collection(refreshTokensCollectionName).Indexes().DropAll(ctx); err != nil {
+				return err
+			}
+			_, err := db.Collection(revokedTokensCollectionName).Indexes().DropAll(ctx)
+			return err
+		},
+	},
+	{
+		Version:     8,
+		Description: "oauth client and authorization code indexes",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection(oauthClientsCollectionName).Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys: bson.D{{Key: "createdAt", Value: 1}},
+			})
+			if err != nil {
+				return err
+			}
+			_, err = db.Collection(authCodesCollectionName).Indexes().CreateMany(ctx, []mongo.IndexModel{
+				{Keys: bson.D{{Key: "hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+				{Keys: bson.D{{Key: "expiresAt", Value: 1}}},
+			})
+			return err
+		},
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			if _, err := db.Collection(oauthClientsCollectionName).Indexes().DropAll(ctx); err != nil {
+				return err
+			}
+			_, err := db.Collection(authCodesCollectionName).Indexes().DropAll(ctx)
+			return err
+		},
+	},
+	{
+		Version:     9,
+		Description: "identity indexes",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection(identitiesCollectionName).Indexes().CreateMany(ctx, []mongo.IndexModel{
+				{Keys: bson.D{{Key: "provider", Value: 1}, {Key: "subject", Value: 1}}, Options: options.Index().SetUnique(true)},
+				{Keys: bson.D{{Key: "userID", Value: 1}, {Key: "createdAt", Value: 1}}},
+			})
+			return err
+		},
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection(identitiesCollectionName).Indexes().DropAll(ctx)
+			return err
+		},
+	},
+	{
+		Version:     10,
+		Description: "passkey indexes",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection(passkeysCollectionName).Indexes().CreateMany(ctx, []mongo.IndexModel{
+				{Keys: bson.D{{Key: "credentialID", Value: 1}}, Options: options.Index().SetUnique(true)},
+				{Keys: bson.D{{Key: "userID", Value: 1}, {Key: "createdAt", Value: 1}}},
+			})
+			return err
+		},
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection(passkeysCollectionName).Indexes().DropAll(ctx)
+			return err
+		},
+	},
+	{
+		Version:     11,
+		Description: "personal token indexes",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection(personalTokensCollectionName).Indexes().CreateMany(ctx, []mongo.IndexModel{
+				{Keys: bson.D{{Key: "hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+				{Keys: bson.D{{Key: "userID", Value: 1}, {Key: "createdAt", Value: 1}}},
+				{Keys: bson.D{{Key: "expiresAt", Value: 1}}},
+			})
+			return err
+		},
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection(personalTokensCollectionName).Indexes().DropAll(ctx)
+			return err
+		},
+	},
+	{
+		Version:     12,
+		Description: "email token indexes",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection(emailTokensCollectionName).Indexes().CreateMany(ctx, []mongo.IndexModel{
+				{Keys: bson.D{{Key: "hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+				{Keys: bson.D{{Key: "userID", Value: 1}, {Key: "purpose", Value: 1}}},
+				{Keys: bson.D{{Key: "expiresAt", Value: 1}}},
+			})
+			return err
+		},
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection(emailTokensCollectionName).Indexes().DropAll(ctx)
+			return err
+		},
+	},
+	{
+		Version:     13,
+		Description: "login failure indexes",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection(loginFailuresCollectionName).Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys: bson.D{{Key: "expiresAt", Value: 1}},
+			})
+			return err
+		},
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection(loginFailuresCollectionName).Indexes().DropAll(ctx)
+			return err
+		},
+	},
+	{
+		Version:     14,
+		Description: "rate bucket indexes",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection(rateBucketsCollectionName).Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys: bson.D{{Key: "expiresAt", Value: 1}},
+			})
+			return err
+		},
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection(rateBucketsCollectionName).Indexes().DropAll(ctx)
+			return err
+		},
+	},
+	{
+		Version:     15,
+		Description: "session indexes",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection(sessionsCollectionName).Indexes().CreateMany(ctx, []mongo.IndexModel{
+				{Keys: bson.D{{Key: "userID", Value: 1}, {Key: "createdAt", Value: 1}}},
+				{Keys: bson.D{{Key: "expiresAt", Value: 1}}},
+			})
+			return err
+		},
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection(sessionsCollectionName).Indexes().DropAll(ctx)
+			return err
+		},
+	},
+}
+
+// auditIndexes serve FindAudit, which always sorts newest first
+var auditIndexes = []bson.D{
+	{{Key: "time", Value: -1}},
+	{{Key: "actor", Value: 1}, {Key: "time", Value: -1}},
+	{{Key: "target", Value: 1}, {Key: "time", Value: -1}},
+}
+
+// indexName returns the name mongo gives an index on keys by default
+func indexName(keys bson.D) string {
+	parts := []string{}
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%v_%v", k.Key, k.Value))
+	}
+	return strings.Join(parts, "_")
+}
+
+// duplicateEmail is an email shared by more than one user
+type duplicateEmail struct {
+	Email string               `bson:"_id"`
+	IDs   []primitive.ObjectID `bson:"ids"`
+}
+
+// findDuplicateEmails lists every email held by more than one user
+func findDuplicateEmails(ctx context.Context, c *mongo.Collection) ([]duplicateEmail, error) {
+	iter, err := c.Aggregate(ctx, []bson.M{
+		{"$match": bson.M{"email": bson.M{"$exists": true}}},
+		{"$group": bson.M{"_id": "$email", "ids": bson.M{"$push": "$_id"}, "count": bson.M{"$sum": 1}}},
+		{"$match": bson.M{"count": bson.M{"$gt": 1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	dups := []duplicateEmail{}
+	err = iter.All(ctx, &dups)
+	return dups, err
+}
+
+// mongoRecord is how an applied migration is kept in the migrations collection
+type mongoRecord struct {
+	Version     int       `bson:"_id"`
+	Description string    `bson:"description"`
+	AppliedAt   time.Time `bson:"appliedAt"`
+}
+
+// mongoBackend records applied versions in the migrations collection
+type mongoBackend struct {
+	db         *mongo.Database
+	migrations []MongoMigration
+}
+
+// NewMongoRunner returns the runner of the Mongo migrations on db
+func NewMongoRunner(db *mongo.Database) Runner {
+	steps := []step{}
+	for _, m := range Mongo {
+		steps = append(steps, step{Version: m.Version, Description: m.Description})
+	}
+	return newRunner(&mongoBackend{db: db, migrations: Mongo}, steps)
+}
+
+func (b *mongoBackend) applied(ctx context.Context) (map[int]time.Time, error) {
+	iter, err := b.db.Collection(mongoCollectionName).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	records := []mongoRecord{}
+	if err := iter.All(ctx, &records); err != nil {
+		return nil, err
+	}
+	applied := map[int]time.Time{}
+	for _, r := range records {
+		applied[r.Version] = r.AppliedAt
+	}
+	return applied, nil
+}
+
+func (b *mongoBackend) up(ctx context.Context, i int) error {
+	m := b.migrations[i]
+	if err := m.Up(ctx, b.db); err != nil {
+		return err
+	}
+	_, err := b.db.Collection(mongoCollectionName).InsertOne(ctx, &mongoRecord{
+		Version:     m.Version,
+		Description: m.Description,
+		AppliedAt:   time.Now().UTC(),
+	})
+	return err
+}
+
+func (b *mongoBackend) down(ctx context.Context, i int) error {
+	m := b.migrations[i]
+	if m.Down == nil {
+		return ErrIrreversible
+	}
+	if err := m.Down(ctx, b.db); err != nil {
+		return err
+	}
+	_, err := b.db.Collection(mongoCollectionName).DeleteOne(ctx, bson.M{"_id": m.Version})
+	return err
+}
@@ -0,0 +1,356 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"time"
+)
+
+const (
+	driverPostgres = "postgres"
+)
+
+// SQLMigration is one ordered step of the sql schema
+// an empty Down can't be reverted
+type SQLMigration struct {
+	Version     int
+	Description string
+	Up          string
+	Down        string
+}
+
+// SQL lists the sql migrations in order
+// never edit a released migration, append a new one instead
+var SQL = []SQLMigration{
+	{
+		Version:     1,
+		Description: "users table",
+		Up: `CREATE TABLE users (
+			id       CHAR(24) PRIMARY KEY,
+			username VARCHAR(255) NOT NULL,
+			password TEXT,
+			email    VARCHAR(255),
+			role     INTEGER NOT NULL DEFAULT 0,
+			CONSTRAINT users_username_key UNIQUE (username),
+			CONSTRAINT users_email_key UNIQUE (email)
+		)`,
+		Down: `DROP TABLE users`,
+	},
+	{
+		Version:     2,
+		Description: "users.deleted_at tombstone",
+		Up:          `ALTER TABLE users ADD COLUMN deleted_at TIMESTAMP`,
+		Down:        `ALTER TABLE users DROP COLUMN deleted_at`,
+	},
+	{
+		Version:     3,
+		Description: "users.version counter",
+		Up:          `ALTER TABLE users ADD COLUMN version INTEGER NOT NULL DEFAULT 0`,
+		Down:        `ALTER TABLE users DROP COLUMN version`,
+	},
+	{
+		Version:     4,
+		Description: "deleted_at index for the purge job",
+		Up:          `CREATE INDEX users_deleted_at_idx ON users (deleted_at)`,
+		Down:        `DROP INDEX users_deleted_at_idx`,
+	},
+	{
+		Version:     5,
+		Description: "audit_log table",
+		Up: `CREATE TABLE audit_log (
+			id         CHAR(24) PRIMARY KEY,
+			created_at TIMESTAMP NOT NULL,
+			action     VARCHAR(64) NOT NULL,
+			actor      CHAR(24),
+			target     CHAR(24),
+			diff       TEXT,
+			ip         VARCHAR(64) NOT NULL,
+			request_id VARCHAR(64) NOT NULL
+		);
+		CREATE INDEX audit_log_created_at_idx ON audit_log (created_at);
+		CREATE INDEX audit_log_actor_idx ON audit_log (actor, created_at);
+		CREATE INDEX audit_log_target_idx ON audit_log (target, created_at)`,
+		Down: `DROP TABLE audit_log`,
+	},
+	{
+		Version:     6,
+		Description: "refresh_tokens and revoked_tokens tables",
+		Up: `CREATE TABLE refresh_tokens (
+			id                CHAR(24) PRIMARY KEY,
+			hash              CHAR(64) NOT NULL,
+			family            VARCHAR(64) NOT NULL,
+			user_id           CHAR(24) NOT NULL,
+			access_jti        VARCHAR(64) NOT NULL,
+			access_expires_at TIMESTAMP NOT NULL,
+			created_at        TIMESTAMP NOT NULL,
+			expires_at        TIMESTAMP NOT NULL,
+			used_at           TIMESTAMP,
+			revoked_at        TIMESTAMP,
+			CONSTRAINT refresh_tokens_hash_key UNIQUE (hash)
+		);
+		CREATE INDEX refresh_tokens_family_idx ON refresh_tokens (family);
+		CREATE INDEX refresh_tokens_access_jti_idx ON refresh_tokens (access_jti);
+		CREATE INDEX refresh_tokens_expires_at_idx ON refresh_tokens (expires_at);
+		CREATE TABLE revoked_tokens (
+			jti        VARCHAR(64) PRIMARY KEY,
+			expires_at TIMESTAMP NOT NULL
+		);
+		CREATE INDEX revoked_tokens_expires_at_idx ON revoked_tokens (expires_at)`,
+		Down: `DROP TABLE revoked_tokens;
+		DROP TABLE refresh_tokens`,
+	},
+	{
+		Version:     7,
+		Description: "oauth_clients and oauth_codes tables",
+		Up: `CREATE TABLE oauth_clients (
+			client_id     VARCHAR(64) PRIMARY KEY,
+			secret_hash   CHAR(64),
+			name          VARCHAR(255) NOT NULL,
+			redirect_uris TEXT NOT NULL,
+			grant_types   TEXT NOT NULL,
+			scopes        TEXT NOT NULL,
+			created_at    TIMESTAMP NOT NULL
+		);
+		CREATE TABLE oauth_codes (
+			id             CHAR(24) PRIMARY KEY,
+			hash           CHAR(64) NOT NULL,
+			client_id      VARCHAR(64) NOT NULL,
+			user_id        CHAR(24) NOT NULL,
+			redirect_uri   TEXT NOT NULL,
+			scope          TEXT NOT NULL,
+			nonce          TEXT NOT NULL,
+			code_challenge VARCHAR(128) NOT NULL,
+			auth_time      TIMESTAMP NOT NULL,
+			expires_at     TIMESTAMP NOT NULL,
+			used_at        TIMESTAMP,
+			CONSTRAINT oauth_codes_hash_key UNIQUE (hash)
+		);
+		CREATE INDEX oauth_codes_expires_at_idx ON oauth_codes (expires_at)`,
+		Down: `DROP TABLE oauth_codes;
+		DROP TABLE oauth_clients`,
+	},
+	{
+		Version:     8,
+		Description: "identities table",
+		Up: `CREATE TABLE identities (
+			id         CHAR(24) PRIMARY KEY,
+			provider   VARCHAR(64) NOT NULL,
+			subject    VARCHAR(255) NOT NULL,
+			user_id    CHAR(24) NOT NULL,
+			email      VARCHAR(255),
+			created_at TIMESTAMP NOT NULL,
+			CONSTRAINT identities_provider_subject_key UNIQUE (provider, subject)
+		);
+		CREATE INDEX identities_user_id_idx ON identities (user_id)`,
+		Down: `DROP TABLE identities`,
+	},
+	{
+		Version:     9,
+		Description: "two_factor and recovery_codes tables",
+		Up: `CREATE TABLE two_factor (
+			user_id      CHAR(24) PRIMARY KEY,
+			secret       VARCHAR(64) NOT NULL,
+			created_at   TIMESTAMP NOT NULL,
+			confirmed_at TIMESTAMP,
+			last_step    BIGINT NOT NULL
+		);
+		CREATE TABLE recovery_codes (
+			user_id CHAR(24) NOT NULL,
+			hash    CHAR(64) NOT NULL,
+			PRIMARY KEY (user_id, hash)
+		)`,
+		Down: `DROP TABLE recovery_codes;
+		DROP TABLE two_factor`,
+	},
+	{
+		Version:     10,
+		Description: "passkeys table",
+		Up: `CREATE TABLE passkeys (
+			id            CHAR(24) PRIMARY KEY,
+			user_id       CHAR(24) NOT NULL,
+			credential_id VARCHAR(1400) NOT NULL,
+			public_key    TEXT NOT NULL,
+			sign_count    BIGINT NOT NULL,
+			transports    TEXT NOT NULL,
+			name          VARCHAR(255) NOT NULL,
+			created_at    TIMESTAMP NOT NULL,
+			last_used_at  TIMESTAMP,
+			CONSTRAINT passkeys_credential_id_key UNIQUE (credential_id)
+		);
+		CREATE INDEX passkeys_user_id_idx ON passkeys (user_id)`,
+		Down: `DROP TABLE passkeys`,
+	},
+	{
+		Version:     11,
+		Description: "personal_tokens table",
+		Up: `CREATE TABLE personal_tokens (
+			id           CHAR(24) PRIMARY KEY,
+			hash         CHAR(64) NOT NULL,
+			user_id      CHAR(24) NOT NULL,
+			name         VARCHAR(255) NOT NULL,
+			permissions  TEXT NOT NULL,
+			created_at   TIMESTAMP NOT NULL,
+			expires_at   TIMESTAMP NOT NULL,
+			last_used_at TIMESTAMP,
+			CONSTRAINT personal_tokens_hash_key UNIQUE (hash)
+		);
+		CREATE INDEX personal_tokens_user_id_idx ON personal_tokens (user_id);
+		CREATE INDEX personal_tokens_expires_at_idx ON personal_tokens (expires_at)`,
+		Down: `DROP TABLE personal_tokens`,
+	},
+	{
+		Version:     12,
+		Description: "email_tokens table",
+		Up: `CREATE TABLE email_tokens (
+			id         CHAR(24) PRIMARY KEY,
+			hash       CHAR(64) NOT NULL,
+			purpose    VARCHAR(32) NOT NULL,
+			user_id    CHAR(24) NOT NULL,
+			email      VARCHAR(255) NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			CONSTRAINT email_tokens_hash_key UNIQUE (hash)
+		);
+		CREATE INDEX email_tokens_user_id_idx ON email_tokens (user_id, purpose);
+		CREATE INDEX email_tokens_expires_at_idx ON email_tokens (expires_at)`,
+		Down: `DROP TABLE email_tokens`,
+	},
+	{
+		Version:     13,
+		Description: "users.email_verified column",
+		Up:          `ALTER TABLE users ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT FALSE`,
+		Down:        `ALTER TABLE users DROP COLUMN email_verified`,
+	},
+	{
+		Version:     14,
+		Description: "login_failures table",
+		Up: `CREATE TABLE login_failures (
+			subject      VARCHAR(320) PRIMARY KEY,
+			failures     INTEGER NOT NULL,
+			last_failure TIMESTAMP NOT NULL,
+			expires_at   TIMESTAMP NOT NULL
+		);
+		CREATE INDEX login_failures_expires_at_idx ON login_failures (expires_at)`,
+		Down: `DROP TABLE login_failures`,
+	},
+	{
+		Version:     15,
+		Description: "rate_buckets table",
+		Up: `CREATE TABLE rate_buckets (
+			bucket     VARCHAR(512) PRIMARY KEY,
+			tokens     DOUBLE PRECISION NOT NULL,
+			updated_at TIMESTAMP NOT NULL,
+			version    INTEGER NOT NULL,
+			expires_at TIMESTAMP NOT NULL
+		);
+		CREATE INDEX rate_buckets_expires_at_idx ON rate_buckets (expires_at)`,
+		Down: `DROP TABLE rate_buckets`,
+	},
+	{
+		Version:     16,
+		Description: "sessions table",
+		Up: `CREATE TABLE sessions (
+			id           CHAR(24) PRIMARY KEY,
+			user_id      CHAR(24) NOT NULL,
+			user_agent   VARCHAR(512) NOT NULL,
+			ip           VARCHAR(64) NOT NULL,
+			created_at   TIMESTAMP NOT NULL,
+			last_seen_at TIMESTAMP NOT NULL,
+			expires_at   TIMESTAMP NOT NULL
+		);
+		CREATE INDEX sessions_user_id_idx ON sessions (user_id);
+		CREATE INDEX sessions_expires_at_idx ON sessions (expires_at)`,
+		Down: `DROP TABLE sessions`,
+	},
+	{
+		Version:     17,
+		Description: "sessions.client_id column",
+		Up:          `ALTER TABLE sessions ADD COLUMN client_id VARCHAR(64) NOT NULL DEFAULT ''`,
+		Down:        `ALTER TABLE sessions DROP COLUMN client_id`,
+	},
+}
+
+// sqlBackend records applied versions in the schema_migrations table
+// every migration runs in a transaction together with its record
+type sqlBackend struct {
+	db         *sql.DB
+	driver     string
+	migrations []SQLMigration
+}
+
+// NewSQLRunner returns the runner of the sql migrations on db
+func NewSQLRunner(ctx context.Context, db *sql.DB, driver string) (Runner, error) {
+	b := &sqlBackend{db: db, driver: driver, migrations: SQL}
+	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL
+	)`); err != nil {
+		return nil, err
+	}
+
+	steps := []step{}
+	for _, m := range SQL {
+		steps = append(steps, step{Version: m.Version, Description: m.Description})
+	}
+	return newRunner(b, steps), nil
+}
+
+// placeholder returns the n-th (from 1) bind parameter of the driver
+func (b *sqlBackend) placeholder(n int) string {
+	if b.driver == driverPostgres {
+		return "$" + strconv.Itoa(n)
+	}
+	return "?"
+}
+
+func (b *sqlBackend) applied(ctx context.Context) (map[int]time.Time, error) {
+	rows, err := b.db.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var t time.Time
+		if err := rows.Scan(&version, &t); err != nil {
+			return nil, err
+		}
+		applied[version] = t
+	}
+	return applied, rows.Err()
+}
+
+// run executes stmt and then the bookkeeping query in one transaction
+func (b *sqlBackend) run(ctx context.Context, stmt, bookkeeping string, args ...interface{}) error {
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, stmt); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, bookkeeping, args...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (b *sqlBackend) up(ctx context.Context, i int) error {
+	m := b.migrations[i]
+	return b.run(ctx, m.Up,
+		`INSERT INTO schema_migrations (version, applied_at) VALUES (`+b.placeholder(1)+`, `+b.placeholder(2)+`)`,
+		m.Version, time.Now().UTC())
+}
+
+func (b *sqlBackend) down(ctx context.Context, i int) error {
+	m := b.migrations[i]
+	if len(m.Down) == 0 {
+		return ErrIrreversible
+	}
+	return b.run(ctx, m.Down, `DELETE FROM schema_migrations WHERE version = `+b.placeholder(1), m.Version)
+}
@@ -0,0 +1,246 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/mgutz/logxi/v1"
+
+	"github.com/briansan/user-go/config"
+	"github.com/briansan/user-go/keys"
+)
+
+const (
+	// keysRefreshInterval limits how often an unknown kid refetches the jwks
+	keysRefreshInterval = time.Minute
+)
+
+var (
+	logger = log.New("oidc")
+)
+
+// Metadata is the part of the discovery document of a provider in use
+type Metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// IDToken holds the verified claims of an id token used to find or
+// provision the local user
+type IDToken struct {
+	jwt.RegisteredClaims
+	Nonce             string `json:"nonce"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	PreferredUsername string `json:"preferred_username"`
+}
+
+// Provider is an upstream identity provider, its metadata and keys are
+// fetched on first use and cached
+type Provider struct {
+	Name   string
+	Config config.OIDCProvider
+	Client *http.Client
+
+	mu        sync.Mutex
+	metadata  *Metadata
+	keys      map[string]*keys.Key
+	fetchedAt time.Time
+}
+
+// New returns the provider name configured by c
+func New(name string, c config.OIDCProvider) *Provider {
+	return &Provider{Name: name, Config: c, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// FromConfig returns the providers of env.OIDC_PROVIDERS by name
+func FromConfig() map[string]*Provider {
+	providers := map[string]*Provider{}
+	for name, c := range config.GetOIDCProviders() {
+		providers[name] = New(name, c)
+	}
+	return providers
+}
+
+// getJSON decodes the json document at u into v
+func (p *Provider) getJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v: %v", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Metadata returns the discovery document of p
+// error if it can't be fetched or is for another issuer
+func (p *Provider) Metadata(ctx context.Context) (*Metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+	m := &Metadata{}
+	issuer := strings.TrimSuffix(p.Config.Issuer, "/")
+	if err := p.getJSON(ctx, issuer+"/.well-known/openid-configuration", m); err != nil {
+		return nil, err
+	}
+	if m.Issuer != p.Config.Issuer {
+		return nil, fmt.Errorf("discovery issuer %v is not %v", m.Issuer, p.Config.Issuer)
+	}
+	p.metadata = m
+	return m, nil
+}
+
+// key returns the key with kid id, the jwks is refetched if it is unknown
+func (p *Provider) key(ctx context.Context, id string) (*keys.Key, error) {
+	m, err := p.Metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if k, ok := p.keys[id]; ok {
+		return k, nil
+	}
+	if time.Since(p.fetchedAt) < keysRefreshInterval {
+		return nil, fmt.Errorf("unknown kid %q", id)
+	}
+
+	set := &keys.JWKS{}
+	if err := p.getJSON(ctx, m.JWKSURI, set); err != nil {
+		return nil, err
+	}
+	p.keys, p.fetchedAt = map[string]*keys.Key{}, time.Now()
+	for _, jwk := range set.Keys {
+		if len(jwk.Use) > 0 && jwk.Use != "sig" {
+			continue
+		}
+		k, err := keys.ParseJWK(jwk)
+		if err != nil {
+			logger.Warn("skipping jwk", "provider", p.Name, "kid", jwk.Kid, "err", err)
+			continue
+		}
+		p.keys[jwk.Kid] = k
+	}
+	if k, ok := p.keys[id]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown kid %q", id)
+}
+
+// AuthCodeURL returns where to send the user agent to log in
+// with state, nonce and the S256 PKCE challenge
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, challenge string) (string, error) {
+	m, err := p.Metadata(ctx)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(m.AuthorizationEndpoint)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.Config.ClientID)
+	q.Set("redirect_uri", p.Config.RedirectURL)
+	q.Set("scope", strings.Join(append([]string{"openid"}, p.Config.Scopes...), " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", challenge)
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// Exchange redeems code and its PKCE verifier at the token endpoint and
+// returns the verified id token
+func (p *Provider) Exchange(ctx context.Context, code, verifier, nonce string) (*IDToken, error) {
+	m, err := p.Metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.Config.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.Config.ClientID), url.QueryEscape(p.Config.ClientSecret))
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body := struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint: %v %v", body.Error, body.ErrorDescription)
+	}
+	return p.Verify(ctx, body.IDToken, nonce)
+}
+
+// Verify checks the signature, issuer, audience, expiry and nonce of raw
+func (p *Provider) Verify(ctx context.Context, raw, nonce string) (*IDToken, error) {
+	token := &IDToken{}
+	_, err := jwt.ParseWithClaims(raw, token, func(t *jwt.Token) (interface{}, error) {
+		id, _ := t.Header["kid"].(string)
+		k, err := p.key(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if t.Method.Alg() != k.Method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %v for kid %q", t.Header["alg"], id)
+		}
+		return k.Public, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !token.VerifyIssuer(p.Config.Issuer, true) {
+		return nil, fmt.Errorf("bad iss field")
+	}
+	if !token.VerifyAudience(p.Config.ClientID, true) {
+		return nil, fmt.Errorf("bad aud field")
+	}
+	if len(token.Subject) == 0 {
+		return nil, fmt.Errorf("no sub field")
+	}
+	if token.Nonce != nonce {
+		return nil, fmt.Errorf("bad nonce field")
+	}
+	return token, nil
+}
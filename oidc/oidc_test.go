@@ -0,0 +1,92 @@
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/briansan/user-go/config"
+	"github.com/briansan/user-go/oidc/oidctest"
+)
+
+func newTestProvider(idp *oidctest.IdP) *Provider {
+	return New("test", config.OIDCProvider{
+		Issuer:       idp.URL,
+		ClientID:     oidctest.ClientID,
+		ClientSecret: oidctest.ClientSecret,
+		RedirectURL:  "https://bt.example.com/cb",
+		Scopes:       []string{"email"},
+	})
+}
+
+func Test001_CodeFlow(t *testing.T) {
+	idp := oidctest.NewIdP()
+	defer idp.Close()
+	p := newTestProvider(idp)
+	ctx := context.Background()
+	idp.Login(jwt.MapClaims{"sub": "alice", "email": "alice@example.com", "email_verified": true})
+
+	// The authorization url carries the request
+	verifier := "a-verifier-that-is-long-enough-for-rfc-7636-purposes"
+	sum := sha256.Sum256([]byte(verifier))
+	u, err := p.AuthCodeURL(ctx, "state", "nonce", base64.RawURLEncoding.EncodeToString(sum[:]))
+	assert.Nil(t, err)
+	parsed, _ := url.Parse(u)
+	assert.Equal(t, "openid email", parsed.Query().Get("scope"))
+	assert.Equal(t, "https://bt.example.com/cb", parsed.Query().Get("redirect_uri"))
+
+	// Follow it to get a code
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(u)
+	assert.Nil(t, err)
+	location, _ := url.Parse(resp.Header.Get("Location"))
+	assert.Equal(t, "state", location.Query().Get("state"))
+	code := location.Query().Get("code")
+
+	_, err = p.Exchange(ctx, code, "wrong", "nonce")
+	assert.NotNil(t, err)
+
+	resp, _ = client.Get(u)
+	location, _ = url.Parse(resp.Header.Get("Location"))
+	token, err := p.Exchange(ctx, location.Query().Get("code"), verifier, "nonce")
+	assert.Nil(t, err)
+	assert.Equal(t, "alice", token.Subject)
+	assert.Equal(t, "alice@example.com", token.Email)
+	assert.True(t, token.EmailVerified)
+}
+
+func Test002_Verify(t *testing.T) {
+	idp := oidctest.NewIdP()
+	defer idp.Close()
+	p := newTestProvider(idp)
+	ctx := context.Background()
+
+	_, err := p.Verify(ctx, idp.Sign(jwt.MapClaims{"sub": "alice"}, "n"), "n")
+	assert.Nil(t, err)
+
+	// Nonce, audience, issuer, expiry and subject are checked
+	for _, claims := range []jwt.MapClaims{
+		{"sub": "alice", "nonce": "other"},
+		{"sub": "alice", "aud": "someone-else"},
+		{"sub": "alice", "iss": "https://evil.example.com"},
+		{"sub": "alice", "exp": time.Now().Add(-time.Minute).Unix()},
+		{},
+	} {
+		_, err := p.Verify(ctx, idp.Sign(claims, "n"), "n")
+		assert.NotNil(t, err, claims)
+	}
+
+	// Tokens of other keys are rejected
+	other := oidctest.NewIdP()
+	defer other.Close()
+	forged := other.Sign(jwt.MapClaims{"sub": "alice", "iss": idp.URL}, "n")
+	_, err = p.Verify(ctx, forged, "n")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,163 @@
+// Package oidctest runs a mock OpenID Connect identity provider for tests
+package oidctest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+
+	"github.com/briansan/user-go/keys"
+)
+
+const (
+	ClientID     = "bt"
+	ClientSecret = "bt-secret"
+)
+
+// IdP authorizes every request for the user set with Login right away
+// and issues id tokens signed with an ed25519 key
+type IdP struct {
+	*httptest.Server
+	Key *keys.Set
+
+	mu     sync.Mutex
+	claims jwt.MapClaims
+	codes  map[string]code
+}
+
+type code struct {
+	claims    jwt.MapClaims
+	challenge string
+	redirect  string
+}
+
+// NewIdP starts an IdP, close it when done
+func NewIdP() *IdP {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	k, err := keys.NewKey(private)
+	if err != nil {
+		panic(err)
+	}
+	set, err := keys.NewSet(k)
+	if err != nil {
+		panic(err)
+	}
+
+	idp := &IdP{Key: set, codes: map[string]code{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("/jwks", idp.jwks)
+	mux.HandleFunc("/authorize", idp.authorize)
+	mux.HandleFunc("/token", idp.token)
+	idp.Server = httptest.NewServer(mux)
+	return idp
+}
+
+// Login sets the user the next authorization is for by its claims,
+// sub at least
+func (idp *IdP) Login(claims jwt.MapClaims) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.claims = claims
+}
+
+// Sign returns an id token of claims with the usual ones filled in
+func (idp *IdP) Sign(claims jwt.MapClaims, nonce string) string {
+	now := time.Now()
+	token := jwt.MapClaims{
+		"iss":   idp.URL,
+		"aud":   ClientID,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+		"nonce": nonce,
+	}
+	for k, v := range claims {
+		token[k] = v
+	}
+	ss, err := idp.Key.Sign(token)
+	if err != nil {
+		panic(err)
+	}
+	return ss
+}
+
+func (idp *IdP) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 idp.URL,
+		"authorization_endpoint": idp.URL + "/authorize",
+		"token_endpoint":         idp.URL + "/token",
+		"jwks_uri":               idp.URL + "/jwks",
+	})
+}
+
+func (idp *IdP) jwks(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(idp.Key.JWKS())
+}
+
+// authorize redirects back with a code right away
+func (idp *IdP) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != ClientID || q.Get("code_challenge_method") != "S256" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	idp.mu.Lock()
+	claims := jwt.MapClaims{}
+	for k, v := range idp.claims {
+		claims[k] = v
+	}
+	claims["nonce"] = q.Get("nonce")
+	b := make([]byte, 16)
+	rand.Read(b)
+	c := base64.RawURLEncoding.EncodeToString(b)
+	idp.codes[c] = code{claims: claims, challenge: q.Get("code_challenge"), redirect: q.Get("redirect_uri")}
+	idp.mu.Unlock()
+
+	u, _ := url.Parse(q.Get("redirect_uri"))
+	params := u.Query()
+	params.Set("code", c)
+	params.Set("state", q.Get("state"))
+	u.RawQuery = params.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// token redeems a code once for an id token
+func (idp *IdP) token(w http.ResponseWriter, r *http.Request) {
+	id, secret, _ := r.BasicAuth()
+	if id != ClientID || secret != ClientSecret {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	idp.mu.Lock()
+	c, ok := idp.codes[r.FormValue("code")]
+	delete(idp.codes, r.FormValue("code"))
+	idp.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if !ok || c.redirect != r.FormValue("redirect_uri") || c.challenge != base64.RawURLEncoding.EncodeToString(sum[:]) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+	nonce, _ := c.claims["nonce"].(string)
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token": "opaque",
+		"token_type":   "Bearer",
+		"id_token":     idp.Sign(c.claims, nonce),
+	})
+}
@@ -0,0 +1,88 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+var (
+	b64 = base64.RawStdEncoding
+)
+
+// Argon2id hashes passwords with argon2id
+//   Memory is in KiB
+type Argon2id struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+}
+
+// Hash returns the PHC string encoding of pw, e.g.
+//   $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+func (a *Argon2id) Hash(pw string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(pw), salt, a.Time, a.Memory, a.Threads, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, a.Memory, a.Time, a.Threads,
+		b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+// decode splits a PHC string into its parameters, salt and key
+func (a *Argon2id) decode(encoded string) (*Argon2id, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != NameArgon2id {
+		return nil, nil, nil, fmt.Errorf("malformed argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return nil, nil, nil, err
+	}
+	if version != argon2.Version {
+		return nil, nil, nil, fmt.Errorf("unsupported argon2 version %v", version)
+	}
+
+	params := &Argon2id{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return nil, nil, nil, err
+	}
+
+	salt, err := b64.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	key, err := b64.DecodeString(parts[5])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return params, salt, key, nil
+}
+
+// Verify recomputes the key with the parameters stored in encoded
+func (a *Argon2id) Verify(pw, encoded string) (bool, error) {
+	params, salt, key, err := a.decode(encoded)
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey([]byte(pw), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+// NeedsRehash is true unless encoded is an argon2id hash with a's parameters
+func (a *Argon2id) NeedsRehash(encoded string) bool {
+	params, _, _, err := a.decode(encoded)
+	return err != nil || *params != *a
+}
@@ -0,0 +1,37 @@
+package password
+
+import (
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Bcrypt hashes passwords with bcrypt at the given cost
+type Bcrypt struct {
+	Cost int
+}
+
+// Hash returns the modular crypt encoding of pw, e.g. $2a$10$...
+func (b *Bcrypt) Hash(pw string) (string, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(pw), b.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(h), nil
+}
+
+// Verify compares pw against a bcrypt hash
+func (b *Bcrypt) Verify(pw, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(pw))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// NeedsRehash is true unless encoded is a bcrypt hash at b.Cost
+func (b *Bcrypt) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != b.Cost
+}
@@ -0,0 +1,75 @@
+package password
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/briansan/user-go/config"
+)
+
+const (
+	NameBcrypt   = "bcrypt"
+	NameArgon2id = "argon2id"
+)
+
+// Hasher turns plaintext passwords into encoded hashes that carry
+// the algorithm and its parameters so they can be verified later
+type Hasher interface {
+	// Hash returns the encoded hash of pw with a fresh salt
+	Hash(pw string) (string, error)
+	// Verify reports whether pw matches an encoded hash made by this hasher
+	Verify(pw, encoded string) (bool, error)
+	// NeedsRehash reports whether encoded was made by another
+	// algorithm or with other parameters than this hasher's
+	NeedsRehash(encoded string) bool
+}
+
+// New returns the hasher registered under name
+func New(name string) (Hasher, error) {
+	switch name {
+	case NameBcrypt:
+		return &Bcrypt{Cost: config.GetBcryptCost()}, nil
+	case NameArgon2id:
+		return &Argon2id{
+			Time:    uint32(config.GetArgon2Time()),
+			Memory:  uint32(config.GetArgon2Memory()),
+			Threads: uint8(config.GetArgon2Threads()),
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown password hasher %v", name)
+}
+
+// FromConfig returns the hasher selected by env.PASSWORD_HASHER
+func FromConfig() Hasher {
+	h, err := New(config.GetPasswordHasher())
+	if err != nil {
+		panic(err)
+	}
+	return h
+}
+
+// hasherFor picks the hasher able to read encoded by looking at its prefix
+func hasherFor(encoded string) Hasher {
+	switch {
+	case strings.HasPrefix(encoded, prefixWrappedSHA256):
+		return &WrappedSHA256{}
+	case strings.HasPrefix(encoded, "$2a$"),
+		strings.HasPrefix(encoded, "$2b$"),
+		strings.HasPrefix(encoded, "$2y$"):
+		return &Bcrypt{}
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		return &Argon2id{}
+	}
+	return &SHA256{}
+}
+
+// IsLegacy reports whether encoded is an unsalted SHA-256 hash
+func IsLegacy(encoded string) bool {
+	_, ok := hasherFor(encoded).(*SHA256)
+	return ok
+}
+
+// Verify reports whether pw matches encoded whatever algorithm made it
+func Verify(pw, encoded string) (bool, error) {
+	return hasherFor(encoded).Verify(pw, encoded)
+}
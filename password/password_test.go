@@ -0,0 +1,162 @@
+package password
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/briansan/user-go/errors"
+)
+
+func testHasher(t *testing.T, h Hasher) {
+	encoded, err := h.Hash("foo")
+	assert.Nil(t, err)
+
+	// Same password verifies, other doesn't
+	ok, err := Verify("foo", encoded)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	ok, err = Verify("bar", encoded)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// Salted so hashing twice differs
+	other, err := h.Hash("foo")
+	assert.Nil(t, err)
+	assert.NotEqual(t, encoded, other)
+
+	assert.False(t, h.NeedsRehash(encoded))
+}
+
+func Test001_Bcrypt(t *testing.T) {
+	h := &Bcrypt{Cost: 4}
+	testHasher(t, h)
+
+	encoded, _ := h.Hash("foo")
+	assert.True(t, strings.HasPrefix(encoded, "$2a$04$"))
+
+	// Cost change asks for a rehash
+	assert.True(t, (&Bcrypt{Cost: 5}).NeedsRehash(encoded))
+}
+
+func Test002_Argon2id(t *testing.T) {
+	h := &Argon2id{Time: 1, Memory: 1024, Threads: 1}
+	testHasher(t, h)
+
+	encoded, _ := h.Hash("foo")
+	assert.True(t, strings.HasPrefix(encoded, "$argon2id$v=19$m=1024,t=1,p=1$"))
+
+	// Parameter change asks for a rehash
+	assert.True(t, (&Argon2id{Time: 2, Memory: 1024, Threads: 1}).NeedsRehash(encoded))
+
+	// Switching algorithms asks for a rehash both ways
+	bcrypted, _ := (&Bcrypt{Cost: 4}).Hash("foo")
+	assert.True(t, h.NeedsRehash(bcrypted))
+	assert.True(t, (&Bcrypt{Cost: 4}).NeedsRehash(encoded))
+
+	// Malformed hashes don't verify
+	_, err := Verify("foo", "$argon2id$v=19$garbage")
+	assert.NotNil(t, err)
+}
+
+func Test003_SHA256(t *testing.T) {
+	// base64(sha256("baz")) as stored by earlier versions
+	legacy := "uqWglk0zIPvAxqkiFARTyFE+okq4/QV3A0gEqWckgJY="
+
+	ok, err := Verify("baz", legacy)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	ok, err = Verify("foo", legacy)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	assert.True(t, (&Bcrypt{Cost: 4}).NeedsRehash(legacy))
+	assert.True(t, (&Argon2id{Time: 1, Memory: 1024, Threads: 1}).NeedsRehash(legacy))
+}
+
+func Test004_WrappedSHA256(t *testing.T) {
+	legacy := "uqWglk0zIPvAxqkiFARTyFE+okq4/QV3A0gEqWckgJY="
+	assert.True(t, IsLegacy(legacy))
+
+	w := &WrappedSHA256{Cost: 4}
+	wrapped, err := w.Wrap(legacy)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(wrapped, "$sha256$2a$04$"))
+	assert.False(t, IsLegacy(wrapped))
+
+	// The plaintext of the legacy hash still verifies
+	ok, err := Verify("baz", wrapped)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	ok, err = Verify("foo", wrapped)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// And is always upgraded on login
+	assert.True(t, (&Bcrypt{Cost: 4}).NeedsRehash(wrapped))
+	assert.True(t, (&Argon2id{Time: 1, Memory: 1024, Threads: 1}).NeedsRehash(wrapped))
+}
+
+func Test005_Strength(t *testing.T) {
+	assert.Equal(t, 0, Strength(""))
+	assert.Equal(t, 0, Strength("bar"))
+	// Runs, repeats and common words are discounted
+	assert.Equal(t, 0, Strength("abcdefgh"))
+	assert.Equal(t, 0, Strength("aaaaaaaa"))
+	assert.Equal(t, 0, Strength("password1"))
+	assert.Equal(t, 1, Strength("kestrel"))
+	assert.Equal(t, 2, Strength("gammahouse"))
+	assert.Equal(t, 3, Strength("gammahouseigloo"))
+	assert.Equal(t, 4, Strength("Wide-Lantern-58!"))
+}
+
+func Test006_Policy(t *testing.T) {
+	p := &Policy{MinLength: 10, MinClasses: 3, MinStrength: 2}
+	assert.Nil(t, p.Check("Wide-Lantern-58", "alice", "alice@bar.com"))
+
+	err := p.Check("Alice1", "alice", "alice@bar.com")
+	policy, ok := err.(*errors.PolicyError)
+	assert.True(t, ok)
+	assert.Equal(t, "password", policy.Field)
+	rules := []string{}
+	for _, v := range policy.Violations {
+		rules = append(rules, v.Rule)
+	}
+	assert.Equal(t, []string{RuleMinLength, RuleStrength, RuleUsername, RuleEmail}, rules)
+
+	// Short names don't count
+	assert.Nil(t, p.Check("Wide-Lantern-58", "de", "la@bar.com"))
+
+	// Bcrypt refuses what is past its limit
+	p = &Policy{MaxBytes: BcryptMaxBytes}
+	assert.Nil(t, p.Check(strings.Repeat("a", BcryptMaxBytes), "", ""))
+	err = p.Check(strings.Repeat("a", BcryptMaxBytes+1), "", "")
+	assert.Equal(t, RuleMaxLength, err.(*errors.PolicyError).Violations[0].Rule)
+}
+
+func Test007_BreachedDir(t *testing.T) {
+	// SHA-1 of "password" is 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8
+	dir := t.TempDir()
+	lines := "003D68EB55068C33ACE09247EE4C639306B:3\n1E4C9B93F3F0682250B6CF8331B7EE68FD8:9545824\n"
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "5BAA6.txt"), []byte(lines), 0600))
+
+	d := BreachedDir(dir)
+	n, err := d.Count("password")
+	assert.Nil(t, err)
+	assert.Equal(t, 9545824, n)
+
+	// Other suffixes and missing ranges are clean
+	n, err = d.Count("Wide-Lantern-58")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+
+	p := &Policy{Breached: d}
+	err = p.Check("password", "", "")
+	assert.Equal(t, RuleBreached, err.(*errors.PolicyError).Violations[0].Rule)
+}
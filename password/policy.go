@@ -0,0 +1,240 @@
+package password
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/briansan/user-go/config"
+	"github.com/briansan/user-go/errors"
+)
+
+const (
+	// rules of the password policy
+	RuleMinLength  = "minLength"
+	RuleMaxLength  = "maxLength"
+	RuleClasses    = "characterClasses"
+	RuleStrength   = "strength"
+	RuleUsername   = "username"
+	RuleEmail      = "email"
+	RuleBreached   = "breached"
+	fieldPassword  = "password"
+	breachedSuffix = ".txt"
+	// names shorter than this are too likely to show up by chance
+	minNameLength = 3
+	// BcryptMaxBytes is the longest password bcrypt hashes, it refuses
+	// longer ones
+	BcryptMaxBytes = 72
+)
+
+// commonWords are counted as one character by Strength
+var commonWords = []string{
+	"password", "passwd", "qwerty", "azerty", "letmein", "welcome",
+	"iloveyou", "monkey", "dragon", "master", "login", "admin",
+}
+
+// Policy is what new passwords must look like
+type Policy struct {
+	MinLength int
+	// MaxBytes is the longest password in bytes the hasher takes, 0 takes
+	// any length
+	MaxBytes int
+	// MinClasses is how many of lower case, upper case, digit and other
+	// characters must show up
+	MinClasses int
+	// MinStrength is the least Strength
+	MinStrength int
+	// Breached is checked for the password if set
+	Breached Breached
+}
+
+// PolicyFromConfig returns the policy of env.PASSWORD_MIN_LENGTH,
+// env.PASSWORD_MIN_CLASSES, env.PASSWORD_MIN_STRENGTH and
+// env.BREACHED_PASSWORDS, limited to BcryptMaxBytes if env.PASSWORD_HASHER
+// is bcrypt
+func PolicyFromConfig() *Policy {
+	p := &Policy{}
+	p.MinLength, p.MinClasses, p.MinStrength = config.GetPasswordPolicy()
+	if config.GetPasswordHasher() == NameBcrypt {
+		p.MaxBytes = BcryptMaxBytes
+	}
+	if dir := config.GetBreachedPasswords(); len(dir) > 0 {
+		p.Breached = BreachedDir(dir)
+	}
+	return p
+}
+
+// Check returns an *errors.PolicyError listing every rule pw breaks for
+// the user with username and email, nil if it breaks none
+func (p *Policy) Check(pw, username, email string) error {
+	violations := []errors.Violation{}
+	add := func(rule, format string, args ...interface{}) {
+		violations = append(violations, errors.Violation{Rule: rule, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if n := len([]rune(pw)); n < p.MinLength {
+		add(RuleMinLength, "must be at least %d characters long", p.MinLength)
+	}
+	if p.MaxBytes > 0 && len(pw) > p.MaxBytes {
+		add(RuleMaxLength, "must be at most %d bytes long", p.MaxBytes)
+	}
+	if n := classes(pw); n < p.MinClasses {
+		add(RuleClasses, "must mix at least %d of lower case, upper case, digit and other characters", p.MinClasses)
+	}
+	if s := Strength(pw); s < p.MinStrength {
+		add(RuleStrength, "is too easy to guess, strength is %d of at least %d", s, p.MinStrength)
+	}
+
+	lower := strings.ToLower(pw)
+	if len(username) >= minNameLength && strings.Contains(lower, strings.ToLower(username)) {
+		add(RuleUsername, "must not contain the username")
+	}
+	local := strings.SplitN(email, "@", 2)[0]
+	if len(local) >= minNameLength && strings.Contains(lower, strings.ToLower(local)) {
+		add(RuleEmail, "must not contain the email")
+	}
+
+	if p.Breached != nil {
+		n, err := p.Breached.Count(pw)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			add(RuleBreached, "appeared in a data breach")
+		}
+	}
+
+	if len(violations) == 0 {
+		return nil
+	}
+	return errors.NewPolicyError(fieldPassword, violations)
+}
+
+// classes returns how many of lower case, upper case, digit and other
+// characters pw has
+func classes(pw string) int {
+	var lower, upper, digit, other int
+	for _, r := range pw {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	return lower + upper + digit + other
+}
+
+// Strength estimates how hard pw is to guess from 0, trivial, to 4, very
+// hard, by its entropy in bits
+//   repeated characters, runs like abc or 321 and common words count for
+//   less than their length
+func Strength(pw string) int {
+	lower := strings.ToLower(pw)
+	for _, w := range commonWords {
+		lower = strings.Replace(lower, w, "\x00", -1)
+	}
+
+	pool := 0
+	for _, r := range pw {
+		switch {
+		case r >= 'a' && r <= 'z':
+			pool |= 1
+		case r >= 'A' && r <= 'Z':
+			pool |= 2
+		case r >= '0' && r <= '9':
+			pool |= 4
+		case r < unicode.MaxASCII:
+			pool |= 8
+		default:
+			pool |= 16
+		}
+	}
+	size := 0
+	for bit, n := range []int{26, 26, 10, 33, 100} {
+		if pool&(1<<uint(bit)) != 0 {
+			size += n
+		}
+	}
+
+	length, prev := 0.0, rune(-1)
+	for _, r := range lower {
+		if r == prev || r == prev+1 || r == prev-1 {
+			length += 0.5
+		} else {
+			length++
+		}
+		prev = r
+	}
+
+	bits := 0.0
+	if size > 0 {
+		bits = length * math.Log2(float64(size))
+	}
+	switch {
+	case bits < 28:
+		return 0
+	case bits < 36:
+		return 1
+	case bits < 60:
+		return 2
+	case bits < 80:
+		return 3
+	}
+	return 4
+}
+
+// Breached tells how often passwords showed up in data breaches
+type Breached interface {
+	// Count returns how many times pw was seen, 0 if never
+	Count(pw string) (int, error)
+}
+
+// BreachedDir is a directory of breached password hashes split by the
+// first 5 hex digits of their SHA-1, the k-anonymity range format
+//   PREFIX.txt holds the rest of each hash with the times it was seen
+//   as SUFFIX:COUNT, one a line
+type BreachedDir string
+
+// Count looks up the SHA-1 of pw in the file of its prefix
+func (d BreachedDir) Count(pw string) (int, error) {
+	sum := sha1.Sum([]byte(pw))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	f, err := os.Open(filepath.Join(string(d), hash[:5]+breachedSuffix))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(strings.TrimSpace(scanner.Text()), ":", 2)
+		if !strings.EqualFold(parts[0], hash[5:]) {
+			continue
+		}
+		if len(parts) < 2 {
+			return 1, nil
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return 0, fmt.Errorf("bad breached password count %q: %v", parts[1], err)
+		}
+		return n, nil
+	}
+	return 0, scanner.Err()
+}
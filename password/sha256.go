@@ -0,0 +1,69 @@
+package password
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+const (
+	prefixWrappedSHA256 = "$sha256$"
+)
+
+// SHA256 is the legacy unsalted base64(sha256(pw)) format
+// it is only kept so old hashes can be verified and upgraded
+type SHA256 struct{}
+
+// Hash returns base64(sha256(pw))
+func (SHA256) Hash(pw string) (string, error) {
+	h := sha256.Sum256([]byte(pw))
+	return base64.StdEncoding.EncodeToString(h[:]), nil
+}
+
+// Verify compares pw against a legacy hash
+func (s SHA256) Verify(pw, encoded string) (bool, error) {
+	h, _ := s.Hash(pw)
+	return subtle.ConstantTimeCompare([]byte(h), []byte(encoded)) == 1, nil
+}
+
+// NeedsRehash is always true, the format has no salt or work factor
+func (SHA256) NeedsRehash(encoded string) bool {
+	return true
+}
+
+// WrappedSHA256 is a legacy hash run through bcrypt, encoded as $sha256$2a$10$...
+// it lets a migration take unsalted hashes off disk before their users log in
+type WrappedSHA256 struct {
+	Cost int
+}
+
+// Wrap returns the wrapped encoding of a legacy base64(sha256(pw)) hash
+func (w *WrappedSHA256) Wrap(legacy string) (string, error) {
+	h, err := (&Bcrypt{Cost: w.Cost}).Hash(legacy)
+	if err != nil {
+		return "", err
+	}
+	return prefixWrappedSHA256 + h[1:], nil
+}
+
+// Hash returns bcrypt(base64(sha256(pw))) in the wrapped encoding
+func (w *WrappedSHA256) Hash(pw string) (string, error) {
+	legacy, _ := SHA256{}.Hash(pw)
+	return w.Wrap(legacy)
+}
+
+// Verify compares the legacy hash of pw against the wrapped bcrypt hash
+func (w *WrappedSHA256) Verify(pw, encoded string) (bool, error) {
+	if !strings.HasPrefix(encoded, prefixWrappedSHA256) {
+		return false, fmt.Errorf("malformed wrapped sha256 hash")
+	}
+	legacy, _ := SHA256{}.Hash(pw)
+	return (&Bcrypt{}).Verify(legacy, "$"+strings.TrimPrefix(encoded, prefixWrappedSHA256))
+}
+
+// NeedsRehash is always true, the plaintext should be hashed directly
+func (w *WrappedSHA256) NeedsRehash(encoded string) bool {
+	return true
+}
@@ -0,0 +1,56 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// sweepInterval is how often full buckets are dropped
+	sweepInterval = time.Minute
+)
+
+// Memory keeps the buckets in process, each replica counts on its own
+type Memory struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+	swept   time.Time
+}
+
+// memoryBucket is a bucket along with when it is full again
+type memoryBucket struct {
+	Bucket
+	full time.Time
+}
+
+// NewMemory returns a Memory without buckets
+func NewMemory() *Memory {
+	return &Memory{buckets: map[string]*memoryBucket{}}
+}
+
+// Take takes a token out of the bucket of key under p
+func (m *Memory) Take(ctx context.Context, key string, p Policy, now time.Time) (Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// A full bucket is the same as none
+	if now.Sub(m.swept) > sweepInterval {
+		for k, b := range m.buckets {
+			if !now.Before(b.full) {
+				delete(m.buckets, k)
+			}
+		}
+		m.swept = now
+	}
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &memoryBucket{Bucket: p.Full(now)}
+		m.buckets[key] = b
+	}
+	var r Result
+	b.Bucket, r = p.Take(b.Bucket, now)
+	b.full = now.Add(r.Reset)
+	return r, nil
+}
@@ -0,0 +1,99 @@
+// Package ratelimit throttles requests with token buckets, which hold up
+// to Limit tokens and gain them back at Limit per Period, a request takes
+// one token and is refused while there is none
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+const (
+	// what a policy counts requests by
+	ByIP   = "ip"
+	ByUser = "user"
+	ByKey  = "key"
+)
+
+// Policy lets Limit requests through per Period, all at once at most
+type Policy struct {
+	Limit  int
+	Period time.Duration
+	By     string
+}
+
+// Bucket is the state of one token bucket
+type Bucket struct {
+	Tokens    float64
+	UpdatedAt time.Time
+}
+
+// Result tells whether a request may go through and what is left
+type Result struct {
+	Allowed   bool
+	Remaining int
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is how long until the next token, zero if there is one
+	RetryAfter time.Duration
+}
+
+// Store takes tokens out of the bucket of key under p
+type Store interface {
+	Take(ctx context.Context, key string, p Policy, now time.Time) (Result, error)
+}
+
+// StoreFunc turns a function into a Store
+type StoreFunc func(ctx context.Context, key string, p Policy, now time.Time) (Result, error)
+
+// Take calls f
+func (f StoreFunc) Take(ctx context.Context, key string, p Policy, now time.Time) (Result, error) {
+	return f(ctx, key, p, now)
+}
+
+// interval is how long the bucket takes to gain a token
+func (p Policy) interval() time.Duration {
+	return p.Period / time.Duration(p.Limit)
+}
+
+// Full returns the bucket of a key that wasn't seen before
+func (p Policy) Full(now time.Time) Bucket {
+	return Bucket{Tokens: float64(p.Limit), UpdatedAt: now}
+}
+
+// Empty returns the result of a bucket that has no tokens left
+func (p Policy) Empty() Result {
+	_, r := p.Take(Bucket{}, time.Time{})
+	return r
+}
+
+// Take refills b up to now and takes a token out of it if there is one,
+// returning the bucket after and the result
+func (p Policy) Take(b Bucket, now time.Time) (Bucket, Result) {
+	if now.After(b.UpdatedAt) {
+		b.Tokens += float64(now.Sub(b.UpdatedAt)) / float64(p.interval())
+		b.UpdatedAt = now
+	}
+	if b.Tokens > float64(p.Limit) {
+		b.Tokens = float64(p.Limit)
+	}
+
+	r := Result{}
+	if b.Tokens >= 1 {
+		b.Tokens--
+		r.Allowed = true
+	} else {
+		r.RetryAfter = p.wait(1 - b.Tokens)
+	}
+	r.Remaining = int(math.Floor(b.Tokens))
+	r.Reset = p.wait(float64(p.Limit) - b.Tokens)
+	return b, r
+}
+
+// wait returns how long the bucket takes to gain tokens, rounded up to the
+// millisecond, float error aside
+func (p Policy) wait(tokens float64) time.Duration {
+	ms := tokens * float64(p.interval()) / float64(time.Millisecond)
+	return time.Duration(math.Ceil(ms-1e-6)) * time.Millisecond
+}
@@ -0,0 +1,63 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test001_Take(t *testing.T) {
+	now := time.Now()
+	p := Policy{Limit: 3, Period: 3 * time.Minute}
+	b := p.Full(now)
+
+	// A full bucket lets Limit requests through at once
+	var r Result
+	for i := 2; i >= 0; i-- {
+		b, r = p.Take(b, now)
+		assert.True(t, r.Allowed)
+		assert.Equal(t, i, r.Remaining)
+	}
+	assert.Equal(t, 3*time.Minute, r.Reset)
+
+	// then one per Period / Limit
+	b, r = p.Take(b, now.Add(30*time.Second))
+	assert.False(t, r.Allowed)
+	assert.Equal(t, 30*time.Second, r.RetryAfter)
+	b, r = p.Take(b, now.Add(time.Minute))
+	assert.True(t, r.Allowed)
+	assert.Equal(t, 0, r.Remaining)
+
+	// and never holds more than Limit
+	_, r = p.Take(b, now.Add(time.Hour))
+	assert.True(t, r.Allowed)
+	assert.Equal(t, 2, r.Remaining)
+	assert.Equal(t, time.Minute, r.Reset)
+
+	// An empty bucket waits for its next token
+	assert.Equal(t, Result{Reset: 3 * time.Minute, RetryAfter: time.Minute}, p.Empty())
+}
+
+func Test002_Memory(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	m := NewMemory()
+	p := Policy{Limit: 2, Period: time.Minute}
+
+	// Every key has its own bucket
+	for _, allowed := range []bool{true, true, false} {
+		r, err := m.Take(ctx, "a", p, now)
+		assert.Nil(t, err)
+		assert.Equal(t, allowed, r.Allowed)
+	}
+	r, err := m.Take(ctx, "b", p, now)
+	assert.Nil(t, err)
+	assert.True(t, r.Allowed)
+
+	// Full buckets are dropped
+	_, err = m.Take(ctx, "a", p, now.Add(time.Hour))
+	assert.Nil(t, err)
+	assert.Len(t, m.buckets, 1)
+}
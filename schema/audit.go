@@ -0,0 +1,89 @@
+package schema
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	AuditLogin         = "login"
+	AuditLoginFail     = "login.fail"
+	AuditLogout        = "logout"
+	AuditTokenReuse    = "token.reuse"
+	AuditUserCreate    = "user.create"
+	AuditUserUpdate    = "user.update"
+	AuditUserDelete    = "user.delete"
+	AuditUserRestore   = "user.restore"
+	AuditUserUnlock    = "user.unlock"
+	AuditAuthorize     = "oauth.authorize"
+	AuditClientCreate  = "client.create"
+	AuditClientDelete  = "client.delete"
+	AuditIdentityLink  = "identity.link"
+	AuditTwoFactorOn   = "2fa.enable"
+	AuditTwoFactorOff  = "2fa.disable"
+	AuditPasskeyAdd    = "passkey.add"
+	AuditPasskeyRemove = "passkey.remove"
+	AuditTokenCreate   = "pat.create"
+	AuditTokenRevoke   = "pat.revoke"
+	AuditPasswordReset = "password.reset"
+	AuditSessionEnd    = "session.end"
+
+	// Redacted stands in for secrets in audit diffs
+	Redacted = "[redacted]"
+)
+
+// AuditChange is the value of a field before and after a write
+type AuditChange struct {
+	Old interface{} `bson:"old" json:"old"`
+	New interface{} `bson:"new" json:"new"`
+}
+
+// AuditEntry records who did what to whom, entries are never changed
+// Actor and Target are user ids, Actor is empty for anonymous requests
+type AuditEntry struct {
+	ID        primitive.ObjectID     `bson:"_id,omitempty" json:"id"`
+	Time      time.Time              `bson:"time" json:"time"`
+	Action    string                 `bson:"action" json:"action"`
+	Actor     string                 `bson:"actor,omitempty" json:"actor,omitempty"`
+	Target    string                 `bson:"target,omitempty" json:"target,omitempty"`
+	Diff      map[string]AuditChange `bson:"diff,omitempty" json:"diff,omitempty"`
+	IP        string                 `bson:"ip" json:"ip"`
+	RequestID string                 `bson:"requestID" json:"requestID"`
+}
+
+// DiffUser returns the fields patch changes on before, before is nil on create
+// passwords are redacted and fields left unchanged are skipped
+func DiffUser(before *UserSecure, patch *User) map[string]AuditChange {
+	create := before == nil
+	if create {
+		before = &UserSecure{}
+	}
+
+	diff := map[string]AuditChange{}
+	change := func(field string, old, new interface{}) {
+		if create {
+			old = nil
+		} else if old == new {
+			return
+		}
+		diff[field] = AuditChange{Old: old, New: new}
+	}
+
+	if patch.Username != nil {
+		change("username", before.Username, *patch.Username)
+	}
+	if patch.Email != nil {
+		change("email", before.Email, *patch.Email)
+	}
+	if patch.Role != nil {
+		change("role", before.Role, *patch.Role)
+	}
+	if patch.EmailVerified != nil {
+		change("emailVerified", before.EmailVerified, *patch.EmailVerified)
+	}
+	if patch.Password != nil {
+		diff["password"] = AuditChange{Old: Redacted, New: Redacted}
+	}
+	return diff
+}
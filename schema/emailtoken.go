@@ -0,0 +1,29 @@
+package schema
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// EmailTokenReset tokens set a new password
+	EmailTokenReset = "reset"
+	// EmailTokenVerify tokens confirm the current email of a user
+	EmailTokenVerify = "verify"
+	// EmailTokenChange tokens confirm a new email, which replaces the current one
+	EmailTokenChange = "change"
+)
+
+// EmailToken is the stored half of a single-use token mailed to a user,
+// only the sha256 of the token is kept
+type EmailToken struct {
+	ID      primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Hash    string             `bson:"hash" json:"-"`
+	Purpose string             `bson:"purpose" json:"purpose"`
+	UserID  string             `bson:"userID" json:"userID"`
+	// Email is the address the token was sent to
+	Email     string    `bson:"email" json:"email"`
+	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
+	ExpiresAt time.Time `bson:"expiresAt" json:"expiresAt"`
+}
@@ -0,0 +1,18 @@
+package schema
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Identity links the subject of an upstream identity provider to a user
+// a subject is linked to at most one user, a user may have many identities
+type Identity struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Provider  string             `bson:"provider" json:"provider"`
+	Subject   string             `bson:"subject" json:"subject"`
+	UserID    string             `bson:"userID" json:"userID"`
+	Email     string             `bson:"email,omitempty" json:"email,omitempty"`
+	CreatedAt time.Time          `bson:"createdAt" json:"createdAt"`
+}
@@ -0,0 +1,32 @@
+package schema
+
+import (
+	"time"
+)
+
+// LoginFailures counts the failed logins of an account or a source IP
+// Count starts over once ExpiresAt passes without another failure
+type LoginFailures struct {
+	Key         string    `bson:"_id" json:"-"`
+	Count       int       `bson:"count" json:"count"`
+	LastFailure time.Time `bson:"lastFailure" json:"lastFailure"`
+	ExpiresAt   time.Time `bson:"expiresAt" json:"-"`
+}
+
+// LockedUntil returns when logins are let through again, the zero time
+// if they are now
+// the threshold-th failure locks for base and every further one doubles
+// that, up to max, a threshold of 0 never locks
+func (f *LoginFailures) LockedUntil(threshold int, base, max time.Duration) time.Time {
+	if threshold <= 0 || f.Count < threshold {
+		return time.Time{}
+	}
+	lock := base
+	for i := threshold; i < f.Count && lock < max; i++ {
+		lock *= 2
+	}
+	if lock > max {
+		lock = max
+	}
+	return f.LastFailure.Add(lock)
+}
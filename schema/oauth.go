@@ -0,0 +1,96 @@
+package schema
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/briansan/user-go/errors"
+)
+
+const (
+	GrantAuthorizationCode = "authorization_code"
+	GrantClientCredentials = "client_credentials"
+
+	ScopeOpenID  = "openid"
+	ScopeProfile = "profile"
+	ScopeEmail   = "email"
+)
+
+// OAuthClient is an app registered to sign users in through this service
+// or to get tokens of its own with the client credentials grant
+// public clients have no secret and must use PKCE
+type OAuthClient struct {
+	ID           string    `bson:"_id" json:"clientID"`
+	SecretHash   string    `bson:"secretHash,omitempty" json:"-"`
+	Name         string    `bson:"name" json:"name"`
+	RedirectURIs []string  `bson:"redirectURIs" json:"redirectURIs"`
+	GrantTypes   []string  `bson:"grantTypes" json:"grantTypes"`
+	Scopes       []string  `bson:"scopes" json:"scopes"`
+	CreatedAt    time.Time `bson:"createdAt" json:"createdAt"`
+}
+
+// Public reports whether c authenticates without a secret
+func (c *OAuthClient) Public() bool {
+	return len(c.SecretHash) == 0
+}
+
+// HasRedirectURI reports whether uri is registered for c, compared exactly
+func (c *OAuthClient) HasRedirectURI(uri string) bool {
+	return contains(c.RedirectURIs, uri)
+}
+
+// HasGrantType reports whether c may use grant
+func (c *OAuthClient) HasGrantType(grant string) bool {
+	return contains(c.GrantTypes, grant)
+}
+
+// HasScope reports whether c may request scope
+func (c *OAuthClient) HasScope(scope string) bool {
+	return contains(c.Scopes, scope)
+}
+
+// Validate checks that c can be registered
+func (c *OAuthClient) Validate() error {
+	if len(c.Name) == 0 {
+		return errors.NewValidationError("name", "string")
+	}
+	if len(c.GrantTypes) == 0 {
+		return errors.NewValidationError("grantTypes", "list of "+GrantAuthorizationCode+" or "+GrantClientCredentials)
+	}
+	for _, g := range c.GrantTypes {
+		if g != GrantAuthorizationCode && g != GrantClientCredentials {
+			return errors.NewValidationError("grantTypes", "list of "+GrantAuthorizationCode+" or "+GrantClientCredentials)
+		}
+	}
+	if c.HasGrantType(GrantAuthorizationCode) && len(c.RedirectURIs) == 0 {
+		return errors.NewValidationError("redirectURIs", "non-empty list")
+	}
+	return nil
+}
+
+// AuthCode is the stored half of an authorization code, only the sha256
+// of the code is kept and it can be exchanged once
+type AuthCode struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Hash        string             `bson:"hash" json:"-"`
+	ClientID    string             `bson:"clientID" json:"clientID"`
+	UserID      string             `bson:"userID" json:"userID"`
+	RedirectURI string             `bson:"redirectURI" json:"redirectURI"`
+	Scope       string             `bson:"scope" json:"scope"`
+	Nonce       string             `bson:"nonce,omitempty" json:"nonce,omitempty"`
+	// CodeChallenge is the S256 PKCE challenge the code verifier must match
+	CodeChallenge string     `bson:"codeChallenge" json:"-"`
+	AuthTime      time.Time  `bson:"authTime" json:"authTime"`
+	ExpiresAt     time.Time  `bson:"expiresAt" json:"expiresAt"`
+	UsedAt        *time.Time `bson:"usedAt,omitempty" json:"usedAt,omitempty"`
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
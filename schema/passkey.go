@@ -0,0 +1,25 @@
+package schema
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Passkey is a WebAuthn credential a user registered to log in without
+// a password, the credential id is unique across users
+type Passkey struct {
+	ID     primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID string             `bson:"userID" json:"userID"`
+	// CredentialID is the base64url id the authenticator gave the credential
+	CredentialID string `bson:"credentialID" json:"credentialID"`
+	// PublicKey is the COSE key that checks the assertions
+	PublicKey []byte `bson:"publicKey" json:"-"`
+	// SignCount is the counter of the last assertion, one that doesn't move
+	// it forward comes from a cloned authenticator
+	SignCount  int64      `bson:"signCount" json:"signCount"`
+	Transports []string   `bson:"transports" json:"transports"`
+	Name       string     `bson:"name" json:"name"`
+	CreatedAt  time.Time  `bson:"createdAt" json:"createdAt"`
+	LastUsedAt *time.Time `bson:"lastUsedAt,omitempty" json:"lastUsedAt,omitempty"`
+}
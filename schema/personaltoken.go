@@ -0,0 +1,23 @@
+package schema
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// PersonalToken is the stored half of a personal access token a user
+// made for scripts, only the sha256 of the token is kept
+// requests with it may do what the user may, limited to Permissions
+type PersonalToken struct {
+	ID     primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Hash   string             `bson:"hash" json:"-"`
+	UserID string             `bson:"userID" json:"userID"`
+	Name   string             `bson:"name" json:"name"`
+	// Permissions are the names of the permissions of the token, a subset
+	// of the ones of the role of the user when it was made
+	Permissions []string   `bson:"permissions" json:"permissions"`
+	CreatedAt   time.Time  `bson:"createdAt" json:"createdAt"`
+	ExpiresAt   time.Time  `bson:"expiresAt" json:"expiresAt"`
+	LastUsedAt  *time.Time `bson:"lastUsedAt,omitempty" json:"lastUsedAt,omitempty"`
+}
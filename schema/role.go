@@ -16,6 +16,75 @@ var (
 	RoleAdmin   = RoleManager | PermissionModifyAllUsers | PermissionModifyAllTasks
 )
 
+var (
+	// permissionNames name the permissions in the role claims of a session
+	permissionNames = []struct {
+		perm int
+		name string
+	}{
+		{PermissionCreateUser, "createUser"},
+		{PermissionModifySelfTasks, "modifySelfTasks"},
+		{PermissionModifyAllUsers, "modifyAllUsers"},
+		{PermissionModifyAllUsersRestricted, "modifyAllUsersRestricted"},
+		{PermissionViewAllTasks, "viewAllTasks"},
+		{PermissionModifyAllTasks, "modifyAllTasks"},
+	}
+)
+
 func RoleHasPermission(role, perm int) bool {
 	return (role & perm) > 0
 }
+
+// RoleName returns the name of role, empty if it is a custom set of permissions
+func RoleName(role int) string {
+	switch role {
+	case RoleAnon:
+		return "anon"
+	case RoleUser:
+		return "user"
+	case RoleManager:
+		return "manager"
+	case RoleAdmin:
+		return "admin"
+	}
+	return ""
+}
+
+// RoleByName returns the role named name, the reverse of RoleName
+func RoleByName(name string) (int, bool) {
+	for _, role := range []int{RoleAnon, RoleUser, RoleManager, RoleAdmin} {
+		if RoleName(role) == name {
+			return role, true
+		}
+	}
+	return 0, false
+}
+
+// PermissionNames returns the names of the permissions of role
+func PermissionNames(role int) []string {
+	names := []string{}
+	for _, p := range permissionNames {
+		if RoleHasPermission(role, p.perm) {
+			names = append(names, p.name)
+		}
+	}
+	return names
+}
+
+// PermissionsByNames returns the permissions named names, the reverse of
+// PermissionNames, false if a name is unknown
+func PermissionsByNames(names []string) (int, bool) {
+	perms := 0
+	for _, name := range names {
+		found := false
+		for _, p := range permissionNames {
+			if p.name == name {
+				perms, found = perms|p.perm, true
+			}
+		}
+		if !found {
+			return 0, false
+		}
+	}
+	return perms, true
+}
@@ -2,6 +2,7 @@ package schema
 
 import (
 	"encoding/json"
+	"time"
 
 	"testing"
 
@@ -41,6 +42,16 @@ func Test001_Roles(t *testing.T) {
 	assert.True(t, RoleHasPermission(RoleAdmin, PermissionModifyAllUsersRestricted))
 	assert.True(t, RoleHasPermission(RoleAdmin, PermissionViewAllTasks))
 	assert.True(t, RoleHasPermission(RoleAdmin, PermissionModifyAllTasks))
+
+	// Test names
+	assert.Equal(t, "manager", RoleName(RoleManager))
+	assert.Equal(t, "", RoleName(RoleUser|PermissionViewAllTasks))
+	assert.Equal(t, []string{"modifySelfTasks", "modifyAllUsersRestricted", "viewAllTasks"}, PermissionNames(RoleManager))
+	perms, ok := PermissionsByNames(PermissionNames(RoleManager))
+	assert.True(t, ok)
+	assert.Equal(t, RoleManager, perms)
+	_, ok = PermissionsByNames([]string{"viewAllTasks", "everything"})
+	assert.False(t, ok)
 }
 
 func Test002_User(t *testing.T) {
@@ -74,3 +85,19 @@ func Test002_User(t *testing.T) {
 	json.Unmarshal([]byte(`{"email": "foo", "username": "bar", "password": "baz", "oldPassword": "foobar"}`), &u)
 	assert.Equal(t, "foobar", *u.OldPassword)
 }
+
+func Test003_LoginFailures(t *testing.T) {
+	now := time.Now()
+	f := &LoginFailures{Count: 2, LastFailure: now}
+
+	// Below the threshold, or without one, nothing is locked
+	assert.True(t, f.LockedUntil(3, time.Minute, time.Hour).IsZero())
+	f.Count = 10
+	assert.True(t, f.LockedUntil(0, time.Minute, time.Hour).IsZero())
+
+	// then the lock doubles with every failure up to the max
+	for count, lock := range map[int]time.Duration{3: time.Minute, 4: 2 * time.Minute, 6: 8 * time.Minute, 20: time.Hour} {
+		f.Count = count
+		assert.Equal(t, now.Add(lock), f.LockedUntil(3, time.Minute, time.Hour), "count %d", count)
+	}
+}
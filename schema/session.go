@@ -0,0 +1,27 @@
+package schema
+
+import (
+	"time"
+)
+
+// Session is a login of a user, it lasts as long as the refresh tokens of
+// the login and its ID is their Family
+// every session jwt issued for it names it, so ending it logs them out
+type Session struct {
+	ID         string    `bson:"_id" json:"id"`
+	UserID     string    `bson:"userID" json:"userID"`
+	UserAgent  string    `bson:"userAgent" json:"userAgent"`
+	IP         string    `bson:"ip" json:"ip"`
+	CreatedAt  time.Time `bson:"createdAt" json:"createdAt"`
+	LastSeenAt time.Time `bson:"lastSeenAt" json:"lastSeenAt"`
+	ExpiresAt  time.Time `bson:"expiresAt" json:"expiresAt"`
+	// ClientID is set on the sessions of oauth clients the user authorized
+	ClientID string `bson:"clientID,omitempty" json:"clientID,omitempty"`
+	// Current is set on the session of the request listing sessions
+	Current bool `bson:"-" json:"current"`
+}
+
+// Active reports whether s hasn't expired at now
+func (s *Session) Active(now time.Time) bool {
+	return now.Before(s.ExpiresAt)
+}
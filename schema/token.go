@@ -0,0 +1,31 @@
+package schema
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// RefreshToken is the stored half of an opaque refresh token, only the
+// sha256 of its secret is kept
+// every refresh replaces it with a new token of the same Family and marks
+// it used, so presenting it again gives away a stolen copy
+type RefreshToken struct {
+	ID     primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Hash   string             `bson:"hash" json:"-"`
+	Family string             `bson:"family" json:"family"`
+	UserID string             `bson:"userID" json:"userID"`
+	// AccessJTI and AccessExpiresAt describe the access token issued along
+	// with this one so it can be revoked together with the family
+	AccessJTI       string     `bson:"accessJTI" json:"-"`
+	AccessExpiresAt time.Time  `bson:"accessExpiresAt" json:"-"`
+	CreatedAt       time.Time  `bson:"createdAt" json:"createdAt"`
+	ExpiresAt       time.Time  `bson:"expiresAt" json:"expiresAt"`
+	UsedAt          *time.Time `bson:"usedAt,omitempty" json:"usedAt,omitempty"`
+	RevokedAt       *time.Time `bson:"revokedAt,omitempty" json:"revokedAt,omitempty"`
+}
+
+// Active reports whether t can still be exchanged at now
+func (t *RefreshToken) Active(now time.Time) bool {
+	return t.UsedAt == nil && t.RevokedAt == nil && now.Before(t.ExpiresAt)
+}
@@ -0,0 +1,24 @@
+package schema
+
+import (
+	"time"
+)
+
+// TwoFactor is the TOTP enrollment of a user, it only counts once it is
+// confirmed with a code from the app the secret was added to
+type TwoFactor struct {
+	UserID      string     `bson:"_id" json:"userID"`
+	Secret      string     `bson:"secret" json:"-"`
+	CreatedAt   time.Time  `bson:"createdAt" json:"createdAt"`
+	ConfirmedAt *time.Time `bson:"confirmedAt,omitempty" json:"confirmedAt,omitempty"`
+	// LastStep is the time step of the last code accepted, older and equal
+	// ones are refused so that a code works once
+	LastStep int64 `bson:"lastStep" json:"-"`
+	// RecoveryCodes are the sha256 of the recovery codes not used yet
+	RecoveryCodes []string `bson:"recoveryCodes" json:"-"`
+}
+
+// Enabled reports whether logins of the user need a second factor
+func (t *TwoFactor) Enabled() bool {
+	return t.ConfirmedAt != nil
+}
@@ -1,25 +1,37 @@
 package schema
 
 import (
-	"gopkg.in/mgo.v2/bson"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
 
 	"github.com/briansan/user-go/errors"
 )
 
 type UserSecure struct {
-	ID       bson.ObjectId `bson:"_id,omitempty" json:"id"`
-	Username string        `bson:"username" json:"username"`
-	Email    string        `bson:"email" json:"email"`
-	Role     int           `bson:"role" json:"role"`
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Username      string             `bson:"username" json:"username"`
+	Email         string             `bson:"email" json:"email"`
+	Role          int                `bson:"role" json:"role"`
+	EmailVerified bool               `bson:"emailVerified" json:"emailVerified"`
+	Version       int                `bson:"version" json:"version"`
+	DeletedAt     *time.Time         `bson:"deletedAt,omitempty" json:"deletedAt,omitempty"`
 }
 
+// User is the full user document
+// Version counts the writes to it and is bumped by the store on every one
+// a set DeletedAt hides it from every lookup until it is restored or purged
+// EmailVerified is set once the owner of Email follows a verification link
 type User struct {
-	ID          bson.ObjectId `bson:"_id,omitempty" json:"id"`
-	Username    *string       `bson:"username,omitempty" json:"username,omitempty"`
-	OldPassword *string       `bson:"-" json:"oldPassword,omitempty"`
-	Password    *string       `bson:"password,omitempty" json:"password,omitempty"`
-	Email       *string       `bson:"email,omitempty" json:"email,omitempty"`
-	Role        *int          `bson:"role,omitempty" json:"role"`
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Username      *string            `bson:"username,omitempty" json:"username,omitempty"`
+	OldPassword   *string            `bson:"-" json:"oldPassword,omitempty"`
+	Password      *string            `bson:"password,omitempty" json:"password,omitempty"`
+	Email         *string            `bson:"email,omitempty" json:"email,omitempty"`
+	Role          *int               `bson:"role,omitempty" json:"role"`
+	EmailVerified *bool              `bson:"emailVerified,omitempty" json:"emailVerified,omitempty"`
+	Version       int                `bson:"version,omitempty" json:"-"`
+	DeletedAt     *time.Time         `bson:"deletedAt,omitempty" json:"-"`
 }
 
 func (u *User) Validate() error {
@@ -34,3 +46,26 @@ func (u *User) Validate() error {
 	}
 	return nil
 }
+
+// Empty reports whether u sets none of the fields a patch can set
+func (u *User) Empty() bool {
+	return u.Username == nil && u.Password == nil && u.Email == nil && u.Role == nil && u.EmailVerified == nil
+}
+
+// Secure returns the user without its password
+func (u *User) Secure() *UserSecure {
+	s := &UserSecure{ID: u.ID, Version: u.Version, DeletedAt: u.DeletedAt}
+	if u.Username != nil {
+		s.Username = *u.Username
+	}
+	if u.Email != nil {
+		s.Email = *u.Email
+	}
+	if u.Role != nil {
+		s.Role = *u.Role
+	}
+	if u.EmailVerified != nil {
+		s.EmailVerified = *u.EmailVerified
+	}
+	return s
+}
@@ -0,0 +1,124 @@
+package store
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/briansan/user-go/errors"
+	"github.com/briansan/user-go/schema"
+)
+
+const (
+	auditCollectionName = "audit"
+)
+
+// AuditLog is the append-only record of user and auth events
+type AuditLog interface {
+	// AppendAudit stores e, stamping its id and time if they are unset
+	AppendAudit(ctx context.Context, e *schema.AuditEntry) error
+	// FindAudit returns the entries selected by q, newest first
+	FindAudit(ctx context.Context, q *AuditQuery) ([]*schema.AuditEntry, error)
+}
+
+// AuditQuery filters the entries returned by FindAudit
+type AuditQuery struct {
+	// Actor only keeps entries written by this user id
+	Actor string
+	// Target only keeps entries about this user id
+	Target string
+	// From and To bound the entry time, both inclusive, zero is unbounded
+	From time.Time
+	To   time.Time
+	// Limit is the number of entries returned, DefaultLimit if zero
+	Limit int
+}
+
+// Validate normalizes q and checks its limit and time range
+func (q *AuditQuery) Validate() error {
+	if q.Limit == 0 {
+		q.Limit = DefaultLimit
+	}
+	if q.Limit < 0 || q.Limit > MaxLimit {
+		return errors.NewValidationError("limit", "integer between 1 and "+strconv.Itoa(MaxLimit))
+	}
+	if !q.From.IsZero() && !q.To.IsZero() && q.To.Before(q.From) {
+		return errors.NewValidationError("to", "time after from")
+	}
+	return nil
+}
+
+// matches reports whether e passes the filters of q
+func (q *AuditQuery) matches(e *schema.AuditEntry) bool {
+	if len(q.Actor) > 0 && e.Actor != q.Actor {
+		return false
+	}
+	if len(q.Target) > 0 && e.Target != q.Target {
+		return false
+	}
+	if !q.From.IsZero() && e.Time.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && e.Time.After(q.To) {
+		return false
+	}
+	return true
+}
+
+// stampAudit gives e an id and, unless set, the current time
+// times are kept at millisecond precision since that is all mongo stores
+func stampAudit(e *schema.AuditEntry) {
+	e.ID = primitive.NewObjectID()
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Time = e.Time.UTC().Truncate(time.Millisecond)
+}
+
+// GetAuditCollection returns a mongo instance to the audit collection
+func (m *MongoStore) GetAuditCollection() *mongo.Collection {
+	return m.GetDatabase().Collection(auditCollectionName)
+}
+
+// AppendAudit inserts e into the audit collection
+// error is 500 if mongo fails, else nil
+func (m *MongoStore) AppendAudit(ctx context.Context, e *schema.AuditEntry) error {
+	stampAudit(e)
+	_, err := m.GetAuditCollection().InsertOne(ctx, e)
+	return err
+}
+
+// FindAudit returns the audit entries selected by q, newest first
+func (m *MongoStore) FindAudit(ctx context.Context, q *AuditQuery) ([]*schema.AuditEntry, error) {
+	filter := bson.M{}
+	if len(q.Actor) > 0 {
+		filter["actor"] = q.Actor
+	}
+	if len(q.Target) > 0 {
+		filter["target"] = q.Target
+	}
+	if !q.From.IsZero() || !q.To.IsZero() {
+		t := bson.M{}
+		if !q.From.IsZero() {
+			t["$gte"] = q.From
+		}
+		if !q.To.IsZero() {
+			t["$lte"] = q.To
+		}
+		filter["time"] = t
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: -1}, {Key: "_id", Value: -1}}).SetLimit(int64(q.Limit))
+	iter, err := m.GetAuditCollection().Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	entries := []*schema.AuditEntry{}
+	err = iter.All(ctx, &entries)
+	return entries, err
+}
@@ -0,0 +1,105 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/briansan/user-go/schema"
+)
+
+const (
+	emailTokensCollectionName = "emailTokens"
+)
+
+// EmailTokenStore keeps the single-use tokens mailed to users, expired
+// ones go away with PurgeExpiredEmailTokens and the rest when their user
+// is purged
+type EmailTokenStore interface {
+	// CreateEmailToken stores t, stamping its id and creation time
+	CreateEmailToken(ctx context.Context, t *schema.EmailToken) error
+	// GetEmailToken returns the token of purpose with hash without using it
+	// error is 404 if there is none or it expired before now
+	GetEmailToken(ctx context.Context, purpose, hash string, now time.Time) (*schema.EmailToken, error)
+	// UseEmailToken removes the token of purpose with hash and returns it
+	// error is 404 if there is none or it expired before now
+	UseEmailToken(ctx context.Context, purpose, hash string, now time.Time) (*schema.EmailToken, error)
+	// LastEmailToken returns the newest token of purpose of user userID,
+	// expired or not
+	// error is 404 if there is none
+	LastEmailToken(ctx context.Context, userID, purpose string) (*schema.EmailToken, error)
+	// DeleteEmailTokens removes the tokens of purpose of user userID
+	DeleteEmailTokens(ctx context.Context, userID, purpose string) error
+	// PurgeExpiredEmailTokens removes the tokens expired before t and
+	// returns how many were removed
+	PurgeExpiredEmailTokens(ctx context.Context, t time.Time) (int, error)
+}
+
+// stampEmailToken gives t an id and its creation time
+// times are kept at millisecond precision since that is all mongo stores
+func stampEmailToken(t *schema.EmailToken) {
+	t.ID = primitive.NewObjectID()
+	t.CreatedAt = time.Now().UTC().Truncate(time.Millisecond)
+	t.ExpiresAt = t.ExpiresAt.UTC().Truncate(time.Millisecond)
+}
+
+// GetEmailTokensCollection returns a mongo instance to the email tokens collection
+func (m *MongoStore) GetEmailTokensCollection() *mongo.Collection {
+	return m.GetDatabase().Collection(emailTokensCollectionName)
+}
+
+// CreateEmailToken inserts t into the email tokens collection
+func (m *MongoStore) CreateEmailToken(ctx context.Context, t *schema.EmailToken) error {
+	stampEmailToken(t)
+	_, err := m.GetEmailTokensCollection().InsertOne(ctx, t)
+	return err
+}
+
+// GetEmailToken looks up the token of purpose with hash
+// error is 404 if there is none or it expired, 500 if mongo fails, else nil
+func (m *MongoStore) GetEmailToken(ctx context.Context, purpose, hash string, now time.Time) (*schema.EmailToken, error) {
+	t := schema.EmailToken{}
+	q := bson.M{"purpose": purpose, "hash": hash, "expiresAt": bson.M{"$gt": now}}
+	if err := m.GetEmailTokensCollection().FindOne(ctx, q).Decode(&t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// UseEmailToken removes the token of purpose with hash and returns it
+// error is 404 if there is none or it expired, 500 if mongo fails, else nil
+func (m *MongoStore) UseEmailToken(ctx context.Context, purpose, hash string, now time.Time) (*schema.EmailToken, error) {
+	t := schema.EmailToken{}
+	q := bson.M{"purpose": purpose, "hash": hash, "expiresAt": bson.M{"$gt": now}}
+	if err := m.GetEmailTokensCollection().FindOneAndDelete(ctx, q).Decode(&t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// LastEmailToken returns the newest token of purpose of user userID
+// error is 404 if there is none, 500 if mongo fails, else nil
+func (m *MongoStore) LastEmailToken(ctx context.Context, userID, purpose string) (*schema.EmailToken, error) {
+	t := schema.EmailToken{}
+	opts := options.FindOne().SetSort(bson.D{{Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}})
+	if err := m.GetEmailTokensCollection().FindOne(ctx, bson.M{"userID": userID, "purpose": purpose}, opts).Decode(&t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// DeleteEmailTokens removes the tokens of purpose of user userID
+func (m *MongoStore) DeleteEmailTokens(ctx context.Context, userID, purpose string) error {
+	_, err := m.GetEmailTokensCollection().DeleteMany(ctx, bson.M{"userID": userID, "purpose": purpose})
+	return err
+}
+
+// PurgeExpiredEmailTokens removes the tokens expired before t and returns
+// how many were removed
+func (m *MongoStore) PurgeExpiredEmailTokens(ctx context.Context, t time.Time) (int, error) {
+	return deleteExpired(ctx, m.GetEmailTokensCollection(), t)
+}
@@ -0,0 +1,78 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/briansan/user-go/errors"
+	"github.com/briansan/user-go/schema"
+)
+
+const (
+	identitiesCollectionName = "identities"
+)
+
+// IdentityStore keeps the links of upstream identity provider subjects
+// to users, they go away when their user is purged
+type IdentityStore interface {
+	// LinkIdentity stores id, stamping its id and creation time
+	// error is 409 if the subject of the provider is linked already
+	LinkIdentity(ctx context.Context, id *schema.Identity) error
+	// GetIdentity looks up the link of subject at provider
+	GetIdentity(ctx context.Context, provider, subject string) (*schema.Identity, error)
+	// GetIdentities returns the links of user userID, oldest first
+	GetIdentities(ctx context.Context, userID string) ([]*schema.Identity, error)
+}
+
+// stampIdentity gives id an id and its creation time
+func stampIdentity(id *schema.Identity) {
+	id.ID = primitive.NewObjectID()
+	id.CreatedAt = time.Now().UTC().Truncate(time.Millisecond)
+}
+
+// identityConflict is the error of linking a subject twice
+func identityConflict(id *schema.Identity) error {
+	return errors.NewConflictError("identity", "subject", id.Provider+"/"+id.Subject)
+}
+
+// GetIdentitiesCollection returns a mongo instance to the identities collection
+func (m *MongoStore) GetIdentitiesCollection() *mongo.Collection {
+	return m.GetDatabase().Collection(identitiesCollectionName)
+}
+
+// LinkIdentity inserts id into the identities collection
+// error is 409 if the subject is linked already, 500 if mongo fails, else nil
+func (m *MongoStore) LinkIdentity(ctx context.Context, id *schema.Identity) error {
+	stampIdentity(id)
+	_, err := m.GetIdentitiesCollection().InsertOne(ctx, id)
+	if mongo.IsDuplicateKeyError(err) {
+		return identityConflict(id)
+	}
+	return err
+}
+
+// GetIdentity looks up the link of subject at provider
+func (m *MongoStore) GetIdentity(ctx context.Context, provider, subject string) (*schema.Identity, error) {
+	id := schema.Identity{}
+	if err := m.GetIdentitiesCollection().FindOne(ctx, bson.M{"provider": provider, "subject": subject}).Decode(&id); err != nil {
+		return nil, err
+	}
+	return &id, nil
+}
+
+// GetIdentities returns the links of user userID, oldest first
+func (m *MongoStore) GetIdentities(ctx context.Context, userID string) ([]*schema.Identity, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}})
+	iter, err := m.GetIdentitiesCollection().Find(ctx, bson.M{"userID": userID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	identities := []*schema.Identity{}
+	err = iter.All(ctx, &identities)
+	return identities, err
+}
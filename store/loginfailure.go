@@ -0,0 +1,85 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/briansan/user-go/schema"
+)
+
+const (
+	loginFailuresCollectionName = "loginFailures"
+)
+
+// LoginFailureStore counts failed logins by key, an account or a source
+// IP, expired counts go away with PurgeExpiredLoginFailures
+type LoginFailureStore interface {
+	// GetLoginFailures returns the failures of key that haven't expired by now
+	// error is 404 if there are none
+	GetLoginFailures(ctx context.Context, key string, now time.Time) (*schema.LoginFailures, error)
+	// AddLoginFailure counts a failure of key at now, starting over if the
+	// count expired, which it does window after this failure
+	AddLoginFailure(ctx context.Context, key string, now time.Time, window time.Duration) (*schema.LoginFailures, error)
+	// ClearLoginFailures forgets the failures of key
+	ClearLoginFailures(ctx context.Context, key string) error
+	// PurgeExpiredLoginFailures removes the counts expired before t and
+	// returns how many were removed
+	PurgeExpiredLoginFailures(ctx context.Context, t time.Time) (int, error)
+}
+
+// GetLoginFailuresCollection returns a mongo instance to the login failures collection
+func (m *MongoStore) GetLoginFailuresCollection() *mongo.Collection {
+	return m.GetDatabase().Collection(loginFailuresCollectionName)
+}
+
+// GetLoginFailures looks up the failures of key that haven't expired by now
+// error is 404 if there are none, 500 if mongo fails, else nil
+func (m *MongoStore) GetLoginFailures(ctx context.Context, key string, now time.Time) (*schema.LoginFailures, error) {
+	f := schema.LoginFailures{}
+	q := bson.M{"_id": key, "expiresAt": bson.M{"$gt": now}}
+	if err := m.GetLoginFailuresCollection().FindOne(ctx, q).Decode(&f); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// AddLoginFailure counts a failure of key at now
+// error is 500 if mongo fails, else nil
+func (m *MongoStore) AddLoginFailure(ctx context.Context, key string, now time.Time, window time.Duration) (*schema.LoginFailures, error) {
+	now = now.UTC().Truncate(time.Millisecond)
+	set := bson.M{"lastFailure": now, "expiresAt": now.Add(window)}
+	f := schema.LoginFailures{}
+
+	// An expired count starts over
+	restart := bson.M{"$set": bson.M{"count": 1, "lastFailure": now, "expiresAt": now.Add(window)}}
+	err := m.GetLoginFailuresCollection().FindOneAndUpdate(ctx, bson.M{"_id": key, "expiresAt": bson.M{"$lte": now}}, restart, returnNew).Decode(&f)
+	if err != ErrNotFound {
+		if err != nil {
+			return nil, err
+		}
+		return &f, nil
+	}
+
+	// else it goes up, from nothing if there was none
+	upsert := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	if err := m.GetLoginFailuresCollection().FindOneAndUpdate(ctx, bson.M{"_id": key}, bson.M{"$inc": bson.M{"count": 1}, "$set": set}, upsert).Decode(&f); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// ClearLoginFailures removes the failures of key
+func (m *MongoStore) ClearLoginFailures(ctx context.Context, key string) error {
+	_, err := m.GetLoginFailuresCollection().DeleteOne(ctx, bson.M{"_id": key})
+	return err
+}
+
+// PurgeExpiredLoginFailures removes the counts expired before t and
+// returns how many were removed
+func (m *MongoStore) PurgeExpiredLoginFailures(ctx context.Context, t time.Time) (int, error) {
+	return deleteExpired(ctx, m.GetLoginFailuresCollection(), t)
+}
@@ -0,0 +1,1344 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/briansan/user-go/errors"
+	"github.com/briansan/user-go/ratelimit"
+	"github.com/briansan/user-go/schema"
+)
+
+// MemoryStore keeps users in a map guarded by a mutex
+// it is meant for tests and for running the api without a database
+// calls never wait on I/O so their context is ignored
+type MemoryStore struct {
+	mu    *sync.RWMutex
+	users map[primitive.ObjectID]*schema.User
+	audit []*schema.AuditEntry
+	// refresh holds refresh tokens by id and revoked access token expiries by jti
+	refresh map[primitive.ObjectID]*schema.RefreshToken
+	revoked map[string]time.Time
+	// clients holds oauth clients by client id and codes authorization codes by hash
+	clients map[string]*schema.OAuthClient
+	codes   map[string]*schema.AuthCode
+	// identities holds identity links by provider and subject
+	identities map[identityKey]*schema.Identity
+	// twoFactor holds TOTP enrollments by user id
+	twoFactor map[string]*schema.TwoFactor
+	// passkeys holds WebAuthn credentials by credential id
+	passkeys map[string]*schema.Passkey
+	// personal holds personal access tokens by id
+	personal map[primitive.ObjectID]*schema.PersonalToken
+	// emailTokens holds mailed tokens by hash
+	emailTokens map[string]*schema.EmailToken
+	// loginFailures holds failed login counts by key
+	loginFailures map[string]*schema.LoginFailures
+	// rates holds the rate limit buckets
+	rates *ratelimit.Memory
+	// sessions holds logins by id
+	sessions map[string]*schema.Session
+}
+
+type identityKey struct {
+	provider, subject string
+}
+
+// NewMemoryStore returns an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		mu:      &sync.RWMutex{},
+		users:   map[primitive.ObjectID]*schema.User{},
+		refresh: map[primitive.ObjectID]*schema.RefreshToken{},
+		revoked: map[string]time.Time{},
+		clients: map[string]*schema.OAuthClient{},
+		codes:   map[string]*schema.AuthCode{},
+
+		identities: map[identityKey]*schema.Identity{},
+		twoFactor:  map[string]*schema.TwoFactor{},
+		passkeys:   map[string]*schema.Passkey{},
+		personal:   map[primitive.ObjectID]*schema.PersonalToken{},
+
+		emailTokens:   map[string]*schema.EmailToken{},
+		loginFailures: map[string]*schema.LoginFailures{},
+		rates:         ratelimit.NewMemory(),
+		sessions:      map[string]*schema.Session{},
+	}
+}
+
+// Copy returns the same store since there is no session to copy
+func (m *MemoryStore) Copy(ctx context.Context) (UserStore, error) {
+	return m, nil
+}
+
+// Cleanup is a no-op for the in-memory store
+func (m *MemoryStore) Cleanup() {}
+
+func copyString(s *string) *string {
+	if s == nil {
+		return nil
+	}
+	c := *s
+	return &c
+}
+
+func copyInt(i *int) *int {
+	if i == nil {
+		return nil
+	}
+	c := *i
+	return &c
+}
+
+func copyBool(b *bool) *bool {
+	if b == nil {
+		return nil
+	}
+	c := *b
+	return &c
+}
+
+func copyTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	c := *t
+	return &c
+}
+
+func cloneUser(u *schema.User) *schema.User {
+	return &schema.User{
+		ID:            u.ID,
+		Username:      copyString(u.Username),
+		Password:      copyString(u.Password),
+		Email:         copyString(u.Email),
+		Role:          copyInt(u.Role),
+		EmailVerified: copyBool(u.EmailVerified),
+		Version:       u.Version,
+		DeletedAt:     copyTime(u.DeletedAt),
+	}
+}
+
+// find returns the stored user matching f, caller must hold the lock
+// tombstoned users are included since they still hold their username and email
+func (m *MemoryStore) find(f func(u *schema.User) bool) *schema.User {
+	for _, u := range m.users {
+		if f(u) {
+			return u
+		}
+	}
+	return nil
+}
+
+// findLive is find without tombstoned users
+func (m *MemoryStore) findLive(f func(u *schema.User) bool) *schema.User {
+	return m.find(func(u *schema.User) bool {
+		return u.DeletedAt == nil && f(u)
+	})
+}
+
+func (m *MemoryStore) findByUsername(username string) *schema.User {
+	return m.find(func(u *schema.User) bool {
+		return u.Username != nil && *u.Username == username
+	})
+}
+
+func (m *MemoryStore) findByEmail(email string) *schema.User {
+	return m.find(func(u *schema.User) bool {
+		return u.Email != nil && *u.Email == email
+	})
+}
+
+// conflict is checkConflict for callers that already hold the lock
+func (m *MemoryStore) conflict(id primitive.ObjectID, user *schema.User) error {
+	if user.Username != nil {
+		if other := m.findByUsername(*user.Username); other != nil && other.ID != id {
+			return errors.NewConflictError("user", "username", *user.Username)
+		}
+	}
+	if user.Email != nil {
+		if other := m.findByEmail(*user.Email); other != nil && other.ID != id {
+			return errors.NewConflictError("user", "email", *user.Email)
+		}
+	}
+	return nil
+}
+
+// CreateUser inserts a copy of user into the map
+// error is 409 if username or email exists, else nil
+func (m *MemoryStore) CreateUser(ctx context.Context, user *schema.User) error {
+	// Hash the password before taking the lock since it is slow on purpose
+	if err := hashPassword(user); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.conflict(primitive.NilObjectID, user); err != nil {
+		return err
+	}
+
+	user.ID = primitive.NewObjectID()
+	user.Version = 1
+	m.users[user.ID] = cloneUser(user)
+	return nil
+}
+
+// GetAllUsers retrieves all users ordered by id
+func (m *MemoryStore) GetAllUsers(ctx context.Context) ([]*schema.UserSecure, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	users := []*schema.UserSecure{}
+	for _, u := range m.users {
+		if u.DeletedAt == nil {
+			users = append(users, u.Secure())
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].ID.Hex() < users[j].ID.Hex()
+	})
+	return users, nil
+}
+
+// FindUsers returns the page of users selected by q
+func (m *MemoryStore) FindUsers(ctx context.Context, q *UserQuery) (*UserPage, error) {
+	after, err := q.after()
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	users := []*schema.UserSecure{}
+	for _, u := range m.users {
+		if s := u.Secure(); u.DeletedAt == nil && q.matches(s) {
+			users = append(users, s)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return q.compare(users[i], users[j]) < 0
+	})
+	total := len(users)
+
+	// Skip everything up to and including the cursor
+	if after != nil {
+		at := q.cursorUser(after)
+		i := sort.Search(len(users), func(i int) bool {
+			return q.compare(users[i], at) > 0
+		})
+		users = users[i:]
+	}
+	if len(users) > q.Limit+1 {
+		users = users[:q.Limit+1]
+	}
+	return q.page(users, total), nil
+}
+
+// getUser returns the first user matching f or ErrNotFound
+func (m *MemoryStore) getUser(f func(u *schema.User) bool) (*schema.UserSecure, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if u := m.findLive(f); u != nil {
+		return u.Secure(), nil
+	}
+	return nil, ErrNotFound
+}
+
+// GetUserByID looks up user with given object id
+func (m *MemoryStore) GetUserByID(ctx context.Context, id string) (*schema.UserSecure, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	return m.getUser(func(u *schema.User) bool {
+		return u.ID == oid
+	})
+}
+
+// GetUserByUsername looks up user with given username
+func (m *MemoryStore) GetUserByUsername(ctx context.Context, username string) (*schema.UserSecure, error) {
+	return m.getUser(func(u *schema.User) bool {
+		return u.Username != nil && *u.Username == username
+	})
+}
+
+// GetUserByCreds looks up user with given username and checks pw against its hash
+func (m *MemoryStore) GetUserByCreds(ctx context.Context, user, pw string) (*schema.UserSecure, error) {
+	m.mu.RLock()
+	stored := m.findLive(func(u *schema.User) bool {
+		return u.Username != nil && *u.Username == user
+	})
+	if stored != nil {
+		stored = cloneUser(stored)
+	}
+	m.mu.RUnlock()
+
+	return verifyCreds(ctx, m, stored, pw)
+}
+
+// GetUserByEmail looks up user with given email
+func (m *MemoryStore) GetUserByEmail(ctx context.Context, email string) (*schema.UserSecure, error) {
+	return m.getUser(func(u *schema.User) bool {
+		return u.Email != nil && *u.Email == email
+	})
+}
+
+// live returns the stored user with given id at version, caller must hold the lock
+// error is 404 if user doesn't exist or is deleted, 412 if version doesn't match
+func (m *MemoryStore) live(userID string, version int) (*schema.User, error) {
+	oid, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	stored, ok := m.users[oid]
+	if !ok || stored.DeletedAt != nil {
+		return nil, ErrNotFound
+	}
+	if version != AnyVersion && version != stored.Version {
+		return nil, ErrVersionMismatch
+	}
+	return stored, nil
+}
+
+// UpdateUser sets every non-nil field of user on the stored user and bumps its version
+// error is 404 if user doesn't exist, 412 if version doesn't match,
+// 409 if username or email is taken, else nil
+func (m *MemoryStore) UpdateUser(ctx context.Context, userID string, user *schema.User, version int) (*schema.UserSecure, error) {
+	// Hash the password if provided
+	if err := hashPassword(user); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, err := m.live(userID, version)
+	if err != nil {
+		return nil, err
+	}
+
+	// Refuse to take another user's username or email
+	if err := m.conflict(stored.ID, user); err != nil {
+		return nil, err
+	}
+
+	patch := cloneUser(user)
+	if patch.Username != nil {
+		stored.Username = patch.Username
+	}
+	if patch.Password != nil {
+		stored.Password = patch.Password
+	}
+	if patch.Email != nil {
+		stored.Email = patch.Email
+	}
+	if patch.Role != nil {
+		stored.Role = patch.Role
+	}
+	if patch.EmailVerified != nil {
+		stored.EmailVerified = patch.EmailVerified
+	}
+	stored.Version++
+	return stored.Secure(), nil
+}
+
+// DeleteUser tombstones user with given id, it is hidden from every lookup
+// until RestoreUser or PurgeDeletedUsers
+// error is 404 if user doesn't exist, 412 if version doesn't match, else nil
+func (m *MemoryStore) DeleteUser(ctx context.Context, userID string, version int) (*schema.UserSecure, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, err := m.live(userID, version)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	stored.DeletedAt = &now
+	stored.Version++
+	return stored.Secure(), nil
+}
+
+// RestoreUser removes the tombstone of user with given id
+// error is 404 if user isn't deleted, else nil
+func (m *MemoryStore) RestoreUser(ctx context.Context, userID string) (*schema.UserSecure, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	oid, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	stored, ok := m.users[oid]
+	if !ok || stored.DeletedAt == nil {
+		return nil, ErrNotFound
+	}
+	stored.DeletedAt = nil
+	stored.Version++
+	return stored.Secure(), nil
+}
+
+// PurgeDeletedUsers removes every user tombstoned before t from the map
+// and returns how many were removed
+func (m *MemoryStore) PurgeDeletedUsers(ctx context.Context, t time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := 0
+	for id, u := range m.users {
+		if u.DeletedAt != nil && u.DeletedAt.Before(t) {
+			delete(m.users, id)
+			n++
+		}
+	}
+	// Drop the userData of users that are gone for good
+	gone := func(userID string) bool {
+		oid, err := primitive.ObjectIDFromHex(userID)
+		return err != nil || m.users[oid] == nil
+	}
+	for k, identity := range m.identities {
+		if gone(identity.UserID) {
+			delete(m.identities, k)
+		}
+	}
+	for userID := range m.twoFactor {
+		if gone(userID) {
+			delete(m.twoFactor, userID)
+		}
+	}
+	for credentialID, p := range m.passkeys {
+		if gone(p.UserID) {
+			delete(m.passkeys, credentialID)
+		}
+	}
+	for id, t := range m.personal {
+		if gone(t.UserID) {
+			delete(m.personal, id)
+		}
+	}
+	for hash, t := range m.emailTokens {
+		if gone(t.UserID) {
+			delete(m.emailTokens, hash)
+		}
+	}
+	for id, session := range m.sessions {
+		if gone(session.UserID) {
+			delete(m.sessions, id)
+		}
+	}
+	return n, nil
+}
+
+// AdminExistsOrCreate checks for existence of admin account
+// and creates one with given key if it doesn't exist
+func (m *MemoryStore) AdminExistsOrCreate(ctx context.Context, secret string) error {
+	return adminExistsOrCreate(ctx, m, secret)
+}
+
+// AppendAudit appends a copy of e to the in-memory log
+func (m *MemoryStore) AppendAudit(ctx context.Context, e *schema.AuditEntry) error {
+	stampAudit(e)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c := *e
+	m.audit = append(m.audit, &c)
+	return nil
+}
+
+// FindAudit returns the audit entries selected by q, newest first
+func (m *MemoryStore) FindAudit(ctx context.Context, q *AuditQuery) ([]*schema.AuditEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	entries := []*schema.AuditEntry{}
+	for i := len(m.audit) - 1; i >= 0 && len(entries) < q.Limit; i-- {
+		if e := m.audit[i]; q.matches(e) {
+			c := *e
+			entries = append(entries, &c)
+		}
+	}
+	return entries, nil
+}
+
+func cloneRefreshToken(t *schema.RefreshToken) *schema.RefreshToken {
+	c := *t
+	c.UsedAt = copyTime(t.UsedAt)
+	c.RevokedAt = copyTime(t.RevokedAt)
+	return &c
+}
+
+// CreateRefreshToken stores a copy of t
+func (m *MemoryStore) CreateRefreshToken(ctx context.Context, t *schema.RefreshToken) error {
+	stampRefreshToken(t)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.refresh[t.ID] = cloneRefreshToken(t)
+	return nil
+}
+
+// getRefreshToken returns a copy of the first refresh token matching f or ErrNotFound
+func (m *MemoryStore) getRefreshToken(f func(t *schema.RefreshToken) bool) (*schema.RefreshToken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, t := range m.refresh {
+		if f(t) {
+			return cloneRefreshToken(t), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// GetRefreshToken looks up a refresh token by the hash of its secret
+func (m *MemoryStore) GetRefreshToken(ctx context.Context, hash string) (*schema.RefreshToken, error) {
+	return m.getRefreshToken(func(t *schema.RefreshToken) bool {
+		return t.Hash == hash
+	})
+}
+
+// GetRefreshTokenByJTI looks up the refresh token issued along with access token jti
+func (m *MemoryStore) GetRefreshTokenByJTI(ctx context.Context, jti string) (*schema.RefreshToken, error) {
+	return m.getRefreshToken(func(t *schema.RefreshToken) bool {
+		return t.AccessJTI == jti
+	})
+}
+
+// RotateRefreshToken marks old used and stores next in its place
+// error is ErrTokenReused if old was used or revoked meanwhile
+func (m *MemoryStore) RotateRefreshToken(ctx context.Context, old, next *schema.RefreshToken) error {
+	stampRefreshToken(next)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.refresh[old.ID]
+	if !ok || stored.UsedAt != nil || stored.RevokedAt != nil {
+		return ErrTokenReused
+	}
+	now := time.Now().UTC()
+	stored.UsedAt = &now
+	old.UsedAt = copyTime(&now)
+	m.refresh[next.ID] = cloneRefreshToken(next)
+	return nil
+}
+
+// RevokeTokenFamily revokes every refresh token of family and the access
+// tokens issued along with them
+func (m *MemoryStore) RevokeTokenFamily(ctx context.Context, family string) error {
+	m.mu.Lock()
+	now := time.Now().UTC()
+	tokens := []*schema.RefreshToken{}
+	for _, t := range m.refresh {
+		if t.Family != family {
+			continue
+		}
+		if t.RevokedAt == nil {
+			t.RevokedAt = copyTime(&now)
+		}
+		tokens = append(tokens, cloneRefreshToken(t))
+	}
+	m.mu.Unlock()
+
+	return revokeAccessTokens(ctx, m, tokens)
+}
+
+// RevokeUserTokens revokes every refresh token of user userID and the
+// access tokens issued along with them
+func (m *MemoryStore) RevokeUserTokens(ctx context.Context, userID string) error {
+	m.mu.Lock()
+	now := time.Now().UTC()
+	tokens := []*schema.RefreshToken{}
+	for _, t := range m.refresh {
+		if t.UserID != userID {
+			continue
+		}
+		if t.RevokedAt == nil {
+			t.RevokedAt = copyTime(&now)
+		}
+		tokens = append(tokens, cloneRefreshToken(t))
+	}
+	m.mu.Unlock()
+
+	return revokeAccessTokens(ctx, m, tokens)
+}
+
+// RevokeAccessToken rejects access token jti until it expires
+func (m *MemoryStore) RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.revoked[jti]; !ok {
+		m.revoked[jti] = expiresAt
+	}
+	return nil
+}
+
+// IsAccessTokenRevoked reports whether access token jti was revoked
+func (m *MemoryStore) IsAccessTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, ok := m.revoked[jti]
+	return ok, nil
+}
+
+// PurgeExpiredTokens removes the refresh tokens and revoked access tokens
+// expired before t and returns how many were removed
+func (m *MemoryStore) PurgeExpiredTokens(ctx context.Context, t time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := 0
+	for id, token := range m.refresh {
+		if token.ExpiresAt.Before(t) {
+			delete(m.refresh, id)
+			n++
+		}
+	}
+	for jti, expiresAt := range m.revoked {
+		if expiresAt.Before(t) {
+			delete(m.revoked, jti)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func cloneClient(c *schema.OAuthClient) *schema.OAuthClient {
+	clone := *c
+	clone.RedirectURIs = append([]string{}, c.RedirectURIs...)
+	clone.GrantTypes = append([]string{}, c.GrantTypes...)
+	clone.Scopes = append([]string{}, c.Scopes...)
+	return &clone
+}
+
+// CreateClient stores a copy of c
+// error is 409 if the client id is taken
+func (m *MemoryStore) CreateClient(ctx context.Context, c *schema.OAuthClient) error {
+	stampClient(c)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.clients[c.ID]; ok {
+		return errors.NewConflictError("client", "clientID", c.ID)
+	}
+	m.clients[c.ID] = cloneClient(c)
+	return nil
+}
+
+// GetClient looks up a client by its client id
+func (m *MemoryStore) GetClient(ctx context.Context, id string) (*schema.OAuthClient, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	c, ok := m.clients[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return cloneClient(c), nil
+}
+
+// GetClients returns every client, oldest first
+func (m *MemoryStore) GetClients(ctx context.Context) ([]*schema.OAuthClient, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	clients := []*schema.OAuthClient{}
+	for _, c := range m.clients {
+		clients = append(clients, cloneClient(c))
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		if !clients[i].CreatedAt.Equal(clients[j].CreatedAt) {
+			return clients[i].CreatedAt.Before(clients[j].CreatedAt)
+		}
+		return clients[i].ID < clients[j].ID
+	})
+	return clients, nil
+}
+
+// DeleteClient removes client id
+// error is 404 if there is none
+func (m *MemoryStore) DeleteClient(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.clients[id]; !ok {
+		return ErrNotFound
+	}
+	delete(m.clients, id)
+	return nil
+}
+
+// CreateAuthCode stores a copy of code
+func (m *MemoryStore) CreateAuthCode(ctx context.Context, code *schema.AuthCode) error {
+	stampAuthCode(code)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c := *code
+	m.codes[code.Hash] = &c
+	return nil
+}
+
+// ConsumeAuthCode marks the code with hash used and returns it
+// error is 404 if there is none or it was used already
+func (m *MemoryStore) ConsumeAuthCode(ctx context.Context, hash string) (*schema.AuthCode, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	code, ok := m.codes[hash]
+	if !ok || code.UsedAt != nil {
+		return nil, ErrNotFound
+	}
+	now := time.Now().UTC()
+	code.UsedAt = &now
+	c := *code
+	c.UsedAt = copyTime(&now)
+	return &c, nil
+}
+
+// PurgeExpiredAuthCodes removes the codes expired before t and returns how
+// many were removed
+func (m *MemoryStore) PurgeExpiredAuthCodes(ctx context.Context, t time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := 0
+	for hash, code := range m.codes {
+		if code.ExpiresAt.Before(t) {
+			delete(m.codes, hash)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// LinkIdentity stores a copy of id
+// error is 409 if the subject is linked already
+func (m *MemoryStore) LinkIdentity(ctx context.Context, id *schema.Identity) error {
+	stampIdentity(id)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k := identityKey{id.Provider, id.Subject}
+	if _, ok := m.identities[k]; ok {
+		return identityConflict(id)
+	}
+	c := *id
+	m.identities[k] = &c
+	return nil
+}
+
+// GetIdentity looks up the link of subject at provider
+func (m *MemoryStore) GetIdentity(ctx context.Context, provider, subject string) (*schema.Identity, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	id, ok := m.identities[identityKey{provider, subject}]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *id
+	return &c, nil
+}
+
+// GetIdentities returns the links of user userID, oldest first
+func (m *MemoryStore) GetIdentities(ctx context.Context, userID string) ([]*schema.Identity, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	identities := []*schema.Identity{}
+	for _, id := range m.identities {
+		if id.UserID == userID {
+			c := *id
+			identities = append(identities, &c)
+		}
+	}
+	sort.Slice(identities, func(i, j int) bool {
+		if !identities[i].CreatedAt.Equal(identities[j].CreatedAt) {
+			return identities[i].CreatedAt.Before(identities[j].CreatedAt)
+		}
+		return identities[i].ID.Hex() < identities[j].ID.Hex()
+	})
+	return identities, nil
+}
+
+func cloneTwoFactor(t *schema.TwoFactor) *schema.TwoFactor {
+	clone := *t
+	clone.ConfirmedAt = copyTime(t.ConfirmedAt)
+	clone.RecoveryCodes = append([]string{}, t.RecoveryCodes...)
+	return &clone
+}
+
+// CreateTwoFactor stores a copy of t
+// error is 409 if the user has a confirmed enrollment
+func (m *MemoryStore) CreateTwoFactor(ctx context.Context, t *schema.TwoFactor) error {
+	stampTwoFactor(t)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if stored, ok := m.twoFactor[t.UserID]; ok && stored.Enabled() {
+		return twoFactorConflict(t)
+	}
+	m.twoFactor[t.UserID] = cloneTwoFactor(t)
+	return nil
+}
+
+// GetTwoFactor looks up the enrollment of user userID
+func (m *MemoryStore) GetTwoFactor(ctx context.Context, userID string) (*schema.TwoFactor, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	t, ok := m.twoFactor[userID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return cloneTwoFactor(t), nil
+}
+
+// ConfirmTwoFactor enables the enrollment of user userID
+// error is 404 if there is none or it is confirmed already
+func (m *MemoryStore) ConfirmTwoFactor(ctx context.Context, userID string, step int64, recoveryCodes []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.twoFactor[userID]
+	if !ok || t.Enabled() {
+		return ErrNotFound
+	}
+	now := time.Now().UTC()
+	t.ConfirmedAt = &now
+	t.LastStep = step
+	t.RecoveryCodes = append([]string{}, recoveryCodes...)
+	return nil
+}
+
+// UseTOTPStep records that a code of step was accepted
+// error is 404 if step isn't newer than the last one
+func (m *MemoryStore) UseTOTPStep(ctx context.Context, userID string, step int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.twoFactor[userID]
+	if !ok || !t.Enabled() || t.LastStep >= step {
+		return ErrNotFound
+	}
+	t.LastStep = step
+	return nil
+}
+
+// UseRecoveryCode removes the recovery code with hash
+// error is 404 if the user has no such code
+func (m *MemoryStore) UseRecoveryCode(ctx context.Context, userID, hash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.twoFactor[userID]
+	if !ok || !t.Enabled() {
+		return ErrNotFound
+	}
+	for i, h := range t.RecoveryCodes {
+		if h == hash {
+			t.RecoveryCodes = append(t.RecoveryCodes[:i:i], t.RecoveryCodes[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// DeleteTwoFactor removes the enrollment of user userID
+// error is 404 if there is none
+func (m *MemoryStore) DeleteTwoFactor(ctx context.Context, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.twoFactor[userID]; !ok {
+		return ErrNotFound
+	}
+	delete(m.twoFactor, userID)
+	return nil
+}
+
+func clonePasskey(p *schema.Passkey) *schema.Passkey {
+	clone := *p
+	clone.PublicKey = append([]byte{}, p.PublicKey...)
+	clone.Transports = append([]string{}, p.Transports...)
+	clone.LastUsedAt = copyTime(p.LastUsedAt)
+	return &clone
+}
+
+// CreatePasskey stores a copy of p
+// error is 409 if the credential is registered already
+func (m *MemoryStore) CreatePasskey(ctx context.Context, p *schema.Passkey) error {
+	stampPasskey(p)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.passkeys[p.CredentialID]; ok {
+		return passkeyConflict(p)
+	}
+	m.passkeys[p.CredentialID] = clonePasskey(p)
+	return nil
+}
+
+// GetPasskey looks up the passkey with credentialID
+func (m *MemoryStore) GetPasskey(ctx context.Context, credentialID string) (*schema.Passkey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	p, ok := m.passkeys[credentialID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return clonePasskey(p), nil
+}
+
+// GetPasskeys returns the passkeys of user userID, oldest first
+func (m *MemoryStore) GetPasskeys(ctx context.Context, userID string) ([]*schema.Passkey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	passkeys := []*schema.Passkey{}
+	for _, p := range m.passkeys {
+		if p.UserID == userID {
+			passkeys = append(passkeys, clonePasskey(p))
+		}
+	}
+	sort.Slice(passkeys, func(i, j int) bool {
+		if !passkeys[i].CreatedAt.Equal(passkeys[j].CreatedAt) {
+			return passkeys[i].CreatedAt.Before(passkeys[j].CreatedAt)
+		}
+		return passkeys[i].ID.Hex() < passkeys[j].ID.Hex()
+	})
+	return passkeys, nil
+}
+
+// UsePasskey moves the counter of credentialID forward to signCount
+// error is 404 if it doesn't move forward
+func (m *MemoryStore) UsePasskey(ctx context.Context, credentialID string, signCount int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.passkeys[credentialID]
+	if !ok || !(p.SignCount < signCount || p.SignCount == 0 && signCount == 0) {
+		return ErrNotFound
+	}
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	p.SignCount = signCount
+	p.LastUsedAt = &now
+	return nil
+}
+
+// DeletePasskey removes the passkey id of user userID
+// error is 404 if the user has no such passkey
+func (m *MemoryStore) DeletePasskey(ctx context.Context, userID, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for credentialID, p := range m.passkeys {
+		if p.ID.Hex() == id && p.UserID == userID {
+			delete(m.passkeys, credentialID)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func clonePersonalToken(t *schema.PersonalToken) *schema.PersonalToken {
+	clone := *t
+	clone.Permissions = append([]string{}, t.Permissions...)
+	clone.LastUsedAt = copyTime(t.LastUsedAt)
+	return &clone
+}
+
+// CreatePersonalToken stores a copy of t
+func (m *MemoryStore) CreatePersonalToken(ctx context.Context, t *schema.PersonalToken) error {
+	stampPersonalToken(t)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.personal[t.ID] = clonePersonalToken(t)
+	return nil
+}
+
+// GetPersonalToken looks up a personal token by the hash of the token
+func (m *MemoryStore) GetPersonalToken(ctx context.Context, hash string) (*schema.PersonalToken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, t := range m.personal {
+		if t.Hash == hash {
+			return clonePersonalToken(t), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// GetPersonalTokens returns the personal tokens of user userID, oldest first
+func (m *MemoryStore) GetPersonalTokens(ctx context.Context, userID string) ([]*schema.PersonalToken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	tokens := []*schema.PersonalToken{}
+	for _, t := range m.personal {
+		if t.UserID == userID {
+			tokens = append(tokens, clonePersonalToken(t))
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		if !tokens[i].CreatedAt.Equal(tokens[j].CreatedAt) {
+			return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+		}
+		return tokens[i].ID.Hex() < tokens[j].ID.Hex()
+	})
+	return tokens, nil
+}
+
+// TouchPersonalToken sets the last use of token id to t
+// error is 404 if there is no such token
+func (m *MemoryStore) TouchPersonalToken(ctx context.Context, id string, t time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return ErrNotFound
+	}
+	token, ok := m.personal[oid]
+	if !ok {
+		return ErrNotFound
+	}
+	t = t.UTC().Truncate(time.Millisecond)
+	token.LastUsedAt = &t
+	return nil
+}
+
+// DeletePersonalToken removes the personal token id of user userID
+// error is 404 if the user has no such token
+func (m *MemoryStore) DeletePersonalToken(ctx context.Context, userID, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return ErrNotFound
+	}
+	if t, ok := m.personal[oid]; !ok || t.UserID != userID {
+		return ErrNotFound
+	}
+	delete(m.personal, oid)
+	return nil
+}
+
+// DeleteUserPersonalTokens removes every personal token of user userID
+func (m *MemoryStore) DeleteUserPersonalTokens(ctx context.Context, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, t := range m.personal {
+		if t.UserID == userID {
+			delete(m.personal, id)
+		}
+	}
+	return nil
+}
+
+// PurgeExpiredPersonalTokens removes the personal tokens expired before t
+// and returns how many were removed
+func (m *MemoryStore) PurgeExpiredPersonalTokens(ctx context.Context, t time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := 0
+	for id, token := range m.personal {
+		if token.ExpiresAt.Before(t) {
+			delete(m.personal, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// CreateEmailToken stores a copy of t
+func (m *MemoryStore) CreateEmailToken(ctx context.Context, t *schema.EmailToken) error {
+	stampEmailToken(t)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c := *t
+	m.emailTokens[t.Hash] = &c
+	return nil
+}
+
+// GetEmailToken returns a copy of the token of purpose with hash
+// error is 404 if there is none or it expired
+func (m *MemoryStore) GetEmailToken(ctx context.Context, purpose, hash string, now time.Time) (*schema.EmailToken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	t, ok := m.emailTokens[hash]
+	if !ok || t.Purpose != purpose || !t.ExpiresAt.After(now) {
+		return nil, ErrNotFound
+	}
+	c := *t
+	return &c, nil
+}
+
+// UseEmailToken removes the token of purpose with hash and returns it
+// error is 404 if there is none or it expired
+func (m *MemoryStore) UseEmailToken(ctx context.Context, purpose, hash string, now time.Time) (*schema.EmailToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.emailTokens[hash]
+	if !ok || t.Purpose != purpose || !t.ExpiresAt.After(now) {
+		return nil, ErrNotFound
+	}
+	delete(m.emailTokens, hash)
+	return t, nil
+}
+
+// LastEmailToken returns a copy of the newest token of purpose of user userID
+// error is 404 if there is none
+func (m *MemoryStore) LastEmailToken(ctx context.Context, userID, purpose string) (*schema.EmailToken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var last *schema.EmailToken
+	for _, t := range m.emailTokens {
+		if t.UserID != userID || t.Purpose != purpose {
+			continue
+		}
+		if last == nil || t.CreatedAt.After(last.CreatedAt) ||
+			(t.CreatedAt.Equal(last.CreatedAt) && t.ID.Hex() > last.ID.Hex()) {
+			last = t
+		}
+	}
+	if last == nil {
+		return nil, ErrNotFound
+	}
+	c := *last
+	return &c, nil
+}
+
+// DeleteEmailTokens removes the tokens of purpose of user userID
+func (m *MemoryStore) DeleteEmailTokens(ctx context.Context, userID, purpose string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for hash, t := range m.emailTokens {
+		if t.UserID == userID && t.Purpose == purpose {
+			delete(m.emailTokens, hash)
+		}
+	}
+	return nil
+}
+
+// PurgeExpiredEmailTokens removes the tokens expired before t and returns
+// how many were removed
+func (m *MemoryStore) PurgeExpiredEmailTokens(ctx context.Context, t time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := 0
+	for hash, token := range m.emailTokens {
+		if token.ExpiresAt.Before(t) {
+			delete(m.emailTokens, hash)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// GetLoginFailures returns a copy of the failures of key that haven't expired by now
+// error is 404 if there are none
+func (m *MemoryStore) GetLoginFailures(ctx context.Context, key string, now time.Time) (*schema.LoginFailures, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	f, ok := m.loginFailures[key]
+	if !ok || !f.ExpiresAt.After(now) {
+		return nil, ErrNotFound
+	}
+	c := *f
+	return &c, nil
+}
+
+// AddLoginFailure counts a failure of key at now
+func (m *MemoryStore) AddLoginFailure(ctx context.Context, key string, now time.Time, window time.Duration) (*schema.LoginFailures, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now = now.UTC().Truncate(time.Millisecond)
+	f, ok := m.loginFailures[key]
+	if !ok || !f.ExpiresAt.After(now) {
+		f = &schema.LoginFailures{Key: key}
+		m.loginFailures[key] = f
+	}
+	f.Count++
+	f.LastFailure = now
+	f.ExpiresAt = now.Add(window)
+	c := *f
+	return &c, nil
+}
+
+// ClearLoginFailures removes the failures of key
+func (m *MemoryStore) ClearLoginFailures(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.loginFailures, key)
+	return nil
+}
+
+// PurgeExpiredLoginFailures removes the counts expired before t and returns
+// how many were removed
+func (m *MemoryStore) PurgeExpiredLoginFailures(ctx context.Context, t time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := 0
+	for key, f := range m.loginFailures {
+		if f.ExpiresAt.Before(t) {
+			delete(m.loginFailures, key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// TakeRateToken takes a token out of the bucket of key under p
+func (m *MemoryStore) TakeRateToken(ctx context.Context, key string, p ratelimit.Policy, now time.Time) (ratelimit.Result, error) {
+	return m.rates.Take(ctx, key, p, now)
+}
+
+// PurgeExpiredRateBuckets removes nothing, the buckets in process drop
+// themselves once they are full again
+func (m *MemoryStore) PurgeExpiredRateBuckets(ctx context.Context, t time.Time) (int, error) {
+	return 0, nil
+}
+
+// CreateSession stores a copy of s
+// error is 409 if the session id is taken
+func (m *MemoryStore) CreateSession(ctx context.Context, s *schema.Session) error {
+	stampSession(s)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.sessions[s.ID]; ok {
+		return errors.NewConflictError("session", "id", s.ID)
+	}
+	clone := *s
+	m.sessions[s.ID] = &clone
+	return nil
+}
+
+// GetSession looks up session id
+func (m *MemoryStore) GetSession(ctx context.Context, id string) (*schema.Session, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	s, ok := m.sessions[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	clone := *s
+	return &clone, nil
+}
+
+// GetSessions returns the sessions of user userID active at now, oldest first
+func (m *MemoryStore) GetSessions(ctx context.Context, userID string, now time.Time) ([]*schema.Session, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	sessions := []*schema.Session{}
+	for _, s := range m.sessions {
+		if s.UserID == userID && s.Active(now) {
+			clone := *s
+			sessions = append(sessions, &clone)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].CreatedAt.Equal(sessions[j].CreatedAt) {
+			return sessions[i].CreatedAt.Before(sessions[j].CreatedAt)
+		}
+		return sessions[i].ID < sessions[j].ID
+	})
+	return sessions, nil
+}
+
+// TouchSession sets the last use of session id to t
+// error is 404 if there is no such session
+func (m *MemoryStore) TouchSession(ctx context.Context, id string, t time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[id]
+	if !ok {
+		return ErrNotFound
+	}
+	s.LastSeenAt = t.UTC().Truncate(time.Millisecond)
+	return nil
+}
+
+// DeleteSession removes the session id of user userID
+// error is 404 if the user has no such session
+func (m *MemoryStore) DeleteSession(ctx context.Context, userID, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if s, ok := m.sessions[id]; !ok || s.UserID != userID {
+		return ErrNotFound
+	}
+	delete(m.sessions, id)
+	return nil
+}
+
+// DeleteUserSessions removes every session of user userID
+func (m *MemoryStore) DeleteUserSessions(ctx context.Context, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, s := range m.sessions {
+		if s.UserID == userID {
+			delete(m.sessions, id)
+		}
+	}
+	return nil
+}
+
+// PurgeExpiredSessions removes the sessions expired before t and returns
+// how many were removed
+func (m *MemoryStore) PurgeExpiredSessions(ctx context.Context, t time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := 0
+	for id, session := range m.sessions {
+		if session.ExpiresAt.Before(t) {
+			delete(m.sessions, id)
+			n++
+		}
+	}
+	return n, nil
+}
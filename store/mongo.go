@@ -1,81 +1,117 @@
 package store
 
 import (
+	"context"
 	"fmt"
 	"time"
 
 	"github.com/mgutz/logxi/v1"
-	"gopkg.in/mgo.v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 
 	"github.com/briansan/user-go/config"
+	"github.com/briansan/user-go/migrations"
 )
 
 var (
 	databaseName = config.GetMongoDatabase()
 	logger       = log.New("store")
 
-	mongo *mgo.Session
+	client *mongo.Client
 )
 
 type MongoStore struct {
-	s *mgo.Session
+	db *mongo.Database
 }
 
-// InitMongoSession resets the mongo session pointer with updated connection info
-func InitMongoSession() error {
+// connectMongo returns a client of env.MONGO_URL that answered a ping
+func connectMongo(ctx context.Context) (*mongo.Client, error) {
+	url := config.GetMongoURL()
+	logger.Debug("init mongo", "url", url)
+	c, err := mongo.Connect(ctx, options.Client().ApplyURI(url))
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Ping(ctx, nil); err != nil {
+		c.Disconnect(context.Background())
+		return nil, err
+	}
+	return c, nil
+}
+
+// InitMongoSession resets the mongo client with updated connection info
+func InitMongoSession(ctx context.Context) error {
 	// To avoid a socket leak
-	if mongo != nil {
-		CleanupMongoSession()
+	if client != nil {
+		CleanupMongoSession(ctx)
 	}
 
-	// Establish new session
-	url := config.GetMongoURL()
-	logger.Debug("init mongo", "url", url)
+	// Establish new client
 	var err error
-	if mongo, err = mgo.Dial(url); err != nil {
+	if client, err = connectMongo(ctx); err != nil {
 		return err
 	}
 
-	// Ensure indicies
-	ensureUserIndex()
-
+	// Apply pending migrations
+	if config.GetMigrateOnStart() {
+		return migrations.NewMongoRunner(client.Database(databaseName)).Up(ctx, migrations.Latest)
+	}
 	return nil
 }
 
-// CleanupMongoSession closes the current session and sets the pointer to nil
-func CleanupMongoSession() {
-	if mongo == nil {
+// CleanupMongoSession disconnects the current client and sets the pointer to nil
+func CleanupMongoSession(ctx context.Context) {
+	if client == nil {
 		return
 	}
-	mongo.Close()
-	time.Sleep(time.Second)
-
-	mongo = nil
+	client.Disconnect(ctx)
+	client = nil
 }
 
 // Nuke destroys the database if it is in a test environment
-func Nuke() error {
-	if config.IsTesting() && mongo != nil {
-		return mongo.DB(databaseName).DropDatabase()
+func Nuke(ctx context.Context) error {
+	if config.IsTesting() && client != nil {
+		return client.Database(databaseName).Drop(ctx)
 	}
 	return fmt.Errorf("env.TESTING must be set to true")
 }
 
-// NewMongoStore returns an instance of the store with a copied mongo session
+// NewMongoStore returns an instance of the store on the current client
+// error is 500 if mongo ping fails
+func NewMongoStore(ctx context.Context) (*MongoStore, error) {
+	if client == nil {
+		return nil, fmt.Errorf("mongo is not initialized")
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		return nil, err
+	}
+	return &MongoStore{db: client.Database(databaseName)}, nil
+}
+
+// Copy returns the same store since the client pools its own connections
 // error is 500 if mongo ping fails
-func NewMongoStore() (*MongoStore, error) {
-	if err := mongo.Ping(); err != nil {
+func (m *MongoStore) Copy(ctx context.Context) (UserStore, error) {
+	if err := m.db.Client().Ping(ctx, nil); err != nil {
 		return nil, err
 	}
-	return &MongoStore{s: mongo.Copy()}, nil
+	return m, nil
 }
 
-// Cleanup closes the mongo session of this store object
-func (m *MongoStore) Cleanup() {
-	m.s.Close()
+// Cleanup is a no-op, connections go back to the pool of the client on their own
+func (m *MongoStore) Cleanup() {}
+
+// GetDatabase returns a pointer to a mongo database object
+func (m *MongoStore) GetDatabase() *mongo.Database {
+	return m.db
 }
 
-// GetDatabase returns a pointer to an mgo database object
-func (m *MongoStore) GetDatabase() *mgo.Database {
-	return m.s.DB(databaseName)
+// deleteExpired removes the documents of c whose expiresAt is before t and
+// returns how many were removed
+func deleteExpired(ctx context.Context, c *mongo.Collection, t time.Time) (int, error) {
+	res, err := c.DeleteMany(ctx, bson.M{"expiresAt": bson.M{"$lt": t}})
+	if err != nil {
+		return 0, err
+	}
+	return int(res.DeletedCount), nil
 }
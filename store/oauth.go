@@ -0,0 +1,135 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/briansan/user-go/schema"
+)
+
+const (
+	oauthClientsCollectionName = "oauthClients"
+	authCodesCollectionName    = "authCodes"
+)
+
+// OAuthStore keeps the registered oauth clients and the authorization
+// codes issued to them
+type OAuthStore interface {
+	// CreateClient registers c, stamping its creation time
+	CreateClient(ctx context.Context, c *schema.OAuthClient) error
+	// GetClient looks up a client by its client id
+	GetClient(ctx context.Context, id string) (*schema.OAuthClient, error)
+	// GetClients returns every client, oldest first
+	GetClients(ctx context.Context) ([]*schema.OAuthClient, error)
+	// DeleteClient removes client id
+	// error is 404 if there is none
+	DeleteClient(ctx context.Context, id string) error
+	// CreateAuthCode stores code, stamping its id
+	CreateAuthCode(ctx context.Context, code *schema.AuthCode) error
+	// ConsumeAuthCode marks the code with hash used and returns it
+	// error is 404 if there is none or it was used already
+	ConsumeAuthCode(ctx context.Context, hash string) (*schema.AuthCode, error)
+	// PurgeExpiredAuthCodes removes the codes expired before t and returns
+	// how many were removed
+	PurgeExpiredAuthCodes(ctx context.Context, t time.Time) (int, error)
+}
+
+// stampClient sets the creation time of c
+// times are kept at millisecond precision since that is all mongo stores
+func stampClient(c *schema.OAuthClient) {
+	c.CreatedAt = time.Now().UTC().Truncate(time.Millisecond)
+}
+
+// stampAuthCode gives code an id
+func stampAuthCode(code *schema.AuthCode) {
+	code.ID = primitive.NewObjectID()
+	code.AuthTime = code.AuthTime.UTC().Truncate(time.Millisecond)
+	code.ExpiresAt = code.ExpiresAt.UTC().Truncate(time.Millisecond)
+}
+
+// GetOAuthClientsCollection returns a mongo instance to the oauth clients collection
+func (m *MongoStore) GetOAuthClientsCollection() *mongo.Collection {
+	return m.GetDatabase().Collection(oauthClientsCollectionName)
+}
+
+// GetAuthCodesCollection returns a mongo instance to the authorization codes collection
+func (m *MongoStore) GetAuthCodesCollection() *mongo.Collection {
+	return m.GetDatabase().Collection(authCodesCollectionName)
+}
+
+// CreateClient inserts c into the oauth clients collection
+// error is 409 if the client id is taken, 500 if mongo fails, else nil
+func (m *MongoStore) CreateClient(ctx context.Context, c *schema.OAuthClient) error {
+	stampClient(c)
+	_, err := m.GetOAuthClientsCollection().InsertOne(ctx, c)
+	return err
+}
+
+// GetClient looks up a client by its client id
+func (m *MongoStore) GetClient(ctx context.Context, id string) (*schema.OAuthClient, error) {
+	c := schema.OAuthClient{}
+	if err := m.GetOAuthClientsCollection().FindOne(ctx, bson.M{"_id": id}).Decode(&c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// GetClients returns every client, oldest first
+func (m *MongoStore) GetClients(ctx context.Context) ([]*schema.OAuthClient, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}})
+	iter, err := m.GetOAuthClientsCollection().Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	clients := []*schema.OAuthClient{}
+	err = iter.All(ctx, &clients)
+	return clients, err
+}
+
+// DeleteClient removes client id
+// error is 404 if there is none, 500 if mongo fails
+func (m *MongoStore) DeleteClient(ctx context.Context, id string) error {
+	res, err := m.GetOAuthClientsCollection().DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// CreateAuthCode inserts code into the authorization codes collection
+// error is 500 if mongo fails, else nil
+func (m *MongoStore) CreateAuthCode(ctx context.Context, code *schema.AuthCode) error {
+	stampAuthCode(code)
+	_, err := m.GetAuthCodesCollection().InsertOne(ctx, code)
+	return err
+}
+
+// ConsumeAuthCode marks the code with hash used and returns it
+// error is 404 if there is none or it was used already, 500 if mongo fails
+func (m *MongoStore) ConsumeAuthCode(ctx context.Context, hash string) (*schema.AuthCode, error) {
+	// Only one concurrent exchange can match the unused code
+	code := schema.AuthCode{}
+	err := m.GetAuthCodesCollection().FindOneAndUpdate(ctx,
+		bson.M{"hash": hash, "usedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"usedAt": time.Now().UTC()}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&code)
+	if err != nil {
+		return nil, err
+	}
+	return &code, nil
+}
+
+// PurgeExpiredAuthCodes removes the codes expired before t and returns how
+// many were removed
+func (m *MongoStore) PurgeExpiredAuthCodes(ctx context.Context, t time.Time) (int, error) {
+	return deleteExpired(ctx, m.GetAuthCodesCollection(), t)
+}
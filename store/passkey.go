@@ -0,0 +1,122 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/briansan/user-go/errors"
+	"github.com/briansan/user-go/schema"
+)
+
+const (
+	passkeysCollectionName = "passkeys"
+)
+
+// PasskeyStore keeps the WebAuthn credentials of users, they go away
+// when their user is purged
+type PasskeyStore interface {
+	// CreatePasskey stores p, stamping its id and creation time
+	// error is 409 if the credential is registered already
+	CreatePasskey(ctx context.Context, p *schema.Passkey) error
+	// GetPasskey looks up the passkey with credentialID
+	GetPasskey(ctx context.Context, credentialID string) (*schema.Passkey, error)
+	// GetPasskeys returns the passkeys of user userID, oldest first
+	GetPasskeys(ctx context.Context, userID string) ([]*schema.Passkey, error)
+	// UsePasskey records an assertion with signCount and the time of it
+	// error is 404 unless signCount is past the stored one, or both are
+	// zero for authenticators that don't count
+	UsePasskey(ctx context.Context, credentialID string, signCount int64) error
+	// DeletePasskey removes the passkey id of user userID
+	DeletePasskey(ctx context.Context, userID, id string) error
+}
+
+// stampPasskey gives p an id and its creation time
+func stampPasskey(p *schema.Passkey) {
+	p.ID = primitive.NewObjectID()
+	p.CreatedAt = time.Now().UTC().Truncate(time.Millisecond)
+	if p.Transports == nil {
+		p.Transports = []string{}
+	}
+}
+
+// passkeyConflict is the error of registering a credential twice
+func passkeyConflict(p *schema.Passkey) error {
+	return errors.NewConflictError("passkey", "credentialID", p.CredentialID)
+}
+
+// GetPasskeysCollection returns a mongo instance to the passkeys collection
+func (m *MongoStore) GetPasskeysCollection() *mongo.Collection {
+	return m.GetDatabase().Collection(passkeysCollectionName)
+}
+
+// CreatePasskey inserts p into the passkeys collection
+// error is 409 if the credential is registered already, 500 if mongo fails, else nil
+func (m *MongoStore) CreatePasskey(ctx context.Context, p *schema.Passkey) error {
+	stampPasskey(p)
+	_, err := m.GetPasskeysCollection().InsertOne(ctx, p)
+	if mongo.IsDuplicateKeyError(err) {
+		return passkeyConflict(p)
+	}
+	return err
+}
+
+// GetPasskey looks up the passkey with credentialID
+func (m *MongoStore) GetPasskey(ctx context.Context, credentialID string) (*schema.Passkey, error) {
+	p := schema.Passkey{}
+	if err := m.GetPasskeysCollection().FindOne(ctx, bson.M{"credentialID": credentialID}).Decode(&p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// GetPasskeys returns the passkeys of user userID, oldest first
+func (m *MongoStore) GetPasskeys(ctx context.Context, userID string) ([]*schema.Passkey, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}})
+	iter, err := m.GetPasskeysCollection().Find(ctx, bson.M{"userID": userID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	passkeys := []*schema.Passkey{}
+	err = iter.All(ctx, &passkeys)
+	return passkeys, err
+}
+
+// UsePasskey moves the counter of credentialID forward to signCount
+// error is 404 if it doesn't move forward, 500 if mongo fails, else nil
+func (m *MongoStore) UsePasskey(ctx context.Context, credentialID string, signCount int64) error {
+	q := bson.M{"credentialID": credentialID, "signCount": bson.M{"$lt": signCount}}
+	if signCount == 0 {
+		q["signCount"] = 0
+	}
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	res, err := m.GetPasskeysCollection().UpdateOne(ctx, q, bson.M{"$set": bson.M{"signCount": signCount, "lastUsedAt": now}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeletePasskey removes the passkey id of user userID
+// error is 404 if the user has no such passkey, 500 if mongo fails, else nil
+func (m *MongoStore) DeletePasskey(ctx context.Context, userID, id string) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return ErrNotFound
+	}
+	res, err := m.GetPasskeysCollection().DeleteOne(ctx, bson.M{"_id": oid, "userID": userID})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/briansan/user-go/schema"
+)
+
+const (
+	personalTokensCollectionName = "personalTokens"
+)
+
+// PersonalTokenStore keeps the personal access tokens of users, expired
+// ones go away with PurgeExpiredPersonalTokens and the rest when their
+// user is purged
+type PersonalTokenStore interface {
+	// CreatePersonalToken stores t, stamping its id and creation time
+	CreatePersonalToken(ctx context.Context, t *schema.PersonalToken) error
+	// GetPersonalToken looks up a personal token by the hash of the token
+	GetPersonalToken(ctx context.Context, hash string) (*schema.PersonalToken, error)
+	// GetPersonalTokens returns the personal tokens of user userID, oldest first
+	GetPersonalTokens(ctx context.Context, userID string) ([]*schema.PersonalToken, error)
+	// TouchPersonalToken records that token id was used at t
+	TouchPersonalToken(ctx context.Context, id string, t time.Time) error
+	// DeletePersonalToken removes the personal token id of user userID
+	DeletePersonalToken(ctx context.Context, userID, id string) error
+	// DeleteUserPersonalTokens removes every personal token of user userID
+	DeleteUserPersonalTokens(ctx context.Context, userID string) error
+	// PurgeExpiredPersonalTokens removes the personal tokens expired before
+	// t and returns how many were removed
+	PurgeExpiredPersonalTokens(ctx context.Context, t time.Time) (int, error)
+}
+
+// stampPersonalToken gives t an id and its creation time
+// times are kept at millisecond precision since that is all mongo stores
+func stampPersonalToken(t *schema.PersonalToken) {
+	t.ID = primitive.NewObjectID()
+	t.CreatedAt = time.Now().UTC().Truncate(time.Millisecond)
+	t.ExpiresAt = t.ExpiresAt.UTC().Truncate(time.Millisecond)
+	if t.Permissions == nil {
+		t.Permissions = []string{}
+	}
+}
+
+// GetPersonalTokensCollection returns a mongo instance to the personal tokens collection
+func (m *MongoStore) GetPersonalTokensCollection() *mongo.Collection {
+	return m.GetDatabase().Collection(personalTokensCollectionName)
+}
+
+// CreatePersonalToken inserts t into the personal tokens collection
+func (m *MongoStore) CreatePersonalToken(ctx context.Context, t *schema.PersonalToken) error {
+	stampPersonalToken(t)
+	_, err := m.GetPersonalTokensCollection().InsertOne(ctx, t)
+	return err
+}
+
+// GetPersonalToken looks up a personal token by the hash of the token
+func (m *MongoStore) GetPersonalToken(ctx context.Context, hash string) (*schema.PersonalToken, error) {
+	t := schema.PersonalToken{}
+	if err := m.GetPersonalTokensCollection().FindOne(ctx, bson.M{"hash": hash}).Decode(&t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// GetPersonalTokens returns the personal tokens of user userID, oldest first
+func (m *MongoStore) GetPersonalTokens(ctx context.Context, userID string) ([]*schema.PersonalToken, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}})
+	iter, err := m.GetPersonalTokensCollection().Find(ctx, bson.M{"userID": userID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	tokens := []*schema.PersonalToken{}
+	err = iter.All(ctx, &tokens)
+	return tokens, err
+}
+
+// TouchPersonalToken sets the last use of token id to t
+// error is 404 if there is no such token, 500 if mongo fails, else nil
+func (m *MongoStore) TouchPersonalToken(ctx context.Context, id string, t time.Time) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return ErrNotFound
+	}
+	t = t.UTC().Truncate(time.Millisecond)
+	res, err := m.GetPersonalTokensCollection().UpdateOne(ctx, bson.M{"_id": oid}, bson.M{"$set": bson.M{"lastUsedAt": t}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeletePersonalToken removes the personal token id of user userID
+// error is 404 if the user has no such token, 500 if mongo fails, else nil
+func (m *MongoStore) DeletePersonalToken(ctx context.Context, userID, id string) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return ErrNotFound
+	}
+	res, err := m.GetPersonalTokensCollection().DeleteOne(ctx, bson.M{"_id": oid, "userID": userID})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteUserPersonalTokens removes every personal token of user userID
+func (m *MongoStore) DeleteUserPersonalTokens(ctx context.Context, userID string) error {
+	_, err := m.GetPersonalTokensCollection().DeleteMany(ctx, bson.M{"userID": userID})
+	return err
+}
+
+// PurgeExpiredPersonalTokens removes the personal tokens expired before t
+// and returns how many were removed
+func (m *MongoStore) PurgeExpiredPersonalTokens(ctx context.Context, t time.Time) (int, error) {
+	return deleteExpired(ctx, m.GetPersonalTokensCollection(), t)
+}
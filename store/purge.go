@@ -0,0 +1,70 @@
+package store
+
+import (
+	"context"
+	"time"
+)
+
+// purge removes the expired records of every part of s and, unless after
+// is zero, hard-deletes users tombstoned longer than after ago
+func purge(ctx context.Context, s UserStore, after time.Duration) {
+	db, err := s.Copy(ctx)
+	if err != nil {
+		logger.Warn("purge skipped", "err", err)
+		return
+	}
+	defer db.Cleanup()
+
+	now := time.Now()
+	for _, p := range []struct {
+		records string
+		purge   func(context.Context, time.Time) (int, error)
+	}{
+		{"tokens", db.PurgeExpiredTokens},
+		{"auth codes", db.PurgeExpiredAuthCodes},
+		{"personal tokens", db.PurgeExpiredPersonalTokens},
+		{"email tokens", db.PurgeExpiredEmailTokens},
+		{"login failures", db.PurgeExpiredLoginFailures},
+		{"rate buckets", db.PurgeExpiredRateBuckets},
+		{"sessions", db.PurgeExpiredSessions},
+	} {
+		if n, err := p.purge(ctx, now); err != nil {
+			logger.Warn("expired purge failed", "records", p.records, "err", err)
+		} else if n > 0 {
+			logger.Info("purged expired records", "records", p.records, "count", n)
+		}
+	}
+
+	if after <= 0 {
+		return
+	}
+	n, err := db.PurgeDeletedUsers(ctx, time.Now().Add(-after))
+	if err != nil {
+		logger.Warn("purge failed", "err", err)
+		return
+	}
+	if n > 0 {
+		logger.Info("purged deleted users", "count", n)
+	}
+}
+
+// StartPurge removes expired records and hard-deletes users tombstoned
+// longer than after ago (never if after is zero) right away and then on
+// every interval, until the returned func is called which also cancels
+// a purge that is still running
+func StartPurge(s UserStore, after, interval time.Duration) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			purge(ctx, s, after)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return cancel
+}
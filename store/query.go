@@ -0,0 +1,204 @@
+package store
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/briansan/user-go/errors"
+	"github.com/briansan/user-go/schema"
+)
+
+const (
+	SortID       = "id"
+	SortUsername = "username"
+	SortEmail    = "email"
+	SortRole     = "role"
+
+	DefaultLimit = 100
+	MaxLimit     = 1000
+)
+
+// UserQuery filters, orders and pages the users returned by FindUsers
+type UserQuery struct {
+	// Role only keeps users with exactly this role
+	Role *int
+	// UsernamePrefix only keeps usernames starting with it
+	UsernamePrefix string
+	// EmailDomain only keeps emails ending in @EmailDomain, case insensitive
+	EmailDomain string
+	// Sort is one of the Sort* fields, prefixed with - for descending
+	Sort string
+	// Cursor is UserPage.Next of the previous page
+	Cursor string
+	// Limit is the page size, DefaultLimit if zero
+	Limit int
+}
+
+// UserPage is one page of FindUsers
+type UserPage struct {
+	Users []*schema.UserSecure
+	// Total counts every user matching the filters, not just this page
+	Total int
+	// Next is the cursor of the following page, empty on the last one
+	Next string
+}
+
+// cursor is the position after the last user of a page
+// it carries the sort so it can't be replayed against another order
+type cursor struct {
+	Sort string `json:"s"`
+	Key  string `json:"k"`
+	ID   string `json:"i"`
+}
+
+// Validate normalizes q and checks its sort, limit and cursor
+func (q *UserQuery) Validate() error {
+	if len(q.Sort) == 0 {
+		q.Sort = SortID
+	}
+	switch q.SortField() {
+	case SortID, SortUsername, SortEmail, SortRole:
+	default:
+		return errors.NewValidationError("sort", "one of id, username, email, role")
+	}
+
+	if q.Limit == 0 {
+		q.Limit = DefaultLimit
+	}
+	if q.Limit < 0 || q.Limit > MaxLimit {
+		return errors.NewValidationError("limit", "integer between 1 and "+strconv.Itoa(MaxLimit))
+	}
+
+	if _, err := q.after(); err != nil {
+		return errors.NewValidationError("cursor", "cursor from a previous page")
+	}
+	return nil
+}
+
+// SortField returns the field q is ordered by
+func (q *UserQuery) SortField() string {
+	return strings.TrimPrefix(q.Sort, "-")
+}
+
+// Descending reports whether q is ordered from the largest value down
+func (q *UserQuery) Descending() bool {
+	return strings.HasPrefix(q.Sort, "-")
+}
+
+// after decodes q.Cursor, nil if q starts at the first page
+func (q *UserQuery) after() (*cursor, error) {
+	if len(q.Cursor) == 0 {
+		return nil, nil
+	}
+	buf, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	c := &cursor{}
+	if err := json.Unmarshal(buf, c); err != nil {
+		return nil, err
+	}
+	if c.Sort != q.Sort || !primitive.IsValidObjectID(c.ID) {
+		return nil, errors.NewValidationError("cursor", "cursor from a previous page")
+	}
+	if q.SortField() == SortRole {
+		if _, err := strconv.Atoi(c.Key); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// afterValue returns the sort key of the cursor typed for the database
+func (q *UserQuery) afterValue(c *cursor) interface{} {
+	switch q.SortField() {
+	case SortID:
+		id, _ := primitive.ObjectIDFromHex(c.ID)
+		return id
+	case SortRole:
+		role, _ := strconv.Atoi(c.Key)
+		return role
+	}
+	return c.Key
+}
+
+// cursorUser returns a user sitting exactly at c for compare
+func (q *UserQuery) cursorUser(c *cursor) *schema.UserSecure {
+	id, _ := primitive.ObjectIDFromHex(c.ID)
+	u := &schema.UserSecure{ID: id}
+	switch q.SortField() {
+	case SortUsername:
+		u.Username = c.Key
+	case SortEmail:
+		u.Email = c.Key
+	case SortRole:
+		u.Role, _ = strconv.Atoi(c.Key)
+	}
+	return u
+}
+
+// sortKey returns the value of u that q is ordered by
+func (q *UserQuery) sortKey(u *schema.UserSecure) string {
+	switch q.SortField() {
+	case SortUsername:
+		return u.Username
+	case SortEmail:
+		return u.Email
+	case SortRole:
+		return strconv.Itoa(u.Role)
+	}
+	return u.ID.Hex()
+}
+
+// page trims users, fetched with a limit of q.Limit + 1, down to q.Limit
+// and sets the next cursor if there was more
+func (q *UserQuery) page(users []*schema.UserSecure, total int) *UserPage {
+	p := &UserPage{Users: users, Total: total}
+	if len(users) <= q.Limit {
+		return p
+	}
+
+	p.Users = users[:q.Limit]
+	last := p.Users[q.Limit-1]
+	buf, _ := json.Marshal(&cursor{Sort: q.Sort, Key: q.sortKey(last), ID: last.ID.Hex()})
+	p.Next = base64.RawURLEncoding.EncodeToString(buf)
+	return p
+}
+
+// matches reports whether u passes the filters of q
+func (q *UserQuery) matches(u *schema.UserSecure) bool {
+	if q.Role != nil && u.Role != *q.Role {
+		return false
+	}
+	if !strings.HasPrefix(u.Username, q.UsernamePrefix) {
+		return false
+	}
+	if len(q.EmailDomain) > 0 && !strings.HasSuffix(strings.ToLower(u.Email), "@"+strings.ToLower(q.EmailDomain)) {
+		return false
+	}
+	return true
+}
+
+// compare orders a and b by the sort field of q, then by id
+func (q *UserQuery) compare(a, b *schema.UserSecure) int {
+	c := 0
+	switch q.SortField() {
+	case SortUsername:
+		c = strings.Compare(a.Username, b.Username)
+	case SortEmail:
+		c = strings.Compare(a.Email, b.Email)
+	case SortRole:
+		c = a.Role - b.Role
+	}
+	if c == 0 {
+		c = strings.Compare(a.ID.Hex(), b.ID.Hex())
+	}
+	if q.Descending() {
+		return -c
+	}
+	return c
+}
@@ -0,0 +1,106 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/briansan/user-go/ratelimit"
+)
+
+const (
+	rateBucketsCollectionName = "rateBuckets"
+
+	// rateRetries bounds how often a bucket write that raced another one
+	// is tried again, a bucket that keeps changing counts as empty
+	rateRetries = 5
+)
+
+// RateLimitStore keeps the token buckets of the rate limits so that every
+// replica enforces the same ones, full buckets go away with
+// PurgeExpiredRateBuckets
+type RateLimitStore interface {
+	// TakeRateToken takes a token out of the bucket of key under p
+	TakeRateToken(ctx context.Context, key string, p ratelimit.Policy, now time.Time) (ratelimit.Result, error)
+	// PurgeExpiredRateBuckets removes the buckets full again before t and
+	// returns how many were removed
+	PurgeExpiredRateBuckets(ctx context.Context, t time.Time) (int, error)
+}
+
+// rateBucket is a stored token bucket, Version guards against lost
+// updates and ExpiresAt is when it is full again
+type rateBucket struct {
+	Key       string    `bson:"_id"`
+	Tokens    float64   `bson:"tokens"`
+	UpdatedAt time.Time `bson:"updatedAt"`
+	Version   int       `bson:"version"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+// takeRateToken runs p on stored, the bucket of key or nil if it has none,
+// and returns what to store if the request is let through
+func takeRateToken(key string, stored *rateBucket, p ratelimit.Policy, now time.Time) (*rateBucket, ratelimit.Result) {
+	b, version := p.Full(now), 0
+	if stored != nil {
+		b, version = ratelimit.Bucket{Tokens: stored.Tokens, UpdatedAt: stored.UpdatedAt}, stored.Version
+	}
+	b, r := p.Take(b, now)
+	if !r.Allowed {
+		return nil, r
+	}
+	return &rateBucket{Key: key, Tokens: b.Tokens, UpdatedAt: b.UpdatedAt, Version: version + 1, ExpiresAt: now.Add(r.Reset)}, r
+}
+
+// GetRateBucketsCollection returns a mongo instance to the rate buckets collection
+func (m *MongoStore) GetRateBucketsCollection() *mongo.Collection {
+	return m.GetDatabase().Collection(rateBucketsCollectionName)
+}
+
+// TakeRateToken takes a token out of the bucket of key under p, a bucket
+// that kept changing through rateRetries tries counts as empty
+// error is 500 if mongo fails, else nil
+func (m *MongoStore) TakeRateToken(ctx context.Context, key string, p ratelimit.Policy, now time.Time) (ratelimit.Result, error) {
+	now = now.UTC().Truncate(time.Millisecond)
+	for i := 0; i < rateRetries; i++ {
+		var stored *rateBucket
+		b := rateBucket{}
+		err := m.GetRateBucketsCollection().FindOne(ctx, bson.M{"_id": key}).Decode(&b)
+		if err == nil {
+			stored = &b
+		} else if err != ErrNotFound {
+			return ratelimit.Result{}, err
+		}
+
+		next, r := takeRateToken(key, stored, p, now)
+		if next == nil {
+			return r, nil
+		}
+
+		// Only write over the version that was read
+		if stored == nil {
+			_, err = m.GetRateBucketsCollection().InsertOne(ctx, next)
+			if mongo.IsDuplicateKeyError(err) {
+				continue
+			}
+		} else {
+			var res *mongo.UpdateResult
+			res, err = m.GetRateBucketsCollection().ReplaceOne(ctx, bson.M{"_id": key, "version": stored.Version}, next)
+			if err == nil && res.MatchedCount == 0 {
+				continue
+			}
+		}
+		if err != nil {
+			return ratelimit.Result{}, err
+		}
+		return r, nil
+	}
+	return p.Empty(), nil
+}
+
+// PurgeExpiredRateBuckets removes the buckets full again before t and
+// returns how many were removed
+func (m *MongoStore) PurgeExpiredRateBuckets(ctx context.Context, t time.Time) (int, error) {
+	return deleteExpired(ctx, m.GetRateBucketsCollection(), t)
+}
@@ -0,0 +1,120 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/briansan/user-go/schema"
+)
+
+const (
+	sessionsCollectionName = "sessions"
+)
+
+// SessionStore keeps the logins of users, expired ones go away with
+// PurgeExpiredSessions and the rest when their user is purged
+type SessionStore interface {
+	// CreateSession stores s, stamping its creation time
+	CreateSession(ctx context.Context, s *schema.Session) error
+	// GetSession looks up session id
+	GetSession(ctx context.Context, id string) (*schema.Session, error)
+	// GetSessions returns the sessions of user userID active at now, oldest first
+	GetSessions(ctx context.Context, userID string, now time.Time) ([]*schema.Session, error)
+	// TouchSession records that session id was used at t
+	TouchSession(ctx context.Context, id string, t time.Time) error
+	// DeleteSession removes the session id of user userID
+	DeleteSession(ctx context.Context, userID, id string) error
+	// DeleteUserSessions removes every session of user userID
+	DeleteUserSessions(ctx context.Context, userID string) error
+	// PurgeExpiredSessions removes the sessions expired before t and
+	// returns how many were removed
+	PurgeExpiredSessions(ctx context.Context, t time.Time) (int, error)
+}
+
+// stampSession gives s its creation time, and last use unless set
+// times are kept at millisecond precision since that is all mongo stores
+func stampSession(s *schema.Session) {
+	s.CreatedAt = time.Now().UTC().Truncate(time.Millisecond)
+	if s.LastSeenAt.IsZero() {
+		s.LastSeenAt = s.CreatedAt
+	}
+	s.LastSeenAt = s.LastSeenAt.UTC().Truncate(time.Millisecond)
+	s.ExpiresAt = s.ExpiresAt.UTC().Truncate(time.Millisecond)
+}
+
+// GetSessionsCollection returns a mongo instance to the sessions collection
+func (m *MongoStore) GetSessionsCollection() *mongo.Collection {
+	return m.GetDatabase().Collection(sessionsCollectionName)
+}
+
+// CreateSession inserts s into the sessions collection
+func (m *MongoStore) CreateSession(ctx context.Context, s *schema.Session) error {
+	stampSession(s)
+	_, err := m.GetSessionsCollection().InsertOne(ctx, s)
+	return err
+}
+
+// GetSession looks up session id
+// error is 404 if there is none, 500 if mongo fails, else nil
+func (m *MongoStore) GetSession(ctx context.Context, id string) (*schema.Session, error) {
+	s := schema.Session{}
+	if err := m.GetSessionsCollection().FindOne(ctx, bson.M{"_id": id}).Decode(&s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// GetSessions returns the sessions of user userID active at now, oldest first
+func (m *MongoStore) GetSessions(ctx context.Context, userID string, now time.Time) ([]*schema.Session, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}})
+	iter, err := m.GetSessionsCollection().Find(ctx, bson.M{"userID": userID, "expiresAt": bson.M{"$gt": now.UTC()}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	sessions := []*schema.Session{}
+	err = iter.All(ctx, &sessions)
+	return sessions, err
+}
+
+// TouchSession sets the last use of session id to t
+// error is 404 if there is no such session, 500 if mongo fails, else nil
+func (m *MongoStore) TouchSession(ctx context.Context, id string, t time.Time) error {
+	t = t.UTC().Truncate(time.Millisecond)
+	res, err := m.GetSessionsCollection().UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"lastSeenAt": t}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteSession removes the session id of user userID
+// error is 404 if the user has no such session, 500 if mongo fails, else nil
+func (m *MongoStore) DeleteSession(ctx context.Context, userID, id string) error {
+	res, err := m.GetSessionsCollection().DeleteOne(ctx, bson.M{"_id": id, "userID": userID})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteUserSessions removes every session of user userID
+func (m *MongoStore) DeleteUserSessions(ctx context.Context, userID string) error {
+	_, err := m.GetSessionsCollection().DeleteMany(ctx, bson.M{"userID": userID})
+	return err
+}
+
+// PurgeExpiredSessions removes the sessions expired before t and returns
+// how many were removed
+func (m *MongoStore) PurgeExpiredSessions(ctx context.Context, t time.Time) (int, error) {
+	return deleteExpired(ctx, m.GetSessionsCollection(), t)
+}
@@ -0,0 +1,133 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/briansan/user-go/config"
+	"github.com/briansan/user-go/migrations"
+)
+
+const (
+	DriverMongo    = "mongo"
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite3"
+)
+
+// SQLStore keeps users in a PostgreSQL or SQLite database
+type SQLStore struct {
+	db     *sql.DB
+	driver string
+	shared bool
+}
+
+// migrateSQL applies every pending sql migration
+func migrateSQL(ctx context.Context, db *sql.DB, driver string) error {
+	runner, err := migrations.NewSQLRunner(ctx, db, driver)
+	if err != nil {
+		return err
+	}
+	return runner.Up(ctx, migrations.Latest)
+}
+
+// NewSQLStore connects to dsn with driver and, unless env.MIGRATE_ON_START
+// is false, migrates the schema
+// error is 500 if the database can't be reached or migrated
+func NewSQLStore(ctx context.Context, driver, dsn string) (*SQLStore, error) {
+	if driver != DriverPostgres && driver != DriverSQLite {
+		return nil, fmt.Errorf("unsupported sql driver %v", driver)
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite serializes writers anyway and each :memory: connection
+	// would otherwise get a database of its own
+	if driver == DriverSQLite {
+		db.SetMaxOpenConns(1)
+	}
+
+	s := &SQLStore{db: db, driver: driver}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if config.GetMigrateOnStart() {
+		if err := migrateSQL(ctx, db, driver); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Copy returns a store sharing the connection pool of s
+// error is 500 if the ping fails
+func (s *SQLStore) Copy(ctx context.Context) (UserStore, error) {
+	if err := s.db.PingContext(ctx); err != nil {
+		return nil, err
+	}
+	return &SQLStore{db: s.db, driver: s.driver, shared: true}, nil
+}
+
+// Cleanup closes the connection pool unless s came from Copy
+func (s *SQLStore) Cleanup() {
+	if !s.shared {
+		s.db.Close()
+	}
+}
+
+// rebind rewrites ? placeholders into $n for postgres
+func (s *SQLStore) rebind(q string) string {
+	if s.driver != DriverPostgres {
+		return q
+	}
+	b := strings.Builder{}
+	n := 0
+	for _, r := range q {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (s *SQLStore) exec(ctx context.Context, q string, args ...interface{}) (sql.Result, error) {
+	return s.db.ExecContext(ctx, s.rebind(q), args...)
+}
+
+func (s *SQLStore) queryRow(ctx context.Context, q string, args ...interface{}) *sql.Row {
+	return s.db.QueryRowContext(ctx, s.rebind(q), args...)
+}
+
+func (s *SQLStore) query(ctx context.Context, q string, args ...interface{}) (*sql.Rows, error) {
+	return s.db.QueryContext(ctx, s.rebind(q), args...)
+}
+
+// deleteExpired removes the rows of table whose expires_at is before t and
+// returns how many were removed
+func (s *SQLStore) deleteExpired(ctx context.Context, table string, t time.Time) (int, error) {
+	res, err := s.exec(ctx, `DELETE FROM `+table+` WHERE expires_at < ?`, t.UTC())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// isUniqueViolation reports whether err came from a unique constraint
+// postgres says "violates unique constraint", sqlite "UNIQUE constraint failed"
+func isUniqueViolation(err error) bool {
+	return err != nil && strings.Contains(strings.ToLower(err.Error()), "unique constraint")
+}
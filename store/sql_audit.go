@@ -0,0 +1,91 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/briansan/user-go/schema"
+)
+
+const (
+	sqlAuditColumns = "id, created_at, action, actor, target, diff, ip, request_id"
+)
+
+// nullString maps an empty string to NULL
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: len(s) > 0}
+}
+
+// AppendAudit inserts e into the audit_log table, its diff is kept as json
+// error is 500 if the database fails, else nil
+func (s *SQLStore) AppendAudit(ctx context.Context, e *schema.AuditEntry) error {
+	stampAudit(e)
+
+	var diff sql.NullString
+	if len(e.Diff) > 0 {
+		b, err := json.Marshal(e.Diff)
+		if err != nil {
+			return err
+		}
+		diff = nullString(string(b))
+	}
+
+	_, err := s.exec(ctx, `INSERT INTO audit_log (`+sqlAuditColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.ID.Hex(), e.Time, e.Action, nullString(e.Actor), nullString(e.Target), diff, e.IP, e.RequestID)
+	return err
+}
+
+// FindAudit returns the audit entries selected by q, newest first
+func (s *SQLStore) FindAudit(ctx context.Context, q *AuditQuery) ([]*schema.AuditEntry, error) {
+	where := []string{"1 = 1"}
+	args := []interface{}{}
+	if len(q.Actor) > 0 {
+		where = append(where, "actor = ?")
+		args = append(args, q.Actor)
+	}
+	if len(q.Target) > 0 {
+		where = append(where, "target = ?")
+		args = append(args, q.Target)
+	}
+	if !q.From.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, q.From.UTC())
+	}
+	if !q.To.IsZero() {
+		where = append(where, "created_at <= ?")
+		args = append(args, q.To.UTC())
+	}
+
+	rows, err := s.query(ctx, `SELECT `+sqlAuditColumns+` FROM audit_log WHERE `+strings.Join(where, " AND ")+
+		` ORDER BY created_at DESC, id DESC LIMIT ?`, append(args, q.Limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*schema.AuditEntry{}
+	for rows.Next() {
+		var id string
+		var actor, target, diff sql.NullString
+		e := &schema.AuditEntry{}
+		if err := rows.Scan(&id, &e.Time, &e.Action, &actor, &target, &diff, &e.IP, &e.RequestID); err != nil {
+			return nil, err
+		}
+		if diff.Valid {
+			if err := json.Unmarshal([]byte(diff.String), &e.Diff); err != nil {
+				return nil, err
+			}
+		}
+		if e.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+			return nil, err
+		}
+		e.Time = e.Time.UTC()
+		e.Actor, e.Target = actor.String, target.String
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
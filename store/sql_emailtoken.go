@@ -0,0 +1,96 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/briansan/user-go/schema"
+)
+
+const (
+	sqlEmailTokenColumns = "id, hash, purpose, user_id, email, created_at, expires_at"
+)
+
+// CreateEmailToken inserts t into the email_tokens table
+func (s *SQLStore) CreateEmailToken(ctx context.Context, t *schema.EmailToken) error {
+	stampEmailToken(t)
+	_, err := s.exec(ctx, `INSERT INTO email_tokens (`+sqlEmailTokenColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		t.ID.Hex(), t.Hash, t.Purpose, t.UserID, t.Email, t.CreatedAt, t.ExpiresAt)
+	return err
+}
+
+// GetEmailToken looks up the token of purpose with hash
+// error is 404 if there is none or it expired, 500 if the database fails, else nil
+func (s *SQLStore) GetEmailToken(ctx context.Context, purpose, hash string, now time.Time) (*schema.EmailToken, error) {
+	var id string
+	t := &schema.EmailToken{}
+	err := s.queryRow(ctx, `SELECT `+sqlEmailTokenColumns+` FROM email_tokens WHERE purpose = ? AND hash = ? AND expires_at > ?`,
+		purpose, hash, now.UTC()).Scan(&id, &t.Hash, &t.Purpose, &t.UserID, &t.Email, &t.CreatedAt, &t.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if t.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+		return nil, err
+	}
+	t.CreatedAt = t.CreatedAt.UTC()
+	t.ExpiresAt = t.ExpiresAt.UTC()
+	return t, nil
+}
+
+// UseEmailToken removes the token of purpose with hash and returns it
+// error is 404 if there is none or it expired, 500 if the database fails, else nil
+func (s *SQLStore) UseEmailToken(ctx context.Context, purpose, hash string, now time.Time) (*schema.EmailToken, error) {
+	t, err := s.GetEmailToken(ctx, purpose, hash, now)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the request that deletes it gets to use it
+	res, err := s.exec(ctx, `DELETE FROM email_tokens WHERE id = ?`, t.ID.Hex())
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return nil, ErrNotFound
+	}
+	return t, nil
+}
+
+// LastEmailToken returns the newest token of purpose of user userID
+// error is 404 if there is none, 500 if the database fails, else nil
+func (s *SQLStore) LastEmailToken(ctx context.Context, userID, purpose string) (*schema.EmailToken, error) {
+	var id string
+	t := &schema.EmailToken{}
+	err := s.queryRow(ctx, `SELECT `+sqlEmailTokenColumns+` FROM email_tokens WHERE user_id = ? AND purpose = ? ORDER BY created_at DESC, id DESC LIMIT 1`,
+		userID, purpose).Scan(&id, &t.Hash, &t.Purpose, &t.UserID, &t.Email, &t.CreatedAt, &t.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if t.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+		return nil, err
+	}
+	t.CreatedAt = t.CreatedAt.UTC()
+	t.ExpiresAt = t.ExpiresAt.UTC()
+	return t, nil
+}
+
+// DeleteEmailTokens removes the tokens of purpose of user userID
+func (s *SQLStore) DeleteEmailTokens(ctx context.Context, userID, purpose string) error {
+	_, err := s.exec(ctx, `DELETE FROM email_tokens WHERE user_id = ? AND purpose = ?`, userID, purpose)
+	return err
+}
+
+// PurgeExpiredEmailTokens removes the tokens expired before t and returns
+// how many were removed
+func (s *SQLStore) PurgeExpiredEmailTokens(ctx context.Context, t time.Time) (int, error) {
+	return s.deleteExpired(ctx, "email_tokens", t)
+}
@@ -0,0 +1,71 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/briansan/user-go/schema"
+)
+
+const (
+	sqlIdentityColumns = "id, provider, subject, user_id, email, created_at"
+)
+
+// scanIdentity reads a row selected with sqlIdentityColumns
+func scanIdentity(row scanner) (*schema.Identity, error) {
+	var id string
+	var email sql.NullString
+	identity := &schema.Identity{}
+	if err := row.Scan(&id, &identity.Provider, &identity.Subject, &identity.UserID, &email, &identity.CreatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+	identity.ID = oid
+	identity.Email = email.String
+	identity.CreatedAt = identity.CreatedAt.UTC()
+	return identity, nil
+}
+
+// LinkIdentity inserts id into the identities table
+// error is 409 if the subject is linked already, 500 if the database fails, else nil
+func (s *SQLStore) LinkIdentity(ctx context.Context, id *schema.Identity) error {
+	stampIdentity(id)
+	_, err := s.exec(ctx, `INSERT INTO identities (`+sqlIdentityColumns+`) VALUES (?, ?, ?, ?, ?, ?)`,
+		id.ID.Hex(), id.Provider, id.Subject, id.UserID, nullString(id.Email), id.CreatedAt)
+	if isUniqueViolation(err) {
+		return identityConflict(id)
+	}
+	return err
+}
+
+// GetIdentity looks up the link of subject at provider
+func (s *SQLStore) GetIdentity(ctx context.Context, provider, subject string) (*schema.Identity, error) {
+	return scanIdentity(s.queryRow(ctx, `SELECT `+sqlIdentityColumns+` FROM identities WHERE provider = ? AND subject = ?`, provider, subject))
+}
+
+// GetIdentities returns the links of user userID, oldest first
+func (s *SQLStore) GetIdentities(ctx context.Context, userID string) ([]*schema.Identity, error) {
+	rows, err := s.query(ctx, `SELECT `+sqlIdentityColumns+` FROM identities WHERE user_id = ? ORDER BY created_at, id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []*schema.Identity{}
+	for rows.Next() {
+		id, err := scanIdentity(rows)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, id)
+	}
+	return identities, rows.Err()
+}
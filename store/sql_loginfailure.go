@@ -0,0 +1,66 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/briansan/user-go/schema"
+)
+
+// GetLoginFailures looks up the failures of key that haven't expired by now
+// error is 404 if there are none, 500 if the database fails, else nil
+func (s *SQLStore) GetLoginFailures(ctx context.Context, key string, now time.Time) (*schema.LoginFailures, error) {
+	f := &schema.LoginFailures{Key: key}
+	err := s.queryRow(ctx, `SELECT failures, last_failure, expires_at FROM login_failures WHERE subject = ? AND expires_at > ?`,
+		key, now.UTC()).Scan(&f.Count, &f.LastFailure, &f.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	f.LastFailure = f.LastFailure.UTC()
+	f.ExpiresAt = f.ExpiresAt.UTC()
+	return f, nil
+}
+
+// AddLoginFailure counts a failure of key at now
+// error is 500 if the database fails, else nil
+func (s *SQLStore) AddLoginFailure(ctx context.Context, key string, now time.Time, window time.Duration) (*schema.LoginFailures, error) {
+	now = now.UTC().Truncate(time.Millisecond)
+	expires := now.Add(window)
+
+	// An expired count starts over, else it goes up
+	// a concurrent first failure makes the insert fail, then the update works
+	for i := 0; i < 2; i++ {
+		res, err := s.exec(ctx, `UPDATE login_failures SET failures = CASE WHEN expires_at <= ? THEN 1 ELSE failures + 1 END,
+			last_failure = ?, expires_at = ? WHERE subject = ?`, now, now, expires, key)
+		if err != nil {
+			return nil, err
+		}
+		if n, err := res.RowsAffected(); err == nil && n > 0 {
+			break
+		}
+		_, err = s.exec(ctx, `INSERT INTO login_failures (subject, failures, last_failure, expires_at) VALUES (?, 1, ?, ?)`, key, now, expires)
+		if err == nil {
+			break
+		}
+		if !isUniqueViolation(err) || i > 0 {
+			return nil, err
+		}
+	}
+	return s.GetLoginFailures(ctx, key, now)
+}
+
+// ClearLoginFailures removes the failures of key
+func (s *SQLStore) ClearLoginFailures(ctx context.Context, key string) error {
+	_, err := s.exec(ctx, `DELETE FROM login_failures WHERE subject = ?`, key)
+	return err
+}
+
+// PurgeExpiredLoginFailures removes the counts expired before t and
+// returns how many were removed
+func (s *SQLStore) PurgeExpiredLoginFailures(ctx context.Context, t time.Time) (int, error) {
+	return s.deleteExpired(ctx, "login_failures", t)
+}
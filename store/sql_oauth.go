@@ -0,0 +1,142 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/briansan/user-go/errors"
+	"github.com/briansan/user-go/schema"
+)
+
+const (
+	sqlClientColumns   = "client_id, secret_hash, name, redirect_uris, grant_types, scopes, created_at"
+	sqlAuthCodeColumns = "id, hash, client_id, user_id, redirect_uri, scope, nonce, code_challenge, auth_time, expires_at, used_at"
+)
+
+// scanClient reads a row selected with sqlClientColumns, lists are kept as json
+func scanClient(row scanner) (*schema.OAuthClient, error) {
+	var secretHash sql.NullString
+	var redirectURIs, grantTypes, scopes string
+	c := &schema.OAuthClient{}
+	if err := row.Scan(&c.ID, &secretHash, &c.Name, &redirectURIs, &grantTypes, &scopes, &c.CreatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	for _, list := range []struct {
+		raw string
+		v   *[]string
+	}{{redirectURIs, &c.RedirectURIs}, {grantTypes, &c.GrantTypes}, {scopes, &c.Scopes}} {
+		if err := json.Unmarshal([]byte(list.raw), list.v); err != nil {
+			return nil, err
+		}
+	}
+	c.SecretHash = secretHash.String
+	c.CreatedAt = c.CreatedAt.UTC()
+	return c, nil
+}
+
+// jsonList encodes list as a json array, never null
+func jsonList(list []string) string {
+	if list == nil {
+		list = []string{}
+	}
+	b, _ := json.Marshal(list)
+	return string(b)
+}
+
+// CreateClient inserts c into the oauth_clients table
+// error is 409 if the client id is taken, 500 if the database fails, else nil
+func (s *SQLStore) CreateClient(ctx context.Context, c *schema.OAuthClient) error {
+	stampClient(c)
+	_, err := s.exec(ctx, `INSERT INTO oauth_clients (`+sqlClientColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		c.ID, nullString(c.SecretHash), c.Name, jsonList(c.RedirectURIs), jsonList(c.GrantTypes), jsonList(c.Scopes), c.CreatedAt)
+	if isUniqueViolation(err) {
+		return errors.NewConflictError("client", "clientID", c.ID)
+	}
+	return err
+}
+
+// GetClient looks up a client by its client id
+func (s *SQLStore) GetClient(ctx context.Context, id string) (*schema.OAuthClient, error) {
+	return scanClient(s.queryRow(ctx, `SELECT `+sqlClientColumns+` FROM oauth_clients WHERE client_id = ?`, id))
+}
+
+// GetClients returns every client, oldest first
+func (s *SQLStore) GetClients(ctx context.Context) ([]*schema.OAuthClient, error) {
+	rows, err := s.query(ctx, `SELECT `+sqlClientColumns+` FROM oauth_clients ORDER BY created_at, client_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := []*schema.OAuthClient{}
+	for rows.Next() {
+		c, err := scanClient(rows)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, c)
+	}
+	return clients, rows.Err()
+}
+
+// DeleteClient removes client id
+// error is 404 if there is none, 500 if the database fails
+func (s *SQLStore) DeleteClient(ctx context.Context, id string) error {
+	res, err := s.exec(ctx, `DELETE FROM oauth_clients WHERE client_id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// CreateAuthCode inserts code into the oauth_codes table
+// error is 500 if the database fails, else nil
+func (s *SQLStore) CreateAuthCode(ctx context.Context, code *schema.AuthCode) error {
+	stampAuthCode(code)
+	_, err := s.exec(ctx, `INSERT INTO oauth_codes (id, hash, client_id, user_id, redirect_uri, scope, nonce, code_challenge, auth_time, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		code.ID.Hex(), code.Hash, code.ClientID, code.UserID, code.RedirectURI, code.Scope, code.Nonce, code.CodeChallenge,
+		code.AuthTime, code.ExpiresAt)
+	return err
+}
+
+// ConsumeAuthCode marks the code with hash used and returns it
+// error is 404 if there is none or it was used already, 500 if the database fails
+func (s *SQLStore) ConsumeAuthCode(ctx context.Context, hash string) (*schema.AuthCode, error) {
+	// Only one concurrent exchange can match the unused code
+	res, err := s.exec(ctx, `UPDATE oauth_codes SET used_at = ? WHERE hash = ? AND used_at IS NULL`, time.Now().UTC(), hash)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return nil, ErrNotFound
+	}
+
+	var id string
+	code := &schema.AuthCode{}
+	if err := s.queryRow(ctx, `SELECT `+sqlAuthCodeColumns+` FROM oauth_codes WHERE hash = ?`, hash).Scan(
+		&id, &code.Hash, &code.ClientID, &code.UserID, &code.RedirectURI, &code.Scope, &code.Nonce, &code.CodeChallenge,
+		&code.AuthTime, &code.ExpiresAt, &code.UsedAt); err != nil {
+		return nil, err
+	}
+	if code.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+		return nil, err
+	}
+	return code, nil
+}
+
+// PurgeExpiredAuthCodes removes the codes expired before t and returns how
+// many were removed
+func (s *SQLStore) PurgeExpiredAuthCodes(ctx context.Context, t time.Time) (int, error) {
+	return s.deleteExpired(ctx, "oauth_codes", t)
+}
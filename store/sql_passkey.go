@@ -0,0 +1,113 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/briansan/user-go/schema"
+)
+
+const (
+	sqlPasskeyColumns = "id, user_id, credential_id, public_key, sign_count, transports, name, created_at, last_used_at"
+)
+
+// scanPasskey reads a row selected with sqlPasskeyColumns
+func scanPasskey(row scanner) (*schema.Passkey, error) {
+	var id, publicKey, transports string
+	p := &schema.Passkey{}
+	if err := row.Scan(&id, &p.UserID, &p.CredentialID, &publicKey, &p.SignCount, &transports, &p.Name, &p.CreatedAt, &p.LastUsedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+	p.ID = oid
+	if p.PublicKey, err = base64.RawURLEncoding.DecodeString(publicKey); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(transports), &p.Transports); err != nil {
+		return nil, err
+	}
+	p.CreatedAt = p.CreatedAt.UTC()
+	if p.LastUsedAt != nil {
+		*p.LastUsedAt = p.LastUsedAt.UTC()
+	}
+	return p, nil
+}
+
+// CreatePasskey inserts p into the passkeys table
+// error is 409 if the credential is registered already, 500 if the database fails, else nil
+func (s *SQLStore) CreatePasskey(ctx context.Context, p *schema.Passkey) error {
+	stampPasskey(p)
+	transports, err := json.Marshal(p.Transports)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec(ctx, `INSERT INTO passkeys (`+sqlPasskeyColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, NULL)`,
+		p.ID.Hex(), p.UserID, p.CredentialID, base64.RawURLEncoding.EncodeToString(p.PublicKey), p.SignCount, string(transports), p.Name, p.CreatedAt)
+	if isUniqueViolation(err) {
+		return passkeyConflict(p)
+	}
+	return err
+}
+
+// GetPasskey looks up the passkey with credentialID
+func (s *SQLStore) GetPasskey(ctx context.Context, credentialID string) (*schema.Passkey, error) {
+	return scanPasskey(s.queryRow(ctx, `SELECT `+sqlPasskeyColumns+` FROM passkeys WHERE credential_id = ?`, credentialID))
+}
+
+// GetPasskeys returns the passkeys of user userID, oldest first
+func (s *SQLStore) GetPasskeys(ctx context.Context, userID string) ([]*schema.Passkey, error) {
+	rows, err := s.query(ctx, `SELECT `+sqlPasskeyColumns+` FROM passkeys WHERE user_id = ? ORDER BY created_at, id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	passkeys := []*schema.Passkey{}
+	for rows.Next() {
+		p, err := scanPasskey(rows)
+		if err != nil {
+			return nil, err
+		}
+		passkeys = append(passkeys, p)
+	}
+	return passkeys, rows.Err()
+}
+
+// UsePasskey moves the counter of credentialID forward to signCount
+// error is 404 if it doesn't move forward, 500 if the database fails, else nil
+func (s *SQLStore) UsePasskey(ctx context.Context, credentialID string, signCount int64) error {
+	res, err := s.exec(ctx, `UPDATE passkeys SET sign_count = ?, last_used_at = ?
+		WHERE credential_id = ? AND (sign_count < ? OR (sign_count = 0 AND ? = 0))`,
+		signCount, time.Now().UTC().Truncate(time.Millisecond), credentialID, signCount, signCount)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeletePasskey removes the passkey id of user userID
+// error is 404 if the user has no such passkey, 500 if the database fails, else nil
+func (s *SQLStore) DeletePasskey(ctx context.Context, userID, id string) error {
+	res, err := s.exec(ctx, `DELETE FROM passkeys WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
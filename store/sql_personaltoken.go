@@ -0,0 +1,116 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/briansan/user-go/schema"
+)
+
+const (
+	sqlPersonalTokenColumns = "id, hash, user_id, name, permissions, created_at, expires_at, last_used_at"
+)
+
+// scanPersonalToken reads a row selected with sqlPersonalTokenColumns
+func scanPersonalToken(row scanner) (*schema.PersonalToken, error) {
+	var id, permissions string
+	t := &schema.PersonalToken{}
+	if err := row.Scan(&id, &t.Hash, &t.UserID, &t.Name, &permissions, &t.CreatedAt, &t.ExpiresAt, &t.LastUsedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+	t.ID = oid
+	if err := json.Unmarshal([]byte(permissions), &t.Permissions); err != nil {
+		return nil, err
+	}
+	t.CreatedAt = t.CreatedAt.UTC()
+	t.ExpiresAt = t.ExpiresAt.UTC()
+	if t.LastUsedAt != nil {
+		*t.LastUsedAt = t.LastUsedAt.UTC()
+	}
+	return t, nil
+}
+
+// CreatePersonalToken inserts t into the personal_tokens table
+func (s *SQLStore) CreatePersonalToken(ctx context.Context, t *schema.PersonalToken) error {
+	stampPersonalToken(t)
+	permissions, err := json.Marshal(t.Permissions)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec(ctx, `INSERT INTO personal_tokens (`+sqlPersonalTokenColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, NULL)`,
+		t.ID.Hex(), t.Hash, t.UserID, t.Name, string(permissions), t.CreatedAt, t.ExpiresAt)
+	return err
+}
+
+// GetPersonalToken looks up a personal token by the hash of the token
+func (s *SQLStore) GetPersonalToken(ctx context.Context, hash string) (*schema.PersonalToken, error) {
+	return scanPersonalToken(s.queryRow(ctx, `SELECT `+sqlPersonalTokenColumns+` FROM personal_tokens WHERE hash = ?`, hash))
+}
+
+// GetPersonalTokens returns the personal tokens of user userID, oldest first
+func (s *SQLStore) GetPersonalTokens(ctx context.Context, userID string) ([]*schema.PersonalToken, error) {
+	rows, err := s.query(ctx, `SELECT `+sqlPersonalTokenColumns+` FROM personal_tokens WHERE user_id = ? ORDER BY created_at, id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []*schema.PersonalToken{}
+	for rows.Next() {
+		t, err := scanPersonalToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// TouchPersonalToken sets the last use of token id to t
+// error is 404 if there is no such token, 500 if the database fails, else nil
+func (s *SQLStore) TouchPersonalToken(ctx context.Context, id string, t time.Time) error {
+	res, err := s.exec(ctx, `UPDATE personal_tokens SET last_used_at = ? WHERE id = ?`, t.UTC().Truncate(time.Millisecond), id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeletePersonalToken removes the personal token id of user userID
+// error is 404 if the user has no such token, 500 if the database fails, else nil
+func (s *SQLStore) DeletePersonalToken(ctx context.Context, userID, id string) error {
+	res, err := s.exec(ctx, `DELETE FROM personal_tokens WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteUserPersonalTokens removes every personal token of user userID
+func (s *SQLStore) DeleteUserPersonalTokens(ctx context.Context, userID string) error {
+	_, err := s.exec(ctx, `DELETE FROM personal_tokens WHERE user_id = ?`, userID)
+	return err
+}
+
+// PurgeExpiredPersonalTokens removes the personal tokens expired before t
+// and returns how many were removed
+func (s *SQLStore) PurgeExpiredPersonalTokens(ctx context.Context, t time.Time) (int, error) {
+	return s.deleteExpired(ctx, "personal_tokens", t)
+}
@@ -0,0 +1,62 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/briansan/user-go/ratelimit"
+)
+
+// TakeRateToken takes a token out of the bucket of key under p, a bucket
+// that kept changing through rateRetries tries counts as empty
+// error is 500 if the database fails, else nil
+func (s *SQLStore) TakeRateToken(ctx context.Context, key string, p ratelimit.Policy, now time.Time) (ratelimit.Result, error) {
+	now = now.UTC().Truncate(time.Millisecond)
+	for i := 0; i < rateRetries; i++ {
+		var stored *rateBucket
+		b := rateBucket{Key: key}
+		err := s.queryRow(ctx, `SELECT tokens, updated_at, version FROM rate_buckets WHERE bucket = ?`, key).
+			Scan(&b.Tokens, &b.UpdatedAt, &b.Version)
+		if err == nil {
+			b.UpdatedAt = b.UpdatedAt.UTC()
+			stored = &b
+		} else if err != sql.ErrNoRows {
+			return ratelimit.Result{}, err
+		}
+
+		next, r := takeRateToken(key, stored, p, now)
+		if next == nil {
+			return r, nil
+		}
+
+		// Only write over the version that was read
+		if stored == nil {
+			_, err = s.exec(ctx, `INSERT INTO rate_buckets (bucket, tokens, updated_at, version, expires_at) VALUES (?, ?, ?, ?, ?)`,
+				key, next.Tokens, next.UpdatedAt, next.Version, next.ExpiresAt)
+			if isUniqueViolation(err) {
+				continue
+			}
+		} else {
+			var res sql.Result
+			res, err = s.exec(ctx, `UPDATE rate_buckets SET tokens = ?, updated_at = ?, version = ?, expires_at = ? WHERE bucket = ? AND version = ?`,
+				next.Tokens, next.UpdatedAt, next.Version, next.ExpiresAt, key, stored.Version)
+			if err == nil {
+				if n, err := res.RowsAffected(); err == nil && n == 0 {
+					continue
+				}
+			}
+		}
+		if err != nil {
+			return ratelimit.Result{}, err
+		}
+		return r, nil
+	}
+	return p.Empty(), nil
+}
+
+// PurgeExpiredRateBuckets removes the buckets full again before t and
+// returns how many were removed
+func (s *SQLStore) PurgeExpiredRateBuckets(ctx context.Context, t time.Time) (int, error) {
+	return s.deleteExpired(ctx, "rate_buckets", t)
+}
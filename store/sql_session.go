@@ -0,0 +1,99 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/briansan/user-go/schema"
+)
+
+const (
+	sqlSessionColumns = "id, user_id, user_agent, ip, created_at, last_seen_at, expires_at, client_id"
+)
+
+// scanSession reads a row selected with sqlSessionColumns
+func scanSession(row scanner) (*schema.Session, error) {
+	s := &schema.Session{}
+	if err := row.Scan(&s.ID, &s.UserID, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt, &s.ClientID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	s.CreatedAt = s.CreatedAt.UTC()
+	s.LastSeenAt = s.LastSeenAt.UTC()
+	s.ExpiresAt = s.ExpiresAt.UTC()
+	return s, nil
+}
+
+// CreateSession inserts session into the sessions table
+func (s *SQLStore) CreateSession(ctx context.Context, session *schema.Session) error {
+	stampSession(session)
+	_, err := s.exec(ctx, `INSERT INTO sessions (`+sqlSessionColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		session.ID, session.UserID, session.UserAgent, session.IP, session.CreatedAt, session.LastSeenAt, session.ExpiresAt, session.ClientID)
+	return err
+}
+
+// GetSession looks up session id
+func (s *SQLStore) GetSession(ctx context.Context, id string) (*schema.Session, error) {
+	return scanSession(s.queryRow(ctx, `SELECT `+sqlSessionColumns+` FROM sessions WHERE id = ?`, id))
+}
+
+// GetSessions returns the sessions of user userID active at now, oldest first
+func (s *SQLStore) GetSessions(ctx context.Context, userID string, now time.Time) ([]*schema.Session, error) {
+	rows, err := s.query(ctx, `SELECT `+sqlSessionColumns+` FROM sessions WHERE user_id = ? AND expires_at > ? ORDER BY created_at, id`,
+		userID, now.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*schema.Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// TouchSession sets the last use of session id to t
+// error is 404 if there is no such session, 500 if the database fails, else nil
+func (s *SQLStore) TouchSession(ctx context.Context, id string, t time.Time) error {
+	res, err := s.exec(ctx, `UPDATE sessions SET last_seen_at = ? WHERE id = ?`, t.UTC().Truncate(time.Millisecond), id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteSession removes the session id of user userID
+// error is 404 if the user has no such session, 500 if the database fails, else nil
+func (s *SQLStore) DeleteSession(ctx context.Context, userID, id string) error {
+	res, err := s.exec(ctx, `DELETE FROM sessions WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteUserSessions removes every session of user userID
+func (s *SQLStore) DeleteUserSessions(ctx context.Context, userID string) error {
+	_, err := s.exec(ctx, `DELETE FROM sessions WHERE user_id = ?`, userID)
+	return err
+}
+
+// PurgeExpiredSessions removes the sessions expired before t and returns
+// how many were removed
+func (s *SQLStore) PurgeExpiredSessions(ctx context.Context, t time.Time) (int, error) {
+	return s.deleteExpired(ctx, "sessions", t)
+}
@@ -0,0 +1,157 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/briansan/user-go/schema"
+)
+
+const (
+	sqlRefreshTokenColumns = "id, hash, family, user_id, access_jti, access_expires_at, created_at, expires_at, used_at, revoked_at"
+)
+
+// scanRefreshToken reads a row selected with sqlRefreshTokenColumns
+func scanRefreshToken(row scanner) (*schema.RefreshToken, error) {
+	var id string
+	t := &schema.RefreshToken{}
+	if err := row.Scan(&id, &t.Hash, &t.Family, &t.UserID, &t.AccessJTI, &t.AccessExpiresAt,
+		&t.CreatedAt, &t.ExpiresAt, &t.UsedAt, &t.RevokedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+	t.ID = oid
+	return t, nil
+}
+
+// CreateRefreshToken inserts t into the refresh_tokens table
+// error is 500 if the database fails, else nil
+func (s *SQLStore) CreateRefreshToken(ctx context.Context, t *schema.RefreshToken) error {
+	stampRefreshToken(t)
+	_, err := s.exec(ctx, `INSERT INTO refresh_tokens (id, hash, family, user_id, access_jti, access_expires_at, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		t.ID.Hex(), t.Hash, t.Family, t.UserID, t.AccessJTI, t.AccessExpiresAt, t.CreatedAt, t.ExpiresAt)
+	return err
+}
+
+// GetRefreshToken looks up a refresh token by the hash of its secret
+func (s *SQLStore) GetRefreshToken(ctx context.Context, hash string) (*schema.RefreshToken, error) {
+	return scanRefreshToken(s.queryRow(ctx, `SELECT `+sqlRefreshTokenColumns+` FROM refresh_tokens WHERE hash = ?`, hash))
+}
+
+// GetRefreshTokenByJTI looks up the refresh token issued along with access token jti
+func (s *SQLStore) GetRefreshTokenByJTI(ctx context.Context, jti string) (*schema.RefreshToken, error) {
+	return scanRefreshToken(s.queryRow(ctx, `SELECT `+sqlRefreshTokenColumns+` FROM refresh_tokens WHERE access_jti = ?`, jti))
+}
+
+// RotateRefreshToken marks old used and stores next in its place
+// error is ErrTokenReused if old was used or revoked meanwhile, 500 if the database fails
+func (s *SQLStore) RotateRefreshToken(ctx context.Context, old, next *schema.RefreshToken) error {
+	// Only one concurrent rotation can match the unused token
+	now := time.Now().UTC()
+	res, err := s.exec(ctx, `UPDATE refresh_tokens SET used_at = ? WHERE id = ? AND used_at IS NULL AND revoked_at IS NULL`,
+		now, old.ID.Hex())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrTokenReused
+	}
+	old.UsedAt = &now
+	return s.CreateRefreshToken(ctx, next)
+}
+
+// RevokeTokenFamily revokes every refresh token of family and the access
+// tokens issued along with them
+func (s *SQLStore) RevokeTokenFamily(ctx context.Context, family string) error {
+	if _, err := s.exec(ctx, `UPDATE refresh_tokens SET revoked_at = ? WHERE family = ? AND revoked_at IS NULL`,
+		time.Now().UTC(), family); err != nil {
+		return err
+	}
+
+	rows, err := s.query(ctx, `SELECT `+sqlRefreshTokenColumns+` FROM refresh_tokens WHERE family = ?`, family)
+	if err != nil {
+		return err
+	}
+	tokens := []*schema.RefreshToken{}
+	for rows.Next() {
+		t, err := scanRefreshToken(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		tokens = append(tokens, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// The rows are closed first since sqlite only has the one connection
+	return revokeAccessTokens(ctx, s, tokens)
+}
+
+// RevokeUserTokens revokes every refresh token of user userID and the
+// access tokens issued along with them
+func (s *SQLStore) RevokeUserTokens(ctx context.Context, userID string) error {
+	if _, err := s.exec(ctx, `UPDATE refresh_tokens SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL`,
+		time.Now().UTC(), userID); err != nil {
+		return err
+	}
+
+	rows, err := s.query(ctx, `SELECT `+sqlRefreshTokenColumns+` FROM refresh_tokens WHERE user_id = ?`, userID)
+	if err != nil {
+		return err
+	}
+	tokens := []*schema.RefreshToken{}
+	for rows.Next() {
+		t, err := scanRefreshToken(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		tokens = append(tokens, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return revokeAccessTokens(ctx, s, tokens)
+}
+
+// RevokeAccessToken rejects access token jti until it expires
+func (s *SQLStore) RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	_, err := s.exec(ctx, `INSERT INTO revoked_tokens (jti, expires_at) VALUES (?, ?) ON CONFLICT (jti) DO NOTHING`,
+		jti, expiresAt.UTC())
+	return err
+}
+
+// IsAccessTokenRevoked reports whether access token jti was revoked
+func (s *SQLStore) IsAccessTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	var n int
+	err := s.queryRow(ctx, `SELECT COUNT(*) FROM revoked_tokens WHERE jti = ?`, jti).Scan(&n)
+	return n > 0, err
+}
+
+// PurgeExpiredTokens removes the refresh tokens and revoked access tokens
+// expired before t and returns how many were removed
+func (s *SQLStore) PurgeExpiredTokens(ctx context.Context, t time.Time) (int, error) {
+	refresh, err := s.deleteExpired(ctx, "refresh_tokens", t)
+	if err != nil {
+		return 0, err
+	}
+	revoked, err := s.deleteExpired(ctx, "revoked_tokens", t)
+	if err != nil {
+		return 0, err
+	}
+	return refresh + revoked, nil
+}
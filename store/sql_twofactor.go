@@ -0,0 +1,124 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/briansan/user-go/schema"
+)
+
+// CreateTwoFactor inserts t into the two_factor table
+// error is 409 if the user has a confirmed enrollment, 500 if the database fails
+func (s *SQLStore) CreateTwoFactor(ctx context.Context, t *schema.TwoFactor) error {
+	stampTwoFactor(t)
+	if _, err := s.exec(ctx, `DELETE FROM two_factor WHERE user_id = ? AND confirmed_at IS NULL`, t.UserID); err != nil {
+		return err
+	}
+	_, err := s.exec(ctx, `INSERT INTO two_factor (user_id, secret, created_at, last_step) VALUES (?, ?, ?, 0)`,
+		t.UserID, t.Secret, t.CreatedAt)
+	if isUniqueViolation(err) {
+		return twoFactorConflict(t)
+	}
+	return err
+}
+
+// GetTwoFactor looks up the enrollment of user userID and its recovery codes
+func (s *SQLStore) GetTwoFactor(ctx context.Context, userID string) (*schema.TwoFactor, error) {
+	t := &schema.TwoFactor{}
+	err := s.queryRow(ctx, `SELECT user_id, secret, created_at, confirmed_at, last_step FROM two_factor WHERE user_id = ?`, userID).Scan(
+		&t.UserID, &t.Secret, &t.CreatedAt, &t.ConfirmedAt, &t.LastStep)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	t.CreatedAt = t.CreatedAt.UTC()
+	if t.ConfirmedAt != nil {
+		*t.ConfirmedAt = t.ConfirmedAt.UTC()
+	}
+
+	rows, err := s.query(ctx, `SELECT hash FROM recovery_codes WHERE user_id = ? ORDER BY hash`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	t.RecoveryCodes = []string{}
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		t.RecoveryCodes = append(t.RecoveryCodes, hash)
+	}
+	return t, rows.Err()
+}
+
+// ConfirmTwoFactor enables the enrollment of user userID
+// error is 404 if there is none or it is confirmed already, 500 if the database fails
+func (s *SQLStore) ConfirmTwoFactor(ctx context.Context, userID string, step int64, recoveryCodes []string) error {
+	res, err := s.exec(ctx, `UPDATE two_factor SET confirmed_at = ?, last_step = ? WHERE user_id = ? AND confirmed_at IS NULL`,
+		time.Now().UTC(), step, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+
+	if _, err := s.exec(ctx, `DELETE FROM recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	for _, hash := range recoveryCodes {
+		if _, err := s.exec(ctx, `INSERT INTO recovery_codes (user_id, hash) VALUES (?, ?)`, userID, hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UseTOTPStep records that a code of step was accepted
+// error is 404 if step isn't newer than the last one, 500 if the database fails
+func (s *SQLStore) UseTOTPStep(ctx context.Context, userID string, step int64) error {
+	// Only one concurrent login can move past the last step
+	res, err := s.exec(ctx, `UPDATE two_factor SET last_step = ? WHERE user_id = ? AND confirmed_at IS NOT NULL AND last_step < ?`,
+		step, userID, step)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// UseRecoveryCode removes the recovery code with hash
+// error is 404 if the user has no such code, 500 if the database fails
+func (s *SQLStore) UseRecoveryCode(ctx context.Context, userID, hash string) error {
+	res, err := s.exec(ctx, `DELETE FROM recovery_codes WHERE user_id = ? AND hash = ?`, userID, hash)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteTwoFactor removes the enrollment of user userID and its recovery codes
+// error is 404 if there is none, 500 if the database fails
+func (s *SQLStore) DeleteTwoFactor(ctx context.Context, userID string) error {
+	if _, err := s.exec(ctx, `DELETE FROM recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	res, err := s.exec(ctx, `DELETE FROM two_factor WHERE user_id = ?`, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
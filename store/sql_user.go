@@ -0,0 +1,354 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/briansan/user-go/errors"
+	"github.com/briansan/user-go/schema"
+)
+
+const (
+	sqlUserColumns = "id, username, password, email, role, email_verified, version, deleted_at"
+)
+
+// scanner is the part of sql.Row and sql.Rows that scanUser needs
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanUser reads a row selected with sqlUserColumns
+func scanUser(row scanner) (*schema.User, error) {
+	var id string
+	var role int
+	var verified bool
+	u := &schema.User{Role: &role, EmailVerified: &verified}
+	if err := row.Scan(&id, &u.Username, &u.Password, &u.Email, u.Role, u.EmailVerified, &u.Version, &u.DeletedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+	u.ID = oid
+	return u, nil
+}
+
+// getUser returns the first live user where column = value
+func (s *SQLStore) getUser(ctx context.Context, column string, value interface{}) (*schema.User, error) {
+	return scanUser(s.queryRow(ctx, `SELECT `+sqlUserColumns+` FROM users WHERE `+column+` = ? AND deleted_at IS NULL`, value))
+}
+
+// uniqueConflict turns a unique constraint violation that slipped past
+// checkConflict because of a concurrent write into a ConflictError
+func uniqueConflict(err error, user *schema.User) error {
+	if !isUniqueViolation(err) {
+		return err
+	}
+	if strings.Contains(err.Error(), "email") && user.Email != nil {
+		return errors.NewConflictError("user", "email", *user.Email)
+	}
+	if user.Username != nil {
+		return errors.NewConflictError("user", "username", *user.Username)
+	}
+	return err
+}
+
+// CreateUser inserts user into the users table
+// error is 500 if the database fails, 409 if username or email exists, else nil
+func (s *SQLStore) CreateUser(ctx context.Context, user *schema.User) error {
+	if err := checkConflict(ctx, s, primitive.NilObjectID, user); err != nil {
+		return err
+	}
+
+	// Hash the password
+	if err := hashPassword(user); err != nil {
+		return err
+	}
+
+	role := 0
+	if user.Role != nil {
+		role = *user.Role
+	}
+	verified := user.EmailVerified != nil && *user.EmailVerified
+
+	// Try to insert and return error
+	id := primitive.NewObjectID()
+	if _, err := s.exec(ctx, `INSERT INTO users (id, username, password, email, role, email_verified, version) VALUES (?, ?, ?, ?, ?, ?, 1)`,
+		id.Hex(), *user.Username, user.Password, user.Email, role, verified); err != nil {
+		return uniqueConflict(err, user)
+	}
+	user.ID = id
+	user.Version = 1
+	return nil
+}
+
+// GetAllUsers retrieves all users ordered by id
+func (s *SQLStore) GetAllUsers(ctx context.Context) ([]*schema.UserSecure, error) {
+	rows, err := s.query(ctx, `SELECT `+sqlUserColumns+` FROM users WHERE deleted_at IS NULL ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*schema.UserSecure{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u.Secure())
+	}
+	return users, rows.Err()
+}
+
+// sqlSortColumns maps UserQuery sort fields onto columns
+var sqlSortColumns = map[string]string{
+	SortID:       "id",
+	SortUsername: "username",
+	SortEmail:    "COALESCE(email, '')",
+	SortRole:     "role",
+}
+
+// likeEscaper escapes the LIKE wildcards of a user supplied pattern
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// FindUsers returns the page of users selected by q
+func (s *SQLStore) FindUsers(ctx context.Context, q *UserQuery) (*UserPage, error) {
+	after, err := q.after()
+	if err != nil {
+		return nil, err
+	}
+
+	// Filters
+	where := []string{"deleted_at IS NULL"}
+	args := []interface{}{}
+	if q.Role != nil {
+		where = append(where, "role = ?")
+		args = append(args, *q.Role)
+	}
+	if len(q.UsernamePrefix) > 0 {
+		where = append(where, `username LIKE ? ESCAPE '\'`)
+		args = append(args, likeEscaper.Replace(q.UsernamePrefix)+"%")
+	}
+	if len(q.EmailDomain) > 0 {
+		where = append(where, `LOWER(email) LIKE ? ESCAPE '\'`)
+		args = append(args, "%@"+likeEscaper.Replace(strings.ToLower(q.EmailDomain)))
+	}
+
+	var total int
+	if err := s.queryRow(ctx, `SELECT COUNT(*) FROM users WHERE `+strings.Join(where, " AND "), args...).Scan(&total); err != nil {
+		return nil, err
+	}
+
+	// Order by the sort column then id so the cursor is a total order
+	column := sqlSortColumns[q.SortField()]
+	op, dir := ">", "ASC"
+	if q.Descending() {
+		op, dir = "<", "DESC"
+	}
+
+	// Resume after the cursor
+	if after != nil {
+		if column == "id" {
+			where = append(where, "id "+op+" ?")
+			args = append(args, after.ID)
+		} else {
+			value := q.afterValue(after)
+			where = append(where, "("+column+" "+op+" ? OR ("+column+" = ? AND id "+op+" ?))")
+			args = append(args, value, value, after.ID)
+		}
+	}
+
+	order := column + " " + dir
+	if column != "id" {
+		order += ", id " + dir
+	}
+	args = append(args, q.Limit+1)
+	rows, err := s.query(ctx, `SELECT `+sqlUserColumns+` FROM users WHERE `+strings.Join(where, " AND ")+
+		` ORDER BY `+order+` LIMIT ?`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*schema.UserSecure{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u.Secure())
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return q.page(users, total), nil
+}
+
+// GetUserByID looks up user with given object id
+func (s *SQLStore) GetUserByID(ctx context.Context, id string) (*schema.UserSecure, error) {
+	if !primitive.IsValidObjectID(id) {
+		return nil, ErrNotFound
+	}
+	u, err := s.getUser(ctx, "id", id)
+	if err != nil {
+		return nil, err
+	}
+	return u.Secure(), nil
+}
+
+// GetUserByUsername looks up user with given username
+func (s *SQLStore) GetUserByUsername(ctx context.Context, username string) (*schema.UserSecure, error) {
+	u, err := s.getUser(ctx, "username", username)
+	if err != nil {
+		return nil, err
+	}
+	return u.Secure(), nil
+}
+
+// GetUserByCreds looks up user with given username and checks pw against its hash
+func (s *SQLStore) GetUserByCreds(ctx context.Context, user, pw string) (*schema.UserSecure, error) {
+	u, err := s.getUser(ctx, "username", user)
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	return verifyCreds(ctx, s, u, pw)
+}
+
+// GetUserByEmail looks up user with given email
+func (s *SQLStore) GetUserByEmail(ctx context.Context, email string) (*schema.UserSecure, error) {
+	u, err := s.getUser(ctx, "email", email)
+	if err != nil {
+		return nil, err
+	}
+	return u.Secure(), nil
+}
+
+// whereLive matches the live user with given id at version
+func whereLive(userID string, version int) (string, []interface{}) {
+	if version == AnyVersion {
+		return "id = ? AND deleted_at IS NULL", []interface{}{userID}
+	}
+	return "id = ? AND deleted_at IS NULL AND version = ?", []interface{}{userID, version}
+}
+
+// UpdateUser sets every non-nil field of user on the stored user and bumps its version
+// error is 404 if user doesn't exist, 412 if version doesn't match,
+// 409 if username or email is taken, else nil
+func (s *SQLStore) UpdateUser(ctx context.Context, userID string, user *schema.User, version int) (*schema.UserSecure, error) {
+	oid, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	if err := checkConflict(ctx, s, oid, user); err != nil {
+		return nil, err
+	}
+
+	// Hash the password if provided
+	if err := hashPassword(user); err != nil {
+		return nil, err
+	}
+
+	// Build the SET clause out of the fields that are present
+	sets := []string{"version = version + 1"}
+	args := []interface{}{}
+	if user.Username != nil {
+		sets = append(sets, "username = ?")
+		args = append(args, *user.Username)
+	}
+	if user.Password != nil {
+		sets = append(sets, "password = ?")
+		args = append(args, *user.Password)
+	}
+	if user.Email != nil {
+		sets = append(sets, "email = ?")
+		args = append(args, *user.Email)
+	}
+	if user.Role != nil {
+		sets = append(sets, "role = ?")
+		args = append(args, *user.Role)
+	}
+	if user.EmailVerified != nil {
+		sets = append(sets, "email_verified = ?")
+		args = append(args, *user.EmailVerified)
+	}
+
+	where, whereArgs := whereLive(userID, version)
+	res, err := s.exec(ctx, `UPDATE users SET `+strings.Join(sets, ", ")+` WHERE `+where, append(args, whereArgs...)...)
+	if err != nil {
+		return nil, uniqueConflict(err, user)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return nil, notFoundOrMismatch(ctx, s, userID, version)
+	}
+	return s.GetUserByID(ctx, userID)
+}
+
+// DeleteUser tombstones user with given id, it is hidden from every lookup
+// until RestoreUser or PurgeDeletedUsers
+// error is 404 if user doesn't exist, 412 if version doesn't match, else nil
+func (s *SQLStore) DeleteUser(ctx context.Context, userID string, version int) (*schema.UserSecure, error) {
+	user, err := s.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	where, whereArgs := whereLive(userID, version)
+	res, err := s.exec(ctx, `UPDATE users SET deleted_at = ?, version = version + 1 WHERE `+where, append([]interface{}{now}, whereArgs...)...)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return nil, notFoundOrMismatch(ctx, s, userID, version)
+	}
+	user.DeletedAt = &now
+	user.Version++
+	return user, nil
+}
+
+// RestoreUser removes the tombstone of user with given id
+// error is 404 if user isn't deleted, else nil
+func (s *SQLStore) RestoreUser(ctx context.Context, userID string) (*schema.UserSecure, error) {
+	if !primitive.IsValidObjectID(userID) {
+		return nil, ErrNotFound
+	}
+	res, err := s.exec(ctx, `UPDATE users SET deleted_at = NULL, version = version + 1 WHERE id = ? AND deleted_at IS NOT NULL`, userID)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return nil, ErrNotFound
+	}
+	return s.GetUserByID(ctx, userID)
+}
+
+// PurgeDeletedUsers removes every user tombstoned before t for good, along
+// with its userData, and returns how many were removed
+func (s *SQLStore) PurgeDeletedUsers(ctx context.Context, t time.Time) (int, error) {
+	for _, d := range userData {
+		if _, err := s.exec(ctx, `DELETE FROM `+d.table+` WHERE user_id IN (SELECT id FROM users WHERE deleted_at < ?)`, t.UTC()); err != nil {
+			return 0, err
+		}
+	}
+	res, err := s.exec(ctx, `DELETE FROM users WHERE deleted_at < ?`, t.UTC())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// AdminExistsOrCreate checks for existence of admin account
+// and creates one with given key if it doesn't exist
+func (s *SQLStore) AdminExistsOrCreate(ctx context.Context, secret string) error {
+	return adminExistsOrCreate(ctx, s, secret)
+}
@@ -0,0 +1,247 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/briansan/user-go/config"
+	"github.com/briansan/user-go/errors"
+	"github.com/briansan/user-go/migrations"
+	"github.com/briansan/user-go/password"
+	"github.com/briansan/user-go/schema"
+)
+
+const (
+	// AnyVersion skips the version check of UpdateUser and DeleteUser
+	AnyVersion = -1
+)
+
+var (
+	// ErrNotFound is returned by every store when a lookup matches nothing
+	ErrNotFound = mongo.ErrNoDocuments
+	// ErrVersionMismatch is returned by UpdateUser and DeleteUser when the
+	// user exists with another version than the expected one
+	ErrVersionMismatch = errors.ErrVersionMismatch
+
+	hasher = password.FromConfig()
+
+	// dummyHash is a hash made by hasher that logins of users without a
+	// password are checked against, made on first use
+	dummyHash   string
+	dummyHashMu sync.Mutex
+)
+
+const (
+	dummyPassword = "not the password of anyone"
+)
+
+// userData lists where the records of a user are kept, the mongo
+// collection with the field holding the user id and the sql table, so
+// PurgeDeletedUsers drops them first and none outlives its user
+// recovery codes are part of the 2FA enrollment in mongo
+var userData = []struct {
+	collection, field, table string
+}{
+	{identitiesCollectionName, "userID", "identities"},
+	{"", "", "recovery_codes"},
+	{twoFactorCollectionName, "_id", "two_factor"},
+	{passkeysCollectionName, "userID", "passkeys"},
+	{personalTokensCollectionName, "userID", "personal_tokens"},
+	{emailTokensCollectionName, "userID", "email_tokens"},
+	{sessionsCollectionName, "userID", "sessions"},
+}
+
+// SetPasswordHasher changes the hasher new passwords are stored with
+// existing hashes are upgraded to it on the next successful login
+func SetPasswordHasher(h password.Hasher) {
+	dummyHashMu.Lock()
+	defer dummyHashMu.Unlock()
+	hasher, dummyHash = h, ""
+}
+
+// verifyDummy checks pw against dummyHash so that logins of unknown users
+// take as long as wrong passwords
+func verifyDummy(pw string) {
+	dummyHashMu.Lock()
+	if len(dummyHash) == 0 {
+		h, err := hasher.Hash(dummyPassword)
+		if err != nil {
+			dummyHashMu.Unlock()
+			logger.Warn("failed to hash dummy password", "err", err)
+			return
+		}
+		dummyHash = h
+	}
+	h, encoded := hasher, dummyHash
+	dummyHashMu.Unlock()
+	h.Verify(pw, encoded)
+}
+
+// hashPassword replaces the plaintext password of user with its hash
+func hashPassword(user *schema.User) error {
+	if user.Password == nil {
+		return nil
+	}
+	h, err := hasher.Hash(*user.Password)
+	if err != nil {
+		return err
+	}
+	user.Password = &h
+	return nil
+}
+
+// checkConflict returns a ConflictError naming the first unique field of user
+// (username, then email) that already belongs to a user other than id
+func checkConflict(ctx context.Context, s UserStore, id primitive.ObjectID, user *schema.User) error {
+	if user.Username != nil {
+		other, err := s.GetUserByUsername(ctx, *user.Username)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+		if other != nil && other.ID != id {
+			return errors.NewConflictError("user", "username", *user.Username)
+		}
+	}
+	if user.Email != nil {
+		other, err := s.GetUserByEmail(ctx, *user.Email)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+		if other != nil && other.ID != id {
+			return errors.NewConflictError("user", "email", *user.Email)
+		}
+	}
+	return nil
+}
+
+// notFoundOrMismatch tells apart why a write guarded by version matched nothing
+func notFoundOrMismatch(ctx context.Context, s UserStore, userID string, version int) error {
+	if version == AnyVersion {
+		return ErrNotFound
+	}
+	if _, err := s.GetUserByID(ctx, userID); err != nil {
+		return err
+	}
+	return ErrVersionMismatch
+}
+
+// verifyCreds checks pw against u, the full user document found by username
+// or nil if there is none, and upgrades the stored hash through s if the
+// hasher asks for it
+// error is ErrNotFound on mismatch so a bad password looks like a missing
+// user, which takes as long to check
+func verifyCreds(ctx context.Context, s UserStore, u *schema.User, pw string) (*schema.UserSecure, error) {
+	if u == nil || u.Password == nil {
+		verifyDummy(pw)
+		return nil, ErrNotFound
+	}
+	ok, err := password.Verify(pw, *u.Password)
+	if err != nil {
+		logger.Warn("unreadable password hash", "user", u.ID.Hex(), "err", err)
+		return nil, ErrNotFound
+	}
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	// Upgrade the hash now that we know the plaintext
+	if hasher.NeedsRehash(*u.Password) {
+		if _, err := s.UpdateUser(ctx, u.ID.Hex(), &schema.User{Password: &pw}, AnyVersion); err != nil {
+			logger.Warn("failed to upgrade password hash", "user", u.ID.Hex(), "err", err)
+		}
+	}
+	return u.Secure(), nil
+}
+
+// Open connects to the backend selected by env.STORE_DRIVER
+func Open(ctx context.Context) (UserStore, error) {
+	switch driver := config.GetStoreDriver(); driver {
+	case DriverMongo:
+		if err := InitMongoSession(ctx); err != nil {
+			return nil, err
+		}
+		s, err := NewMongoStore(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case DriverPostgres, DriverSQLite:
+		s, err := NewSQLStore(ctx, driver, config.GetSQLDSN())
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("unknown store driver %v", driver)
+	}
+}
+
+// OpenMigrations returns the migration runner of the backend selected by
+// env.STORE_DRIVER without applying anything, and a func that disconnects it
+func OpenMigrations(ctx context.Context) (migrations.Runner, func(), error) {
+	switch driver := config.GetStoreDriver(); driver {
+	case DriverMongo:
+		c, err := connectMongo(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		return migrations.NewMongoRunner(c.Database(databaseName)), func() { c.Disconnect(context.Background()) }, nil
+	case DriverPostgres, DriverSQLite:
+		db, err := sql.Open(driver, config.GetSQLDSN())
+		if err != nil {
+			return nil, nil, err
+		}
+		runner, err := migrations.NewSQLRunner(ctx, db, driver)
+		if err != nil {
+			db.Close()
+			return nil, nil, err
+		}
+		return runner, func() { db.Close() }, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown store driver %v", driver)
+	}
+}
+
+// UserStore is the set of user operations the api depends on
+// MongoStore, SQLStore and MemoryStore all implement it
+// every call takes the context of the request it serves so that a client
+// going away or a deadline passing cancels the database work
+type UserStore interface {
+	AuditLog
+	TokenStore
+	OAuthStore
+	IdentityStore
+	TwoFactorStore
+	PasskeyStore
+	PersonalTokenStore
+	EmailTokenStore
+	LoginFailureStore
+	RateLimitStore
+	SessionStore
+
+	// Copy returns a store that is safe to use for the lifetime of a single request
+	Copy(ctx context.Context) (UserStore, error)
+	// Cleanup releases whatever Copy acquired
+	Cleanup()
+
+	CreateUser(ctx context.Context, user *schema.User) error
+	GetAllUsers(ctx context.Context) ([]*schema.UserSecure, error)
+	FindUsers(ctx context.Context, q *UserQuery) (*UserPage, error)
+	GetUserByID(ctx context.Context, id string) (*schema.UserSecure, error)
+	GetUserByUsername(ctx context.Context, username string) (*schema.UserSecure, error)
+	GetUserByCreds(ctx context.Context, user, pw string) (*schema.UserSecure, error)
+	GetUserByEmail(ctx context.Context, email string) (*schema.UserSecure, error)
+	// UpdateUser and DeleteUser only apply if the stored version equals
+	// version, pass AnyVersion to skip the check
+	UpdateUser(ctx context.Context, userID string, user *schema.User, version int) (*schema.UserSecure, error)
+	DeleteUser(ctx context.Context, userID string, version int) (*schema.UserSecure, error)
+	RestoreUser(ctx context.Context, userID string) (*schema.UserSecure, error)
+	PurgeDeletedUsers(ctx context.Context, t time.Time) (int, error)
+	AdminExistsOrCreate(ctx context.Context, secret string) error
+}
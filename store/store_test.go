@@ -1,42 +1,145 @@
 package store
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/suite"
-	"gopkg.in/mgo.v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 
+	"github.com/briansan/user-go/errors"
+	"github.com/briansan/user-go/password"
+	"github.com/briansan/user-go/ratelimit"
 	"github.com/briansan/user-go/schema"
 )
 
 type StoreTestSuite struct {
 	suite.Suite
-	store *MongoStore
+	open  func() UserStore
+	store UserStore
+	ctx   context.Context
 }
 
 func (suite *StoreTestSuite) SetupTest() {
-	// Use test database and reestablish session
-	os.Setenv(envDatabaseName, "test")
-	InitMongoSession()
+	SetPasswordHasher(&password.Bcrypt{Cost: 4})
+	suite.ctx = context.Background()
+	suite.store = suite.open()
+}
 
-	var err error
-	suite.store, err = NewMongoStore()
-	suite.Nil(err)
+func (suite *StoreTestSuite) TearDownTest() {
+	suite.store.Cleanup()
+}
 
-	suite.store.GetUsersCollection().RemoveAll(nil)
+func openTestMongoStore() UserStore {
+	ctx := context.Background()
+	store, err := NewMongoStore(ctx)
+	if err != nil {
+		panic(err)
+	}
+	store.GetUsersCollection().DeleteMany(ctx, bson.M{})
+	store.GetAuditCollection().DeleteMany(ctx, bson.M{})
+	store.GetRefreshTokensCollection().DeleteMany(ctx, bson.M{})
+	store.GetRevokedTokensCollection().DeleteMany(ctx, bson.M{})
+	store.GetOAuthClientsCollection().DeleteMany(ctx, bson.M{})
+	store.GetAuthCodesCollection().DeleteMany(ctx, bson.M{})
+	store.GetIdentitiesCollection().DeleteMany(ctx, bson.M{})
+	store.GetTwoFactorCollection().DeleteMany(ctx, bson.M{})
+	store.GetPasskeysCollection().DeleteMany(ctx, bson.M{})
+	store.GetPersonalTokensCollection().DeleteMany(ctx, bson.M{})
+	store.GetEmailTokensCollection().DeleteMany(ctx, bson.M{})
+	store.GetLoginFailuresCollection().DeleteMany(ctx, bson.M{})
+	store.GetRateBucketsCollection().DeleteMany(ctx, bson.M{})
+	store.GetSessionsCollection().DeleteMany(ctx, bson.M{})
+	return store
 }
 
-func (suite *StoreTestSuite) TearDownTest() {
+func TestMongoStore(t *testing.T) {
 	// Use test database and reestablish session
-	suite.store.Cleanup()
+	os.Setenv("BT_MONGO_DATABASE", "test")
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := InitMongoSession(ctx); err != nil {
+		t.Skip("mongo unavailable: ", err)
+	}
+	suite.Run(t, &StoreTestSuite{open: openTestMongoStore})
+}
+
+func TestSQLiteStore(t *testing.T) {
+	suite.Run(t, &StoreTestSuite{open: func() UserStore {
+		store, err := NewSQLStore(context.Background(), DriverSQLite, ":memory:")
+		if err != nil {
+			panic(err)
+		}
+		return store
+	}})
+}
+
+func TestPostgresStore(t *testing.T) {
+	// Only run against a database that was set aside for it
+	dsn := os.Getenv("BT_TEST_POSTGRES_DSN")
+	if len(dsn) == 0 {
+		t.Skip("BT_TEST_POSTGRES_DSN not set")
+	}
+	suite.Run(t, &StoreTestSuite{open: func() UserStore {
+		ctx := context.Background()
+		store, err := NewSQLStore(ctx, DriverPostgres, dsn)
+		if err != nil {
+			panic(err)
+		}
+		store.exec(ctx, `DELETE FROM users`)
+		store.exec(ctx, `DELETE FROM audit_log`)
+		store.exec(ctx, `DELETE FROM refresh_tokens`)
+		store.exec(ctx, `DELETE FROM revoked_tokens`)
+		store.exec(ctx, `DELETE FROM oauth_clients`)
+		store.exec(ctx, `DELETE FROM oauth_codes`)
+		store.exec(ctx, `DELETE FROM identities`)
+		store.exec(ctx, `DELETE FROM recovery_codes`)
+		store.exec(ctx, `DELETE FROM two_factor`)
+		store.exec(ctx, `DELETE FROM passkeys`)
+		store.exec(ctx, `DELETE FROM personal_tokens`)
+		store.exec(ctx, `DELETE FROM email_tokens`)
+		store.exec(ctx, `DELETE FROM login_failures`)
+		store.exec(ctx, `DELETE FROM rate_buckets`)
+		store.exec(ctx, `DELETE FROM sessions`)
+		return store
+	}})
 }
 
-func TestExampleTestSuite(t *testing.T) {
-	suite.Run(t, new(StoreTestSuite))
+func TestMemoryStore(t *testing.T) {
+	suite.Run(t, &StoreTestSuite{open: func() UserStore {
+		return NewMemoryStore()
+	}})
 }
 
-// Test001_User asserts proper CRUD functionality of user object with mongo
+// storedPassword peeks at the hash a store keeps for username
+func storedPassword(s UserStore, username string) string {
+	u := schema.User{}
+	switch s := s.(type) {
+	case *MongoStore:
+		s.GetUsersCollection().FindOne(context.Background(), newUserQueryByUsername(username)).Decode(&u)
+	case *SQLStore:
+		stored, _ := s.getUser(context.Background(), "username", username)
+		u = *stored
+	case *MemoryStore:
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		u = *s.findByUsername(username)
+	}
+	return *u.Password
+}
+
+// isConflict reports whether err is how a store rejects a duplicate username
+func isConflict(err error) bool {
+	_, ok := err.(*errors.ConflictError)
+	return ok || mongo.IsDuplicateKeyError(err)
+}
+
+// Test001_User asserts proper CRUD functionality of user object with the store
 func (suite *StoreTestSuite) Test001_User() {
 	username := "foo"
 	email := "bar"
@@ -50,11 +153,11 @@ func (suite *StoreTestSuite) Test001_User() {
 		Password: &pw,
 		Role:     &role,
 	}
-	err := suite.store.CreateUser(newUser)
+	err := suite.store.CreateUser(suite.ctx, newUser)
 	suite.Nil(err)
 
 	// Test GetUserByUsername
-	user, err := suite.store.GetUserByUsername(username)
+	user, err := suite.store.GetUserByUsername(suite.ctx, username)
 	suite.Nil(err)
 	suite.NotNil(user)
 	suite.Equal(username, user.Username)
@@ -63,66 +166,974 @@ func (suite *StoreTestSuite) Test001_User() {
 	id := user.ID.Hex()
 
 	// Test GetUserByEmail
-	user, err = suite.store.GetUserByEmail(email)
+	user, err = suite.store.GetUserByEmail(suite.ctx, email)
 	suite.Nil(err)
 	suite.NotNil(user)
 	suite.Equal(username, user.Username)
 	suite.Equal(email, user.Email)
 
 	// Test GetUserByPassword
-	user, err = suite.store.GetUserByCreds(username, pw)
+	user, err = suite.store.GetUserByCreds(suite.ctx, username, pw)
 	suite.Nil(err)
 	suite.NotNil(user)
 	suite.Equal(username, user.Username)
 	suite.Equal(email, user.Email)
 
 	// Test CreateUser with conflict
-	err = suite.store.CreateUser(newUser)
+	err = suite.store.CreateUser(suite.ctx, newUser)
 	suite.NotNil(err)
 	suite.Equal("user with username as foo already exists", err.Error())
 
 	// Test UpdateUser
 	newUsername := "foobar"
 	userPatch := &schema.User{Username: &newUsername}
-	user, err = suite.store.UpdateUser(id, userPatch)
+	user, err = suite.store.UpdateUser(suite.ctx, id, userPatch, AnyVersion)
 	suite.Nil(err)
 	suite.Equal(newUsername, user.Username)
 	suite.Equal(email, user.Email)
 	suite.Equal(role, user.Role)
 
 	// Add second user
-	err = suite.store.CreateUser(newUser)
+	otherEmail := "qux"
+	newUser.Email = &otherEmail
+	err = suite.store.CreateUser(suite.ctx, newUser)
 	suite.Nil(err)
 
 	// Try to update second user
-	u, err := suite.store.GetUserByUsername(*newUser.Username)
+	u, err := suite.store.GetUserByUsername(suite.ctx, *newUser.Username)
 	suite.Nil(err)
 
-	user, err = suite.store.UpdateUser(u.ID.Hex(), userPatch)
+	user, err = suite.store.UpdateUser(suite.ctx, u.ID.Hex(), userPatch, AnyVersion)
 	suite.Nil(user)
-	suite.True(mgo.IsDup(err))
+	suite.True(isConflict(err))
 
 	// Test GetAllUsers
-	users, err := suite.store.GetAllUsers()
+	users, err := suite.store.GetAllUsers(suite.ctx)
 	suite.Nil(err)
 	suite.Equal(len(users), 2)
 
 	// Test DeleteUser
-	user, err = suite.store.DeleteUser(id)
+	user, err = suite.store.DeleteUser(suite.ctx, id, AnyVersion)
 	suite.Nil(err)
 	suite.NotNil(user)
 	suite.Equal(newUsername, user.Username)
 	suite.Equal(email, user.Email)
+
+	// Test lookup after delete
+	user, err = suite.store.GetUserByID(suite.ctx, id)
+	suite.Nil(user)
+	suite.Equal(ErrNotFound, err)
 }
 
 // Test002_Admin asserts proper admin insertion
 func (suite *StoreTestSuite) Test002_Admin() {
 	// Create admin
-	err := suite.store.AdminExistsOrCreate("test_secret")
+	err := suite.store.AdminExistsOrCreate(suite.ctx, "test_secret")
 	suite.Nil(err)
 
 	// Fetch admin
-	u, err := suite.store.GetUserByCreds("boss", "test_secret")
+	u, err := suite.store.GetUserByCreds(suite.ctx, "boss", "test_secret")
 	suite.Nil(err)
 	suite.Equal(schema.RoleAdmin, u.Role)
+	suite.True(u.EmailVerified)
+}
+
+// Test003_PasswordUpgrade asserts that old hashes are replaced on login
+func (suite *StoreTestSuite) Test003_PasswordUpgrade() {
+	username, email, pw := "foo", "bar", "baz"
+
+	// Create user the way earlier versions did
+	SetPasswordHasher(password.SHA256{})
+	err := suite.store.CreateUser(suite.ctx, &schema.User{
+		Username: &username,
+		Email:    &email,
+		Password: &pw,
+		Role:     &schema.RoleUser,
+	})
+	suite.Nil(err)
+	suite.Equal("uqWglk0zIPvAxqkiFARTyFE+okq4/QV3A0gEqWckgJY=", storedPassword(suite.store, username))
+
+	// Switch to argon2id
+	argon := &password.Argon2id{Time: 1, Memory: 1024, Threads: 1}
+	SetPasswordHasher(argon)
+
+	// Wrong password leaves the hash alone
+	u, err := suite.store.GetUserByCreds(suite.ctx, username, "qux")
+	suite.Nil(u)
+	suite.Equal(ErrNotFound, err)
+	suite.True(argon.NeedsRehash(storedPassword(suite.store, username)))
+
+	// Unknown users are checked against a hash of the new hasher too
+	u, err = suite.store.GetUserByCreds(suite.ctx, "nobody", pw)
+	suite.Nil(u)
+	suite.Equal(ErrNotFound, err)
+	suite.False(argon.NeedsRehash(dummyHash))
+
+	// Right password upgrades the hash
+	u, err = suite.store.GetUserByCreds(suite.ctx, username, pw)
+	suite.Nil(err)
+	suite.Equal(username, u.Username)
+	suite.False(argon.NeedsRehash(storedPassword(suite.store, username)))
+
+	// And the new hash still logs in
+	u, err = suite.store.GetUserByCreds(suite.ctx, username, pw)
+	suite.Nil(err)
+	suite.Equal(username, u.Username)
+}
+
+// Test004_Conflicts asserts that username and email stay unique on create and update
+func (suite *StoreTestSuite) Test004_Conflicts() {
+	foo, bar, pw := "foo", "bar", "baz"
+	fooEmail, barEmail := "foo@example.com", "bar@example.com"
+
+	err := suite.store.CreateUser(suite.ctx, &schema.User{Username: &foo, Email: &fooEmail, Password: &pw, Role: &schema.RoleUser})
+	suite.Nil(err)
+	err = suite.store.CreateUser(suite.ctx, &schema.User{Username: &bar, Email: &barEmail, Password: &pw, Role: &schema.RoleUser})
+	suite.Nil(err)
+
+	// Create with a taken email
+	qux := "qux"
+	err = suite.store.CreateUser(suite.ctx, &schema.User{Username: &qux, Email: &fooEmail, Password: &pw})
+	conflict, ok := err.(*errors.ConflictError)
+	suite.True(ok)
+	suite.Equal("email", conflict.Field)
+	suite.Equal(fooEmail, conflict.Value)
+
+	u, err := suite.store.GetUserByUsername(suite.ctx, bar)
+	suite.Nil(err)
+	id := u.ID.Hex()
+
+	// Rename onto a taken username
+	user, err := suite.store.UpdateUser(suite.ctx, id, &schema.User{Username: &foo}, AnyVersion)
+	suite.Nil(user)
+	conflict, ok = err.(*errors.ConflictError)
+	suite.True(ok)
+	suite.Equal("username", conflict.Field)
+
+	// Change to a taken email
+	user, err = suite.store.UpdateUser(suite.ctx, id, &schema.User{Email: &fooEmail}, AnyVersion)
+	suite.Nil(user)
+	conflict, ok = err.(*errors.ConflictError)
+	suite.True(ok)
+	suite.Equal("email", conflict.Field)
+
+	// Keeping your own username and email is not a conflict
+	user, err = suite.store.UpdateUser(suite.ctx, id, &schema.User{Username: &bar, Email: &barEmail}, AnyVersion)
+	suite.Nil(err)
+	suite.Equal(bar, user.Username)
+	suite.Equal(barEmail, user.Email)
+}
+
+// Test005_FindUsers asserts filtering, ordering and paging of users
+func (suite *StoreTestSuite) Test005_FindUsers() {
+	pw := "baz"
+	for i, name := range []string{"carol", "alice", "bob", "alfred", "dave"} {
+		username, email := name, name+"@example.com"
+		role := schema.RoleUser
+		if i%2 == 0 {
+			email = name + "@Other.org"
+			role = schema.RoleManager
+		}
+		err := suite.store.CreateUser(suite.ctx, &schema.User{Username: &username, Email: &email, Password: &pw, Role: &role})
+		suite.Nil(err)
+	}
+
+	usernames := func(p *UserPage) []string {
+		names := []string{}
+		for _, u := range p.Users {
+			names = append(names, u.Username)
+		}
+		return names
+	}
+
+	// Everything by username
+	q := &UserQuery{Sort: SortUsername}
+	suite.Nil(q.Validate())
+	p, err := suite.store.FindUsers(suite.ctx, q)
+	suite.Nil(err)
+	suite.Equal(5, p.Total)
+	suite.Equal([]string{"alfred", "alice", "bob", "carol", "dave"}, usernames(p))
+	suite.Empty(p.Next)
+
+	// Filters
+	role := schema.RoleManager
+	q = &UserQuery{Role: &role, Sort: "-" + SortUsername}
+	suite.Nil(q.Validate())
+	p, err = suite.store.FindUsers(suite.ctx, q)
+	suite.Nil(err)
+	suite.Equal([]string{"dave", "carol", "bob"}, usernames(p))
+
+	q = &UserQuery{UsernamePrefix: "al", Sort: SortUsername}
+	suite.Nil(q.Validate())
+	p, err = suite.store.FindUsers(suite.ctx, q)
+	suite.Nil(err)
+	suite.Equal([]string{"alfred", "alice"}, usernames(p))
+
+	q = &UserQuery{EmailDomain: "other.ORG", Sort: SortUsername}
+	suite.Nil(q.Validate())
+	p, err = suite.store.FindUsers(suite.ctx, q)
+	suite.Nil(err)
+	suite.Equal(3, p.Total)
+	suite.Equal([]string{"bob", "carol", "dave"}, usernames(p))
+
+	// Walk pages of two ordered by role then id
+	q = &UserQuery{Sort: SortRole, Limit: 2}
+	suite.Nil(q.Validate())
+	seen := []string{}
+	for pages := 0; pages < 5; pages++ {
+		p, err = suite.store.FindUsers(suite.ctx, q)
+		suite.Nil(err)
+		suite.Equal(5, p.Total)
+		seen = append(seen, usernames(p)...)
+		if len(p.Next) == 0 {
+			break
+		}
+		q.Cursor = p.Next
+	}
+	suite.Equal(5, len(seen))
+	suite.ElementsMatch([]string{"alice", "alfred"}, seen[:2])
+	suite.ElementsMatch([]string{"carol", "bob", "dave"}, seen[2:])
+
+	// A cursor can't be replayed against another sort
+	q = &UserQuery{Sort: SortUsername, Cursor: q.Cursor}
+	suite.NotNil(q.Validate())
+}
+
+// Test006_SoftDelete asserts that deleted users are hidden until restored or purged
+func (suite *StoreTestSuite) Test006_SoftDelete() {
+	username, email, pw := "foo", "foo@example.com", "baz"
+	err := suite.store.CreateUser(suite.ctx, &schema.User{Username: &username, Email: &email, Password: &pw, Role: &schema.RoleUser})
+	suite.Nil(err)
+	u, err := suite.store.GetUserByUsername(suite.ctx, username)
+	suite.Nil(err)
+	id := u.ID.Hex()
+
+	// Delete leaves a tombstone
+	u, err = suite.store.DeleteUser(suite.ctx, id, AnyVersion)
+	suite.Nil(err)
+	suite.NotNil(u.DeletedAt)
+
+	// Hidden from every lookup
+	_, err = suite.store.GetUserByID(suite.ctx, id)
+	suite.Equal(ErrNotFound, err)
+	_, err = suite.store.GetUserByUsername(suite.ctx, username)
+	suite.Equal(ErrNotFound, err)
+	_, err = suite.store.GetUserByEmail(suite.ctx, email)
+	suite.Equal(ErrNotFound, err)
+	_, err = suite.store.GetUserByCreds(suite.ctx, username, pw)
+	suite.Equal(ErrNotFound, err)
+	_, err = suite.store.UpdateUser(suite.ctx, id, &schema.User{Email: &email}, AnyVersion)
+	suite.Equal(ErrNotFound, err)
+	_, err = suite.store.DeleteUser(suite.ctx, id, AnyVersion)
+	suite.Equal(ErrNotFound, err)
+	users, err := suite.store.GetAllUsers(suite.ctx)
+	suite.Nil(err)
+	suite.Empty(users)
+
+	// The username stays taken while the tombstone exists
+	err = suite.store.CreateUser(suite.ctx, &schema.User{Username: &username, Email: &email, Password: &pw})
+	_, ok := err.(*errors.ConflictError)
+	suite.True(ok)
+
+	// Restore brings it back
+	u, err = suite.store.RestoreUser(suite.ctx, id)
+	suite.Nil(err)
+	suite.Nil(u.DeletedAt)
+	u, err = suite.store.GetUserByCreds(suite.ctx, username, pw)
+	suite.Nil(err)
+	suite.Equal(username, u.Username)
+	_, err = suite.store.RestoreUser(suite.ctx, id)
+	suite.Equal(ErrNotFound, err)
+
+	// Purge only removes tombstones older than the cutoff
+	_, err = suite.store.DeleteUser(suite.ctx, id, AnyVersion)
+	suite.Nil(err)
+	n, err := suite.store.PurgeDeletedUsers(suite.ctx, time.Now().Add(-time.Hour))
+	suite.Nil(err)
+	suite.Equal(0, n)
+	n, err = suite.store.PurgeDeletedUsers(suite.ctx, time.Now().Add(time.Hour))
+	suite.Nil(err)
+	suite.Equal(1, n)
+	_, err = suite.store.RestoreUser(suite.ctx, id)
+	suite.Equal(ErrNotFound, err)
+
+	// And frees the username
+	err = suite.store.CreateUser(suite.ctx, &schema.User{Username: &username, Email: &email, Password: &pw})
+	suite.Nil(err)
+}
+
+// Test007_Versions asserts that writes bump the version and can be guarded by it
+func (suite *StoreTestSuite) Test007_Versions() {
+	username, email, pw := "foo", "foo@example.com", "baz"
+	newUser := &schema.User{Username: &username, Email: &email, Password: &pw, Role: &schema.RoleUser}
+	err := suite.store.CreateUser(suite.ctx, newUser)
+	suite.Nil(err)
+	suite.Equal(1, newUser.Version)
+	id := newUser.ID.Hex()
+
+	u, err := suite.store.GetUserByID(suite.ctx, id)
+	suite.Nil(err)
+	suite.Equal(1, u.Version)
+
+	// Matching version applies and bumps
+	other := "bar@example.com"
+	u, err = suite.store.UpdateUser(suite.ctx, id, &schema.User{Email: &other}, 1)
+	suite.Nil(err)
+	suite.Equal(2, u.Version)
+	suite.Equal(other, u.Email)
+
+	// Stale version is refused and changes nothing
+	u, err = suite.store.UpdateUser(suite.ctx, id, &schema.User{Email: &email}, 1)
+	suite.Nil(u)
+	suite.Equal(ErrVersionMismatch, err)
+	u, err = suite.store.DeleteUser(suite.ctx, id, 1)
+	suite.Nil(u)
+	suite.Equal(ErrVersionMismatch, err)
+	u, err = suite.store.GetUserByID(suite.ctx, id)
+	suite.Nil(err)
+	suite.Equal(other, u.Email)
+	suite.Equal(2, u.Version)
+
+	// Missing user is still not found
+	_, err = suite.store.UpdateUser(suite.ctx, "000000000000000000000000", &schema.User{Email: &email}, 1)
+	suite.Equal(ErrNotFound, err)
+
+	// Delete and restore bump too
+	u, err = suite.store.DeleteUser(suite.ctx, id, 2)
+	suite.Nil(err)
+	suite.Equal(3, u.Version)
+	u, err = suite.store.RestoreUser(suite.ctx, id)
+	suite.Nil(err)
+	suite.Equal(4, u.Version)
+}
+
+func (suite *StoreTestSuite) Test008_Audit() {
+	actor, alice, bob := primitive.NewObjectID().Hex(), primitive.NewObjectID().Hex(), primitive.NewObjectID().Hex()
+	start := time.Now().UTC().Truncate(time.Second).Add(-time.Hour)
+	entries := []*schema.AuditEntry{
+		{Time: start, Action: schema.AuditUserCreate, Target: alice, IP: "10.0.0.1", RequestID: "a",
+			Diff: map[string]schema.AuditChange{"username": {New: "alice"}}},
+		{Time: start.Add(time.Minute), Action: schema.AuditLogin, Actor: alice, Target: alice, IP: "10.0.0.1", RequestID: "b"},
+		{Time: start.Add(2 * time.Minute), Action: schema.AuditUserUpdate, Actor: actor, Target: bob, IP: "10.0.0.2", RequestID: "c",
+			Diff: map[string]schema.AuditChange{"email": {Old: "b@example.com", New: "bob@example.com"}}},
+		{Time: start.Add(3 * time.Minute), Action: schema.AuditUserDelete, Actor: actor, Target: alice, IP: "10.0.0.2", RequestID: "d"},
+	}
+	for _, e := range entries {
+		suite.Nil(suite.store.AppendAudit(suite.ctx, e))
+		suite.False(e.ID.IsZero())
+	}
+
+	requestIDs := func(q *AuditQuery) []string {
+		suite.Nil(q.Validate())
+		found, err := suite.store.FindAudit(suite.ctx, q)
+		suite.Nil(err)
+		ids := []string{}
+		for _, e := range found {
+			ids = append(ids, e.RequestID)
+		}
+		return ids
+	}
+
+	// Newest first
+	suite.Equal([]string{"d", "c", "b", "a"}, requestIDs(&AuditQuery{}))
+	suite.Equal([]string{"d", "c"}, requestIDs(&AuditQuery{Limit: 2}))
+
+	// Filters
+	suite.Equal([]string{"d", "c"}, requestIDs(&AuditQuery{Actor: actor}))
+	suite.Equal([]string{"d", "b", "a"}, requestIDs(&AuditQuery{Target: alice}))
+	suite.Equal([]string{"d"}, requestIDs(&AuditQuery{Actor: actor, Target: alice}))
+	suite.Equal([]string{"c", "b"}, requestIDs(&AuditQuery{From: start.Add(time.Minute), To: start.Add(2 * time.Minute)}))
+
+	// Fields survive the round trip
+	found, err := suite.store.FindAudit(suite.ctx, &AuditQuery{Target: bob, Limit: 1})
+	suite.Nil(err)
+	suite.Len(found, 1)
+	e := found[0]
+	suite.Equal(entries[2].ID, e.ID)
+	suite.True(entries[2].Time.Equal(e.Time))
+	suite.Equal(schema.AuditUserUpdate, e.Action)
+	suite.Equal(actor, e.Actor)
+	suite.Equal("10.0.0.2", e.IP)
+	suite.Equal("bob@example.com", e.Diff["email"].New)
+
+	// Bad range
+	suite.NotNil((&AuditQuery{From: start, To: start.Add(-time.Minute)}).Validate())
+}
+
+func (suite *StoreTestSuite) Test009_Tokens() {
+	now := time.Now()
+	userID := primitive.NewObjectID().Hex()
+	newToken := func(hash, family, jti string) *schema.RefreshToken {
+		return &schema.RefreshToken{
+			Hash: hash, Family: family, UserID: userID,
+			AccessJTI: jti, AccessExpiresAt: now.Add(time.Hour),
+			ExpiresAt: now.Add(24 * time.Hour),
+		}
+	}
+
+	// Create and look up by hash and jti
+	first := newToken("h1", "f1", "j1")
+	suite.Nil(suite.store.CreateRefreshToken(suite.ctx, first))
+	suite.False(first.ID.IsZero())
+
+	t, err := suite.store.GetRefreshToken(suite.ctx, "h1")
+	suite.Nil(err)
+	suite.Equal(first.ID, t.ID)
+	suite.Equal(userID, t.UserID)
+	suite.True(first.ExpiresAt.Equal(t.ExpiresAt))
+	suite.True(t.Active(now))
+
+	t, err = suite.store.GetRefreshTokenByJTI(suite.ctx, "j1")
+	suite.Nil(err)
+	suite.Equal(first.ID, t.ID)
+
+	_, err = suite.store.GetRefreshToken(suite.ctx, "missing")
+	suite.Equal(ErrNotFound, err)
+
+	// Rotate once, the second time is reuse
+	second := newToken("h2", "f1", "j2")
+	suite.Nil(suite.store.RotateRefreshToken(suite.ctx, first, second))
+	suite.NotNil(first.UsedAt)
+	t, err = suite.store.GetRefreshToken(suite.ctx, "h1")
+	suite.Nil(err)
+	suite.NotNil(t.UsedAt)
+	suite.False(t.Active(now))
+
+	suite.Equal(ErrTokenReused, suite.store.RotateRefreshToken(suite.ctx, first, newToken("h3", "f1", "j3")))
+	_, err = suite.store.GetRefreshToken(suite.ctx, "h3")
+	suite.Equal(ErrNotFound, err)
+
+	// Revoking the family revokes its refresh and access tokens only
+	other := newToken("h4", "f2", "j4")
+	suite.Nil(suite.store.CreateRefreshToken(suite.ctx, other))
+	suite.Nil(suite.store.RevokeTokenFamily(suite.ctx, "f1"))
+
+	t, err = suite.store.GetRefreshToken(suite.ctx, "h2")
+	suite.Nil(err)
+	suite.NotNil(t.RevokedAt)
+	suite.Equal(ErrTokenReused, suite.store.RotateRefreshToken(suite.ctx, t, newToken("h5", "f1", "j5")))
+	for jti, revoked := range map[string]bool{"j1": true, "j2": true, "j4": false} {
+		ok, err := suite.store.IsAccessTokenRevoked(suite.ctx, jti)
+		suite.Nil(err)
+		suite.Equal(revoked, ok, jti)
+	}
+	t, err = suite.store.GetRefreshToken(suite.ctx, "h4")
+	suite.Nil(err)
+	suite.True(t.Active(now))
+
+	// Revoking twice is fine
+	suite.Nil(suite.store.RevokeAccessToken(suite.ctx, "j4", now.Add(time.Hour)))
+	suite.Nil(suite.store.RevokeAccessToken(suite.ctx, "j4", now.Add(time.Hour)))
+	ok, err := suite.store.IsAccessTokenRevoked(suite.ctx, "j4")
+	suite.Nil(err)
+	suite.True(ok)
+
+	// Purge drops what expired, the 3 revoked jtis first and then the 3 refresh tokens
+	n, err := suite.store.PurgeExpiredTokens(suite.ctx, now.Add(2*time.Hour))
+	suite.Nil(err)
+	suite.Equal(3, n)
+	n, err = suite.store.PurgeExpiredTokens(suite.ctx, now.Add(48*time.Hour))
+	suite.Nil(err)
+	suite.Equal(3, n)
+	_, err = suite.store.GetRefreshToken(suite.ctx, "h1")
+	suite.Equal(ErrNotFound, err)
+}
+
+func (suite *StoreTestSuite) Test010_OAuth() {
+	// Register a confidential and a public client
+	app := &schema.OAuthClient{
+		ID: "app", SecretHash: "s", Name: "App",
+		RedirectURIs: []string{"https://app.example.com/cb"},
+		GrantTypes:   []string{schema.GrantAuthorizationCode, schema.GrantClientCredentials},
+		Scopes:       []string{schema.ScopeOpenID, schema.ScopeEmail},
+	}
+	spa := &schema.OAuthClient{ID: "spa", Name: "SPA", RedirectURIs: []string{"http://localhost/cb"},
+		GrantTypes: []string{schema.GrantAuthorizationCode}}
+	suite.Nil(suite.store.CreateClient(suite.ctx, app))
+	suite.False(app.CreatedAt.IsZero())
+	suite.Nil(suite.store.CreateClient(suite.ctx, spa))
+	suite.True(isConflict(suite.store.CreateClient(suite.ctx, &schema.OAuthClient{ID: "app", Name: "Other"})))
+
+	c, err := suite.store.GetClient(suite.ctx, "app")
+	suite.Nil(err)
+	suite.Equal(app, c)
+	suite.False(c.Public())
+	c, err = suite.store.GetClient(suite.ctx, "spa")
+	suite.Nil(err)
+	suite.True(c.Public())
+	suite.Equal([]string{}, c.Scopes)
+
+	clients, err := suite.store.GetClients(suite.ctx)
+	suite.Nil(err)
+	suite.Len(clients, 2)
+
+	// Codes are consumed once
+	now := time.Now()
+	code := &schema.AuthCode{Hash: "h", ClientID: "app", UserID: primitive.NewObjectID().Hex(),
+		RedirectURI: "https://app.example.com/cb", Scope: "openid email", Nonce: "n", CodeChallenge: "cc",
+		AuthTime: now, ExpiresAt: now.Add(time.Minute)}
+	suite.Nil(suite.store.CreateAuthCode(suite.ctx, code))
+	suite.False(code.ID.IsZero())
+
+	consumed, err := suite.store.ConsumeAuthCode(suite.ctx, "h")
+	suite.Nil(err)
+	suite.Equal(code.ID, consumed.ID)
+	suite.Equal("openid email", consumed.Scope)
+	suite.Equal("cc", consumed.CodeChallenge)
+	suite.True(code.ExpiresAt.Equal(consumed.ExpiresAt))
+	suite.NotNil(consumed.UsedAt)
+	_, err = suite.store.ConsumeAuthCode(suite.ctx, "h")
+	suite.Equal(ErrNotFound, err)
+
+	// Expired codes are purged
+	n, err := suite.store.PurgeExpiredAuthCodes(suite.ctx, now.Add(time.Hour))
+	suite.Nil(err)
+	suite.Equal(1, n)
+
+	// Delete
+	suite.Nil(suite.store.DeleteClient(suite.ctx, "spa"))
+	suite.Equal(ErrNotFound, suite.store.DeleteClient(suite.ctx, "spa"))
+	_, err = suite.store.GetClient(suite.ctx, "spa")
+	suite.Equal(ErrNotFound, err)
+}
+
+func (suite *StoreTestSuite) Test011_Identities() {
+	username, email, pw := "fed", "fed@example.com", "pw"
+	user := &schema.User{Username: &username, Email: &email, Password: &pw}
+	suite.Nil(suite.store.CreateUser(suite.ctx, user))
+	userID := user.ID.Hex()
+
+	// A subject links to one user
+	corp := &schema.Identity{Provider: "corp", Subject: "123", UserID: userID, Email: email}
+	suite.Nil(suite.store.LinkIdentity(suite.ctx, corp))
+	suite.False(corp.ID.IsZero())
+	suite.False(corp.CreatedAt.IsZero())
+	suite.True(isConflict(suite.store.LinkIdentity(suite.ctx,
+		&schema.Identity{Provider: "corp", Subject: "123", UserID: primitive.NewObjectID().Hex()})))
+
+	// The same subject at another provider is another identity
+	other := &schema.Identity{Provider: "other", Subject: "123", UserID: userID}
+	suite.Nil(suite.store.LinkIdentity(suite.ctx, other))
+
+	id, err := suite.store.GetIdentity(suite.ctx, "corp", "123")
+	suite.Nil(err)
+	suite.Equal(corp, id)
+	_, err = suite.store.GetIdentity(suite.ctx, "corp", "456")
+	suite.Equal(ErrNotFound, err)
+
+	identities, err := suite.store.GetIdentities(suite.ctx, userID)
+	suite.Nil(err)
+	suite.Len(identities, 2)
+	suite.Equal("", identities[1].Email)
+	identities, err = suite.store.GetIdentities(suite.ctx, primitive.NewObjectID().Hex())
+	suite.Nil(err)
+	suite.Len(identities, 0)
+
+	// Soft deleted users keep their links, purged ones lose them
+	_, err = suite.store.DeleteUser(suite.ctx, userID, AnyVersion)
+	suite.Nil(err)
+	_, err = suite.store.GetIdentity(suite.ctx, "corp", "123")
+	suite.Nil(err)
+	n, err := suite.store.PurgeDeletedUsers(suite.ctx, time.Now().Add(time.Minute))
+	suite.Nil(err)
+	suite.Equal(1, n)
+	_, err = suite.store.GetIdentity(suite.ctx, "corp", "123")
+	suite.Equal(ErrNotFound, err)
+}
+
+func (suite *StoreTestSuite) Test012_TwoFactor() {
+	userID := primitive.NewObjectID().Hex()
+	_, err := suite.store.GetTwoFactor(suite.ctx, userID)
+	suite.Equal(ErrNotFound, err)
+
+	// Enrollments can be restarted until they are confirmed
+	suite.Nil(suite.store.CreateTwoFactor(suite.ctx, &schema.TwoFactor{UserID: userID, Secret: "A"}))
+	suite.Nil(suite.store.CreateTwoFactor(suite.ctx, &schema.TwoFactor{UserID: userID, Secret: "B"}))
+	t, err := suite.store.GetTwoFactor(suite.ctx, userID)
+	suite.Nil(err)
+	suite.Equal("B", t.Secret)
+	suite.False(t.Enabled())
+	suite.Equal(ErrNotFound, suite.store.UseTOTPStep(suite.ctx, userID, 1))
+
+	suite.Nil(suite.store.ConfirmTwoFactor(suite.ctx, userID, 10, []string{"h1", "h2"}))
+	suite.Equal(ErrNotFound, suite.store.ConfirmTwoFactor(suite.ctx, userID, 11, nil))
+	suite.True(isConflict(suite.store.CreateTwoFactor(suite.ctx, &schema.TwoFactor{UserID: userID, Secret: "C"})))
+	t, err = suite.store.GetTwoFactor(suite.ctx, userID)
+	suite.Nil(err)
+	suite.True(t.Enabled())
+	suite.Equal(int64(10), t.LastStep)
+	suite.Equal([]string{"h1", "h2"}, t.RecoveryCodes)
+
+	// Steps only move forward and codes work once
+	suite.Equal(ErrNotFound, suite.store.UseTOTPStep(suite.ctx, userID, 10))
+	suite.Nil(suite.store.UseTOTPStep(suite.ctx, userID, 12))
+	suite.Equal(ErrNotFound, suite.store.UseTOTPStep(suite.ctx, userID, 11))
+	suite.Nil(suite.store.UseRecoveryCode(suite.ctx, userID, "h1"))
+	suite.Equal(ErrNotFound, suite.store.UseRecoveryCode(suite.ctx, userID, "h1"))
+	t, err = suite.store.GetTwoFactor(suite.ctx, userID)
+	suite.Nil(err)
+	suite.Equal([]string{"h2"}, t.RecoveryCodes)
+
+	suite.Nil(suite.store.DeleteTwoFactor(suite.ctx, userID))
+	suite.Equal(ErrNotFound, suite.store.DeleteTwoFactor(suite.ctx, userID))
+	suite.Equal(ErrNotFound, suite.store.UseRecoveryCode(suite.ctx, userID, "h2"))
+}
+
+func (suite *StoreTestSuite) Test013_Passkeys() {
+	username, email, pw := "passkey", "passkey@example.com", "pw"
+	user := &schema.User{Username: &username, Email: &email, Password: &pw}
+	suite.Nil(suite.store.CreateUser(suite.ctx, user))
+	userID := user.ID.Hex()
+
+	// A credential belongs to one user
+	phone := &schema.Passkey{UserID: userID, CredentialID: "cred-1", PublicKey: []byte{1, 2, 3}, Transports: []string{"internal"}, Name: "phone"}
+	suite.Nil(suite.store.CreatePasskey(suite.ctx, phone))
+	suite.False(phone.ID.IsZero())
+	suite.True(isConflict(suite.store.CreatePasskey(suite.ctx,
+		&schema.Passkey{UserID: primitive.NewObjectID().Hex(), CredentialID: "cred-1", PublicKey: []byte{4}})))
+	key := &schema.Passkey{UserID: userID, CredentialID: "cred-2", PublicKey: []byte{4}, Name: "key"}
+	suite.Nil(suite.store.CreatePasskey(suite.ctx, key))
+
+	p, err := suite.store.GetPasskey(suite.ctx, "cred-1")
+	suite.Nil(err)
+	suite.Equal(phone, p)
+	_, err = suite.store.GetPasskey(suite.ctx, "cred-3")
+	suite.Equal(ErrNotFound, err)
+	passkeys, err := suite.store.GetPasskeys(suite.ctx, userID)
+	suite.Nil(err)
+	suite.Len(passkeys, 2)
+	suite.Equal("key", passkeys[1].Name)
+	suite.Equal([]string{}, passkeys[1].Transports)
+
+	// Counters only move forward, unless the authenticator doesn't count
+	suite.Nil(suite.store.UsePasskey(suite.ctx, "cred-1", 5))
+	suite.Equal(ErrNotFound, suite.store.UsePasskey(suite.ctx, "cred-1", 5))
+	suite.Equal(ErrNotFound, suite.store.UsePasskey(suite.ctx, "cred-1", 0))
+	suite.Nil(suite.store.UsePasskey(suite.ctx, "cred-2", 0))
+	suite.Nil(suite.store.UsePasskey(suite.ctx, "cred-2", 0))
+	p, err = suite.store.GetPasskey(suite.ctx, "cred-1")
+	suite.Nil(err)
+	suite.Equal(int64(5), p.SignCount)
+	suite.NotNil(p.LastUsedAt)
+
+	// Users only remove their own passkeys
+	suite.Equal(ErrNotFound, suite.store.DeletePasskey(suite.ctx, primitive.NewObjectID().Hex(), key.ID.Hex()))
+	suite.Nil(suite.store.DeletePasskey(suite.ctx, userID, key.ID.Hex()))
+	suite.Equal(ErrNotFound, suite.store.DeletePasskey(suite.ctx, userID, key.ID.Hex()))
+
+	// Purged users lose them
+	_, err = suite.store.DeleteUser(suite.ctx, userID, AnyVersion)
+	suite.Nil(err)
+	_, err = suite.store.PurgeDeletedUsers(suite.ctx, time.Now().Add(time.Minute))
+	suite.Nil(err)
+	_, err = suite.store.GetPasskey(suite.ctx, "cred-1")
+	suite.Equal(ErrNotFound, err)
+}
+
+func (suite *StoreTestSuite) Test014_PersonalTokens() {
+	username, email, pw := "ci", "ci@example.com", "pw"
+	user := &schema.User{Username: &username, Email: &email, Password: &pw}
+	suite.Nil(suite.store.CreateUser(suite.ctx, user))
+	userID := user.ID.Hex()
+
+	now := time.Now()
+	deploy := &schema.PersonalToken{Hash: "h1", UserID: userID, Name: "deploy", Permissions: []string{"viewAllTasks"}, ExpiresAt: now.Add(time.Hour)}
+	suite.Nil(suite.store.CreatePersonalToken(suite.ctx, deploy))
+	suite.False(deploy.ID.IsZero())
+	nightly := &schema.PersonalToken{Hash: "h2", UserID: userID, Name: "nightly", ExpiresAt: now.Add(48 * time.Hour)}
+	suite.Nil(suite.store.CreatePersonalToken(suite.ctx, nightly))
+
+	t, err := suite.store.GetPersonalToken(suite.ctx, "h1")
+	suite.Nil(err)
+	suite.Equal(deploy, t)
+	_, err = suite.store.GetPersonalToken(suite.ctx, "h3")
+	suite.Equal(ErrNotFound, err)
+	tokens, err := suite.store.GetPersonalTokens(suite.ctx, userID)
+	suite.Nil(err)
+	suite.Len(tokens, 2)
+	suite.Equal([]string{}, tokens[1].Permissions)
+
+	suite.Nil(suite.store.TouchPersonalToken(suite.ctx, deploy.ID.Hex(), now))
+	suite.Equal(ErrNotFound, suite.store.TouchPersonalToken(suite.ctx, primitive.NewObjectID().Hex(), now))
+	t, err = suite.store.GetPersonalToken(suite.ctx, "h1")
+	suite.Nil(err)
+	suite.Equal(now.UTC().Truncate(time.Millisecond), *t.LastUsedAt)
+
+	// Users only revoke their own tokens
+	suite.Equal(ErrNotFound, suite.store.DeletePersonalToken(suite.ctx, primitive.NewObjectID().Hex(), deploy.ID.Hex()))
+	suite.Nil(suite.store.DeletePersonalToken(suite.ctx, userID, deploy.ID.Hex()))
+	suite.Equal(ErrNotFound, suite.store.DeletePersonalToken(suite.ctx, userID, deploy.ID.Hex()))
+
+	// Expired tokens are purged
+	suite.Nil(suite.store.CreatePersonalToken(suite.ctx, &schema.PersonalToken{Hash: "h3", UserID: userID, ExpiresAt: now.Add(time.Hour)}))
+	n, err := suite.store.PurgeExpiredPersonalTokens(suite.ctx, now.Add(2*time.Hour))
+	suite.Nil(err)
+	suite.Equal(1, n)
+	_, err = suite.store.GetPersonalToken(suite.ctx, "h2")
+	suite.Nil(err)
+
+	// and so are the tokens of purged users
+	_, err = suite.store.DeleteUser(suite.ctx, userID, AnyVersion)
+	suite.Nil(err)
+	_, err = suite.store.PurgeDeletedUsers(suite.ctx, time.Now().Add(time.Minute))
+	suite.Nil(err)
+	_, err = suite.store.GetPersonalToken(suite.ctx, "h2")
+	suite.Equal(ErrNotFound, err)
+
+	// Tokens of a user go all at once, on a password reset
+	other := &schema.PersonalToken{Hash: "h4", UserID: primitive.NewObjectID().Hex(), ExpiresAt: now.Add(time.Hour)}
+	suite.Nil(suite.store.CreatePersonalToken(suite.ctx, other))
+	suite.Nil(suite.store.CreatePersonalToken(suite.ctx, &schema.PersonalToken{Hash: "h5", UserID: userID, ExpiresAt: now.Add(time.Hour)}))
+	suite.Nil(suite.store.DeleteUserPersonalTokens(suite.ctx, userID))
+	tokens, err = suite.store.GetPersonalTokens(suite.ctx, userID)
+	suite.Nil(err)
+	suite.Len(tokens, 0)
+	_, err = suite.store.GetPersonalToken(suite.ctx, "h4")
+	suite.Nil(err)
+}
+
+func (suite *StoreTestSuite) Test015_EmailTokens() {
+	now := time.Now()
+	userID := primitive.NewObjectID().Hex()
+	reset := &schema.EmailToken{Hash: "h1", Purpose: schema.EmailTokenReset, UserID: userID, Email: "foo@example.com", ExpiresAt: now.Add(time.Hour)}
+	suite.Nil(suite.store.CreateEmailToken(suite.ctx, reset))
+	suite.False(reset.ID.IsZero())
+
+	// A token is used once, for its purpose, before it expires
+	_, err := suite.store.UseEmailToken(suite.ctx, "other", "h1", now)
+	suite.Equal(ErrNotFound, err)
+	_, err = suite.store.UseEmailToken(suite.ctx, schema.EmailTokenReset, "h1", now.Add(2*time.Hour))
+	suite.Equal(ErrNotFound, err)
+	_, err = suite.store.GetEmailToken(suite.ctx, schema.EmailTokenReset, "h1", now.Add(2*time.Hour))
+	suite.Equal(ErrNotFound, err)
+	t, err := suite.store.GetEmailToken(suite.ctx, schema.EmailTokenReset, "h1", now)
+	suite.Nil(err)
+	suite.Equal(reset, t)
+	t, err = suite.store.UseEmailToken(suite.ctx, schema.EmailTokenReset, "h1", now)
+	suite.Nil(err)
+	suite.Equal(reset, t)
+	_, err = suite.store.UseEmailToken(suite.ctx, schema.EmailTokenReset, "h1", now)
+	suite.Equal(ErrNotFound, err)
+
+	// The tokens of a user can be dropped at once
+	suite.Nil(suite.store.CreateEmailToken(suite.ctx, &schema.EmailToken{Hash: "h2", Purpose: schema.EmailTokenReset, UserID: userID, ExpiresAt: now.Add(time.Hour)}))
+	suite.Nil(suite.store.CreateEmailToken(suite.ctx, &schema.EmailToken{Hash: "h3", Purpose: schema.EmailTokenReset, UserID: userID, ExpiresAt: now.Add(time.Hour)}))
+	suite.Nil(suite.store.DeleteEmailTokens(suite.ctx, userID, schema.EmailTokenReset))
+	_, err = suite.store.UseEmailToken(suite.ctx, schema.EmailTokenReset, "h3", now)
+	suite.Equal(ErrNotFound, err)
+
+	// and expired ones are purged
+	suite.Nil(suite.store.CreateEmailToken(suite.ctx, &schema.EmailToken{Hash: "h4", Purpose: schema.EmailTokenReset, UserID: userID, ExpiresAt: now.Add(time.Hour)}))
+	n, err := suite.store.PurgeExpiredEmailTokens(suite.ctx, now.Add(2*time.Hour))
+	suite.Nil(err)
+	suite.Equal(1, n)
+}
+
+func (suite *StoreTestSuite) Test016_RevokeUserTokens() {
+	now := time.Now()
+	userID, otherID := primitive.NewObjectID().Hex(), primitive.NewObjectID().Hex()
+	for i, owner := range []string{userID, userID, otherID} {
+		suite.Nil(suite.store.CreateRefreshToken(suite.ctx, &schema.RefreshToken{
+			Hash: fmt.Sprintf("h%d", i), Family: fmt.Sprintf("f%d", i), UserID: owner,
+			AccessJTI: fmt.Sprintf("j%d", i), AccessExpiresAt: now.Add(time.Hour),
+			ExpiresAt: now.Add(24 * time.Hour),
+		}))
+	}
+
+	// Every login of the user ends, the ones of others don't
+	suite.Nil(suite.store.RevokeUserTokens(suite.ctx, userID))
+	for i, revoked := range []bool{true, true, false} {
+		t, err := suite.store.GetRefreshToken(suite.ctx, fmt.Sprintf("h%d", i))
+		suite.Nil(err)
+		suite.Equal(revoked, !t.Active(now))
+		ok, err := suite.store.IsAccessTokenRevoked(suite.ctx, fmt.Sprintf("j%d", i))
+		suite.Nil(err)
+		suite.Equal(revoked, ok)
+	}
+}
+
+func (suite *StoreTestSuite) Test017_EmailVerified() {
+	username, email, pw := "vera", "vera@example.com", "pw"
+	u := &schema.User{Username: &username, Email: &email, Password: &pw, Role: &schema.RoleUser}
+	suite.Nil(suite.store.CreateUser(suite.ctx, u))
+	userID := u.ID.Hex()
+
+	// New users start out unverified
+	user, err := suite.store.GetUserByID(suite.ctx, userID)
+	suite.Nil(err)
+	suite.False(user.EmailVerified)
+
+	// until the flag is set
+	verified := true
+	user, err = suite.store.UpdateUser(suite.ctx, userID, &schema.User{EmailVerified: &verified}, user.Version)
+	suite.Nil(err)
+	suite.True(user.EmailVerified)
+	user, err = suite.store.GetUserByEmail(suite.ctx, email)
+	suite.Nil(err)
+	suite.True(user.EmailVerified)
+
+	// and it survives other changes
+	other := "vera@example.org"
+	user, err = suite.store.UpdateUser(suite.ctx, userID, &schema.User{Email: &other}, AnyVersion)
+	suite.Nil(err)
+	suite.True(user.EmailVerified)
+
+	// The newest token of a purpose is found, whether or not it expired
+	_, err = suite.store.LastEmailToken(suite.ctx, userID, schema.EmailTokenVerify)
+	suite.Equal(ErrNotFound, err)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		suite.Nil(suite.store.CreateEmailToken(suite.ctx, &schema.EmailToken{
+			Hash: fmt.Sprintf("v%d", i), Purpose: schema.EmailTokenVerify, UserID: userID, Email: email, ExpiresAt: now.Add(-time.Hour),
+		}))
+	}
+	suite.Nil(suite.store.CreateEmailToken(suite.ctx, &schema.EmailToken{
+		Hash: "c0", Purpose: schema.EmailTokenChange, UserID: userID, Email: other, ExpiresAt: now.Add(time.Hour),
+	}))
+	t, err := suite.store.LastEmailToken(suite.ctx, userID, schema.EmailTokenVerify)
+	suite.Nil(err)
+	suite.Equal("v2", t.Hash)
+	t, err = suite.store.LastEmailToken(suite.ctx, userID, schema.EmailTokenChange)
+	suite.Nil(err)
+	suite.Equal(other, t.Email)
+}
+
+func (suite *StoreTestSuite) Test018_LoginFailures() {
+	now := time.Now()
+	_, err := suite.store.GetLoginFailures(suite.ctx, "user:foo", now)
+	suite.Equal(ErrNotFound, err)
+
+	// Failures add up while they keep coming within the window
+	for i := 1; i <= 3; i++ {
+		f, err := suite.store.AddLoginFailure(suite.ctx, "user:foo", now.Add(time.Duration(i)*time.Minute), time.Hour)
+		suite.Nil(err)
+		suite.Equal(i, f.Count)
+	}
+	f, err := suite.store.GetLoginFailures(suite.ctx, "user:foo", now)
+	suite.Nil(err)
+	suite.Equal(3, f.Count)
+	suite.Equal(now.Add(3*time.Minute).UTC().Truncate(time.Millisecond), f.LastFailure)
+	_, err = suite.store.AddLoginFailure(suite.ctx, "ip:127.0.0.1", now, time.Hour)
+	suite.Nil(err)
+
+	// and start over once it passed
+	_, err = suite.store.GetLoginFailures(suite.ctx, "user:foo", now.Add(2*time.Hour))
+	suite.Equal(ErrNotFound, err)
+	f, err = suite.store.AddLoginFailure(suite.ctx, "user:foo", now.Add(2*time.Hour), time.Hour)
+	suite.Nil(err)
+	suite.Equal(1, f.Count)
+
+	// Clearing a key leaves the others
+	suite.Nil(suite.store.ClearLoginFailures(suite.ctx, "user:foo"))
+	_, err = suite.store.GetLoginFailures(suite.ctx, "user:foo", now)
+	suite.Equal(ErrNotFound, err)
+	_, err = suite.store.GetLoginFailures(suite.ctx, "ip:127.0.0.1", now)
+	suite.Nil(err)
+
+	// and expired counts are purged
+	n, err := suite.store.PurgeExpiredLoginFailures(suite.ctx, now.Add(2*time.Hour))
+	suite.Nil(err)
+	suite.Equal(1, n)
+}
+
+func (suite *StoreTestSuite) Test019_RateLimits() {
+	now := time.Now()
+	p := ratelimit.Policy{Limit: 5, Period: time.Minute}
+
+	// Replicas racing for the same bucket let Limit requests through
+	allowed := make(chan bool, 8)
+	for i := 0; i < cap(allowed); i++ {
+		go func() {
+			r, err := suite.store.TakeRateToken(suite.ctx, "ip:127.0.0.1", p, now)
+			suite.Nil(err)
+			allowed <- r.Allowed
+		}()
+	}
+	n := 0
+	for i := 0; i < cap(allowed); i++ {
+		if <-allowed {
+			n++
+		}
+	}
+	suite.Equal(p.Limit, n)
+
+	// then one per Period / Limit
+	r, err := suite.store.TakeRateToken(suite.ctx, "ip:127.0.0.1", p, now.Add(5*time.Second))
+	suite.Nil(err)
+	suite.False(r.Allowed)
+	suite.Equal(7*time.Second, r.RetryAfter)
+	r, err = suite.store.TakeRateToken(suite.ctx, "ip:127.0.0.1", p, now.Add(12*time.Second))
+	suite.Nil(err)
+	suite.True(r.Allowed)
+
+	// Other keys have buckets of their own
+	r, err = suite.store.TakeRateToken(suite.ctx, "ip:127.0.0.2", p, now)
+	suite.Nil(err)
+	suite.True(r.Allowed)
+	suite.Equal(4, r.Remaining)
+
+	// and full buckets are purged
+	_, err = suite.store.PurgeExpiredRateBuckets(suite.ctx, now.Add(time.Hour))
+	suite.Nil(err)
+	r, err = suite.store.TakeRateToken(suite.ctx, "ip:127.0.0.1", p, now.Add(time.Hour))
+	suite.Nil(err)
+	suite.Equal(4, r.Remaining)
+}
+
+// Test020_Sessions asserts that sessions are listed per user while active,
+// touched and ended one at a time or all at once
+func (suite *StoreTestSuite) Test020_Sessions() {
+	now := time.Now()
+	userID, other := primitive.NewObjectID().Hex(), primitive.NewObjectID().Hex()
+	sessions := []*schema.Session{
+		{ID: primitive.NewObjectID().Hex(), UserID: userID, UserAgent: "curl/8.0", IP: "192.0.2.1", ExpiresAt: now.Add(time.Hour)},
+		{ID: primitive.NewObjectID().Hex(), UserID: userID, UserAgent: "Firefox", IP: "192.0.2.2", ExpiresAt: now.Add(2 * time.Hour), ClientID: "app"},
+		{ID: primitive.NewObjectID().Hex(), UserID: other, ExpiresAt: now.Add(time.Hour)},
+	}
+	for _, s := range sessions {
+		suite.Nil(suite.store.CreateSession(suite.ctx, s))
+		suite.False(s.CreatedAt.IsZero())
+		suite.Equal(s.CreatedAt, s.LastSeenAt)
+	}
+
+	s, err := suite.store.GetSession(suite.ctx, sessions[0].ID)
+	suite.Nil(err)
+	suite.Equal(sessions[0], s)
+	_, err = suite.store.GetSession(suite.ctx, primitive.NewObjectID().Hex())
+	suite.Equal(ErrNotFound, err)
+
+	// Only active sessions of the user are listed, oldest first
+	list, err := suite.store.GetSessions(suite.ctx, userID, now)
+	suite.Nil(err)
+	suite.Equal(2, len(list))
+	suite.Equal(sessions[0].ID, list[0].ID)
+	suite.Equal("Firefox", list[1].UserAgent)
+	suite.Equal("app", list[1].ClientID)
+	list, err = suite.store.GetSessions(suite.ctx, userID, now.Add(90*time.Minute))
+	suite.Nil(err)
+	suite.Equal(1, len(list))
+
+	later := now.Add(time.Minute)
+	suite.Nil(suite.store.TouchSession(suite.ctx, sessions[0].ID, later))
+	s, err = suite.store.GetSession(suite.ctx, sessions[0].ID)
+	suite.Nil(err)
+	suite.Equal(later.UTC().Truncate(time.Millisecond), s.LastSeenAt)
+	suite.Equal(ErrNotFound, suite.store.TouchSession(suite.ctx, primitive.NewObjectID().Hex(), later))
+
+	// Sessions are only ended by their own user
+	suite.Equal(ErrNotFound, suite.store.DeleteSession(suite.ctx, other, sessions[0].ID))
+	suite.Nil(suite.store.DeleteSession(suite.ctx, userID, sessions[0].ID))
+	suite.Equal(ErrNotFound, suite.store.DeleteSession(suite.ctx, userID, sessions[0].ID))
+
+	suite.Nil(suite.store.DeleteUserSessions(suite.ctx, userID))
+	list, err = suite.store.GetSessions(suite.ctx, userID, now)
+	suite.Nil(err)
+	suite.Equal(0, len(list))
+
+	// and expired ones are purged
+	n, err := suite.store.PurgeExpiredSessions(suite.ctx, now.Add(2*time.Hour))
+	suite.Nil(err)
+	suite.Equal(1, n)
+	_, err = suite.store.GetSession(suite.ctx, sessions[2].ID)
+	suite.Equal(ErrNotFound, err)
 }
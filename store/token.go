@@ -0,0 +1,209 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/briansan/user-go/schema"
+)
+
+const (
+	refreshTokensCollectionName = "refreshTokens"
+	revokedTokensCollectionName = "revokedTokens"
+)
+
+var (
+	// ErrTokenReused is returned by RotateRefreshToken when the token was
+	// already used or revoked
+	ErrTokenReused = fmt.Errorf("refresh token reused")
+)
+
+// TokenStore keeps refresh tokens and the access tokens revoked before
+// they expire
+type TokenStore interface {
+	// CreateRefreshToken stores t, stamping its id
+	CreateRefreshToken(ctx context.Context, t *schema.RefreshToken) error
+	// GetRefreshToken looks up a refresh token by the hash of its secret
+	GetRefreshToken(ctx context.Context, hash string) (*schema.RefreshToken, error)
+	// GetRefreshTokenByJTI looks up the refresh token issued along with access token jti
+	GetRefreshTokenByJTI(ctx context.Context, jti string) (*schema.RefreshToken, error)
+	// RotateRefreshToken marks old used and stores next in its place
+	// error is ErrTokenReused if old was used or revoked meanwhile
+	RotateRefreshToken(ctx context.Context, old, next *schema.RefreshToken) error
+	// RevokeTokenFamily revokes every refresh token of family and the
+	// access tokens issued along with them
+	RevokeTokenFamily(ctx context.Context, family string) error
+	// RevokeUserTokens revokes every refresh token of user userID and the
+	// access tokens issued along with them, ending all of its logins
+	RevokeUserTokens(ctx context.Context, userID string) error
+	// RevokeAccessToken rejects access token jti until it expires
+	RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error
+	IsAccessTokenRevoked(ctx context.Context, jti string) (bool, error)
+	// PurgeExpiredTokens removes the refresh tokens and revoked access
+	// tokens expired before t and returns how many were removed
+	PurgeExpiredTokens(ctx context.Context, t time.Time) (int, error)
+}
+
+// stampRefreshToken gives t an id and, unless set, the current time
+// times are kept at millisecond precision since that is all mongo stores
+func stampRefreshToken(t *schema.RefreshToken) {
+	t.ID = primitive.NewObjectID()
+	if t.CreatedAt.IsZero() {
+		t.CreatedAt = time.Now()
+	}
+	t.CreatedAt = t.CreatedAt.UTC().Truncate(time.Millisecond)
+	t.ExpiresAt = t.ExpiresAt.UTC().Truncate(time.Millisecond)
+	t.AccessExpiresAt = t.AccessExpiresAt.UTC().Truncate(time.Millisecond)
+}
+
+// revokeAccessTokens revokes the access tokens issued along with tokens
+// that haven't expired yet
+func revokeAccessTokens(ctx context.Context, s TokenStore, tokens []*schema.RefreshToken) error {
+	now := time.Now()
+	for _, t := range tokens {
+		if len(t.AccessJTI) == 0 || !t.AccessExpiresAt.After(now) {
+			continue
+		}
+		if err := s.RevokeAccessToken(ctx, t.AccessJTI, t.AccessExpiresAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetRefreshTokensCollection returns a mongo instance to the refresh tokens collection
+func (m *MongoStore) GetRefreshTokensCollection() *mongo.Collection {
+	return m.GetDatabase().Collection(refreshTokensCollectionName)
+}
+
+// GetRevokedTokensCollection returns a mongo instance to the revoked access tokens collection
+func (m *MongoStore) GetRevokedTokensCollection() *mongo.Collection {
+	return m.GetDatabase().Collection(revokedTokensCollectionName)
+}
+
+// CreateRefreshToken inserts t into the refresh tokens collection
+// error is 500 if mongo fails, else nil
+func (m *MongoStore) CreateRefreshToken(ctx context.Context, t *schema.RefreshToken) error {
+	stampRefreshToken(t)
+	_, err := m.GetRefreshTokensCollection().InsertOne(ctx, t)
+	return err
+}
+
+// getRefreshToken returns the refresh token matching q
+// error is 404 if there is none, 500 if mongo fails, else nil
+func (m *MongoStore) getRefreshToken(ctx context.Context, q bson.M) (*schema.RefreshToken, error) {
+	t := schema.RefreshToken{}
+	if err := m.GetRefreshTokensCollection().FindOne(ctx, q).Decode(&t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// GetRefreshToken looks up a refresh token by the hash of its secret
+func (m *MongoStore) GetRefreshToken(ctx context.Context, hash string) (*schema.RefreshToken, error) {
+	return m.getRefreshToken(ctx, bson.M{"hash": hash})
+}
+
+// GetRefreshTokenByJTI looks up the refresh token issued along with access token jti
+func (m *MongoStore) GetRefreshTokenByJTI(ctx context.Context, jti string) (*schema.RefreshToken, error) {
+	return m.getRefreshToken(ctx, bson.M{"accessJTI": jti})
+}
+
+// RotateRefreshToken marks old used and stores next in its place
+// error is ErrTokenReused if old was used or revoked meanwhile, 500 if mongo fails
+func (m *MongoStore) RotateRefreshToken(ctx context.Context, old, next *schema.RefreshToken) error {
+	// Only one concurrent rotation can match the unused token
+	now := time.Now().UTC()
+	res, err := m.GetRefreshTokensCollection().UpdateOne(ctx,
+		bson.M{"_id": old.ID, "usedAt": bson.M{"$exists": false}, "revokedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"usedAt": now}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.ModifiedCount == 0 {
+		return ErrTokenReused
+	}
+	old.UsedAt = &now
+	return m.CreateRefreshToken(ctx, next)
+}
+
+// RevokeTokenFamily revokes every refresh token of family and the access
+// tokens issued along with them
+func (m *MongoStore) RevokeTokenFamily(ctx context.Context, family string) error {
+	c := m.GetRefreshTokensCollection()
+	if _, err := c.UpdateMany(ctx,
+		bson.M{"family": family, "revokedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revokedAt": time.Now().UTC()}},
+	); err != nil {
+		return err
+	}
+
+	iter, err := c.Find(ctx, bson.M{"family": family})
+	if err != nil {
+		return err
+	}
+	tokens := []*schema.RefreshToken{}
+	if err := iter.All(ctx, &tokens); err != nil {
+		return err
+	}
+	return revokeAccessTokens(ctx, m, tokens)
+}
+
+// RevokeUserTokens revokes every refresh token of user userID and the
+// access tokens issued along with them
+func (m *MongoStore) RevokeUserTokens(ctx context.Context, userID string) error {
+	c := m.GetRefreshTokensCollection()
+	if _, err := c.UpdateMany(ctx,
+		bson.M{"userID": userID, "revokedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revokedAt": time.Now().UTC()}},
+	); err != nil {
+		return err
+	}
+
+	iter, err := c.Find(ctx, bson.M{"userID": userID})
+	if err != nil {
+		return err
+	}
+	tokens := []*schema.RefreshToken{}
+	if err := iter.All(ctx, &tokens); err != nil {
+		return err
+	}
+	return revokeAccessTokens(ctx, m, tokens)
+}
+
+// RevokeAccessToken rejects access token jti until it expires
+func (m *MongoStore) RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	_, err := m.GetRevokedTokensCollection().UpdateOne(ctx,
+		bson.M{"_id": jti},
+		bson.M{"$set": bson.M{"expiresAt": expiresAt.UTC()}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// IsAccessTokenRevoked reports whether access token jti was revoked
+func (m *MongoStore) IsAccessTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	n, err := m.GetRevokedTokensCollection().CountDocuments(ctx, bson.M{"_id": jti})
+	return n > 0, err
+}
+
+// PurgeExpiredTokens removes the refresh tokens and revoked access tokens
+// expired before t and returns how many were removed
+func (m *MongoStore) PurgeExpiredTokens(ctx context.Context, t time.Time) (int, error) {
+	refresh, err := deleteExpired(ctx, m.GetRefreshTokensCollection(), t)
+	if err != nil {
+		return 0, err
+	}
+	revoked, err := deleteExpired(ctx, m.GetRevokedTokensCollection(), t)
+	if err != nil {
+		return 0, err
+	}
+	return refresh + revoked, nil
+}
@@ -0,0 +1,144 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/briansan/user-go/errors"
+	"github.com/briansan/user-go/schema"
+)
+
+const (
+	twoFactorCollectionName = "twoFactor"
+)
+
+// TwoFactorStore keeps the TOTP enrollments of users and their recovery
+// codes, they go away when their user is purged
+type TwoFactorStore interface {
+	// CreateTwoFactor starts the enrollment t, stamping its creation time
+	// and replacing an enrollment that wasn't confirmed
+	// error is 409 if the user has a confirmed one
+	CreateTwoFactor(ctx context.Context, t *schema.TwoFactor) error
+	// GetTwoFactor looks up the enrollment of user userID
+	GetTwoFactor(ctx context.Context, userID string) (*schema.TwoFactor, error)
+	// ConfirmTwoFactor enables the enrollment of user userID with the step
+	// of the code that confirmed it and the hashes of its recovery codes
+	// error is 404 if there is none or it is confirmed already
+	ConfirmTwoFactor(ctx context.Context, userID string, step int64, recoveryCodes []string) error
+	// UseTOTPStep records that a code of step was accepted
+	// error is 404 if the enrollment isn't confirmed or step isn't newer
+	// than the last one, which means the code was used already
+	UseTOTPStep(ctx context.Context, userID string, step int64) error
+	// UseRecoveryCode removes the recovery code with hash
+	// error is 404 if the user has no such code
+	UseRecoveryCode(ctx context.Context, userID, hash string) error
+	// DeleteTwoFactor removes the enrollment of user userID
+	// error is 404 if there is none
+	DeleteTwoFactor(ctx context.Context, userID string) error
+}
+
+// stampTwoFactor sets the creation time of t
+func stampTwoFactor(t *schema.TwoFactor) {
+	t.CreatedAt = time.Now().UTC().Truncate(time.Millisecond)
+	t.ConfirmedAt = nil
+	t.LastStep = 0
+	t.RecoveryCodes = []string{}
+}
+
+// twoFactorConflict is the error of enrolling a user twice
+func twoFactorConflict(t *schema.TwoFactor) error {
+	return errors.NewConflictError("twoFactor", "userID", t.UserID)
+}
+
+// GetTwoFactorCollection returns a mongo instance to the two factor collection
+func (m *MongoStore) GetTwoFactorCollection() *mongo.Collection {
+	return m.GetDatabase().Collection(twoFactorCollectionName)
+}
+
+// CreateTwoFactor inserts t into the two factor collection
+// error is 409 if the user has a confirmed enrollment, 500 if mongo fails
+func (m *MongoStore) CreateTwoFactor(ctx context.Context, t *schema.TwoFactor) error {
+	stampTwoFactor(t)
+	if _, err := m.GetTwoFactorCollection().DeleteOne(ctx, bson.M{"_id": t.UserID, "confirmedAt": bson.M{"$exists": false}}); err != nil {
+		return err
+	}
+	_, err := m.GetTwoFactorCollection().InsertOne(ctx, t)
+	if mongo.IsDuplicateKeyError(err) {
+		return twoFactorConflict(t)
+	}
+	return err
+}
+
+// GetTwoFactor looks up the enrollment of user userID
+func (m *MongoStore) GetTwoFactor(ctx context.Context, userID string) (*schema.TwoFactor, error) {
+	t := schema.TwoFactor{}
+	if err := m.GetTwoFactorCollection().FindOne(ctx, bson.M{"_id": userID}).Decode(&t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// ConfirmTwoFactor enables the enrollment of user userID
+// error is 404 if there is none or it is confirmed already, 500 if mongo fails
+func (m *MongoStore) ConfirmTwoFactor(ctx context.Context, userID string, step int64, recoveryCodes []string) error {
+	res, err := m.GetTwoFactorCollection().UpdateOne(ctx,
+		bson.M{"_id": userID, "confirmedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"confirmedAt": time.Now().UTC(), "lastStep": step, "recoveryCodes": recoveryCodes}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// UseTOTPStep records that a code of step was accepted
+// error is 404 if step isn't newer than the last one, 500 if mongo fails
+func (m *MongoStore) UseTOTPStep(ctx context.Context, userID string, step int64) error {
+	// Only one concurrent login can move past the last step
+	res, err := m.GetTwoFactorCollection().UpdateOne(ctx,
+		bson.M{"_id": userID, "confirmedAt": bson.M{"$exists": true}, "lastStep": bson.M{"$lt": step}},
+		bson.M{"$set": bson.M{"lastStep": step}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// UseRecoveryCode removes the recovery code with hash
+// error is 404 if the user has no such code, 500 if mongo fails
+func (m *MongoStore) UseRecoveryCode(ctx context.Context, userID, hash string) error {
+	res, err := m.GetTwoFactorCollection().UpdateOne(ctx,
+		bson.M{"_id": userID, "confirmedAt": bson.M{"$exists": true}, "recoveryCodes": hash},
+		bson.M{"$pull": bson.M{"recoveryCodes": hash}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.ModifiedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteTwoFactor removes the enrollment of user userID
+// error is 404 if there is none, 500 if mongo fails
+func (m *MongoStore) DeleteTwoFactor(ctx context.Context, userID string) error {
+	res, err := m.GetTwoFactorCollection().DeleteOne(ctx, bson.M{"_id": userID})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
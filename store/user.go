@@ -1,13 +1,18 @@
 package store
 
 import (
-	"crypto/sha256"
-	"encoding/base64"
+	"context"
+	"regexp"
+	"strings"
+	"time"
 
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 
 	"github.com/briansan/user-go/errors"
+	"github.com/briansan/user-go/password"
 	"github.com/briansan/user-go/schema"
 )
 
@@ -20,82 +25,154 @@ var (
 	adminEmail    = "bk@breadtech.com"
 )
 
-func hash(s string) string {
-	hash := sha256.Sum256([]byte(s))
-	return base64.StdEncoding.EncodeToString(hash[:])
-}
-
-func ensureUserIndex() {
-	c := mongo.DB(databaseName).C(usersCollectionName)
-	if err := c.EnsureIndex(mgo.Index{
-		Key:      []string{"username"},
-		Unique:   true,
-		DropDups: true,
-	}); err != nil {
-		panic(err)
-	}
+// notDeleted matches users without a tombstone
+var notDeleted = bson.M{"$exists": false}
 
-}
+// returnNew makes FindOneAndUpdate decode the document as updated
+var returnNew = options.FindOneAndUpdate().SetReturnDocument(options.After)
 
-func newUserQueryByID(id string) bson.M {
-	return bson.M{"_id": bson.ObjectIdHex(id)}
+func newUserQueryByID(id primitive.ObjectID) bson.M {
+	return bson.M{"_id": id, "deletedAt": notDeleted}
 }
 
 func newUserQueryByUsername(username string) bson.M {
-	return bson.M{"username": username}
+	return bson.M{"username": username, "deletedAt": notDeleted}
 }
 
 func newUserQueryByEmail(email string) bson.M {
-	return bson.M{"email": email}
+	return bson.M{"email": email, "deletedAt": notDeleted}
 }
 
-func newUserQueryByCreds(user, pw string) bson.M {
-	return bson.M{"username": user, "password": hash(pw)}
+// dupConflict turns a duplicate key error that slipped past checkConflict
+// because of a concurrent write into a ConflictError
+func dupConflict(err error, user *schema.User) error {
+	if !mongo.IsDuplicateKeyError(err) {
+		return err
+	}
+	if strings.Contains(err.Error(), "email") && user.Email != nil {
+		return errors.NewConflictError("user", "email", *user.Email)
+	}
+	if user.Username != nil {
+		return errors.NewConflictError("user", "username", *user.Username)
+	}
+	return err
 }
 
-// GetUsersCollection returns an mgo instance to the users collection
-func (m *MongoStore) GetUsersCollection() *mgo.Collection {
-	return m.GetDatabase().C(usersCollectionName)
+// GetUsersCollection returns a mongo instance to the users collection
+func (m *MongoStore) GetUsersCollection() *mongo.Collection {
+	return m.GetDatabase().Collection(usersCollectionName)
 }
 
 // CreateUser inserts user object into db
-// error is 500 if mongo fails, 409 if user exists, else nil
-func (m *MongoStore) CreateUser(user *schema.User) error {
-	uname := *user.Username
-	if user, err := m.GetUserByUsername(uname); err != nil && err != mgo.ErrNotFound {
+// error is 500 if mongo fails, 409 if username or email exists, else nil
+func (m *MongoStore) CreateUser(ctx context.Context, user *schema.User) error {
+	if err := checkConflict(ctx, m, primitive.NilObjectID, user); err != nil {
 		return err
-	} else if user != nil {
-		return errors.NewConflictError("user", "username", uname)
 	}
 
 	// Hash the password
-	pw := hash(*user.Password)
-	user.Password = &pw
+	if err := hashPassword(user); err != nil {
+		return err
+	}
 
 	// Try to insert and return error
-	user.ID = bson.NewObjectId()
-	if err := m.GetUsersCollection().Insert(user); err != nil {
-		return err
+	user.ID = primitive.NewObjectID()
+	user.Version = 1
+	if _, err := m.GetUsersCollection().InsertOne(ctx, user); err != nil {
+		return dupConflict(err, user)
 	}
 	return nil
 }
 
 // GetAllUsers retrieves all users
-func (m *MongoStore) GetAllUsers() ([]*schema.UserSecure, error) {
-	users := []*schema.UserSecure{}
-	err := m.GetUsersCollection().Find(nil).All(&users)
+func (m *MongoStore) GetAllUsers(ctx context.Context) ([]*schema.UserSecure, error) {
+	iter, err := m.GetUsersCollection().Find(ctx, bson.M{"deletedAt": notDeleted})
 	if err != nil {
 		return nil, err
 	}
 
+	users := []*schema.UserSecure{}
+	if err := iter.All(ctx, &users); err != nil {
+		return nil, err
+	}
 	return users, nil
 }
 
+// mongoSortFields maps UserQuery sort fields onto document fields
+var mongoSortFields = map[string]string{
+	SortID:       "_id",
+	SortUsername: "username",
+	SortEmail:    "email",
+	SortRole:     "role",
+}
+
+// FindUsers returns the page of users selected by q
+func (m *MongoStore) FindUsers(ctx context.Context, q *UserQuery) (*UserPage, error) {
+	after, err := q.after()
+	if err != nil {
+		return nil, err
+	}
+
+	// Filters
+	filter := bson.M{"deletedAt": notDeleted}
+	if q.Role != nil {
+		filter["role"] = *q.Role
+	}
+	if len(q.UsernamePrefix) > 0 {
+		filter["username"] = primitive.Regex{Pattern: "^" + regexp.QuoteMeta(q.UsernamePrefix)}
+	}
+	if len(q.EmailDomain) > 0 {
+		filter["email"] = primitive.Regex{Pattern: "@" + regexp.QuoteMeta(q.EmailDomain) + "$", Options: "i"}
+	}
+
+	c := m.GetUsersCollection()
+	total, err := c.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	// Order by the sort field then _id so the cursor is a total order
+	field := mongoSortFields[q.SortField()]
+	op, dir := "$gt", 1
+	if q.Descending() {
+		op, dir = "$lt", -1
+	}
+	sort := bson.D{{Key: field, Value: dir}}
+	if field != "_id" {
+		sort = append(sort, bson.E{Key: "_id", Value: dir})
+	}
+
+	// Resume after the cursor
+	page := filter
+	if after != nil {
+		id, _ := primitive.ObjectIDFromHex(after.ID)
+		resume := bson.M{"_id": bson.M{op: id}}
+		if field != "_id" {
+			value := q.afterValue(after)
+			resume = bson.M{"$or": []bson.M{
+				{field: bson.M{op: value}},
+				{field: value, "_id": bson.M{op: id}},
+			}}
+		}
+		page = bson.M{"$and": []bson.M{filter, resume}}
+	}
+
+	iter, err := c.Find(ctx, page, options.Find().SetSort(sort).SetLimit(int64(q.Limit+1)))
+	if err != nil {
+		return nil, err
+	}
+	users := []*schema.UserSecure{}
+	if err := iter.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	return q.page(users, int(total)), nil
+}
+
 // GetUser looks up user in db with given query for entire object (excpet password)
 // error is 500 if mongo fails, else nil
-func (m *MongoStore) GetUser(q bson.M) (*schema.UserSecure, error) {
+func (m *MongoStore) GetUser(ctx context.Context, q bson.M) (*schema.UserSecure, error) {
 	user := schema.UserSecure{}
-	err := m.GetUsersCollection().Find(q).One(&user)
+	err := m.GetUsersCollection().FindOne(ctx, q).Decode(&user)
 	if err != nil {
 		return nil, err
 	}
@@ -103,70 +180,172 @@ func (m *MongoStore) GetUser(q bson.M) (*schema.UserSecure, error) {
 }
 
 // GetUserByID looks up user with given object id
-func (m *MongoStore) GetUserByID(id string) (*schema.UserSecure, error) {
-	return m.GetUser(newUserQueryByID(id))
+func (m *MongoStore) GetUserByID(ctx context.Context, id string) (*schema.UserSecure, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	return m.GetUser(ctx, newUserQueryByID(oid))
 }
 
 // GetUserByUsername looks up user with given username
-func (m *MongoStore) GetUserByUsername(username string) (*schema.UserSecure, error) {
-	return m.GetUser(newUserQueryByUsername(username))
+func (m *MongoStore) GetUserByUsername(ctx context.Context, username string) (*schema.UserSecure, error) {
+	return m.GetUser(ctx, newUserQueryByUsername(username))
 }
 
-// GetUserByCreds looks up user with given username, password
-func (m *MongoStore) GetUserByCreds(user, pw string) (*schema.UserSecure, error) {
-	return m.GetUser(newUserQueryByCreds(user, pw))
+// GetUserByCreds looks up user with given username and checks pw against its hash
+func (m *MongoStore) GetUserByCreds(ctx context.Context, user, pw string) (*schema.UserSecure, error) {
+	u := &schema.User{}
+	err := m.GetUsersCollection().FindOne(ctx, newUserQueryByUsername(user)).Decode(u)
+	if err == ErrNotFound {
+		u = nil
+	} else if err != nil {
+		return nil, err
+	}
+	return verifyCreds(ctx, m, u, pw)
 }
 
 // GetUserByEmail looks up user with given email
-func (m *MongoStore) GetUserByEmail(email string) (*schema.UserSecure, error) {
-	return m.GetUser(newUserQueryByEmail(email))
+func (m *MongoStore) GetUserByEmail(ctx context.Context, email string) (*schema.UserSecure, error) {
+	return m.GetUser(ctx, newUserQueryByEmail(email))
+}
+
+// newUserQueryByIDAndVersion matches the live user with given id at version
+func newUserQueryByIDAndVersion(id primitive.ObjectID, version int) bson.M {
+	q := newUserQueryByID(id)
+	if version != AnyVersion {
+		q["version"] = version
+	}
+	return q
 }
 
-// UpdateUser ...
-// TODO check for username exists and email exists
-func (m *MongoStore) UpdateUser(userID string, user *schema.User) (*schema.UserSecure, error) {
+// UpdateUser sets every non-nil field of user on the stored user and bumps its version
+// error is 404 if user doesn't exist, 412 if version doesn't match,
+// 409 if username or email is taken, else nil
+func (m *MongoStore) UpdateUser(ctx context.Context, userID string, user *schema.User, version int) (*schema.UserSecure, error) {
+	oid, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	if err := checkConflict(ctx, m, oid, user); err != nil {
+		return nil, err
+	}
+
 	// Hash the password if provided
-	if user.Password != nil {
-		h := hash(*user.Password)
-		user.Password = &h
+	if err := hashPassword(user); err != nil {
+		return nil, err
 	}
 
-	// Try to update the user
-	q := newUserQueryByID(userID)
-	changeInfo := mgo.Change{
-		Update:    bson.M{"$set": user},
-		Upsert:    false,
-		ReturnNew: true,
+	// Only $set the fields that are present, mongo rejects an empty $set
+	update := bson.M{"$inc": bson.M{"version": 1}}
+	set := bson.M{}
+	if raw, err := bson.Marshal(user); err != nil {
+		return nil, err
+	} else if err := bson.Unmarshal(raw, &set); err != nil {
+		return nil, err
+	}
+	if len(set) > 0 {
+		update["$set"] = set
 	}
+
+	// Try to update the user
 	safeUser := schema.UserSecure{}
-	_, err := m.GetUsersCollection().Find(q).Apply(changeInfo, &safeUser)
+	err = m.GetUsersCollection().FindOneAndUpdate(ctx, newUserQueryByIDAndVersion(oid, version), update, returnNew).Decode(&safeUser)
+	if err == ErrNotFound {
+		return nil, notFoundOrMismatch(ctx, m, userID, version)
+	}
 	if err != nil {
-		return nil, err
+		return nil, dupConflict(err, user)
 	}
 	return &safeUser, nil
 }
 
-// DeleteUser removes user from db with given username
-// error is 500 if mongo fails, else nil
-func (m *MongoStore) DeleteUser(userID string) (*schema.UserSecure, error) {
-	user, err := m.GetUserByID(userID)
+// DeleteUser tombstones user with given id, it is hidden from every lookup
+// until RestoreUser or PurgeDeletedUsers
+// error is 404 if user doesn't exist, 412 if version doesn't match,
+// 500 if mongo fails, else nil
+func (m *MongoStore) DeleteUser(ctx context.Context, userID string, version int) (*schema.UserSecure, error) {
+	oid, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	update := bson.M{
+		"$set": bson.M{"deletedAt": time.Now().UTC()},
+		"$inc": bson.M{"version": 1},
+	}
+	user := schema.UserSecure{}
+	err = m.GetUsersCollection().FindOneAndUpdate(ctx, newUserQueryByIDAndVersion(oid, version), update, returnNew).Decode(&user)
+	if err == ErrNotFound {
+		return nil, notFoundOrMismatch(ctx, m, userID, version)
+	}
 	if err != nil {
 		return nil, err
 	}
+	return &user, nil
+}
 
-	if err = m.GetUsersCollection().Remove(newUserQueryByID(userID)); err != nil {
-		return user, err
+// RestoreUser removes the tombstone of user with given id
+// error is 404 if user isn't deleted, 500 if mongo fails, else nil
+func (m *MongoStore) RestoreUser(ctx context.Context, userID string) (*schema.UserSecure, error) {
+	oid, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	q := bson.M{"_id": oid, "deletedAt": bson.M{"$exists": true}}
+	update := bson.M{
+		"$unset": bson.M{"deletedAt": ""},
+		"$inc":   bson.M{"version": 1},
+	}
+	user := schema.UserSecure{}
+	if err := m.GetUsersCollection().FindOneAndUpdate(ctx, q, update, returnNew).Decode(&user); err != nil {
+		return nil, err
 	}
+	return &user, nil
+}
 
-	return user, nil
+// PurgeDeletedUsers removes every user tombstoned before t for good, along
+// with its userData, and returns how many were removed
+func (m *MongoStore) PurgeDeletedUsers(ctx context.Context, t time.Time) (int, error) {
+	q := bson.M{"deletedAt": bson.M{"$lt": t}}
+	ids, err := m.GetUsersCollection().Distinct(ctx, "_id", q)
+	if err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	userIDs := []string{}
+	for _, id := range ids {
+		if oid, ok := id.(primitive.ObjectID); ok {
+			userIDs = append(userIDs, oid.Hex())
+		}
+	}
+	for _, d := range userData {
+		if len(d.collection) == 0 {
+			continue
+		}
+		if _, err := m.GetDatabase().Collection(d.collection).DeleteMany(ctx, bson.M{d.field: bson.M{"$in": userIDs}}); err != nil {
+			return 0, err
+		}
+	}
+
+	res, err := m.GetUsersCollection().DeleteMany(ctx, q)
+	if err != nil {
+		return 0, err
+	}
+	return int(res.DeletedCount), nil
 }
 
 // AdminExistsOrCreate checks for existence of admin account
 // and creates one with given key if it doesn't exist
-func (m *MongoStore) AdminExistsOrCreate(secret string) error {
+func (m *MongoStore) AdminExistsOrCreate(ctx context.Context, secret string) error {
+	return adminExistsOrCreate(ctx, m, secret)
+}
+
+func adminExistsOrCreate(ctx context.Context, s UserStore, secret string) error {
 	// Try to fetch admin user
-	user, err := m.GetUserByUsername(adminUsername)
-	if err != nil && err != mgo.ErrNotFound {
+	user, err := s.GetUserByUsername(ctx, adminUsername)
+	if err != nil && err != ErrNotFound {
 		return err
 	}
 
@@ -175,11 +354,25 @@ func (m *MongoStore) AdminExistsOrCreate(secret string) error {
 		return nil
 	}
 
-	// Create admin
-	return m.CreateUser(&schema.User{
-		Username: &adminUsername,
-		Password: &secret,
-		Email:    &adminEmail,
-		Role:     &schema.RoleAdmin,
+	// The secret is the admin password from now on
+	if err := password.PolicyFromConfig().Check(secret, adminUsername, adminEmail); err != nil {
+		return err
+	}
+
+	// Create admin, nobody can follow a link mailed to its address
+	verified := true
+	err = s.CreateUser(ctx, &schema.User{
+		Username:      &adminUsername,
+		Password:      &secret,
+		Email:         &adminEmail,
+		Role:          &schema.RoleAdmin,
+		EmailVerified: &verified,
 	})
+
+	// A tombstoned admin still holds the username
+	if _, ok := err.(*errors.ConflictError); ok {
+		logger.Warn("admin account is deleted, restore it to log in as admin", "username", adminUsername)
+		return nil
+	}
+	return err
 }
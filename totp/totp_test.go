@@ -0,0 +1,48 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test001_Code(t *testing.T) {
+	// The SHA-1 vectors of RFC 6238 appendix B, last 6 digits
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	for unix, code := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		c, err := Code(secret, Step(time.Unix(unix, 0)))
+		assert.Nil(t, err)
+		assert.Equal(t, code, c, "at %v", unix)
+	}
+
+	_, err := Code("not base32!", 1)
+	assert.NotNil(t, err)
+}
+
+func Test002_Validate(t *testing.T) {
+	secret, err := NewSecret()
+	assert.Nil(t, err)
+	assert.Len(t, secret, 32)
+
+	now := time.Now()
+	code, _ := Code(secret, Step(now)-1)
+	step, ok := Validate(secret, code, now, 1)
+	assert.True(t, ok)
+	assert.Equal(t, Step(now)-1, step)
+	_, ok = Validate(secret, code, now.Add(2*Period), 1)
+	assert.False(t, ok)
+	_, ok = Validate(secret, "12345", now, 1)
+	assert.False(t, ok)
+
+	uri := URI("bt", "foo@bar.com", secret)
+	assert.True(t, strings.HasPrefix(uri, "otpauth://totp/bt:foo@bar.com?"))
+	assert.Contains(t, uri, "secret="+secret)
+}
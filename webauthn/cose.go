@@ -0,0 +1,106 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+
+	"github.com/fxamacker/cbor/v2"
+
+	"github.com/briansan/user-go/keys"
+)
+
+const (
+	// COSE key types and curves (RFC 9053)
+	coseOKP     = 1
+	coseEC2     = 2
+	coseRSA     = 3
+	coseP256    = 1
+	coseEd25519 = 6
+
+	// COSE key parameters
+	coseKty = 1
+	coseAlg = 3
+	// -1 to -3 are crv, x and y of EC2 and OKP keys and n and e of RSA keys
+	coseParam1 = -1
+	coseParam2 = -2
+	coseParam3 = -3
+)
+
+// ParsePublicKey reads a COSE encoded ES256, EdDSA or RS256 public key
+func ParsePublicKey(b []byte) (*keys.Key, error) {
+	m := map[int]cbor.RawMessage{}
+	if err := cbor.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("bad cose key: %v", err)
+	}
+	var kty, alg int
+	if err := cbor.Unmarshal(m[coseKty], &kty); err != nil {
+		return nil, fmt.Errorf("bad cose key type")
+	}
+	if err := cbor.Unmarshal(m[coseAlg], &alg); err != nil {
+		return nil, fmt.Errorf("bad cose key alg")
+	}
+	param := func(label int) []byte {
+		var v []byte
+		cbor.Unmarshal(m[label], &v)
+		return v
+	}
+
+	switch {
+	case kty == coseEC2 && alg == AlgES256:
+		var crv int
+		if cbor.Unmarshal(m[coseParam1], &crv); crv != coseP256 {
+			return nil, fmt.Errorf("unsupported cose curve %v", crv)
+		}
+		x, y := param(coseParam2), param(coseParam3)
+		if len(x) != 32 || len(y) != 32 {
+			return nil, fmt.Errorf("bad cose key coordinates")
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, fmt.Errorf("cose key point is not on the curve")
+		}
+		return keys.NewKey(pub)
+	case kty == coseOKP && alg == AlgEdDSA:
+		var crv int
+		if cbor.Unmarshal(m[coseParam1], &crv); crv != coseEd25519 {
+			return nil, fmt.Errorf("unsupported cose curve %v", crv)
+		}
+		x := param(coseParam2)
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("bad cose key x")
+		}
+		return keys.NewKey(ed25519.PublicKey(x))
+	case kty == coseRSA && alg == AlgRS256:
+		n, e := param(coseParam1), param(coseParam2)
+		if len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("bad cose rsa key")
+		}
+		return keys.NewKey(&rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())})
+	}
+	return nil, fmt.Errorf("unsupported cose key type %v with alg %v", kty, alg)
+}
+
+// verifySignature checks sig of data by k, ecdsa signatures are ASN.1
+// encoded in WebAuthn, unlike in jwts
+func verifySignature(k *keys.Key, data, sig []byte) error {
+	hash := sha256.Sum256(data)
+	ok := false
+	switch pub := k.Public.(type) {
+	case *ecdsa.PublicKey:
+		ok = ecdsa.VerifyASN1(pub, hash[:], sig)
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(pub, data, sig)
+	case *rsa.PublicKey:
+		ok = rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], sig) == nil
+	}
+	if !ok {
+		return fmt.Errorf("bad signature")
+	}
+	return nil
+}
@@ -0,0 +1,375 @@
+// Package webauthn verifies the registration and authentication ceremonies
+// of WebAuthn (passkeys) for a relying party
+// attestation statements aren't checked, every authenticator is trusted,
+// and user verification is always required
+package webauthn
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+
+	"github.com/briansan/user-go/config"
+)
+
+const (
+	// Timeout is how long browsers give the user to finish a ceremony
+	Timeout = 5 * time.Minute
+
+	// COSE algorithms of the keys that can be registered
+	AlgES256 = -7
+	AlgEdDSA = -8
+	AlgRS256 = -257
+
+	typePublicKey = "public-key"
+	typeCreate    = "webauthn.create"
+	typeGet       = "webauthn.get"
+
+	// flags of the authenticator data
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttested     = 0x40
+	flagExtensions   = 0x80
+
+	maxCredentialIDLength = 1023
+)
+
+// Bytes are binary values, base64url encoded in json like the
+// PublicKeyCredential.toJSON() of browsers does
+type Bytes []byte
+
+// MarshalJSON encodes b as unpadded base64url
+func (b Bytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+// UnmarshalJSON decodes base64url with or without padding
+func (b *Bytes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return err
+	}
+	*b = decoded
+	return nil
+}
+
+// RelyingParty is the service passkeys are registered with
+type RelyingParty struct {
+	// ID is the domain passkeys are scoped to
+	ID   string
+	Name string
+	// Origin is where the ceremonies run, scheme and host of the frontend
+	Origin string
+}
+
+// FromConfig returns the relying party of env.WEBAUTHN_RP_ID,
+// env.WEBAUTHN_RP_NAME and env.WEBAUTHN_ORIGIN
+func FromConfig() *RelyingParty {
+	return &RelyingParty{
+		ID:     config.GetWebAuthnRPID(),
+		Name:   config.GetWebAuthnRPName(),
+		Origin: config.GetWebAuthnOrigin(),
+	}
+}
+
+// Entity names the relying party in creation options
+type Entity struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// UserEntity names the user a passkey is created for, ID is the user
+// handle authenticators return when the passkey is used
+type UserEntity struct {
+	ID          Bytes  `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+// Parameter is a key type the relying party accepts
+type Parameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+// Descriptor identifies a registered credential
+type Descriptor struct {
+	Type       string   `json:"type"`
+	ID         Bytes    `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+// NewDescriptor returns the descriptor of credential id
+func NewDescriptor(id []byte, transports []string) Descriptor {
+	return Descriptor{Type: typePublicKey, ID: id, Transports: transports}
+}
+
+// AuthenticatorSelection asks for passkeys that verify the user
+type AuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// CreationOptions are the publicKey options of navigator.credentials.create
+type CreationOptions struct {
+	Challenge              Bytes                  `json:"challenge"`
+	RP                     Entity                 `json:"rp"`
+	User                   UserEntity             `json:"user"`
+	PubKeyCredParams       []Parameter            `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []Descriptor           `json:"excludeCredentials"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// RequestOptions are the publicKey options of navigator.credentials.get
+// no AllowCredentials lets the user pick any passkey of the relying party
+type RequestOptions struct {
+	Challenge        Bytes        `json:"challenge"`
+	Timeout          int64        `json:"timeout"`
+	RPID             string       `json:"rpId"`
+	AllowCredentials []Descriptor `json:"allowCredentials"`
+	UserVerification string       `json:"userVerification"`
+}
+
+// NewCreationOptions returns the options to register a passkey for user
+// that isn't one of exclude
+func (rp *RelyingParty) NewCreationOptions(challenge []byte, user UserEntity, exclude []Descriptor) *CreationOptions {
+	if exclude == nil {
+		exclude = []Descriptor{}
+	}
+	return &CreationOptions{
+		Challenge: challenge,
+		RP:        Entity{ID: rp.ID, Name: rp.Name},
+		User:      user,
+		PubKeyCredParams: []Parameter{
+			{Type: typePublicKey, Alg: AlgES256},
+			{Type: typePublicKey, Alg: AlgEdDSA},
+			{Type: typePublicKey, Alg: AlgRS256},
+		},
+		Timeout:                int64(Timeout / time.Millisecond),
+		ExcludeCredentials:     exclude,
+		AuthenticatorSelection: AuthenticatorSelection{ResidentKey: "preferred", UserVerification: "required"},
+		Attestation:            "none",
+	}
+}
+
+// NewRequestOptions returns the options to log in with one of allow,
+// or any passkey if allow is empty
+func (rp *RelyingParty) NewRequestOptions(challenge []byte, allow []Descriptor) *RequestOptions {
+	if allow == nil {
+		allow = []Descriptor{}
+	}
+	return &RequestOptions{
+		Challenge:        challenge,
+		Timeout:          int64(Timeout / time.Millisecond),
+		RPID:             rp.ID,
+		AllowCredentials: allow,
+		UserVerification: "required",
+	}
+}
+
+// RegistrationCredential is the json of the credential
+// navigator.credentials.create returns
+type RegistrationCredential struct {
+	ID       string `json:"id"`
+	RawID    Bytes  `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    Bytes    `json:"clientDataJSON"`
+		AttestationObject Bytes    `json:"attestationObject"`
+		Transports        []string `json:"transports,omitempty"`
+	} `json:"response"`
+}
+
+// AssertionCredential is the json of the credential
+// navigator.credentials.get returns
+type AssertionCredential struct {
+	ID       string `json:"id"`
+	RawID    Bytes  `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    Bytes `json:"clientDataJSON"`
+		AuthenticatorData Bytes `json:"authenticatorData"`
+		Signature         Bytes `json:"signature"`
+		UserHandle        Bytes `json:"userHandle,omitempty"`
+	} `json:"response"`
+}
+
+// Credential is a verified registration to store
+type Credential struct {
+	ID []byte
+	// PublicKey is the COSE encoded public key
+	PublicKey  []byte
+	SignCount  uint32
+	Transports []string
+}
+
+// clientData is the part of the collected client data that is checked
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// verifyClientData checks that raw is of a ceremony of kind for challenge
+// at the origin of rp
+func (rp *RelyingParty) verifyClientData(raw []byte, kind string, challenge []byte) error {
+	c := clientData{}
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return fmt.Errorf("bad client data: %v", err)
+	}
+	if c.Type != kind {
+		return fmt.Errorf("client data type is %q, not %q", c.Type, kind)
+	}
+	got, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(c.Challenge, "="))
+	if err != nil || subtle.ConstantTimeCompare(got, challenge) != 1 {
+		return fmt.Errorf("challenge mismatch")
+	}
+	if c.Origin != rp.Origin {
+		return fmt.Errorf("origin %q is not %q", c.Origin, rp.Origin)
+	}
+	return nil
+}
+
+// authenticatorData is the parsed authenticator data of a ceremony
+type authenticatorData struct {
+	rpIDHash     []byte
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	publicKey    []byte
+}
+
+// parseAuthenticatorData reads the binary layout of WebAuthn 6.1
+func parseAuthenticatorData(b []byte) (*authenticatorData, error) {
+	if len(b) < 37 {
+		return nil, fmt.Errorf("authenticator data too short")
+	}
+	d := &authenticatorData{rpIDHash: b[:32], flags: b[32], signCount: binary.BigEndian.Uint32(b[33:37])}
+	rest := b[37:]
+
+	if d.flags&flagAttested != 0 {
+		// aaguid, length of the credential id, credential id, public key
+		if len(rest) < 18 {
+			return nil, fmt.Errorf("attested credential data too short")
+		}
+		n := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if n > maxCredentialIDLength || len(rest) < n {
+			return nil, fmt.Errorf("bad credential id length")
+		}
+		d.credentialID, rest = rest[:n], rest[n:]
+
+		var key cbor.RawMessage
+		var err error
+		if rest, err = cbor.UnmarshalFirst(rest, &key); err != nil {
+			return nil, fmt.Errorf("bad credential public key: %v", err)
+		}
+		d.publicKey = key
+	}
+	if d.flags&flagExtensions == 0 && len(rest) > 0 {
+		return nil, fmt.Errorf("trailing authenticator data")
+	}
+	return d, nil
+}
+
+// verifyAuthenticatorData checks that d is for rp and that the user was
+// present and verified
+func (rp *RelyingParty) verifyAuthenticatorData(d *authenticatorData) error {
+	hash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(d.rpIDHash, hash[:]) {
+		return fmt.Errorf("rp id hash mismatch")
+	}
+	if d.flags&flagUserPresent == 0 {
+		return fmt.Errorf("user not present")
+	}
+	if d.flags&flagUserVerified == 0 {
+		return fmt.Errorf("user not verified")
+	}
+	return nil
+}
+
+// VerifyRegistration checks a credential created with the options of
+// challenge and returns it to store (WebAuthn 7.1)
+func (rp *RelyingParty) VerifyRegistration(challenge []byte, c *RegistrationCredential) (*Credential, error) {
+	if c.Type != typePublicKey {
+		return nil, fmt.Errorf("credential type is %q", c.Type)
+	}
+	if err := rp.verifyClientData(c.Response.ClientDataJSON, typeCreate, challenge); err != nil {
+		return nil, err
+	}
+
+	attestation := struct {
+		Fmt      string          `cbor:"fmt"`
+		AttStmt  cbor.RawMessage `cbor:"attStmt"`
+		AuthData []byte          `cbor:"authData"`
+	}{}
+	if err := cbor.Unmarshal(c.Response.AttestationObject, &attestation); err != nil {
+		return nil, fmt.Errorf("bad attestation object: %v", err)
+	}
+	d, err := parseAuthenticatorData(attestation.AuthData)
+	if err != nil {
+		return nil, err
+	}
+	if err := rp.verifyAuthenticatorData(d); err != nil {
+		return nil, err
+	}
+	if d.flags&flagAttested == 0 {
+		return nil, fmt.Errorf("no attested credential data")
+	}
+	if !bytes.Equal(d.credentialID, c.RawID) {
+		return nil, fmt.Errorf("credential id mismatch")
+	}
+	if _, err := ParsePublicKey(d.publicKey); err != nil {
+		return nil, err
+	}
+	return &Credential{
+		ID:         d.credentialID,
+		PublicKey:  d.publicKey,
+		SignCount:  d.signCount,
+		Transports: c.Response.Transports,
+	}, nil
+}
+
+// VerifyAssertion checks an assertion made with the options of challenge
+// by the credential with the COSE key publicKey and returns its signature
+// counter, which the caller has to check moved forward (WebAuthn 7.2)
+func (rp *RelyingParty) VerifyAssertion(challenge []byte, c *AssertionCredential, publicKey []byte) (uint32, error) {
+	if c.Type != typePublicKey {
+		return 0, fmt.Errorf("credential type is %q", c.Type)
+	}
+	if err := rp.verifyClientData(c.Response.ClientDataJSON, typeGet, challenge); err != nil {
+		return 0, err
+	}
+	d, err := parseAuthenticatorData(c.Response.AuthenticatorData)
+	if err != nil {
+		return 0, err
+	}
+	if err := rp.verifyAuthenticatorData(d); err != nil {
+		return 0, err
+	}
+
+	key, err := ParsePublicKey(publicKey)
+	if err != nil {
+		return 0, err
+	}
+	hash := sha256.Sum256(c.Response.ClientDataJSON)
+	signed := append(append([]byte{}, c.Response.AuthenticatorData...), hash[:]...)
+	if err := verifySignature(key, signed, c.Response.Signature); err != nil {
+		return 0, err
+	}
+	return d.signCount, nil
+}
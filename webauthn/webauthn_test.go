@@ -0,0 +1,88 @@
+package webauthn_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/briansan/user-go/webauthn"
+	"github.com/briansan/user-go/webauthn/webauthntest"
+)
+
+var rp = &webauthn.RelyingParty{ID: "example.com", Name: "bt", Origin: "https://example.com"}
+
+func Test001_Ceremonies(t *testing.T) {
+	a := webauthntest.New(rp.Origin)
+
+	// Register
+	challenge := []byte("registration challenge")
+	creation := rp.NewCreationOptions(challenge, webauthn.UserEntity{ID: []byte("user"), Name: "foo", DisplayName: "Foo"}, nil)
+	created := a.Create(creation)
+
+	// The credential goes through json like it does from a browser
+	b, err := json.Marshal(created)
+	assert.Nil(t, err)
+	registration := &webauthn.RegistrationCredential{}
+	assert.Nil(t, json.Unmarshal(b, registration))
+
+	_, err = rp.VerifyRegistration([]byte("other challenge"), registration)
+	assert.NotNil(t, err)
+	other := *rp
+	other.Origin = "https://evil.example.com"
+	_, err = other.VerifyRegistration(challenge, registration)
+	assert.NotNil(t, err)
+	other = *rp
+	other.ID = "evil.example.com"
+	_, err = other.VerifyRegistration(challenge, registration)
+	assert.NotNil(t, err)
+
+	c, err := rp.VerifyRegistration(challenge, registration)
+	assert.Nil(t, err)
+	assert.Equal(t, a.CredentialID(), c.ID)
+	assert.Equal(t, []string{"internal"}, c.Transports)
+	key, err := webauthn.ParsePublicKey(c.PublicKey)
+	assert.Nil(t, err)
+	assert.Equal(t, "ES256", key.Method.Alg())
+
+	// Log in, the counter moves forward
+	challenge = []byte("assertion challenge")
+	request := rp.NewRequestOptions(challenge, []webauthn.Descriptor{webauthn.NewDescriptor(c.ID, c.Transports)})
+	assertion := a.Get(request)
+	count, err := rp.VerifyAssertion(challenge, assertion, c.PublicKey)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), count)
+
+	_, err = rp.VerifyAssertion([]byte("other challenge"), assertion, c.PublicKey)
+	assert.NotNil(t, err)
+	assertion.Response.Signature[len(assertion.Response.Signature)-1] ^= 1
+	_, err = rp.VerifyAssertion(challenge, assertion, c.PublicKey)
+	assert.NotNil(t, err)
+
+	// A registration isn't an assertion
+	assertion = a.Get(request)
+	assertion.Response.ClientDataJSON = created.Response.ClientDataJSON
+	_, err = rp.VerifyAssertion(challenge, assertion, c.PublicKey)
+	assert.NotNil(t, err)
+}
+
+func Test002_ParsePublicKey(t *testing.T) {
+	pub, _, _ := ed25519.GenerateKey(rand.Reader)
+	cose, _ := cbor.Marshal(map[int]interface{}{1: 1, 3: webauthn.AlgEdDSA, -1: 6, -2: []byte(pub)})
+	key, err := webauthn.ParsePublicKey(cose)
+	assert.Nil(t, err)
+	assert.Equal(t, "EdDSA", key.Method.Alg())
+
+	// Unsupported curves and algorithms
+	cose, _ = cbor.Marshal(map[int]interface{}{1: 1, 3: webauthn.AlgEdDSA, -1: 7, -2: []byte(pub)})
+	_, err = webauthn.ParsePublicKey(cose)
+	assert.NotNil(t, err)
+	cose, _ = cbor.Marshal(map[int]interface{}{1: 2, 3: -35, -1: 2, -2: []byte{1}, -3: []byte{2}})
+	_, err = webauthn.ParsePublicKey(cose)
+	assert.NotNil(t, err)
+	_, err = webauthn.ParsePublicKey([]byte("not cbor"))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,122 @@
+// Package webauthntest is a software authenticator for tests that makes
+// ES256 passkeys and always reports the user present and verified
+package webauthntest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+
+	"github.com/fxamacker/cbor/v2"
+
+	"github.com/briansan/user-go/webauthn"
+)
+
+// Authenticator holds one passkey, made by Create
+type Authenticator struct {
+	// Origin is the origin the browser reports for the ceremonies
+	Origin string
+	// SignCount is the counter of the last signature, Get bumps it
+	SignCount uint32
+
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+}
+
+// New returns an authenticator used from origin
+func New(origin string) *Authenticator {
+	return &Authenticator{Origin: origin}
+}
+
+// CredentialID returns the id of the passkey
+func (a *Authenticator) CredentialID() []byte {
+	return a.credentialID
+}
+
+func (a *Authenticator) clientData(kind string, challenge []byte) []byte {
+	b, _ := json.Marshal(map[string]interface{}{
+		"type":        kind,
+		"challenge":   base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":      a.Origin,
+		"crossOrigin": false,
+	})
+	return b
+}
+
+func (a *Authenticator) authenticatorData(rpID string, flags byte, attested []byte) []byte {
+	hash := sha256.Sum256([]byte(rpID))
+	d := append(hash[:], flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(d[33:], a.SignCount)
+	return append(d, attested...)
+}
+
+// Create makes a new passkey for options
+func (a *Authenticator) Create(options *webauthn.CreationOptions) *webauthn.RegistrationCredential {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	a.key, a.userHandle, a.SignCount = key, options.User.ID, 0
+	a.credentialID = make([]byte, 16)
+	rand.Read(a.credentialID)
+
+	x, y := make([]byte, 32), make([]byte, 32)
+	key.X.FillBytes(x)
+	key.Y.FillBytes(y)
+	cose, err := cbor.Marshal(map[int]interface{}{1: 2, 3: webauthn.AlgES256, -1: 1, -2: x, -3: y})
+	if err != nil {
+		panic(err)
+	}
+
+	// aaguid of zeros, the id length, the id and the key
+	attested := make([]byte, 18)
+	binary.BigEndian.PutUint16(attested[16:], uint16(len(a.credentialID)))
+	attested = append(append(attested, a.credentialID...), cose...)
+	object, err := cbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": a.authenticatorData(options.RP.ID, 0x45, attested),
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	c := &webauthn.RegistrationCredential{
+		ID:    base64.RawURLEncoding.EncodeToString(a.credentialID),
+		RawID: a.credentialID,
+		Type:  "public-key",
+	}
+	c.Response.ClientDataJSON = a.clientData("webauthn.create", options.Challenge)
+	c.Response.AttestationObject = object
+	c.Response.Transports = []string{"internal"}
+	return c
+}
+
+// Get signs in with the passkey for options
+func (a *Authenticator) Get(options *webauthn.RequestOptions) *webauthn.AssertionCredential {
+	a.SignCount++
+	data := a.authenticatorData(options.RPID, 0x05, nil)
+	clientData := a.clientData("webauthn.get", options.Challenge)
+	hash := sha256.Sum256(clientData)
+	signed := sha256.Sum256(append(append([]byte{}, data...), hash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, signed[:])
+	if err != nil {
+		panic(err)
+	}
+
+	c := &webauthn.AssertionCredential{
+		ID:    base64.RawURLEncoding.EncodeToString(a.credentialID),
+		RawID: a.credentialID,
+		Type:  "public-key",
+	}
+	c.Response.ClientDataJSON = clientData
+	c.Response.AuthenticatorData = data
+	c.Response.Signature = sig
+	c.Response.UserHandle = a.userHandle
+	return c
+}